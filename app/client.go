@@ -1,24 +1,93 @@
 package main
 
 import (
-	"bufio"
 	"database/sql"
-	"fmt"
+	"errors"
 	"github.com/BurntSushi/toml"
 	"github.com/ldsec/medco-loader/loader"
 	"github.com/ldsec/medco-loader/loader/genomic"
 	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/ldsec/medco-loader/loader/identifiers"
+	"github.com/ldsec/unlynx/lib"
 	_ "github.com/lib/pq"
 	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 // Loader functions
 //______________________________________________________________________________________________________________________
 
+// exitCodes maps the categories of errors of the loaders to the exit codes of the CLI (see main)
+var exitCodes = []struct {
+	kind error
+	code int
+}{
+	{loader.ErrInputFormat, 2},
+	{loader.ErrMissingOntologyElement, 3},
+	{loader.ErrDDT, 4},
+	{loader.ErrSerialization, 5},
+	{loader.ErrOutput, 6},
+	{loader.ErrDBLoad, 7},
+	{loader.ErrRandomness, 8},
+}
+
+// exitError returns the error with the exit code of its category (1 if it has none)
+func exitError(err error) error {
+	for _, c := range exitCodes {
+		if errors.Is(err, c.kind) {
+			return cli.NewExitError(err, c.code)
+		}
+	}
+	return cli.NewExitError(err, 1)
+}
+
+// collectiveAuthority returns the roster of the collective authority that tags the sensitive elements: the one of the
+// group file, or with --local-ca an in-process one of N nodes (as in the tests) whose tags and ciphertexts are only valid
+// for this run. closeCA stops the in-process collective authority (it does nothing otherwise).
+func collectiveAuthority(c *cli.Context) (roster *onet.Roster, testing bool, closeCA func(), err error) {
+	closeCA = func() {}
+	entryPointIdx := c.Int("entryPointIdx")
+
+	if nodes := c.Int("local-ca"); nodes > 0 {
+		if entryPointIdx < 0 || entryPointIdx >= nodes {
+			err = errors.New("the entry point index " + strconv.Itoa(entryPointIdx) + " is not one of the " + strconv.Itoa(nodes) + " nodes of the local collective authority")
+			log.Error("Wrong entry point:", err)
+			return nil, false, closeCA, cli.NewExitError(err, 1)
+		}
+
+		log.Warn("Using an in-process collective authority of " + strconv.Itoa(nodes) + " nodes (--local-ca): its keys only " +
+			"exist for this run, the tags and ciphertexts are NOT valid for production and the loaded data cannot be " +
+			"queried by a MedCo deployment")
+		local := onet.NewLocalTest(libunlynx.SuiTe)
+		_, roster, _ = local.GenTree(nodes, true)
+		return roster, true, local.CloseAll, nil
+	}
+
+	// generate el with group file
+	f, err := os.Open(c.String("group"))
+	if err != nil {
+		log.Error("Error while opening group file:", err)
+		return nil, false, closeCA, cli.NewExitError(err, 1)
+	}
+	defer f.Close()
+	el, err := app.ReadGroupDescToml(f)
+	if err != nil {
+		log.Error("Error while reading group file:", err)
+		return nil, false, closeCA, cli.NewExitError(err, 1)
+	}
+	if len(el.Roster.List) <= 0 {
+		err = errors.New("empty group file " + c.String("group"))
+		log.Error("Empty or invalid group file:", err)
+		return nil, false, closeCA, cli.NewExitError(err, 1)
+	}
+	return el.Roster, false, closeCA, nil
+}
+
 //----------------------------------------------------------------------------------------------------------------------
 //#----------------------------------------------- LOAD DATA -----------------------------------------------------------
 //----------------------------------------------------------------------------------------------------------------------
@@ -30,11 +99,19 @@ func loadV0(c *cli.Context) error {
 	genomicOntologyPath := c.String("ont_genomic")
 	clinicalFilePath := c.String("clinical")
 	genomicFilePath := c.String("genomic")
-	groupFilePath := c.String("group")
+	genomicFormat := c.String("genomic_format")
+	allelesKey := c.String("alleles_key")
+	assembly := c.String("assembly")
 	entryPointIdx := c.Int("entryPointIdx")
 	sensitiveFilePath := c.String("sensitive")
 	replaySize := c.Int("replay")
 	outputPath := c.String("output")
+	convertOnly := c.Bool("convert-only")
+	verify := c.Bool("verify")
+	checkpointDir := c.String("checkpoint")
+	resume := c.Bool("resume")
+	tagging := loader.TaggingOptions{BatchSize: c.Int("ddt_batch_size"), Retries: c.Int("ddt_retries"), Backoff: c.Duration("ddt_backoff")}
+	appendData := c.Bool("append")
 
 	// i2b2 db settings
 	i2b2DbHost := c.String("i2b2DbHost")
@@ -53,40 +130,42 @@ func loadV0(c *cli.Context) error {
 	i2b2DB := loader.DBSettings{DBhost: i2b2DbHost, DBport: i2b2DbPort, DBname: i2b2DbName, DBuser: i2b2DbUser, DBpassword: i2b2DbPassword}
 	gaDB := loader.DBSettings{DBhost: gaDbHost, DBport: gaDbPort, DBname: gaDbName, DBuser: gaDbUser, DBpassword: gaDbPassword}
 
-	// check if db connection works
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", i2b2DbHost, i2b2DbPort, i2b2DbUser, i2b2DbPassword, i2b2DbName)
-	db, err := sql.Open("postgres", psqlInfo)
-	err = db.Ping()
-	if err != nil {
-		log.Error("Error while connecting to i2b2 database", err)
-		return cli.NewExitError(err, 1)
+	// check if db connection works (the data already loaded is read when appending)
+	if !convertOnly || appendData {
+		db, err := sql.Open("postgres", i2b2DB.ConnectionString())
+		err = db.Ping()
+		if err != nil {
+			log.Error("Error while connecting to i2b2 database", err)
+			return exitError(&loader.LoadError{Err: err})
+		}
+		db.Close()
+
+		db, err = sql.Open("postgres", gaDB.ConnectionString())
+		err = db.Ping()
+		if err != nil {
+			log.Error("Error while connecting to genomic annotations database", err)
+			return exitError(&loader.LoadError{Err: err})
+		}
+		db.Close()
 	}
-	db.Close()
 
-	psqlInfo = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", gaDbHost, gaDbPort, gaDbUser, gaDbPassword, gaDbName)
-	db, err = sql.Open("postgres", psqlInfo)
-	err = db.Ping()
-	if err != nil {
-		log.Error("Error while connecting to genomic annotations database", err)
+	if _, err := identifiers.NormalizeAssembly(assembly); err != nil {
+		log.Error("Wrong reference genome assembly", err)
 		return cli.NewExitError(err, 1)
 	}
-	db.Close()
 
-	// generate el with group file
-	f, err := os.Open(groupFilePath)
-	if err != nil {
-		log.Error("Error while opening group file", err)
+	if genomicFormat != loadergenomic.FormatMAF && genomicFormat != loadergenomic.FormatVCF {
+		err := errors.New("unknown genomic format " + genomicFormat)
+		log.Error("Wrong genomic format", err)
 		return cli.NewExitError(err, 1)
 	}
-	el, err := app.ReadGroupDescToml(f)
+
+	// the collective authority of the group file or an in-process one
+	roster, testing, closeCA, err := collectiveAuthority(c)
 	if err != nil {
-		log.Error("Error while reading group file", err)
-		return cli.NewExitError(err, 1)
-	}
-	if len(el.Roster.List) <= 0 {
-		log.Error("Empty or invalid group file", err)
-		return cli.NewExitError(err, 1)
+		return err
 	}
+	defer closeCA()
 
 	fOntClinical, err := os.Open(clinicalOntologyPath)
 	if err != nil {
@@ -112,32 +191,26 @@ func loadV0(c *cli.Context) error {
 		return cli.NewExitError(err, 1)
 	}
 
-	// get the list of sensitiveConcepts
-	f, err = os.Open(sensitiveFilePath)
+	// get the sensitivity policy (or the list of the sensitive elements)
+	policy, err := loader.LoadPolicy(sensitiveFilePath)
 	if err != nil {
-		log.Error("Error while reading [sensitive].txt:", err)
-		return cli.NewExitError(err, 1)
-	}
-
-	// place all sensitive attributes in map set to allow for faster search
-	mapSensitive := make(map[string]struct{}, 0)
-	scanner := bufio.NewScanner(f)
-	allSensitive := false
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "all" {
-			allSensitive = true
-			break
-		}
-		mapSensitive[line] = struct{}{}
+		log.Error("Error while reading the sensitivity policy:", err)
+		return exitError(err)
 	}
 
 	if replaySize < 0 {
 		log.Error("Wrong file size value (1>)", err)
 		return cli.NewExitError(err, 1)
+	} else if replaySize > 1 && genomicFormat == loadergenomic.FormatVCF {
+		err := errors.New("the replay of the genomic file is only supported for the " + loadergenomic.FormatMAF + " format")
+		log.Error("Wrong file size value", err)
+		return cli.NewExitError(err, 1)
 	} else if replaySize > 1 {
 		fGenomic.Close()
-		loadergenomic.ReplayDataset(genomicFilePath, replaySize)
+		if err := loadergenomic.ReplayDataset(genomicFilePath, replaySize); err != nil {
+			log.Error("Error while replaying the genomic file", err)
+			return exitError(err)
+		}
 
 		fGenomic, err = os.Open(genomicFilePath)
 		if err != nil {
@@ -146,9 +219,37 @@ func loadV0(c *cli.Context) error {
 		}
 	}
 
-	err = loadergenomic.LoadGenomicData(el.Roster, entryPointIdx, fOntClinical, fOntGenomic, fClinical, fGenomic, outputPath, allSensitive, mapSensitive, i2b2DB, gaDB, false)
+	l, err := loadergenomic.NewLoader(loadergenomic.Options{
+		Roster:        roster,
+		Testing:       testing,
+		EntryPointIdx: entryPointIdx,
+		OntClinical:   fOntClinical,
+		OntGenomic:    fOntGenomic,
+		Clinical:      fClinical,
+		Genomic:       fGenomic,
+		OutputPath:    outputPath,
+		Policy:        policy,
+		I2B2DB:        i2b2DB,
+		GaDB:          gaDB,
+		ConvertOnly:   convertOnly,
+		Verify:        verify,
+		CheckpointDir: checkpointDir,
+		Resume:        resume,
+		Tagging:       tagging,
+		Append:        appendData,
+		GenomicFormat: genomicFormat,
+		AllelesKey:    []byte(allelesKey),
+		Assembly:      assembly,
+	})
 	if err != nil {
-		log.Fatal("Error while loading client data:", err)
+		log.Error("Error while creating the loader:", err)
+		return exitError(err)
+	}
+
+	err = l.Load()
+	if err != nil {
+		log.Error("Error while loading client data:", err)
+		return exitError(err)
 	}
 
 	return nil
@@ -156,11 +257,23 @@ func loadV0(c *cli.Context) error {
 
 func loadV1(c *cli.Context) error {
 	// data set file paths
-	groupFilePath := c.String("group")
 	dataFilesPath := c.String("files")
 	sensitiveFilePath := c.String("sensitive")
 	entryPointIdx := c.Int("entryPointIdx")
 	empty := c.Bool("empty")
+	convertOnly := c.Bool("convert-only")
+	verify := c.Bool("verify")
+	checkpointDir := c.String("checkpoint")
+	resume := c.Bool("resume")
+	tagging := loader.TaggingOptions{BatchSize: c.Int("ddt_batch_size"), Retries: c.Int("ddt_retries"), Backoff: c.Duration("ddt_backoff")}
+	delta := c.Bool("delta")
+	permutationKey := c.String("permutation_key")
+	mappingKey := c.String("mapping_key")
+	mappingSchema := c.String("mapping_schema")
+	plaintextMappings := c.Bool("plaintext_mappings")
+	dummies := c.Int("dummies")
+	dummyClusters := c.Int("dummy_clusters")
+	dummyStrategy := c.String("dummy_strategy")
 
 	// db settings
 	i2b2DbHost := c.String("i2b2DbHost")
@@ -171,32 +284,23 @@ func loadV1(c *cli.Context) error {
 
 	i2b2DB := loader.DBSettings{DBhost: i2b2DbHost, DBport: i2b2DbPort, DBname: i2b2DbName, DBuser: i2b2DbUser, DBpassword: i2b2DbPassword}
 
-	// check if db connection works
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", i2b2DbHost, i2b2DbPort, i2b2DbUser, i2b2DbPassword, i2b2DbName)
-	db, err := sql.Open("postgres", psqlInfo)
-	err = db.Ping()
-	if err != nil {
-		log.Error("Error while connecting to i2b2 database", err)
-		return cli.NewExitError(err, 1)
+	// check if db connection works (the data already loaded is read for a delta load)
+	if !convertOnly || delta {
+		db, err := sql.Open("postgres", i2b2DB.ConnectionString())
+		err = db.Ping()
+		if err != nil {
+			log.Error("Error while connecting to i2b2 database", err)
+			return exitError(&loader.LoadError{Err: err})
+		}
+		db.Close()
 	}
-	db.Close()
 
-	// generate el with group file
-	f, err := os.Open(groupFilePath)
+	// the collective authority of the group file or an in-process one
+	roster, testing, closeCA, err := collectiveAuthority(c)
 	if err != nil {
-		log.Error("Error while opening group file:", err)
-		return cli.NewExitError(err, 1)
-	}
-	el, err := app.ReadGroupDescToml(f)
-	if err != nil {
-		log.Error("Error while reading group file:", err)
-		return cli.NewExitError(err, 1)
+		return err
 	}
-	if len(el.Roster.List) <= 0 {
-		log.Error("Empty or invalid group file:", err)
-		return cli.NewExitError(err, 1)
-	}
-	f.Close()
+	defer closeCA()
 
 	// get all files to convert
 	var files loaderi2b2.Files
@@ -206,30 +310,45 @@ func loadV1(c *cli.Context) error {
 	}
 	directory := filepath.Dir(dataFilesPath)
 
-	// get the list of sensitiveConcepts
-	f, err = os.Open(sensitiveFilePath)
+	// get the sensitivity policy (or the list of the sensitive elements)
+	policy, err := loader.LoadPolicy(sensitiveFilePath)
 	if err != nil {
-		log.Error("Error while reading [sensitive].txt:", err)
-		return cli.NewExitError(err, 1)
+		log.Error("Error while reading the sensitivity policy:", err)
+		return exitError(err)
 	}
 
-	// place all sensitive attributes in map set to allow for faster search
-	mapSensitive := make(map[string]struct{}, 0)
-	scanner := bufio.NewScanner(f)
-	allSensitive := false
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "all" {
-			allSensitive = true
-			break
-		}
-		mapSensitive[line] = struct{}{}
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{
+		Roster:            roster,
+		Testing:           testing,
+		EntryPointIdx:     entryPointIdx,
+		Directory:         directory,
+		Files:             files,
+		Policy:            policy,
+		I2B2DB:            i2b2DB,
+		Empty:             empty,
+		ConvertOnly:       convertOnly,
+		Verify:            verify,
+		PermutationKey:    []byte(permutationKey),
+		MappingKey:        []byte(mappingKey),
+		MappingSchema:     mappingSchema,
+		PlaintextMappings: plaintextMappings,
+		Delta:             delta,
+		Dummies:           dummies,
+		DummyClusters:     dummyClusters,
+		DummyStrategy:     loaderi2b2.DummyStrategy(dummyStrategy),
+		CheckpointDir:     checkpointDir,
+		Resume:            resume,
+		Tagging:           tagging,
+	})
+	if err != nil {
+		log.Error("Error while creating the loader:", err)
+		return exitError(err)
 	}
 
-	err = loaderi2b2.LoadI2B2Data(el.Roster, entryPointIdx, directory, files, allSensitive, mapSensitive, i2b2DB, empty)
+	err = l.Load()
 	if err != nil {
 		log.Error("Error while converting I2B2 data:", err)
-		return cli.NewExitError(err, 1)
+		return exitError(err)
 	}
 
 	return nil
@@ -1,11 +1,11 @@
 package main
 
 import (
+	"github.com/ldsec/medco-loader/loader"
 	"github.com/urfave/cli"
 	"os"
 
 	"go.dedis.ch/onet/v3/log"
-	"go.dedis.ch/onet/v3/network"
 )
 
 const (
@@ -20,6 +20,19 @@ const (
 	optionEntryPointIdx      = "entryPointIdx"
 	optionEntryPointIdxShort = "entry"
 
+	optionLocalCA = "local-ca"
+
+	optionConvertOnly = "convert-only"
+	optionVerify      = "verify"
+
+	optionCheckpoint = "checkpoint"
+	optionResume     = "resume"
+
+	// distributed deterministic tagging settings
+	optionDDTBatchSize = "ddt_batch_size"
+	optionDDTRetries   = "ddt_retries"
+	optionDDTBackoff   = "ddt_backoff"
+
 	// i2b2 database settings
 	optionI2b2DBhost      = "i2b2DbHost"
 	optionI2b2DBhostShort = "i2b2H"
@@ -65,7 +78,7 @@ const (
 	// DefaultOutputPath is the output path for the generated .csv files
 	DefaultOutputPath = "../data/genomic/"
 
-	// dataset settings (for now we have no incremental loading, and so we require both ontology and dataset files)
+	// dataset settings (both ontology and dataset files are required, also when appending to the loaded data)
 	optionOntologyClinical      = "ont_clinical"
 	optionOntologyClinicalShort = "oc"
 
@@ -78,9 +91,20 @@ const (
 	optionGenomicFile      = "genomic"
 	optionGenomicFileShort = "gen"
 
+	optionGenomicFormat      = "genomic_format"
+	optionGenomicFormatShort = "gf"
+
+	optionAllelesKey      = "alleles_key"
+	optionAllelesKeyShort = "ak"
+
+	optionAssembly      = "assembly"
+	optionAssemblyShort = "as"
+
 	optionOutputPath     = "output"
 	optionOuputPathShort = "o"
 
+	optionAppend = "append"
+
 	// #---- V1 ----#
 
 	// DefaultDataFiles is the name of the default toml file with the file paths
@@ -91,17 +115,37 @@ const (
 
 	optionEmpty      = "empty"
 	optionEmptyShort = "e"
+
+	optionDelta = "delta"
+
+	optionPermutationKey      = "permutation_key"
+	optionPermutationKeyShort = "pk"
+
+	optionMappingKey      = "mapping_key"
+	optionMappingKeyShort = "mk"
+
+	optionMappingSchema = "mapping_schema"
+
+	optionPlaintextMappings = "plaintext_mappings"
+
+	optionDummies       = "dummies"
+	optionDummyClusters = "dummy_clusters"
+	optionDummyStrategy = "dummy_strategy"
 )
 
 /*
 Return system error codes signification
 0: success
 1: failed to init client
+2: invalid input file
+3: element of the dataset missing from the ontology
+4: distributed deterministic tagging failed
+5: serialization error
+6: failed to write the converted files
+7: failed to load the database
+8: the system's secure random number generator failed
 */
 func main() {
-	// increase maximum in onet.tcp.go to allow for big packets (for now is the max value for uint32)
-	network.MaxPacketSize = network.Size(^uint32(0))
-
 	cliApp := cli.NewApp()
 	cliApp.Name = "MedCo Loader"
 	cliApp.Usage = "Software tool to manipulate i2b2/medco data"
@@ -126,6 +170,41 @@ func main() {
 			Usage:  "Index (relative to the group definition file) of the collective authority server to load the data",
 			EnvVar: "UNLYNX_GROUP_FILE_IDX",
 		},
+		cli.IntFlag{
+			Name:  optionLocalCA,
+			Usage: "Start an in-process collective authority of N nodes instead of using the group file (development and offline testing only: the tags are not valid for production)",
+		},
+		cli.BoolFlag{
+			Name:  optionConvertOnly,
+			Usage: "Only convert the data (no database connection needed): the .csv files and a summary of what would be truncated and loaded are written in the output folder",
+		},
+		cli.BoolFlag{
+			Name:  optionVerify,
+			Usage: "Once loaded, compare the row counts and checksums of the tables with the converted files and check that the TAG_IDs of the observations are in sensitive_tagged",
+		},
+		cli.StringFlag{
+			Name:  optionCheckpoint,
+			Usage: "Folder where the results of the phases of the loading (tags of the sensitive elements, converted files, completed transactions) are persisted",
+		},
+		cli.BoolFlag{
+			Name:  optionResume,
+			Usage: "Resume a loading that failed: skip the phases completed in the checkpoint folder by a previous run with the same input files and settings",
+		},
+		cli.IntFlag{
+			Name:  optionDDTBatchSize,
+			Value: loader.DefaultTaggingBatchSize,
+			Usage: "Number of sensitive elements tagged per request to the collective authority (at most 50000)",
+		},
+		cli.IntFlag{
+			Name:  optionDDTRetries,
+			Value: loader.DefaultTaggingRetries,
+			Usage: "Number of times the tagging of a batch is retried before giving up (0 for the default, negative for none)",
+		},
+		cli.DurationFlag{
+			Name:  optionDDTBackoff,
+			Value: loader.DefaultTaggingBackoff,
+			Usage: "Delay before the first retry of a batch (doubled for each next one)",
+		},
 		cli.StringFlag{
 			Name:   optionI2b2DBhost + ", " + optionI2b2DBhostShort,
 			Usage:  "I2B2 database hostname",
@@ -161,7 +240,7 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  optionSensitiveFile + ", " + optionSensitiveFileShort,
-			Usage: "File with the list of clinical sensitive attributes (e.g., CANCER_TYPE_DETAILED). The entry 'all' means all attributes are considered sensitive)",
+			Usage: "File with the list of clinical sensitive attributes (e.g., CANCER_TYPE_DETAILED). The entry 'all' means all attributes are considered sensitive). A .toml file holds a sensitivity policy instead: rules of patterns of the sensitive fields and values, with exceptions",
 		},
 		cli.StringFlag{
 			Name:  optionOntologyGenomic + ", " + optionOntologyGenomicShort,
@@ -178,11 +257,29 @@ func main() {
 			Value: DefaultGenomicFile,
 			Usage: "Genomic file to load",
 		},
+		cli.StringFlag{
+			Name:  optionGenomicFormat + ", " + optionGenomicFormatShort,
+			Value: "maf",
+			Usage: "Format of the genomic ontology and dataset files (maf or vcf)",
+		},
+		cli.StringFlag{
+			Name:   optionAllelesKey + ", " + optionAllelesKeyShort,
+			Usage:  "Secret key of the hash encoding the alleles longer than 6 bases, shared by all the nodes (required for the variants with such alleles)",
+			EnvVar: "ALLELES_KEY",
+		},
+		cli.StringFlag{
+			Name:  optionAssembly + ", " + optionAssemblyShort,
+			Usage: "Reference genome assembly of the genomic ontology and dataset (GRCh37 or GRCh38, required)",
+		},
 		cli.StringFlag{
 			Name:  optionOutputPath + ", " + optionOuputPathShort,
 			Value: DefaultOutputPath,
 			Usage: "Output path for the .csv files",
 		},
+		cli.BoolFlag{
+			Name:  optionAppend,
+			Usage: "Append the dataset to the data already loaded instead of replacing it (the databases are read, also with --" + optionConvertOnly + ")",
+		},
 		cli.StringFlag{
 			Name:   optionGaDBhost + ", " + optionGaDBhostShort,
 			Usage:  "Genomic annotations database hostname",
@@ -219,12 +316,47 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  optionSensitiveFile + ", " + optionSensitiveFileShort,
-			Usage: `File with the list of sensitive concepts (e.g., \i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\). The entry 'all' means all concepts are considered sensitive)`,
+			Usage: `File with the list of sensitive concepts (e.g., \i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\). The entry 'all' means all concepts are considered sensitive). A .toml file holds a sensitivity policy instead: rules of patterns of the sensitive concept paths, with exceptions`,
 		},
 		cli.BoolFlag{
 			Name:  optionEmpty + ", " + optionEmptyShort,
 			Usage: "Empty patient and visit dimension tables",
 		},
+		cli.StringFlag{
+			Name:   optionPermutationKey + ", " + optionPermutationKeyShort,
+			Usage:  "Secret key of the site from which the permutations of the patient_num, encounter_num and TAG_IDs are derived (reproducible mapping, random if empty)",
+			EnvVar: "PERMUTATION_KEY",
+		},
+		cli.StringFlag{
+			Name:   optionMappingKey + ", " + optionMappingKeyShort,
+			Usage:  "Key or passphrase encrypting the mapping files (old to new patient_num and encounter_num, tagged paths) and the sensitivity report, written in the MappingFolder of the [files].toml or in the output folder",
+			EnvVar: "MAPPING_KEY",
+		},
+		cli.StringFlag{
+			Name:  optionMappingSchema,
+			Usage: "Restricted database schema (lowercase letters, digits and underscores) where the mappings are stored instead of being written in files (not with --" + optionConvertOnly + ")",
+		},
+		cli.BoolFlag{
+			Name:  optionPlaintextMappings,
+			Usage: "Allow writing the mapping files and the sensitivity report in plaintext in the output folder when there is neither a MappingFolder in the [files].toml nor a --" + optionMappingKey + " (the output folder must then not be shared)",
+		},
+		cli.BoolFlag{
+			Name:  optionDelta,
+			Usage: "Add the dataset to the data already loaded instead of replacing it (the database and the mappings of the previous conversion are read, also with --" + optionConvertOnly + ")",
+		},
+		cli.IntFlag{
+			Name:  optionDummies,
+			Usage: "Number of dummy patients generated from clusters of the real patients (the DummyToPatient of the [files].toml is then not read, not with --" + optionDelta + ")",
+		},
+		cli.IntFlag{
+			Name:  optionDummyClusters,
+			Usage: "Number of clusters of patients the generated dummies are drawn from (default: sqrt(#patients / 2))",
+		},
+		cli.StringFlag{
+			Name:  optionDummyStrategy,
+			Value: "without_replacement",
+			Usage: "How the observations of the dummies are copied from their original patient (without_replacement, with_replacement, per_encounter or concept_distribution)",
+		},
 	}
 	loaderFlagsv1 = append(loaderFlagsCommon, loaderFlagsv1...)
 
@@ -244,7 +376,59 @@ func main() {
 			Flags:   loaderFlagsv1,
 			Action:  loadV1,
 		},
+		{
+			Name:  "validate",
+			Usage: "Check the i2b2 files before their conversion (columns, mandatory fields, dates, concept paths and references between the files)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  optionDataFiles + ", " + optionDataFilesShort,
+					Value: DefaultDataFiles,
+					Usage: "Configuration toml with the path of the all the necessary i2b2 files",
+				},
+				cli.BoolFlag{
+					Name:  optionDelta,
+					Usage: "The files are a delta load (the patients and visits they reference can already be loaded)",
+				},
+				cli.IntFlag{
+					Name:  optionDummies,
+					Usage: "Number of dummy patients generated by the loader (the DummyToPatient is then not checked)",
+				},
+			},
+			Action: validateV1,
+		},
 		// CLIENT END: DATA LOADER ------------
+
+		// BEGIN TOOLS: VARIANT IDS ----------
+		{
+			Name:  "variant",
+			Usage: "Encode and decode genomic variant IDs",
+			Subcommands: []cli.Command{
+				{
+					Name:      "encode",
+					Usage:     "Print the ID of a variant",
+					ArgsUsage: "CHROMOSOME POSITION REF ALT",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   optionAllelesKey + ", " + optionAllelesKeyShort,
+							Usage:  "Secret key of the hash encoding the alleles longer than 6 bases, shared by all the nodes (required for the variants with such alleles)",
+							EnvVar: "ALLELES_KEY",
+						},
+						cli.StringFlag{
+							Name:  optionAssembly + ", " + optionAssemblyShort,
+							Usage: "Reference genome assembly of the variant (GRCh37 or GRCh38, required)",
+						},
+					},
+					Action: encodeVariantID,
+				},
+				{
+					Name:      "decode",
+					Usage:     "Print the variants of IDs (put -- before negative IDs)",
+					ArgsUsage: "ID...",
+					Action:    decodeVariantID,
+				},
+			},
+		},
+		// TOOLS END: VARIANT IDS ------------
 	}
 
 	cliApp.Flags = binaryFlags
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3/log"
+	"path/filepath"
+	"strconv"
+)
+
+// Validation functions
+//______________________________________________________________________________________________________________________
+
+// validateV1 checks the i2b2 files of the [files].toml and prints the issues found (one per line)
+func validateV1(c *cli.Context) error {
+	dataFilesPath := c.String("files")
+
+	var files loaderi2b2.Files
+	if _, err := toml.DecodeFile(dataFilesPath, &files); err != nil {
+		log.Error("Error while reading [files].toml:", err)
+		return cli.NewExitError(err, 1)
+	}
+
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{
+		Directory: filepath.Dir(dataFilesPath),
+		Files:     files,
+		Delta:     c.Bool("delta"),
+		Dummies:   c.Int("dummies"),
+		// nothing is written by the validation
+		PlaintextMappings: true,
+	})
+	if err != nil {
+		log.Error("Error while creating the loader:", err)
+		return exitError(err)
+	}
+
+	issues, err := l.Validate()
+	if err != nil {
+		log.Error("Error while validating the i2b2 files:", err)
+		return exitError(err)
+	}
+
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if len(issues) > 0 {
+		return exitError(loader.NewError(loader.ErrInputFormat, errors.New(strconv.Itoa(len(issues))+" issues found")))
+	}
+	log.Info("The i2b2 files are valid")
+	return nil
+}
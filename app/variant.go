@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/identifiers"
+	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3/log"
+	"strconv"
+)
+
+// Variant ID functions
+//______________________________________________________________________________________________________________________
+
+// encodeVariantID prints the ID of the variant given as arguments (chromosome, position, reference and alternate alleles)
+func encodeVariantID(c *cli.Context) error {
+	if c.NArg() != 4 {
+		err := errors.New("expected 4 arguments (chromosome, position, reference allele, alternate allele), got " + strconv.Itoa(c.NArg()))
+		log.Error("Wrong arguments", err)
+		return cli.NewExitError(err, 1)
+	}
+
+	position, err := strconv.ParseInt(c.Args().Get(1), 10, 64)
+	if err != nil {
+		log.Error("Wrong position", err)
+		return exitError(loader.NewError(loader.ErrInputFormat, err))
+	}
+
+	encoder, err := identifiers.NewVariantIDEncoder(c.String("assembly"), []byte(c.String("alleles_key")))
+	if err != nil {
+		log.Error("Wrong reference genome assembly", err)
+		return cli.NewExitError(err, 1)
+	}
+
+	id, err := encoder.GetVariantID(c.Args().Get(0), position, c.Args().Get(2), c.Args().Get(3))
+	if err != nil {
+		log.Error("Error while encoding the variant", err)
+		return exitError(err)
+	}
+
+	fmt.Println(id)
+	return nil
+}
+
+// decodeVariantID prints the variants of the IDs given as arguments
+func decodeVariantID(c *cli.Context) error {
+	if c.NArg() == 0 {
+		err := errors.New("expected at least one variant ID")
+		log.Error("Wrong arguments", err)
+		return cli.NewExitError(err, 1)
+	}
+
+	for _, arg := range c.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			log.Error("Wrong variant ID", err)
+			return exitError(loader.NewError(loader.ErrInputFormat, err))
+		}
+
+		variant, err := identifiers.ParseVariantID(id)
+		if err != nil {
+			log.Error("Error while decoding the variant", err)
+			return exitError(err)
+		}
+
+		if variant.LongAlleles {
+			fmt.Println(id, variant.String(), "long alleles hash="+strconv.FormatInt(variant.AllelesHash, 10))
+		} else {
+			fmt.Println(id, variant.String())
+		}
+	}
+	return nil
+}
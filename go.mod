@@ -9,6 +9,7 @@ require (
 	github.com/urfave/cli v1.22.3
 	go.dedis.ch/kyber/v3 v3.0.12
 	go.dedis.ch/onet/v3 v3.2.0
+	golang.org/x/crypto v0.0.0-20200317142112-1b76d66859c6
 )
 
 go 1.13
@@ -0,0 +1,294 @@
+package loader
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The files of a checkpoint directory
+const (
+	checkpointFile = "checkpoint.json"
+	termsFile      = "terms.csv"
+)
+
+// Checkpoint persists the results of the phases of a loading, so that a run that failed can be resumed without redoing
+// the expensive ones: the encryption and the distributed deterministic tagging of the sensitive elements (see Terms) and
+// the phases that were completed (e.g. the conversion, whose files must not have changed since). A checkpoint belongs to
+// the inputs and settings it was created with (see CheckpointKey): it is started over if they change.
+//
+// The methods of a nil *Checkpoint do nothing, a nil checkpoint stands for a loading without checkpoints.
+type Checkpoint struct {
+	Dir string `json:"-"`
+	Key string `json:"key"`
+	// Phases are the completed phases (in the order of their completion)
+	Phases []Phase `json:"phases"`
+
+	terms map[int64]Term
+}
+
+// Phase is a completed phase and the hashes (SHA-256) of the files it produced
+type Phase struct {
+	Name  string            `json:"name"`
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// Term is a sensitive element once encrypted (the serialized ciphertext, empty if it is not needed) and tagged
+type Term struct {
+	Ciphertext string
+	Tag        string
+}
+
+// CheckpointKey derives the key of the checkpoint of a loading from the aggregate key of the collective authority (the
+// tags depend on it), the content of the input files and the settings of the conversion
+func CheckpointKey(aggregate kyber.Point, inputs []string, settings ...string) (string, error) {
+	h := sha256.New()
+	key, err := aggregate.MarshalBinary()
+	if err != nil {
+		return "", NewError(ErrSerialization, err)
+	}
+	h.Write(key)
+
+	for _, path := range inputs {
+		hash, err := hashFile(path)
+		if err != nil {
+			return "", NewInputError(path, err)
+		}
+		h.Write([]byte(hash))
+	}
+	for _, setting := range settings {
+		h.Write([]byte(strconv.Itoa(len(setting)) + ":" + setting))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// OpenCheckpoint opens the checkpoint directory dir (it is created if needed). If resume is set and the checkpoint it
+// holds has the same key, the completed phases and the tagged terms are kept, otherwise the checkpoint is started over.
+func OpenCheckpoint(dir, key string, resume bool) (*Checkpoint, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, NewError(ErrOutput, err).InFile(dir, 0)
+	}
+
+	c := &Checkpoint{Dir: dir, Key: key, Phases: make([]Phase, 0), terms: make(map[int64]Term)}
+	if resume {
+		previous := &Checkpoint{}
+		content, err := ioutil.ReadFile(filepath.Join(dir, checkpointFile))
+		if os.IsNotExist(err) {
+			log.Warn("No checkpoint in " + dir + ", starting from the beginning")
+		} else if err != nil {
+			return nil, NewInputError(filepath.Join(dir, checkpointFile), err)
+		} else if err := json.Unmarshal(content, previous); err != nil {
+			return nil, NewInputError(filepath.Join(dir, checkpointFile), err)
+		} else if previous.Key != key {
+			log.Warn("The checkpoint in " + dir + " was created with other input files or settings, starting from the beginning")
+		} else {
+			c.Phases = previous.Phases
+			if err := c.readTerms(); err != nil {
+				return nil, err
+			}
+			names := make([]string, len(c.Phases))
+			for i, phase := range c.Phases {
+				names[i] = phase.Name
+			}
+			log.Lvl2("Resuming from the checkpoint in", dir, ": completed phases [", strings.Join(names, ", "), "],", len(c.terms), "tagged terms")
+			return c, nil
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, termsFile)); err != nil && !os.IsNotExist(err) {
+		return nil, NewError(ErrOutput, err).InFile(filepath.Join(dir, termsFile), 0)
+	}
+	return c, c.save()
+}
+
+// Done returns true if the phase was completed and the files it produced have not changed since. Otherwise the phase and
+// the ones completed after it are forgotten (they have to be done again).
+func (c *Checkpoint) Done(name string) bool {
+	if c == nil {
+		return false
+	}
+
+	for i, phase := range c.Phases {
+		if phase.Name != name {
+			continue
+		}
+		for path, hash := range phase.Files {
+			if current, err := hashFile(path); err != nil || current != hash {
+				log.Warn("The file " + path + " changed since the checkpoint, redoing the phase " + name)
+				c.forget(i)
+				return false
+			}
+		}
+		log.Lvl2("Skipping the phase", name, "(completed before the checkpoint)")
+		return true
+	}
+	return false
+}
+
+// Complete records that the phase was completed, with the hashes of the files it produced
+func (c *Checkpoint) Complete(name string, files []string) error {
+	if c == nil {
+		return nil
+	}
+
+	phase := Phase{Name: name, Files: make(map[string]string)}
+	for _, path := range files {
+		hash, err := hashFile(path)
+		if err != nil {
+			return NewError(ErrOutput, err).InFile(path, 0)
+		}
+		phase.Files[path] = hash
+	}
+
+	for i := range c.Phases {
+		if c.Phases[i].Name == name {
+			c.Phases = c.Phases[:i]
+			break
+		}
+	}
+	c.Phases = append(c.Phases, phase)
+	return c.save()
+}
+
+// Run runs a phase that produces no file (e.g. a loading transaction), unless it was completed before
+func (c *Checkpoint) Run(name string, run func() error) error {
+	if c.Done(name) {
+		return nil
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	return c.Complete(name, nil)
+}
+
+// Terms returns the tagged terms of the elements if all of them are in the checkpoint
+func (c *Checkpoint) Terms(ids []int64) ([]Term, bool) {
+	if c == nil || len(ids) == 0 {
+		return nil, false
+	}
+
+	terms := make([]Term, len(ids))
+	for i, id := range ids {
+		term, ok := c.terms[id]
+		if !ok {
+			return nil, false
+		}
+		terms[i] = term
+	}
+	log.Lvl2("Using the", len(terms), "tagged terms of the checkpoint")
+	return terms, true
+}
+
+// AddTerms adds the tagged terms of the elements to the checkpoint (they are written to disk right away)
+func (c *Checkpoint) AddTerms(ids []int64, terms []Term) error {
+	if c == nil {
+		return nil
+	}
+
+	path := filepath.Join(c.Dir, termsFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return NewError(ErrOutput, err).InFile(path, 0)
+	}
+	defer f.Close()
+
+	writer := csv.NewWriter(f)
+	for i, id := range ids {
+		writer.Write([]string{strconv.FormatInt(id, 10), terms[i].Ciphertext, terms[i].Tag})
+		c.terms[id] = terms[i]
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return NewError(ErrOutput, err).InFile(path, 0)
+	}
+	if err := f.Sync(); err != nil {
+		return NewError(ErrOutput, err).InFile(path, 0)
+	}
+	return nil
+}
+
+// readTerms reads the tagged terms of the checkpoint (a record cut by a failure while writing is ignored)
+func (c *Checkpoint) readTerms() error {
+	path := filepath.Join(c.Dir, termsFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return NewInputError(path, err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 3
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			log.Warn("Ignoring the end of "+path+":", err)
+			return nil
+		}
+		id, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return NewInputError(path, err)
+		}
+		c.terms[id] = Term{Ciphertext: record[1], Tag: record[2]}
+	}
+}
+
+// forget removes the phase i and the ones completed after it
+func (c *Checkpoint) forget(i int) {
+	c.Phases = c.Phases[:i]
+	if err := c.save(); err != nil {
+		log.Error("Error while updating the checkpoint:", err)
+	}
+}
+
+// save writes the checkpoint file (atomically, so that a failure while writing does not corrupt it)
+func (c *Checkpoint) save() error {
+	path := filepath.Join(c.Dir, checkpointFile)
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return NewError(ErrSerialization, err)
+	}
+	if err := ioutil.WriteFile(path+".tmp", content, 0600); err != nil {
+		return NewError(ErrOutput, err).InFile(path, 0)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return NewError(ErrOutput, err).InFile(path, 0)
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 (hex) of the content of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CheckResume checks that a loading can be resumed (it needs a checkpoint directory)
+func CheckResume(dir string, resume bool) error {
+	if resume && dir == "" {
+		return NewError(ErrInputFormat, errors.New("a checkpoint directory is needed to resume a loading"))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package loader_test
+
+import (
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "input.csv"), filepath.Join(dir, "output.csv")
+	assert.Nil(t, ioutil.WriteFile(input, []byte("a,b\n"), 0644))
+	assert.Nil(t, ioutil.WriteFile(output, []byte("1,2\n"), 0644))
+
+	_, pk := libunlynx.GenKey()
+	key, err := loader.CheckpointKey(pk, []string{input}, "setting")
+	assert.Nil(t, err)
+	otherKey, err := loader.CheckpointKey(pk, []string{input}, "other setting")
+	assert.Nil(t, err)
+	assert.NotEqual(t, key, otherKey)
+
+	// a nil checkpoint does nothing
+	var none *loader.Checkpoint
+	assert.False(t, none.Done("convert"))
+	assert.Nil(t, none.Complete("convert", []string{output}))
+	_, ok := none.Terms([]int64{1})
+	assert.False(t, ok)
+
+	c, err := loader.OpenCheckpoint(dir, key, false)
+	assert.Nil(t, err)
+	assert.Nil(t, c.AddTerms([]int64{1, 2}, []loader.Term{{Tag: "tag1"}, {Tag: "tag2"}}))
+	assert.Nil(t, c.Complete("convert", []string{output}))
+	assert.Nil(t, c.Run("load", func() error { return nil }))
+
+	// the completed phases and the terms are kept when resuming
+	c, err = loader.OpenCheckpoint(dir, key, true)
+	assert.Nil(t, err)
+	assert.True(t, c.Done("convert"))
+	assert.True(t, c.Done("load"))
+	terms, ok := c.Terms([]int64{2, 1})
+	assert.True(t, ok)
+	assert.Equal(t, []loader.Term{{Tag: "tag2"}, {Tag: "tag1"}}, terms)
+	_, ok = c.Terms([]int64{1, 3})
+	assert.False(t, ok)
+
+	// a phase whose files changed is done again, as well as the phases completed after it
+	assert.Nil(t, ioutil.WriteFile(output, []byte("1,3\n"), 0644))
+	assert.False(t, c.Done("convert"))
+	assert.False(t, c.Done("load"))
+
+	// the checkpoint is started over with other settings
+	c, err = loader.OpenCheckpoint(dir, otherKey, true)
+	assert.Nil(t, err)
+	_, ok = c.Terms([]int64{1})
+	assert.False(t, ok)
+
+	assert.NotNil(t, loader.CheckResume("", true))
+	assert.Nil(t, loader.CheckResume(dir, true))
+}
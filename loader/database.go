@@ -0,0 +1,412 @@
+package loader
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statement is a single step of a loading transaction: either a plain SQL statement (SQL) or the copy of a .csv file
+// (Path) into a table (Table)
+type Statement struct {
+	SQL    string
+	Table  string
+	Path   string
+	Header bool
+}
+
+// ExecStatement creates a statement that executes plain SQL
+func ExecStatement(query string) Statement {
+	return Statement{SQL: query}
+}
+
+// CopyStatement creates a statement that copies a .csv file into a table (header defines whether the first line of
+// the file should be skipped)
+func CopyStatement(table, path string, header bool) Statement {
+	return Statement{Table: table, Path: path, Header: header}
+}
+
+// TruncateStatement creates a statement that empties a table
+func TruncateStatement(table string) Statement {
+	return Statement{SQL: "TRUNCATE TABLE " + table + ";", Table: table}
+}
+
+// IsCopy returns true if the statement copies a .csv file into a table
+func (s Statement) IsCopy() bool {
+	return s.Path != ""
+}
+
+// LoadError is the error returned when a statement fails. It identifies the table and .csv file concerned and,
+// when known, the row of the .csv file (1-based, without counting the header) that was rejected.
+type LoadError struct {
+	Table string
+	Path  string
+	Row   int64
+	Err   error
+}
+
+func (e *LoadError) Error() string {
+	msg := "error while loading"
+	if e.Table != "" {
+		msg += " table " + e.Table
+	}
+	if e.Path != "" {
+		msg += " from " + e.Path
+	}
+	if e.Row > 0 {
+		msg += " (row " + strconv.FormatInt(e.Row, 10) + ")"
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrDBLoad (all the loading errors belong to this category)
+func (e *LoadError) Is(target error) bool {
+	return target == ErrDBLoad
+}
+
+// ConnectionString returns the connection string of the database
+func (s DBSettings) ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", s.DBhost, s.DBport, s.DBuser, s.DBpassword, s.DBname)
+}
+
+// ExecuteStatements runs all statements against the database in one single transaction. If one of the statements fails
+// the whole transaction is rolled back and a *LoadError is returned.
+func ExecuteStatements(dbSettings DBSettings, statements []Statement) error {
+	db, err := sql.Open("postgres", dbSettings.ConnectionString())
+	if err != nil {
+		return &LoadError{Err: err}
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return &LoadError{Err: err}
+	}
+
+	for _, s := range statements {
+		start := time.Now()
+		if s.IsCopy() {
+			var rows int64
+			rows, err = copyFile(tx, s)
+			if err == nil {
+				log.Lvl2("Copied", rows, "rows into", s.Table, "(", time.Since(start), ")")
+			}
+		} else if _, err = tx.Exec(s.SQL); err != nil {
+			err = &LoadError{Table: s.Table, Err: err}
+		}
+
+		if err != nil {
+			if errRollback := tx.Rollback(); errRollback != nil {
+				log.Error("Error while rolling back the transaction:", errRollback)
+			}
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &LoadError{Err: err}
+	}
+	return nil
+}
+
+// copyFile copies the content of a .csv file into a table using the COPY protocol (the columns are filled in the order
+// in which they were defined, like \copy without a column list)
+func copyFile(tx *sql.Tx, s Statement) (int64, error) {
+	schema, table := splitTableName(s.Table)
+
+	columns, err := tableColumns(tx, schema, table)
+	if err != nil {
+		return 0, &LoadError{Table: s.Table, Path: s.Path, Err: err}
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return 0, &LoadError{Table: s.Table, Path: s.Path, Err: err}
+	}
+	defer f.Close()
+
+	stmt, err := tx.Prepare(pq.CopyInSchema(schema, table, columns...))
+	if err != nil {
+		return 0, &LoadError{Table: s.Table, Path: s.Path, Err: err}
+	}
+
+	reader := NewCSVReader(f)
+	if s.Header {
+		if _, err := reader.Read(); err != nil && err != io.EOF {
+			stmt.Close()
+			return 0, &LoadError{Table: s.Table, Path: s.Path, Err: err}
+		}
+	}
+
+	row := int64(0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		if err != nil {
+			stmt.Close()
+			return row, &LoadError{Table: s.Table, Path: s.Path, Row: row, Err: err}
+		}
+		if len(record) != len(columns) {
+			stmt.Close()
+			return row, &LoadError{Table: s.Table, Path: s.Path, Row: row,
+				Err: fmt.Errorf("expected %d fields, found %d", len(columns), len(record))}
+		}
+
+		values := make([]interface{}, len(record))
+		for i, field := range record {
+			if field != nil {
+				values[i] = *field
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			stmt.Close()
+			return row, &LoadError{Table: s.Table, Path: s.Path, Row: rejectedRow(err, row), Err: err}
+		}
+	}
+
+	// flush the remaining rows
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return row, &LoadError{Table: s.Table, Path: s.Path, Row: rejectedRow(err, 0), Err: err}
+	}
+	if err := stmt.Close(); err != nil {
+		return row, &LoadError{Table: s.Table, Path: s.Path, Err: err}
+	}
+	return row, nil
+}
+
+// LoadingSummary describes what the statements would do to the database (tables truncated and rows loaded) without
+// connecting to it
+func LoadingSummary(dbSettings DBSettings, statements []Statement) (string, error) {
+	summary := "Database " + dbSettings.DBname + " (" + dbSettings.DBhost + ":" + strconv.Itoa(dbSettings.DBport) + "), single transaction:\n"
+
+	truncated, copied, totalRows := 0, 0, int64(0)
+	for _, s := range statements {
+		if s.IsCopy() {
+			rows, err := countRows(s.Path, s.Header)
+			if err != nil {
+				return "", &LoadError{Table: s.Table, Path: s.Path, Err: err}
+			}
+			summary += fmt.Sprintf("  LOAD     %s <- %s (%d rows)\n", s.Table, s.Path, rows)
+			copied++
+			totalRows += rows
+		} else if strings.HasPrefix(s.SQL, "TRUNCATE") {
+			summary += "  TRUNCATE " + s.Table + "\n"
+			truncated++
+		} else {
+			summary += "  EXECUTE  " + strings.TrimSpace(strings.SplitN(s.SQL, "\n", 2)[0]) + "\n"
+		}
+	}
+	summary += fmt.Sprintf("%d tables truncated, %d rows loaded in %d tables\n", truncated, totalRows, copied)
+
+	return summary, nil
+}
+
+// countRows returns the number of records of a .csv file
+func countRows(path string, header bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := NewCSVReader(f)
+	rows := int64(0)
+	for {
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	if header && rows > 0 {
+		rows--
+	}
+	return rows, nil
+}
+
+// QueryRows runs a query on a table and scans its rows, the tables that do not exist yet are considered empty
+func QueryRows(db *sql.DB, table, query string, scan func(rows *sql.Rows) error) error {
+	var exists bool
+	if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return &LoadError{Table: table, Err: err}
+	} else if !exists {
+		return nil
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return &LoadError{Table: table, Err: err}
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return &LoadError{Table: table, Err: err}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &LoadError{Table: table, Err: err}
+	}
+	return nil
+}
+
+// splitTableName splits schema.table into its two components (the schema defaults to public)
+func splitTableName(name string) (string, string) {
+	tokens := strings.SplitN(name, ".", 2)
+	if len(tokens) == 1 {
+		return "public", tokens[0]
+	}
+	return tokens[0], tokens[1]
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func tableColumns(tx *sql.Tx, schema, table string) ([]string, error) {
+	columns, _, err := tableColumnTypes(tx, schema, table)
+	return columns, err
+}
+
+// tableColumnTypes returns the columns of a table and their data types (as named by information_schema) in the order
+// in which they were defined
+func tableColumnTypes(q queryer, schema, table string) ([]string, []string, error) {
+	rows, err := q.Query(`SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`, schema, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, types := make([]string, 0), make([]string, 0)
+	for rows.Next() {
+		var column, dataType string
+		if err := rows.Scan(&column, &dataType); err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, column)
+		types = append(types, dataType)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(columns) == 0 {
+		return nil, nil, errors.New("table " + schema + "." + table + " does not exist")
+	}
+	return columns, types, nil
+}
+
+var copyLineRegex = regexp.MustCompile(`COPY [^,]+, line (\d+)`)
+
+// rejectedRow extracts the row rejected by the server from the error context (e.g. "COPY observation_fact, line 42, column ...").
+// If the context is not available it returns the default value.
+func rejectedRow(err error, defaultRow int64) int64 {
+	if pqErr, ok := err.(*pq.Error); ok {
+		if match := copyLineRegex.FindStringSubmatch(pqErr.Where); match != nil {
+			if row, errParse := strconv.ParseInt(match[1], 10, 64); errParse == nil {
+				return row
+			}
+		}
+	}
+	return defaultRow
+}
+
+// CSVReader reads .csv files following the PostgreSQL CSV format (QUOTE '"', ESCAPE '"'): contrary to encoding/csv it
+// distinguishes between an unquoted empty field (NULL -> nil) and a quoted empty field (empty string).
+type CSVReader struct {
+	r *bufio.Reader
+}
+
+// NewCSVReader creates a new CSVReader reading from r
+func NewCSVReader(r io.Reader) *CSVReader {
+	return &CSVReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next record or io.EOF if there are no more records
+func (cr *CSVReader) Read() ([]*string, error) {
+	record := make([]*string, 0)
+
+	var field strings.Builder
+	quoted, inQuotes, started := false, false, false
+
+	endField := func() {
+		if quoted || field.Len() > 0 {
+			value := field.String()
+			record = append(record, &value)
+		} else {
+			record = append(record, nil)
+		}
+		field.Reset()
+		quoted = false
+	}
+
+	for {
+		c, err := cr.r.ReadByte()
+		if err == io.EOF {
+			if inQuotes {
+				return nil, errors.New("unterminated quoted field")
+			}
+			if !started {
+				return nil, io.EOF
+			}
+			endField()
+			return record, nil
+		} else if err != nil {
+			return nil, err
+		}
+		started = true
+
+		if inQuotes {
+			if c == '"' {
+				next, err := cr.r.Peek(1)
+				if err == nil && next[0] == '"' {
+					cr.r.ReadByte()
+					field.WriteByte('"')
+				} else {
+					inQuotes = false
+				}
+			} else {
+				field.WriteByte(c)
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inQuotes = true
+			quoted = true
+		case ',':
+			endField()
+		case '\r':
+			if next, err := cr.r.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+			field.WriteByte(c)
+		case '\n':
+			endField()
+			return record, nil
+		default:
+			field.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package loader_test
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readAll(t *testing.T, content string) [][]*string {
+	reader := loader.NewCSVReader(strings.NewReader(content))
+	records := make([][]*string, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestCSVReader(t *testing.T) {
+	records := readAll(t, "\"a\",,\"\",\"b \"\"quoted\"\"\"\n1,\"multi\nline\",x\r\n")
+	assert.Equal(t, 2, len(records))
+
+	// unquoted empty fields are NULL, quoted empty fields are empty strings
+	assert.Equal(t, 4, len(records[0]))
+	assert.Equal(t, "a", *records[0][0])
+	assert.Nil(t, records[0][1])
+	assert.Equal(t, "", *records[0][2])
+	assert.Equal(t, `b "quoted"`, *records[0][3])
+
+	assert.Equal(t, 3, len(records[1]))
+	assert.Equal(t, "1", *records[1][0])
+	assert.Equal(t, "multi\nline", *records[1][1])
+	assert.Equal(t, "x", *records[1][2])
+
+	records = readAll(t, "\"\\medco\\\",\"NOW()\",\n")
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, `\medco\`, *records[0][0])
+	assert.Equal(t, "NOW()", *records[0][1])
+	assert.Nil(t, records[0][2])
+
+	_, err := loader.NewCSVReader(strings.NewReader("\"unterminated")).Read()
+	assert.NotNil(t, err)
+}
+
+func TestLoadError(t *testing.T) {
+	err := &loader.LoadError{Table: "i2b2demodata_i2b2.observation_fact", Path: "observation_fact.csv", Row: 42, Err: io.ErrUnexpectedEOF}
+	assert.Equal(t, "error while loading table i2b2demodata_i2b2.observation_fact from observation_fact.csv (row 42): unexpected EOF", err.Error())
+	assert.True(t, errors.Is(err, loader.ErrDBLoad))
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.False(t, errors.Is(err, loader.ErrInputFormat))
+}
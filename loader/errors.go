@@ -0,0 +1,92 @@
+package loader
+
+import (
+	"encoding/csv"
+	"errors"
+	"strconv"
+)
+
+// The categories of errors returned by the loader packages. The errors returned by the loaders wrap one of them so that
+// the caller can tell them apart with errors.Is (e.g. to exit with a different code).
+var (
+	// ErrInputFormat is the category of the errors due to an input file that is missing, unreadable or malformed
+	ErrInputFormat = errors.New("invalid input")
+	// ErrMissingOntologyElement is the category of the errors due to a dataset element that is not in the ontology
+	ErrMissingOntologyElement = errors.New("element missing from the ontology")
+	// ErrDDT is the category of the errors of the distributed deterministic tagging
+	ErrDDT = errors.New("distributed deterministic tagging failed")
+	// ErrSerialization is the category of the errors while (de)serializing cryptographic material
+	ErrSerialization = errors.New("serialization failed")
+	// ErrOutput is the category of the errors while writing the converted files
+	ErrOutput = errors.New("error while writing the converted files")
+	// ErrDBLoad is the category of the errors while loading the converted files in the database (see LoadError)
+	ErrDBLoad = errors.New("error while loading the database")
+	// ErrRandomness is the category of the errors while reading the randomness of the system (crypto/rand)
+	ErrRandomness = errors.New("error while reading the randomness of the system")
+)
+
+// Error is an error of the conversion. It belongs to one of the categories above (Kind) and identifies, when known, the
+// file, the line (1-based) and the table concerned.
+type Error struct {
+	Kind  error
+	Path  string
+	Line  int64
+	Table string
+	Err   error
+}
+
+// NewError creates an error of the category kind
+func NewError(kind error, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+// NewInputError creates an error of the category ErrInputFormat concerning the file path (the line is set if err is a
+// *csv.ParseError)
+func NewInputError(path string, err error) *Error {
+	e := NewError(ErrInputFormat, err).InFile(path, 0)
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		e.Line = int64(parseErr.Line)
+	}
+	return e
+}
+
+// InFile sets the file (and line, 0 if unknown) concerned by the error
+func (e *Error) InFile(path string, line int64) *Error {
+	e.Path = path
+	e.Line = line
+	return e
+}
+
+// InTable sets the table concerned by the error
+func (e *Error) InTable(table string) *Error {
+	e.Table = table
+	return e
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Table != "" {
+		msg += " in table " + e.Table
+	}
+	if e.Path != "" {
+		msg += " in " + e.Path
+		if e.Line > 0 {
+			msg += ":" + strconv.FormatInt(e.Line, 10)
+		}
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error belongs to the category target
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
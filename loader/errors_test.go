@@ -0,0 +1,34 @@
+package loader_test
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	err := loader.NewError(loader.ErrInputFormat, io.ErrUnexpectedEOF).InFile("concept_dimension.csv", 12).InTable("i2b2demodata_i2b2.concept_dimension")
+	assert.Equal(t, "invalid input in table i2b2demodata_i2b2.concept_dimension in concept_dimension.csv:12: unexpected EOF", err.Error())
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.False(t, errors.Is(err, loader.ErrDDT))
+
+	var e *loader.Error
+	assert.True(t, errors.As(error(err), &e))
+	assert.Equal(t, int64(12), e.Line)
+
+	err = loader.NewError(loader.ErrMissingOntologyElement, nil)
+	assert.Equal(t, "element missing from the ontology", err.Error())
+}
+
+func TestNewInputError(t *testing.T) {
+	_, err := csv.NewReader(strings.NewReader("a,b\nc\n")).ReadAll()
+	e := loader.NewInputError("table_access.csv", err)
+	assert.Equal(t, int64(2), e.Line)
+	assert.True(t, errors.Is(e, loader.ErrInputFormat))
+	assert.True(t, errors.Is(e, csv.ErrFieldCount))
+}
@@ -0,0 +1,292 @@
+package loadergenomic
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/identifiers"
+	"strconv"
+	"strings"
+)
+
+// State is the content of the databases an append load builds upon (see Options.Append): the elements that are already
+// loaded keep their IDs and are not written again, the new ones are numbered after the existing ones.
+type State struct {
+	// OntologyPaths are the c_fullname of the rows of the medco_ont tables (clinical_sensitive, clinical_non_sensitive
+	// and sensitive_tagged)
+	OntologyPaths map[string]struct{}
+	// ClinicalConcepts are the IDs of the clinical values, by sanitized field (see SanitizeHeader) and value. The
+	// Identifier is "E" for the sensitive values (ENC_ID) and "C" for the others (CLEAR).
+	ClinicalConcepts map[ConceptPath]ConceptID
+	// TagIDs are the TAG_IDs of the tags of the sensitive values
+	TagIDs map[string]int64
+	// Variants are the IDs of the genomic variants of the annotations, LongAlleles the names (chr:pos:ref>alt) of the
+	// ones with long alleles (their IDs hold a hash of the alleles, see identifiers.VariantIDEncoder)
+	Variants    map[int64]struct{}
+	LongAlleles map[int64]string
+	// ConceptCodes are the concept_cd of the concept_dimension
+	ConceptCodes map[string]struct{}
+	// Patients and Samples are the numbers (patient_num and encounter_num) of the patients and samples, SamplePatients
+	// the patient of each sample
+	Patients       map[string]int64
+	Samples        map[string]int64
+	SamplePatients map[string]string
+	// Provider tells whether the provider is in the provider_dimension
+	Provider bool
+
+	MaxEncID, MaxClearID           int64
+	MaxPatientNum, MaxEncounterNum int64
+	MaxTextSearchIndex             int64
+	tagIDs                         map[int64]struct{}
+}
+
+// NewState creates the state of empty databases
+func NewState() *State {
+	return &State{
+		OntologyPaths:    make(map[string]struct{}),
+		ClinicalConcepts: make(map[ConceptPath]ConceptID),
+		TagIDs:           make(map[string]int64),
+		Variants:         make(map[int64]struct{}),
+		LongAlleles:      make(map[int64]string),
+		ConceptCodes:     make(map[string]struct{}),
+		Patients:         make(map[string]int64),
+		Samples:          make(map[string]int64),
+		SamplePatients:   make(map[string]string),
+		tagIDs:           make(map[int64]struct{}),
+	}
+}
+
+// AddOntologyElement adds a row (c_fullname and c_basecode) of the medco_ont tables
+func (s *State) AddOntologyElement(fullname, basecode string) error {
+	s.OntologyPaths[fullname] = struct{}{}
+	if basecode == "" {
+		return nil
+	}
+
+	tokens := strings.SplitN(basecode, ":", 2)
+	if len(tokens) != 2 {
+		return nil
+	}
+	id, err := strconv.ParseInt(tokens[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	// \medco\clinical\sensitive\<field>\<value>\, \medco\clinical\nonsensitive\<field>\<value>\ or \medco\tagged\<tag>\
+	path := strings.Split(strings.Trim(fullname, `\`), `\`)
+	switch {
+	case tokens[0] == "ENC_ID" && len(path) == 5:
+		s.ClinicalConcepts[ConceptPath{Field: path[3], Record: path[4]}] = ConceptID{Identifier: "E", Value: id}
+		if id > s.MaxEncID {
+			s.MaxEncID = id
+		}
+	case tokens[0] == "CLEAR" && len(path) == 5:
+		s.ClinicalConcepts[ConceptPath{Field: path[3], Record: path[4]}] = ConceptID{Identifier: "C", Value: id}
+		if id > s.MaxClearID {
+			s.MaxClearID = id
+		}
+	case tokens[0] == "TAG_ID" && len(path) == 3:
+		s.TagIDs[path[2]] = id
+		s.tagIDs[id] = struct{}{}
+	}
+	return nil
+}
+
+// AddVariant adds a genomic variant of the annotations (variant_id and variant_name)
+func (s *State) AddVariant(id int64, name string) {
+	s.Variants[id] = struct{}{}
+	if variant, err := identifiers.ParseVariantID(id); err == nil && variant.LongAlleles {
+		s.LongAlleles[id] = name
+	}
+}
+
+// AddPatient adds a patient (patient_ide and patient_num)
+func (s *State) AddPatient(patientID string, num int64) {
+	s.Patients[patientID] = num
+	if num > s.MaxPatientNum {
+		s.MaxPatientNum = num
+	}
+}
+
+// AddSample adds a sample (encounter_ide, patient_ide and encounter_num)
+func (s *State) AddSample(sampleID, patientID string, num int64) {
+	s.Samples[sampleID] = num
+	s.SamplePatients[sampleID] = patientID
+	if num > s.MaxEncounterNum {
+		s.MaxEncounterNum = num
+	}
+}
+
+// hasTagID returns true if the TAG_ID is already taken
+func (s *State) hasTagID(id int64) bool {
+	_, ok := s.tagIDs[id]
+	return ok
+}
+
+// ReadState reads the state of the i2b2 and genomic annotations databases
+func ReadState(i2b2DB, gaDB loader.DBSettings) (*State, error) {
+	s := NewState()
+
+	db, err := sql.Open("postgres", i2b2DB.ConnectionString())
+	if err != nil {
+		return nil, &loader.LoadError{Err: err}
+	}
+	defer db.Close()
+
+	for _, table := range []string{TablenamesOntology[0], TablenamesOntology[1], TablenamesOntology[3]} {
+		err := loader.QueryRows(db, table, "SELECT c_fullname, COALESCE(c_basecode, '') FROM "+table, func(rows *sql.Rows) error {
+			var fullname, basecode string
+			if err := rows.Scan(&fullname, &basecode); err != nil {
+				return err
+			}
+			return s.AddOntologyElement(fullname, basecode)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	queries := []struct {
+		table, query string
+		scan         func(rows *sql.Rows) error
+	}{
+		{TablenamesData[0], "SELECT concept_cd FROM " + TablenamesData[0], func(rows *sql.Rows) error {
+			var code string
+			err := rows.Scan(&code)
+			s.ConceptCodes[code] = struct{}{}
+			return err
+		}},
+		{TablenamesData[1], "SELECT patient_ide, patient_num FROM " + TablenamesData[1] + " WHERE patient_ide_source = 'chuv'", func(rows *sql.Rows) error {
+			var patientID string
+			var num int64
+			err := rows.Scan(&patientID, &num)
+			s.AddPatient(patientID, num)
+			return err
+		}},
+		{TablenamesData[3], "SELECT encounter_ide, patient_ide, encounter_num FROM " + TablenamesData[3] + " WHERE encounter_ide_source = 'chuv'", func(rows *sql.Rows) error {
+			var sampleID, patientID string
+			var num int64
+			err := rows.Scan(&sampleID, &patientID, &num)
+			s.AddSample(sampleID, patientID, num)
+			return err
+		}},
+		{TablenamesData[5], "SELECT COUNT(*) > 0 FROM " + TablenamesData[5] + " WHERE provider_id = 'chuv'", func(rows *sql.Rows) error {
+			return rows.Scan(&s.Provider)
+		}},
+		{TablenamesData[6], "SELECT COALESCE(MAX(text_search_index), 0) FROM " + TablenamesData[6], func(rows *sql.Rows) error {
+			return rows.Scan(&s.MaxTextSearchIndex)
+		}},
+	}
+	for _, q := range queries {
+		if err := loader.QueryRows(db, q.table, q.query, q.scan); err != nil {
+			return nil, err
+		}
+	}
+
+	ga, err := sql.Open("postgres", gaDB.ConnectionString())
+	if err != nil {
+		return nil, &loader.LoadError{Err: err}
+	}
+	defer ga.Close()
+
+	err = loader.QueryRows(ga, TablenamesOntology[2], "SELECT variant_id, variant_name FROM "+TablenamesOntology[2], func(rows *sql.Rows) error {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		variantID, err := strconv.ParseInt(id, 10, 64)
+		s.AddVariant(variantID, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loaded returns true if the ontology element (c_fullname) is already in the databases
+func (l *Loader) loaded(fullname string) bool {
+	if l.State == nil {
+		return false
+	}
+	_, ok := l.State.OntologyPaths[fullname]
+	return ok
+}
+
+// loadedField returns true if the clinical field is already in the sensitive (or non-sensitive) ontology, and an error
+// if it was loaded with another sensitivity (its values would be numbered twice). A partially sensitive field (see
+// loader.Policy) is in both ontologies.
+func (l *Loader) loadedField(field string, sensitive, partial bool) (bool, error) {
+	sensitivePath := `\medco\clinical\sensitive\` + SanitizeHeader(field) + `\`
+	clearPath := `\medco\clinical\nonsensitive\` + SanitizeHeader(field) + `\`
+	if !partial && sensitive && l.loaded(clearPath) {
+		return false, loader.NewError(loader.ErrInputFormat, errors.New("field "+field+" is sensitive but was loaded as non-sensitive"))
+	} else if !partial && !sensitive && l.loaded(sensitivePath) {
+		return false, loader.NewError(loader.ErrInputFormat, errors.New("field "+field+" is non-sensitive but was loaded as sensitive"))
+	}
+	if sensitive {
+		return l.loaded(sensitivePath), nil
+	}
+	return l.loaded(clearPath), nil
+}
+
+// loadedConcept returns the ID (ENC_ID or CLEAR) of a clinical value already in the ontology
+func (l *Loader) loadedConcept(field, value string) (ConceptID, bool) {
+	if l.State == nil {
+		return ConceptID{}, false
+	}
+	id, ok := l.State.ClinicalConcepts[ConceptPath{Field: SanitizeHeader(field), Record: value}]
+	return id, ok
+}
+
+// addLoadedVariants records the alleles of the annotated variants with long alleles in the encoder of the variant IDs, so
+// that the new variants cannot get their IDs (the hash of the alleles can collide)
+func (l *Loader) addLoadedVariants() error {
+	for id, name := range l.State.LongAlleles {
+		// chr:pos:ref>alt, where an empty allele is "?"
+		tokens := strings.Split(name[strings.LastIndex(name, ":")+1:], ">")
+		if len(tokens) != 2 {
+			return loader.NewError(loader.ErrInputFormat, errors.New("invalid name "+name+" of the loaded variant "+strconv.FormatInt(id, 10)))
+		}
+		for i := range tokens {
+			if tokens[i] == "?" {
+				tokens[i] = "-"
+			}
+		}
+		// the MAF annotations name the second tumor allele if the first one (of the ID) is empty
+		if err := l.variantIDs.AddLoadedVariant(id, tokens[0], tokens[1], "-"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sensitiveVariant returns the sensitive ID value of a genomic variant, the variants already in the genomic annotations
+// are tagged (to get their TAG_ID) but not annotated again
+func (l *Loader) sensitiveVariant(genomicID int64, annotation string) SensitiveIDValue {
+	value := SensitiveIDValue{CP: ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}, Annotation: annotation}
+	if l.State != nil {
+		if _, ok := l.State.Variants[genomicID]; ok {
+			value.Annotation = ""
+			value.Loaded = true
+		}
+	}
+	return value
+}
+
+// markLoadedConcepts marks the concepts already in the concept_dimension so that they are not written again
+func (l *Loader) markLoadedConcepts(ontValuesSmallCopy map[ConceptPath]bool) {
+	if l.State == nil {
+		return
+	}
+	for cp, id := range l.OntValues {
+		code := "TAG_ID:" + strconv.FormatInt(id.Value, 10)
+		if id.Identifier == "C" {
+			code = "CLEAR:" + strconv.FormatInt(id.Value, 10)
+		}
+		if _, ok := l.State.ConceptCodes[code]; ok {
+			ontValuesSmallCopy[cp] = true
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package loadergenomic_test
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/genomic"
+	"github.com/ldsec/medco-loader/loader/identifiers"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readCSV reads a converted .csv file
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	assert.Nil(t, err)
+	return records
+}
+
+// readState reads the state of the databases the converted .csv files would be loaded in
+func readState(t *testing.T, output string) *loadergenomic.State {
+	s := loadergenomic.NewState()
+	for _, i := range []int{0, 1, 3} {
+		for _, record := range readCSV(t, output+loadergenomic.FileNamesOntology[i]) {
+			assert.Nil(t, s.AddOntologyElement(record[1], record[6]))
+		}
+	}
+	for _, record := range readCSV(t, output+loadergenomic.FileNamesOntology[2]) {
+		id, err := strconv.ParseInt(record[0], 10, 64)
+		assert.Nil(t, err)
+		s.AddVariant(id, record[2])
+	}
+	for _, record := range readCSV(t, output+loadergenomic.FileNamesData[0]) {
+		s.ConceptCodes[record[1]] = struct{}{}
+	}
+	for _, record := range readCSV(t, output+loadergenomic.FileNamesData[1]) {
+		if num, _ := strconv.ParseInt(record[2], 10, 64); record[1] == "chuv" {
+			s.AddPatient(record[0], num)
+		}
+	}
+	for _, record := range readCSV(t, output+loadergenomic.FileNamesData[3]) {
+		if num, _ := strconv.ParseInt(record[3], 10, 64); record[1] == "chuv" {
+			s.AddSample(record[0], record[4], num)
+		}
+	}
+	s.Provider = len(readCSV(t, output+loadergenomic.FileNamesData[5])) > 0
+	for _, record := range readCSV(t, output+loadergenomic.FileNamesData[6]) {
+		index, err := strconv.ParseInt(record[len(record)-1], 10, 64)
+		assert.Nil(t, err)
+		if index > s.MaxTextSearchIndex {
+			s.MaxTextSearchIndex = index
+		}
+	}
+	return s
+}
+
+// writeLines writes the first lines (and the header) or the last lines of a file
+func writeLines(t *testing.T, src, dst string, first bool, n int) {
+	content, err := ioutil.ReadFile(src)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) <= n {
+		t.Fatalf("%s has %d lines, %d are needed (and its header)", src, len(lines), n)
+	}
+	if first {
+		lines = lines[:n+1]
+	} else {
+		lines = append(lines[:1], lines[len(lines)-n:]...)
+	}
+	assert.Nil(t, ioutil.WriteFile(dst, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+}
+
+func TestAddOntologyElement(t *testing.T) {
+	s := loadergenomic.NewState()
+	assert.Nil(t, s.AddOntologyElement(`\medco\clinical\sensitive\`, ""))
+	assert.Nil(t, s.AddOntologyElement(`\medco\clinical\sensitive\Cancer Type\Lung\`, "ENC_ID:4"))
+	assert.Nil(t, s.AddOntologyElement(`\medco\clinical\nonsensitive\Age\40\`, "CLEAR:2"))
+	assert.Nil(t, s.AddOntologyElement(`\medco\tagged\abc\`, "TAG_ID:12"))
+	assert.NotNil(t, s.AddOntologyElement(`\medco\tagged\def\`, "TAG_ID:x"))
+
+	assert.Contains(t, s.OntologyPaths, `\medco\clinical\sensitive\`)
+	assert.Equal(t, loadergenomic.ConceptID{Identifier: "E", Value: 4}, s.ClinicalConcepts[loadergenomic.ConceptPath{Field: "Cancer Type", Record: "Lung"}])
+	assert.Equal(t, loadergenomic.ConceptID{Identifier: "C", Value: 2}, s.ClinicalConcepts[loadergenomic.ConceptPath{Field: "Age", Record: "40"}])
+	assert.Equal(t, int64(12), s.TagIDs["abc"])
+	assert.Equal(t, int64(4), s.MaxEncID)
+	assert.Equal(t, int64(2), s.MaxClearID)
+}
+
+func TestAppend(t *testing.T) {
+	setupData(t)
+	el, local, err := getRoster("")
+	assert.True(t, err == nil, err)
+	defer local.CloseAll()
+
+	output, err := ioutil.TempDir(DefaultDataPath+"genomic", "converted_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(output)
+
+	convert := func(dir, clinical, genomic string, state *loadergenomic.State) error {
+		assert.Nil(t, os.MkdirAll(dir, 0755))
+		opts := loadergenomic.Options{Roster: el, Testing: true, Assembly: "GRCh37", OutputPath: dir, AllSensitive: true, Append: state != nil,
+			AllelesKey: []byte("site key")}
+		for _, f := range []struct {
+			file **os.File
+			path string
+		}{
+			{&opts.OntClinical, clinical},
+			{&opts.OntGenomic, genomic},
+			{&opts.Clinical, clinical},
+			{&opts.Genomic, genomic},
+		} {
+			*f.file, err = os.Open(f.path)
+			assert.Nil(t, err)
+		}
+
+		l, err := loadergenomic.NewLoader(opts)
+		assert.Nil(t, err)
+		l.State = state
+
+		assert.Nil(t, l.CreateOutputFiles())
+		defer l.CloseOutputFiles()
+		if err := l.GenerateOntologyFiles(); err != nil {
+			return err
+		}
+		assert.Nil(t, l.GenerateDataFiles())
+		return nil
+	}
+
+	// the first 4 patients are loaded first, then the last 4 are appended (with their ontology)
+	writeLines(t, DefaultDataPath+clinicalFile, output+"/clinical_first.csv", true, 4)
+	writeLines(t, DefaultDataPath+genomicFile, output+"/genomic_first.csv", true, 12)
+	writeLines(t, DefaultDataPath+clinicalFile, output+"/clinical_last.csv", false, 4)
+	writeLines(t, DefaultDataPath+genomicFile, output+"/genomic_last.csv", false, 12)
+
+	assert.Nil(t, convert(output+"/first/", output+"/clinical_first.csv", output+"/genomic_first.csv", nil))
+	state := readState(t, output+"/first/")
+	assert.Equal(t, int64(4), state.MaxPatientNum)
+	assert.Nil(t, convert(output+"/last/", output+"/clinical_last.csv", output+"/genomic_last.csv", state))
+
+	// the headers and the values already loaded are not written again, the new values are numbered after the others
+	ontology := readCSV(t, output+"/last/"+loadergenomic.FileNamesOntology[0])
+	paths := make([]string, 0)
+	for _, record := range ontology {
+		paths = append(paths, record[1])
+		assert.NotContains(t, state.OntologyPaths, record[1])
+		id, err := strconv.ParseInt(strings.TrimPrefix(record[6], "ENC_ID:"), 10, 64)
+		assert.Nil(t, err)
+		assert.True(t, id > state.MaxEncID)
+	}
+	assert.ElementsMatch(t, []string{`\medco\clinical\sensitive\Cancer Type\Breast\`, `\medco\clinical\sensitive\Age\44\`,
+		`\medco\clinical\sensitive\Age\45\`, `\medco\clinical\sensitive\Age\46\`, `\medco\clinical\sensitive\Age\47\`}, paths)
+	assert.Empty(t, readCSV(t, output+"/last/"+loadergenomic.FileNamesData[5]))
+
+	// the tagging is deterministic: the values already loaded keep their TAG_ID, the new ones get other TAG_IDs
+	for _, record := range readCSV(t, output+"/last/"+loadergenomic.FileNamesOntology[3]) {
+		assert.NotContains(t, state.OntologyPaths, record[1])
+		assert.NotContains(t, state.TagIDs, strings.Trim(strings.TrimPrefix(record[1], `\medco\tagged\`), `\`))
+		id, err := strconv.ParseInt(strings.TrimPrefix(record[6], "TAG_ID:"), 10, 64)
+		assert.Nil(t, err)
+		for _, loadedID := range state.TagIDs {
+			assert.NotEqual(t, loadedID, id)
+		}
+	}
+	for _, record := range readCSV(t, output+"/last/"+loadergenomic.FileNamesData[0]) {
+		assert.NotContains(t, state.ConceptCodes, record[1])
+	}
+	for _, record := range readCSV(t, output+"/last/"+loadergenomic.FileNamesOntology[2]) {
+		id, err := strconv.ParseInt(record[0], 10, 64)
+		assert.Nil(t, err)
+		assert.NotContains(t, state.Variants, id)
+	}
+
+	// only the new patients and samples are added
+	patients := readCSV(t, output+"/last/"+loadergenomic.FileNamesData[1])
+	assert.Equal(t, 8, len(patients))
+	assert.Equal(t, []string{"TCGA-05", "chuv", "5"}, patients[0][:3])
+	samples := readCSV(t, output+"/last/"+loadergenomic.FileNamesData[3])
+	assert.Equal(t, []string{"TCGA-08-01", "chuv", "Demo", "8", "TCGA-08"}, samples[6][:5])
+
+	// the observations continue the text_search_index and use the TAG_IDs of the loaded values (e.g. Melanoma)
+	facts := readCSV(t, output+"/last/"+loadergenomic.FileNamesData[6])
+	assert.Equal(t, strconv.FormatInt(state.MaxTextSearchIndex+1, 10), facts[0][len(facts[0])-1])
+	codes := make(map[string]struct{})
+	for _, record := range facts {
+		codes[record[2]] = struct{}{}
+	}
+	found := false
+	for _, id := range state.TagIDs {
+		if _, ok := codes["TAG_ID:"+strconv.FormatInt(id, 10)]; ok {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	// the variants with long alleles already loaded are checked against the key (their IDs are hashes of the alleles)
+	encoder, err := identifiers.NewVariantIDEncoder("GRCh37", []byte("other key"))
+	assert.Nil(t, err)
+	id, err := encoder.GetVariantID("10", int64(2300), "C", "CTTTTTTTT")
+	assert.Nil(t, err)
+	state.AddVariant(id, "10:2300:C>CTTTTTTTT")
+	assert.Contains(t, state.LongAlleles, id)
+	err = convert(output+"/other/", output+"/clinical_last.csv", output+"/genomic_last.csv", state)
+	assert.True(t, errors.Is(err, loader.ErrInputFormat), err)
+}
@@ -0,0 +1,38 @@
+package loadergenomic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ldsec/medco-loader/loader"
+	"strconv"
+)
+
+// The phases of the loading recorded in the checkpoint (the tagging of the sensitive ids is recorded by encryptAndTag
+// as it goes), there is one loading phase per transaction
+const (
+	phaseConvert         = "convert"
+	phaseLoadOntology    = "load_ontology"
+	phaseLoadAnnotations = "load_annotations"
+	phaseLoadData        = "load_data"
+)
+
+// openCheckpoint opens the checkpoint of the loading in the CheckpointDir. It is keyed to the aggregate key of the
+// collective authority, the input files and the settings that change the converted files.
+func (l *Loader) openCheckpoint() error {
+	allelesKey := ""
+	if len(l.AllelesKey) > 0 {
+		h := sha256.Sum256(l.AllelesKey)
+		allelesKey = hex.EncodeToString(h[:])
+	}
+
+	key, err := loader.CheckpointKey(l.Roster.Aggregate,
+		[]string{l.OntClinical.Name(), l.OntGenomic.Name(), l.Clinical.Name(), l.Genomic.Name()},
+		l.Policy.String(), strconv.FormatBool(l.Append),
+		l.GenomicFormat, l.Assembly, allelesKey)
+	if err != nil {
+		return err
+	}
+
+	l.checkpoint, err = loader.OpenCheckpoint(l.CheckpointDir, key, l.Resume)
+	return err
+}
@@ -1,20 +1,21 @@
 package loadergenomic
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/csv"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/ldsec/medco-loader/loader"
 	"github.com/ldsec/medco-loader/loader/identifiers"
-	"github.com/ldsec/medco-unlynx/services"
 	"github.com/ldsec/unlynx/lib"
+	"github.com/lib/pq"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
@@ -45,10 +46,8 @@ const ONT = "medco_ont."
 // ANNOTATIONS path to genomic_annotations schema
 const ANNOTATIONS = "genomic_annotations."
 
-// The different paths and handlers for all the .sql files
+// The different tables and file names (in the output folder) for all the .csv files
 var (
-	OutputFilePath = "genomic/"
-
 	TablenamesOntology = [...]string{ONT + "clinical_sensitive",
 		ONT + "clinical_non_sensitive",
 		ANNOTATIONS + "genomic_annotations",
@@ -62,21 +61,20 @@ var (
 		I2B2DEMODATA + "provider_dimension",
 		I2B2DEMODATA + "observation_fact"}
 
-	FileBashPath = [...]string{"25-load-ontology.sh",
-		"26-load-data.sh"}
-
-	FilePathsOntology = [...]string{"MEDCO_ONT_CLINICAL_SENSITIVE.csv",
+	FileNamesOntology = [...]string{"MEDCO_ONT_CLINICAL_SENSITIVE.csv",
 		"MEDCO_ONT_CLINICAL_NON_SENSITIVE.csv",
 		"MEDCO_ONT_GENOMIC_ANNOTATIONS.csv",
 		"MEDCO_ONT_SENSITIVE_TAGGED.csv"}
 
-	FilePathsData = [...]string{"I2B2DEMODATA_CONCEPT_DIMENSION.csv",
+	FileNamesData = [...]string{"I2B2DEMODATA_CONCEPT_DIMENSION.csv",
 		"I2B2DEMODATA_PATIENT_MAPPING.csv",
 		"I2B2DEMODATA_PATIENT_DIMENSION.csv",
 		"I2B2DEMODATA_ENCOUNTER_MAPPING.csv",
 		"I2B2DEMODATA_VISIT_DIMENSION.csv",
 		"I2B2DEMODATA_PROVIDER_DIMENSION.csv",
 		"I2B2DEMODATA_OBSERVATION_FACT.csv"}
+
+	FileNameSummary = "LOADING_SUMMARY.txt"
 )
 
 /*
@@ -107,6 +105,8 @@ var (
 		"REFERENCE_ALLELE":     "RA",
 		"TUMOR_SEQ_ALLELE1":    "TSA1",
 		"TUMOR_SEQ_ALLELE2":    "TSA2",
+		"NCBI_Build":           "BUILD",
+		"NCBI_BUILD":           "BUILD",
 	}
 
 	AnnotationsToQuery = map[string]struct{}{
@@ -115,8 +115,6 @@ var (
 		"PROTEIN_CHANGE":    {},
 		"MA:protein.change": {},
 	}
-
-	AllSensitive = false
 )
 
 /* NumElMap: defines an approximate size of the map (it avoids rehashing and speeds up the execution)
@@ -131,6 +129,7 @@ var (
 type SensitiveIDValue struct {
 	CP         ConceptPath
 	Annotation string
+	Loaded     bool // already in the databases (append mode)
 }
 
 // ConceptPath defines the end of the concept path tree and we use it in a map so that we do not repeat concepts
@@ -145,13 +144,157 @@ type ConceptID struct {
 	Value      int64
 }
 
-// Support global variables
-var (
-	Testing         bool // testing environment
+// Options are the settings of the conversion (and loading) of a genomic dataset
+type Options struct {
+	Roster        *onet.Roster // collective authority
+	EntryPointIdx int          // index (in the roster) of the server used to tag the sensitive concepts
+	Testing       bool         // whether the tagging runs on a local test roster
+
+	// the ontology and dataset files (they are closed once converted)
+	OntClinical, OntGenomic, Clinical, Genomic *os.File
+	// OutputPath is the folder of the converted .csv files
+	OutputPath string
+
+	// Policy decides which clinical fields (or values of fields) are sensitive. If it is nil the policy of AllSensitive
+	// and SensitiveAttributes is used.
+	Policy              *loader.Policy
+	AllSensitive        bool                // all clinical attributes are considered sensitive
+	SensitiveAttributes map[string]struct{} // the sensitive clinical attributes
+
+	I2B2DB      loader.DBSettings
+	GaDB        loader.DBSettings
+	ConvertOnly bool // only convert the data and write a summary of the loading instead of loading it
+	Verify      bool // once loaded, compare the tables with the converted files (see Loader.VerifyFiles)
+	// Append adds the dataset to the one already in the databases (see State) instead of replacing it
+	Append bool
+
+	GenomicFormat string // format of the genomic ontology and dataset files (FormatMAF, the default, or FormatVCF)
+	// Assembly is the reference genome assembly of the genomic ontology and dataset (see identifiers.NormalizeAssembly),
+	// the genomic annotations database cannot hold variants of another assembly
+	Assembly string
+	// AllelesKey is the secret key of the hash encoding the alleles longer than 6 bases, it must be the same on all the
+	// nodes (the variants with long alleles cannot be loaded without it)
+	AllelesKey []byte
+
+	// CheckpointDir is the folder where the results of the phases of the loading are persisted (see loader.Checkpoint),
+	// Resume skips the phases completed by a previous run with the same input files and settings
+	CheckpointDir string
+	Resume        bool
+
+	// Tagging are the settings of the tagging of the sensitive ids
+	Tagging loader.TaggingOptions
+}
+
+// Loader converts and loads a genomic dataset. It holds the whole state of the conversion, so that independent loaders
+// can run concurrently in the same process.
+type Loader struct {
+	Options
+
+	// the paths of the converted .csv files (same order as FileNamesOntology and FileNamesData)
+	FilePathsOntology [len(FileNamesOntology)]string
+	FilePathsData     [len(FileNamesData)]string
+
 	FileHandlers    []*os.File
 	OntValues       map[ConceptPath]ConceptID // stores the concept path and the correspondent ID
 	TextSearchIndex int64                     // needed for the observation_fact table (counter)
-)
+
+	// SensitivityDecisions are the decisions of the Policy about the clinical fields
+	SensitivityDecisions map[string]loader.Decision
+
+	// variantIDs encodes the genomic variants (of both the ontology and the dataset)
+	variantIDs *identifiers.VariantIDEncoder
+
+	// State is the content of the databases the dataset is appended to (read by Load if Append is set), the conversion
+	// builds upon it if not nil
+	State *State
+
+	// surveyID identifies the tagging of this loader in the collective authority
+	surveyID string
+	// checkpoint persists the results of the phases of the loading (nil without CheckpointDir)
+	checkpoint *loader.Checkpoint
+}
+
+// NewLoader creates a loader for the dataset described by the options
+func NewLoader(opts Options) (*Loader, error) {
+	l := &Loader{
+		Options:              opts,
+		FileHandlers:         make([]*os.File, 0),
+		OntValues:            make(map[ConceptPath]ConceptID),
+		TextSearchIndex:      int64(1),
+		SensitivityDecisions: make(map[string]loader.Decision),
+	}
+
+	if l.Policy == nil {
+		sensitive := make([]string, 0, len(opts.SensitiveAttributes))
+		for attribute := range opts.SensitiveAttributes {
+			sensitive = append(sensitive, attribute)
+		}
+		l.Policy = loader.NewListPolicy(opts.AllSensitive, sensitive)
+	}
+	if err := l.Policy.Compile(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	l.variantIDs, err = identifiers.NewVariantIDEncoder(opts.Assembly, opts.AllelesKey)
+	if err != nil {
+		return nil, err
+	}
+	l.Assembly = l.variantIDs.Assembly
+
+	if err := loader.CheckResume(opts.CheckpointDir, opts.Resume); err != nil {
+		return nil, err
+	}
+
+	id, err := GenerateRandomBytes(8)
+	if err != nil {
+		return nil, loader.NewError(loader.ErrRandomness, err)
+	}
+	l.surveyID = "tagging_loading_phase_" + hex.EncodeToString(id)
+
+	for i := range FileNamesOntology {
+		l.FilePathsOntology[i] = opts.OutputPath + FileNamesOntology[i]
+	}
+	for i := range FileNamesData {
+		l.FilePathsData[i] = opts.OutputPath + FileNamesData[i]
+	}
+
+	return l, nil
+}
+
+// CreateOutputFiles creates (or truncates) the converted .csv files
+func (l *Loader) CreateOutputFiles() error {
+	for _, path := range append(l.FilePathsOntology[:], l.FilePathsData[:]...) {
+		fp, err := os.Create(path)
+		if err != nil {
+			return loader.NewError(loader.ErrOutput, err).InFile(path, 0)
+		}
+		l.FileHandlers = append(l.FileHandlers, fp)
+	}
+	return nil
+}
+
+// CloseOutputFiles closes the converted .csv files
+func (l *Loader) CloseOutputFiles() {
+	for _, fp := range l.FileHandlers {
+		fp.Close()
+	}
+	l.FileHandlers = make([]*os.File, 0)
+}
+
+// writeString writes to the converted file of the handler fh (the handlers are in the order of FilePathsOntology then
+// FilePathsData), it fails if the converted files have not been created
+func (l *Loader) writeString(fh int, s string) (int, error) {
+	if fh >= len(l.FileHandlers) {
+		return 0, errors.New("the converted file was not created")
+	}
+	return l.FileHandlers[fh].WriteString(s)
+}
+
+// outputError wraps an error while writing the converted file of the handler fh
+func (l *Loader) outputError(fh int, err error) error {
+	return loader.NewError(loader.ErrOutput, err).InFile(append(l.FilePathsOntology[:], l.FilePathsData[:]...)[fh], 0)
+}
 
 // ReplayDataset replays the dataset x number of times
 func ReplayDataset(filename string, x int) error {
@@ -160,8 +303,7 @@ func ReplayDataset(filename string, x int) error {
 	// open file to read
 	fGenomic, err := os.Open(filename)
 	if err != nil {
-		log.Fatal("Cannot open file to read:", err)
-		return err
+		return loader.NewInputError(filename, err)
 	}
 
 	reader := csv.NewReader(fGenomic)
@@ -170,8 +312,7 @@ func ReplayDataset(filename string, x int) error {
 	// read all genomic file
 	record, err := reader.ReadAll()
 	if err != nil {
-		log.Fatal("Error in the ReplayDataset() - reading:", err)
-		return err
+		return loader.NewInputError(filename, err)
 	}
 
 	finalResult := record[:]
@@ -200,8 +341,7 @@ func ReplayDataset(filename string, x int) error {
 	// open file to write
 	fGenomic, err = os.Create(filename)
 	if err != nil {
-		log.Fatal("Cannot open file to write:", err)
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(filename, 0)
 	}
 
 	writer := csv.NewWriter(fGenomic)
@@ -209,8 +349,7 @@ func ReplayDataset(filename string, x int) error {
 
 	err = writer.WriteAll(finalResult)
 	if err != nil {
-		log.Fatal("Error in the ReplayDataset() - writing:", err)
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(filename, 0)
 	}
 
 	fGenomic.Close()
@@ -219,66 +358,45 @@ func ReplayDataset(filename string, x int) error {
 
 }
 
-// LoadGenomicData initiates the loading process
-func LoadGenomicData(el *onet.Roster, entryPointIdx int, fOntClinical, fOntGenomic, fClinical, fGenomic *os.File, outputPath string, allSensitive bool, mapSensitive map[string]struct{}, i2b2DB loader.DBSettings, gaDB loader.DBSettings, testing bool) error {
+// Load initiates the loading process. If ConvertOnly is set the data is not loaded, instead a summary of the loading is
+// written in the output folder.
+func (l *Loader) Load() error {
 	start := time.Now()
 
-	// init global variables
-	FileHandlers = make([]*os.File, 0)
-	OntValues = make(map[ConceptPath]ConceptID)
-	Testing = testing
-	TextSearchIndex = int64(1) // needed for the observation_fact table (counter)
-	OutputFilePath = outputPath
-	AllSensitive = allSensitive
-
-	for i := range FilePathsOntology {
-		FilePathsOntology[i] = OutputFilePath + FilePathsOntology[i]
-		fp, err := os.Create(FilePathsOntology[i])
+	if l.CheckpointDir != "" {
+		err := l.openCheckpoint()
 		if err != nil {
-			log.Fatal("Error while creating", FilePathsOntology[i])
 			return err
 		}
-		FileHandlers = append(FileHandlers, fp)
 	}
 
-	for i := range FilePathsData {
-		FilePathsData[i] = OutputFilePath + FilePathsData[i]
-		fp, err := os.Create(FilePathsData[i])
+	if !l.checkpoint.Done(phaseConvert) {
+		err := l.Convert()
+		if err != nil {
+			return err
+		}
+		err = l.checkpoint.Complete(phaseConvert, append(l.FilePathsOntology[:], l.FilePathsData[:]...))
 		if err != nil {
-			log.Fatal("Error while creating", FilePathsData[i])
 			return err
 		}
-		FileHandlers = append(FileHandlers, fp)
-	}
-
-	err := GenerateOntologyFiles(el, entryPointIdx, fOntClinical, fOntGenomic, mapSensitive)
-	if err != nil {
-		log.Fatal("Error while generating the ontology .csv files", err)
-		return err
 	}
 
-	// to free
+	if l.ConvertOnly {
+		err := l.WriteLoadingSummary()
+		if err != nil {
+			log.Error("Error while writing the loading summary", err)
+			return err
+		}
 
-	err = GenerateDataFiles(el, fClinical, fGenomic)
-	if err != nil {
-		log.Fatal("Error while generating the data .csv files", err)
-		return err
+		log.LLvl1("The conversion took:", time.Since(start))
+		return nil
 	}
 
-	fClinical.Close()
-	fGenomic.Close()
-
 	startLoadingOntology := time.Now()
 
-	err = GenerateLoadingOntologyScript(i2b2DB, gaDB)
+	err := l.LoadOntologyFiles()
 	if err != nil {
-		log.Fatal("Error while generating the loading ontology .sh file", err)
-		return err
-	}
-
-	err = LoadOntologyFiles()
-	if err != nil {
-		log.Fatal("Error while loading ontology .sql file", err)
+		log.Error("Error while loading the ontology", err)
 		return err
 	}
 
@@ -287,31 +405,25 @@ func LoadGenomicData(el *onet.Roster, entryPointIdx int, fOntClinical, fOntGenom
 
 	startLoadingData := time.Now()
 
-	err = GenerateLoadingDataScript(i2b2DB)
-	if err != nil {
-		log.Fatal("Error while generating the loading dataset .sh file", err)
-		return err
-	}
-
-	err = LoadDataFiles()
+	err = l.checkpoint.Run(phaseLoadData, l.LoadDataFiles)
 	if err != nil {
-		log.Fatal("Error while loading dataset .sql file", err)
+		log.Error("Error while loading the dataset", err)
 		return err
 	}
 
 	loadTime = time.Since(startLoadingData)
 	log.LLvl1("Loading dataset took:", loadTime)
 
-	fOntClinical.Close()
-	fOntGenomic.Close()
-
-	for _, fp := range FileHandlers {
-		fp.Close()
+	if l.Verify {
+		err = l.VerifyFiles()
+		if err != nil {
+			log.Error("Error while verifying the loaded data", err)
+			return err
+		}
 	}
 
 	// to free memory
-	OntValues = make(map[ConceptPath]ConceptID)
-	FileHandlers = make([]*os.File, 0)
+	l.OntValues = make(map[ConceptPath]ConceptID)
 
 	etlTime := time.Since(start)
 	log.LLvl1("The ETL took:", etlTime)
@@ -319,20 +431,45 @@ func LoadGenomicData(el *onet.Roster, entryPointIdx int, fOntClinical, fOntGenom
 	return nil
 }
 
-// GenerateLoadingOntologyScript creates a load ontology .sql script
-func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSettings) error {
-	fp, err := os.Create(FileBashPath[0])
+// Convert generates the ontology and data .csv files (reading the content of the databases first if Append is set)
+func (l *Loader) Convert() error {
+	if l.Append && l.State == nil {
+		state, err := ReadState(l.I2B2DB, l.GaDB)
+		if err != nil {
+			log.Error("Error while reading the content of the databases", err)
+			return err
+		}
+		l.State = state
+	}
+
+	err := l.CreateOutputFiles()
+	if err != nil {
+		return err
+	}
+	defer l.CloseOutputFiles()
+
+	err = l.GenerateOntologyFiles()
+	if err != nil {
+		log.Error("Error while generating the ontology .csv files", err)
+		return err
+	}
+
+	err = l.GenerateDataFiles()
 	if err != nil {
+		log.Error("Error while generating the data .csv files", err)
 		return err
 	}
 
-	loading := `#!/usr/bin/env bash` + "\n" + "\n" + `PGPASSWORD=` + i2b2DB.DBpassword + ` psql -v ON_ERROR_STOP=1 -h "` + i2b2DB.DBhost +
-		`" -U "` + i2b2DB.DBuser + `" -p ` + strconv.FormatInt(int64(i2b2DB.DBport), 10) + ` -d "` + i2b2DB.DBname + `" <<-EOSQL` + "\n"
+	l.CloseOutputFiles()
+	return nil
+}
 
-	loading += "BEGIN;\n"
+// GenerateLoadingOntologyStatements creates the list of statements to load the ontology in the i2b2 database
+func (l *Loader) GenerateLoadingOntologyStatements() []loader.Statement {
+	statements := make([]loader.Statement, 0)
 
 	//update table access
-	loading += `INSERT INTO medco_ont.table_access (c_table_cd, c_table_name, c_protected_access, c_hlevel, c_fullname, c_name,
+	statements = append(statements, loader.ExecStatement(`INSERT INTO medco_ont.table_access (c_table_cd, c_table_name, c_protected_access, c_hlevel, c_fullname, c_name,
 				c_synonym_cd, c_visualattributes, c_facttablecolumn, c_dimtablename,
         		c_columnname, c_columndatatype, c_operator, c_dimcode, c_tooltip) VALUES
         		('CLINICAL_SENSITIVE', 'CLINICAL_SENSITIVE', 'N', 2, '\medco\clinical\sensitive\', 'MedCo Clinical Sensitive Ontology',
@@ -346,9 +483,9 @@ func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSetti
         		c_synonym_cd, c_visualattributes, c_facttablecolumn, c_dimtablename,
         		c_columnname, c_columndatatype, c_operator, c_dimcode, c_tooltip) VALUES
 				('GENOMIC', 'GENOMIC', 'N', 1, '\medco\genomic\', 'MedCo Genomic Ontology',
-        		'N', 'CA', 'concept_cd', 'concept_dimension', 'concept_path', 'T', 'LIKE', '\medco\genomic\', 'MedCo Genomic Ontology') ON CONFLICT DO NOTHING;` + "\n"
+        		'N', 'CA', 'concept_cd', 'concept_dimension', 'concept_path', 'T', 'LIKE', '\medco\genomic\', 'MedCo Genomic Ontology') ON CONFLICT DO NOTHING;`))
 
-	loading += `CREATE TABLE IF NOT EXISTS medco_ont.clinical_sensitive(
+	statements = append(statements, loader.ExecStatement(`CREATE TABLE IF NOT EXISTS medco_ont.clinical_sensitive(
         		c_hlevel numeric(22,0) not null,
         		c_fullname character varying(900) not null,
         		c_name character varying(2000) not null,
@@ -449,9 +586,9 @@ func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSetti
     			ALTER TABLE ONLY medco_ont.genomic ADD CONSTRAINT fullname_pk_22 PRIMARY KEY (c_fullname);
 				
 				ALTER TABLE medco_ont.genomic DROP CONSTRAINT IF EXISTS basecode_un_22;
-    			ALTER TABLE ONLY medco_ont.genomic ADD CONSTRAINT basecode_un_22 UNIQUE (c_basecode);` + "\n"
+    			ALTER TABLE ONLY medco_ont.genomic ADD CONSTRAINT basecode_un_22 UNIQUE (c_basecode);`))
 
-	loading += `INSERT INTO medco_ont.genomic (c_hlevel, c_fullname, c_name, c_synonym_cd, c_visualattributes, c_totalnum,
+	statements = append(statements, loader.ExecStatement(`INSERT INTO medco_ont.genomic (c_hlevel, c_fullname, c_name, c_synonym_cd, c_visualattributes, c_totalnum,
         		c_facttablecolumn, c_tablename, c_columnname, c_columndatatype, c_operator, c_dimcode, c_comment, c_tooltip, update_date,
         		download_date, import_date, valuetype_cd, m_applied_path) values
         		('1', '\medco\genomic\', 'MedCo Genomic Ontology', 'N', 'CA', '0', 'concept_cd', 'concept_dimension', 'concept_path',
@@ -474,33 +611,30 @@ func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSetti
         		download_date, import_date, valuetype_cd, m_applied_path) values
         		('2', '\medco\genomic\variant\', 'Variant Name', 'N', 'LA', '0', 'GEN:variant_name', 'concept_cd', 'concept_dimension', 'concept_path',
         		'T', 'LIKE', '\medco\genomic\variant\', 'Variant Name', '\medco\genomic\variant\',
-        		'NOW()', 'NOW()', 'NOW()', 'GEN', '@') ON CONFLICT DO NOTHING;` + "\n"
+        		'NOW()', 'NOW()', 'NOW()', 'GEN', '@') ON CONFLICT DO NOTHING;`))
 
 	for i := 0; i < len(TablenamesOntology); i++ {
 
 		//TODO: Delete this please
 		if TablenamesOntology[i] != ONT+"non_sensitive_clear" && TablenamesOntology[i] != ANNOTATIONS+"genomic_annotations" {
-			loading += "TRUNCATE " + TablenamesOntology[i] + ";\n"
-			loading += `\copy ` + TablenamesOntology[i] + ` FROM '` + FilePathsOntology[i] + `' ESCAPE '"' DELIMITER ',' CSV;` + "\n"
+			statements = append(statements, l.copyStatements(TablenamesOntology[i], l.FilePathsOntology[i])...)
 		}
 	}
-	loading += "\n"
 
-	loading += `UPDATE medco_ont.table_access SET c_visualattributes = 'CH ' WHERE c_table_cd = 'E2ETEST';` + "\n"
+	statements = append(statements, loader.ExecStatement(`UPDATE medco_ont.table_access SET c_visualattributes = 'CH ' WHERE c_table_cd = 'E2ETEST';`))
 
-	loading += `ALTER TABLE medco_ont.genomic OWNER TO $I2B2_DB_USER;
-    			ALTER TABLE medco_ont.clinical_sensitive OWNER TO $I2B2_DB_USER;
-    			ALTER TABLE medco_ont.clinical_non_sensitive OWNER TO $I2B2_DB_USER;` + "\n"
+	statements = append(statements, loader.ExecStatement(`ALTER TABLE medco_ont.genomic OWNER TO `+pq.QuoteIdentifier(l.I2B2DB.DBuser)+`;
+    			ALTER TABLE medco_ont.clinical_sensitive OWNER TO `+pq.QuoteIdentifier(l.I2B2DB.DBuser)+`;
+    			ALTER TABLE medco_ont.clinical_non_sensitive OWNER TO `+pq.QuoteIdentifier(l.I2B2DB.DBuser)+`;`))
 
-	loading += "COMMIT;\n"
-	loading += "EOSQL"
-
-	loading += "\n \n" + `PGPASSWORD=` + gaDB.DBpassword + ` psql -v ON_ERROR_STOP=1 -h "` + gaDB.DBhost +
-		`" -U "` + gaDB.DBuser + `" -p ` + strconv.FormatInt(int64(gaDB.DBport), 10) + ` -d "` + gaDB.DBname + `" <<-EOSQL` + "\n"
+	return statements
+}
 
-	loading += "BEGIN;\n"
+// GenerateLoadingAnnotationsStatements creates the list of statements to load the genomic annotations in the genomic annotations database
+func (l *Loader) GenerateLoadingAnnotationsStatements() []loader.Statement {
+	statements := make([]loader.Statement, 0)
 
-	loading += `CREATE TABLE IF NOT EXISTS genomic_annotations.genomic_annotations(
+	statements = append(statements, loader.ExecStatement(`CREATE TABLE IF NOT EXISTS genomic_annotations.genomic_annotations(
 				variant_id character varying(255) NOT NULL,
 				variant_id_enc character varying(255) NOT NULL,
 				variant_name character varying(255) NOT NULL,
@@ -513,40 +647,63 @@ func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSetti
 		
 				CREATE TABLE IF NOT EXISTS genomic_annotations.gene_values(
 				gene_value character varying(255) NOT NULL PRIMARY KEY);
+
+				CREATE TABLE IF NOT EXISTS genomic_annotations.assembly(
+				assembly character varying(255) NOT NULL PRIMARY KEY);
 		
 				-- permissions
-				ALTER TABLE genomic_annotations.genomic_annotations OWNER TO $GA_DB_USER;
-				ALTER TABLE genomic_annotations.annotation_names OWNER TO $GA_DB_USER;
-				ALTER TABLE genomic_annotations.gene_values OWNER TO $GA_DB_USER;
-				GRANT ALL on schema genomic_annotations to $GA_DB_USER;
-				GRANT ALL privileges on all tables in schema genomic_annotations to $GA_DB_USER;` + "\n"
+				ALTER TABLE genomic_annotations.genomic_annotations OWNER TO `+pq.QuoteIdentifier(l.GaDB.DBuser)+`;
+				ALTER TABLE genomic_annotations.annotation_names OWNER TO `+pq.QuoteIdentifier(l.GaDB.DBuser)+`;
+				ALTER TABLE genomic_annotations.gene_values OWNER TO `+pq.QuoteIdentifier(l.GaDB.DBuser)+`;
+				ALTER TABLE genomic_annotations.assembly OWNER TO `+pq.QuoteIdentifier(l.GaDB.DBuser)+`;
+				GRANT ALL on schema genomic_annotations to `+pq.QuoteIdentifier(l.GaDB.DBuser)+`;
+				GRANT ALL privileges on all tables in schema genomic_annotations to `+pq.QuoteIdentifier(l.GaDB.DBuser)+`;`))
+
+	// refuse to mix the variants of different assemblies (the variant IDs do not encode the assembly): the assembly of
+	// the replaced annotations is dropped with them, the one of the annotations appended to is checked
+	record := `INSERT INTO genomic_annotations.assembly VALUES (` + pq.QuoteLiteral(l.Assembly) + `) ON CONFLICT DO NOTHING;`
+	if l.Append {
+		statements = append(statements, loader.Statement{Table: ANNOTATIONS + "assembly", SQL: `-- check and record the assembly (` + l.Assembly + `) of the genomic annotations
+				DO $$
+				BEGIN
+					IF EXISTS(SELECT 1 FROM genomic_annotations.assembly WHERE assembly <> ` + pq.QuoteLiteral(l.Assembly) + `)
+					THEN
+						RAISE EXCEPTION 'the genomic annotations database holds variants of another assembly than %', ` + pq.QuoteLiteral(l.Assembly) + `;
+					END IF;
+				END
+				$$;
+				` + record})
+	} else {
+		statements = append(statements, loader.TruncateStatement(ANNOTATIONS+"assembly"),
+			loader.Statement{Table: ANNOTATIONS + "assembly", SQL: `-- record the assembly (` + l.Assembly + `) of the genomic annotations
+				` + record})
+	}
 
 	//TODO: Delete this please
-	loading += "TRUNCATE " + TablenamesOntology[2] + ";\n"
-	loading += `\copy ` + TablenamesOntology[2] + ` FROM '` + FilePathsOntology[2] + `' ESCAPE '"' DELIMITER ',' CSV;` + "\n"
+	statements = append(statements, l.copyStatements(TablenamesOntology[2], l.FilePathsOntology[2])...)
 
 	// create annotations table
-	loading += `DROP TABLE IF EXISTS genomic_annotations.hugo_gene_symbol;` + "\n"
-	loading += `CREATE TABLE genomic_annotations.hugo_gene_symbol as select distinct hugo_gene_symbol as annotation_value from genomic_annotations.genomic_annotations;` + "\n"
+	statements = append(statements, loader.ExecStatement(`DROP TABLE IF EXISTS genomic_annotations.hugo_gene_symbol;`))
+	statements = append(statements, loader.ExecStatement(`CREATE TABLE genomic_annotations.hugo_gene_symbol as select distinct hugo_gene_symbol as annotation_value from genomic_annotations.genomic_annotations;`))
 
-	loading += `DROP TABLE IF EXISTS genomic_annotations.protein_change;` + "\n"
-	loading += `CREATE TABLE genomic_annotations.protein_change as select distinct protein_change as annotation_value from genomic_annotations.genomic_annotations;` + "\n"
+	statements = append(statements, loader.ExecStatement(`DROP TABLE IF EXISTS genomic_annotations.protein_change;`))
+	statements = append(statements, loader.ExecStatement(`CREATE TABLE genomic_annotations.protein_change as select distinct protein_change as annotation_value from genomic_annotations.genomic_annotations;`))
 
-	loading += `DROP TABLE IF EXISTS genomic_annotations.variant_name;` + "\n"
-	loading += `CREATE TABLE genomic_annotations.variant_name as select distinct variant_name as annotation_value from genomic_annotations.genomic_annotations;` + "\n"
+	statements = append(statements, loader.ExecStatement(`DROP TABLE IF EXISTS genomic_annotations.variant_name;`))
+	statements = append(statements, loader.ExecStatement(`CREATE TABLE genomic_annotations.variant_name as select distinct variant_name as annotation_value from genomic_annotations.genomic_annotations;`))
 
-	loading += `CREATE OR REPLACE FUNCTION genomic_annotations.ga_getvalues(annotation varchar, val varchar, lim int) RETURNS SETOF varchar AS \$\$
+	statements = append(statements, loader.ExecStatement(`CREATE OR REPLACE FUNCTION genomic_annotations.ga_getvalues(annotation varchar, val varchar, lim int) RETURNS SETOF varchar AS $$
 				BEGIN
     				RETURN QUERY EXECUTE
 					format('SELECT annotation_value
 					FROM genomic_annotations.%I
-					WHERE annotation_value ~* \$1
-           			ORDER BY annotation_value LIMIT \$2',annotation)
+					WHERE annotation_value ~* $1
+           			ORDER BY annotation_value LIMIT $2',annotation)
     				USING val, lim;
 				END;
-				\$\$ LANGUAGE plpgsql;` + "\n"
+				$$ LANGUAGE plpgsql;`))
 
-	loading += `CREATE OR REPLACE FUNCTION genomic_annotations.ga_getvariants(annotation varchar, val varchar, zygosity varchar, enc bool) RETURNS SETOF varchar AS \$\$
+	statements = append(statements, loader.ExecStatement(`CREATE OR REPLACE FUNCTION genomic_annotations.ga_getvariants(annotation varchar, val varchar, zygosity varchar, enc bool) RETURNS SETOF varchar AS $$
 				DECLARE
 				col varchar;
 				BEGIN
@@ -559,15 +716,15 @@ func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSetti
     				RETURN QUERY EXECUTE
 					format('SELECT %I
 					FROM genomic_annotations.genomic_annotations
-					WHERE lower(%I) = lower(\$1)
-					AND annotations ~* \$2
+					WHERE lower(%I) = lower($1)
+					AND annotations ~* $2
            			ORDER BY variant_id',col,annotation)
     				USING val, zygosity;
 				END;
-				\$\$ LANGUAGE plpgsql;` + "\n"
+				$$ LANGUAGE plpgsql;`))
 
-	loading += `CREATE OR REPLACE FUNCTION genomic_annotations.ga_annotationexists(annotation varchar)
-				RETURNS boolean AS \$\$
+	statements = append(statements, loader.ExecStatement(`CREATE OR REPLACE FUNCTION genomic_annotations.ga_annotationexists(annotation varchar)
+				RETURNS boolean AS $$
 				BEGIN
 				RETURN EXISTS(
 					SELECT 1 FROM pg_tables where
@@ -575,99 +732,134 @@ func GenerateLoadingOntologyScript(i2b2DB loader.DBSettings, gaDB loader.DBSetti
 						tablename = annotation
 				);
 				END;
-				\$\$ LANGUAGE plpgsql;` + "\n"
+				$$ LANGUAGE plpgsql;`))
 
-	loading += "COMMIT;\n"
-	loading += "EOSQL"
+	return statements
+}
 
-	_, err = fp.WriteString(loading)
-	if err != nil {
-		return err
+// GenerateLoadingDataStatements creates the list of statements to load the dataset
+func (l *Loader) GenerateLoadingDataStatements() []loader.Statement {
+	statements := make([]loader.Statement, 0)
+	for i := 0; i < len(TablenamesData); i++ {
+		statements = append(statements, l.copyStatements(TablenamesData[i], l.FilePathsData[i])...)
 	}
-
-	fp.Close()
-
-	return nil
-
+	return statements
 }
 
-// GenerateLoadingDataScript creates a load dataset .sql script
-func GenerateLoadingDataScript(i2b2DB loader.DBSettings) error {
-	fp, err := os.Create(FileBashPath[1])
-	if err != nil {
-		return err
+// copyStatements creates the statements to copy a .csv file into a table, which is emptied first unless in append mode
+func (l *Loader) copyStatements(table, path string) []loader.Statement {
+	if l.Append {
+		return []loader.Statement{loader.CopyStatement(table, path, false)}
 	}
+	return []loader.Statement{loader.TruncateStatement(table), loader.CopyStatement(table, path, false)}
+}
 
-	loading := `#!/usr/bin/env bash` + "\n" + "\n" + `PGPASSWORD=` + i2b2DB.DBpassword + ` psql -v ON_ERROR_STOP=1 -h "` + i2b2DB.DBhost +
-		`" -U "` + i2b2DB.DBuser + `" -p ` + strconv.FormatInt(int64(i2b2DB.DBport), 10) + ` -d "` + i2b2DB.DBname + `" <<-EOSQL` + "\n"
-
-	loading += "BEGIN;\n"
-	for i := 0; i < len(TablenamesData); i++ {
-		loading += "TRUNCATE " + TablenamesData[i] + ";\n"
-		loading += `\copy ` + TablenamesData[i] + ` FROM '` + FilePathsData[i] + `' ESCAPE '"' DELIMITER ',' CSV;` + "\n"
+// WriteLoadingSummary writes a summary of what would be truncated and loaded in both databases (without connecting to them)
+func (l *Loader) WriteLoadingSummary() error {
+	summary := ""
+	for _, step := range []struct {
+		db         loader.DBSettings
+		statements []loader.Statement
+	}{
+		{l.I2B2DB, l.GenerateLoadingOntologyStatements()},
+		{l.GaDB, l.GenerateLoadingAnnotationsStatements()},
+		{l.I2B2DB, l.GenerateLoadingDataStatements()},
+	} {
+		stepSummary, err := loader.LoadingSummary(step.db, step.statements)
+		if err != nil {
+			return err
+		}
+		summary += stepSummary + "\n"
 	}
-	loading += "COMMIT;\n"
-	loading += "EOSQL"
-
-	_, err = fp.WriteString(loading)
+	err := ioutil.WriteFile(l.OutputPath+FileNameSummary, []byte(summary), 0644)
 	if err != nil {
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputPath+FileNameSummary, 0)
 	}
-
-	fp.Close()
-
 	return nil
 }
 
-// LoadOntologyFiles executes the loading script for the ontology
-func LoadOntologyFiles() error {
-	// Display just the stderr if an error occurs
-	cmd := exec.Command("/bin/sh", FileBashPath[0])
-	stderr := &bytes.Buffer{} // make sure to import bytes
-	cmd.Stderr = stderr
-	err := cmd.Run()
+// LoadOntologyFiles loads the ontology into the i2b2 and the genomic annotations databases (one transaction per database,
+// the ones completed before the checkpoint are skipped)
+func (l *Loader) LoadOntologyFiles() error {
+	err := l.checkpoint.Run(phaseLoadOntology, func() error {
+		return loader.ExecuteStatements(l.I2B2DB, l.GenerateLoadingOntologyStatements())
+	})
 	if err != nil {
-		log.LLvl1("Error when running command.  Error log:", stderr.String())
-		log.LLvl1("Got command status:", err.Error())
 		return err
 	}
+	return l.checkpoint.Run(phaseLoadAnnotations, func() error {
+		return loader.ExecuteStatements(l.GaDB, l.GenerateLoadingAnnotationsStatements())
+	})
+}
 
-	return nil
+// LoadDataFiles loads the dataset into the i2b2 database in a single transaction
+func (l *Loader) LoadDataFiles() error {
+	return loader.ExecuteStatements(l.I2B2DB, l.GenerateLoadingDataStatements())
 }
 
-// LoadDataFiles executes the loading script for the dataset
-func LoadDataFiles() error {
-	// Display just the stderr if an error occurs
-	cmd := exec.Command("/bin/sh", FileBashPath[1])
-	stderr := &bytes.Buffer{} // make sure to import bytes
-	cmd.Stderr = stderr
-	err := cmd.Run()
+// VerifyFiles compares the tables loaded by LoadOntologyFiles and LoadDataFiles with the converted files (row counts and
+// checksums) and checks that a sample of the TAG_IDs of the observations are in the sensitive_tagged table. It returns
+// an error of the category ErrDBLoad if they do not match.
+func (l *Loader) VerifyFiles() error {
+	var verification loader.Verification
+	for _, step := range []struct {
+		db         loader.DBSettings
+		statements []loader.Statement
+	}{
+		{l.I2B2DB, l.GenerateLoadingOntologyStatements()},
+		{l.GaDB, l.GenerateLoadingAnnotationsStatements()},
+		{l.I2B2DB, l.GenerateLoadingDataStatements()},
+	} {
+		checks, err := loader.VerifyStatements(step.db, step.statements)
+		if err != nil {
+			return err
+		}
+		verification.Tables = append(verification.Tables, checks...)
+	}
+
+	var err error
+	facts := loader.CopyStatement(TablenamesData[6], l.FilePathsData[6], false)
+	verification.TagsChecked, verification.MissingTags, err = loader.VerifyTags(l.I2B2DB, facts, TablenamesOntology[3])
 	if err != nil {
-		log.LLvl1("Error when running command.  Error log:", stderr.String())
-		log.LLvl1("Got command status:", err.Error())
 		return err
 	}
 
-	return nil
+	log.LLvl1("Verification of the loaded data:\n" + verification.String())
+	return verification.Err()
 }
 
 // GenerateOntologyFiles generates the .csv files that 'belong' to the whole ontology (metadata & medco)
-func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical, fOntGenomic *os.File, mapSensitive map[string]struct{}) error {
+func (l *Loader) GenerateOntologyFiles() error {
 	parsingTime := time.Duration(0)
 	startParsing := time.Now()
 
-	writeMedCoOntologyClearHeader()
-	writeMedCoOntologyEncHeader()
-	writeMedCoSensitiveTaggedHeader()
+	for path, writeHeader := range map[string]func() error{
+		`\medco\clinical\nonsensitive\`: l.writeMedCoOntologyClearHeader,
+		`\medco\clinical\sensitive\`:    l.writeMedCoOntologyEncHeader,
+		`\medco\tagged\`:                l.writeMedCoSensitiveTaggedHeader,
+	} {
+		if l.loaded(path) {
+			continue
+		}
+		if err := writeHeader(); err != nil {
+			return err
+		}
+	}
 
 	allSensitiveIDs := make(map[int64]SensitiveIDValue, NumElMap) // maps the EncID(s) to the concept path
 	toTraverseIndex := make([]int, 0)                             // the indexes of the columns that matter
 
 	encID := int64(1)   // clinical sensitive IDs
 	clearID := int64(1) // clinical non-sensitive IDs
+	if l.State != nil {
+		encID, clearID = l.State.MaxEncID+1, l.State.MaxClearID+1
+		if err := l.addLoadedVariants(); err != nil {
+			return err
+		}
+	}
 
 	// load clinical ontology
-	reader := csv.NewReader(fOntClinical)
+	reader := csv.NewReader(l.OntClinical)
 	reader.Comma = '\t'
 
 	first := true
@@ -679,7 +871,7 @@ func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical,
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return loader.NewInputError(l.OntClinical.Name(), err)
 		}
 
 		// if it is not a commented line
@@ -689,15 +881,30 @@ func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical,
 				for i, rec := range record {
 					// skip SampleID and PatientID and other similar fields
 					if _, ok := ToIgnore[rec]; !ok {
-						// sensitive
-						if _, ok := mapSensitive[rec]; ok || AllSensitive == true {
-							if err := writeMedCoOntologyEnc(rec); err != nil {
-								return err
+						decision := l.Policy.Field(rec)
+						l.SensitivityDecisions[rec] = decision
+						log.Lvl3("Sensitivity of", rec+":", decision)
+
+						// a field of which only some values are sensitive is in both ontologies
+						for _, sensitive := range []bool{true, false} {
+							if !decision.Partial && sensitive != decision.Sensitive {
+								continue
 							}
-							// we don't generate the MetadataOntologyEnc because we will do this afterwards (so that we only perform 1 DDT with all sensitive elements)
-						} else {
-							if err := writeMedCoOntologyClear(rec); err != nil {
-								return err
+							loaded, err := l.loadedField(rec, sensitive, decision.Partial)
+							if err != nil {
+								return err.(*loader.Error).InFile(l.OntClinical.Name(), 0)
+							}
+
+							// sensitive (the fields already in the ontology are not written again)
+							if loaded == false && sensitive {
+								if err := l.writeMedCoOntologyEnc(rec); err != nil {
+									return err
+								}
+								// we don't generate the MetadataOntologyEnc because we will do this afterwards (so that we only perform 1 DDT with all sensitive elements)
+							} else if loaded == false {
+								if err := l.writeMedCoOntologyClear(rec); err != nil {
+									return err
+								}
 							}
 						}
 						headerClinical = append(headerClinical, rec)
@@ -723,26 +930,48 @@ func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical,
 					}
 
 					// sensitive
-					if _, ok := mapSensitive[headerClinical[j]]; ok || AllSensitive == true {
+					if l.valueSensitive(headerClinical[j], record[i]) {
 						// if concept path does not exist
-						if _, ok := OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == false {
-							if err := writeMedCoOntologyLeafEnc(headerClinical[j], record[i], encID); err != nil {
+						if _, ok := l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == false {
+							// the values already in the ontology keep their ID, they are only tagged again
+							if id, ok := l.loadedConcept(headerClinical[j], record[i]); ok {
+								if id.Identifier != "E" {
+									return loader.NewError(loader.ErrInputFormat, errors.New("value "+record[i]+" of field "+headerClinical[j]+
+										" is sensitive but was loaded as non-sensitive")).InFile(l.OntClinical.Name(), 0)
+								}
+								allSensitiveIDs[id.Value] = SensitiveIDValue{CP: ConceptPath{Field: headerClinical[j], Record: record[i]}, Annotation: "NA", Loaded: true}
+								l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}] = id
+								j++
+								continue
+							}
+
+							if err := l.writeMedCoOntologyLeafEnc(headerClinical[j], record[i], encID); err != nil {
 								return err
 							}
 							// we don't generate the MetadataOntologyLeafEnc because we will do this afterwards (so that we only perform 1 DDT with all sensitive elements)
 							allSensitiveIDs[encID] = SensitiveIDValue{CP: ConceptPath{Field: headerClinical[j], Record: record[i]}, Annotation: "NA"}
-							OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}] = ConceptID{Identifier: "E", Value: encID}
+							l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}] = ConceptID{Identifier: "E", Value: encID}
 							encID++
 						}
 						// non-sensitive
 					} else {
 						// if concept path does not exist
-						if _, ok := OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == false {
-							if err := writeMedCoOntologyLeafClear(headerClinical[j], record[i], clearID); err != nil {
+						if _, ok := l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == false {
+							if id, ok := l.loadedConcept(headerClinical[j], record[i]); ok {
+								if id.Identifier != "C" {
+									return loader.NewError(loader.ErrInputFormat, errors.New("value "+record[i]+" of field "+headerClinical[j]+
+										" is non-sensitive but was loaded as sensitive")).InFile(l.OntClinical.Name(), 0)
+								}
+								l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}] = id
+								j++
+								continue
+							}
+
+							if err := l.writeMedCoOntologyLeafClear(headerClinical[j], record[i], clearID); err != nil {
 								return err
 							}
 
-							OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}] = ConceptID{Identifier: "C", Value: clearID}
+							l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}] = ConceptID{Identifier: "C", Value: clearID}
 							clearID++
 						}
 
@@ -754,66 +983,19 @@ func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical,
 		}
 	}
 
-	fOntClinical.Close()
+	l.OntClinical.Close()
 
 	log.LLvl1("Finished parsing the clinical ontology... (", len(allSensitiveIDs), ")")
 
 	// load genomic
-	reader = csv.NewReader(fOntGenomic)
-	reader.Comma = '\t'
-
-	first = true
-	headerGenomic := make([]string, 0)
-	// this arrays stores the indexes of the fields we need to use to generate a genomic id
-	indexGenVariant := make(map[string]int)
-
-	progress := int64(0)
-	for {
-		// read just one record, but we could ReadAll() as well
-		record, err := reader.Read()
-		progress++
-
-		// end-of-file is fitted into err
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	if l.GenomicFormat == FormatVCF {
+		if err := l.parseVCFOntology(allSensitiveIDs); err != nil {
 			return err
 		}
-
-		// for every 100,000 rows parsed print a message
-		if progress%100000 == 0 {
-			log.LLvl1("Continuing parsing the genomic ontology... (", progress, ")")
-		}
-
-		// if it is not a commented line
-		if len(record) > 0 && string(record[0]) != "" && string(record[0][0:1]) != "#" {
-
-			// the HEADER
-			if first == true {
-				for i, el := range record {
-					// the fields we need to generate the genomic id
-					if val, ok := TranslationDic[el]; ok {
-						indexGenVariant[val] = i
-					}
-					headerGenomic = append(headerGenomic, el)
-
-				}
-				first = false
-			} else {
-				// the number of genomic ids does not match the number of distinct mutation because if the RA is too big we discard the mutation
-				genomicID, err := generateGenomicID(indexGenVariant, record)
-
-				// if genomic id already exist we don't need to add it to the medco_ont.genomic_annotations
-				if _, ok := allSensitiveIDs[genomicID]; ok == false && err == nil {
-					allSensitiveIDs[genomicID] = SensitiveIDValue{CP: ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}, Annotation: generateMedCoOntologyGenomicAnnotation(headerGenomic, record)}
-				}
-			}
-
-		}
-
+	} else if err := l.parseMAFOntology(allSensitiveIDs); err != nil {
+		return err
 	}
-
-	fOntGenomic.Close()
+	l.OntGenomic.Close()
 
 	log.LLvl1("Finished parsing the genomic ontology... (", len(allSensitiveIDs), ")")
 
@@ -821,28 +1003,29 @@ func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical,
 	listSensitiveIDs := make([]int64, 0)
 	annotations := make([]string, 0)
 	keyForSensitiveIDs := make([]ConceptPath, 0)
+	loaded := make([]bool, 0)
 	for k, v := range allSensitiveIDs {
 		listSensitiveIDs = append(listSensitiveIDs, k)
 		annotations = append(annotations, v.Annotation)
 		keyForSensitiveIDs = append(keyForSensitiveIDs, v.CP)
+		loaded = append(loaded, v.Loaded)
 	}
 
 	parsingTime += time.Since(startParsing)
 
-	// encrypt sensitive ids
-	listEncryptedElements := EncryptElements(listSensitiveIDs, group)
-	if err := writeMedCoOntologyGenomicAnnotations(listSensitiveIDs, listEncryptedElements, annotations); err != nil {
+	// encrypt and tag the sensitive ids
+	listEncryptedElements, taggedValues, err := l.encryptAndTag(listSensitiveIDs)
+	if err != nil {
 		return err
 	}
-
-	// write the tagged values
-	taggedValues, err := TagElements(listEncryptedElements, group, entryPointIdx)
-	if err != nil {
+	if err := l.writeMedCoOntologyGenomicAnnotations(listSensitiveIDs, listEncryptedElements, annotations); err != nil {
 		return err
 	}
 
+	// write the tagged values
+
 	startParsing = time.Now()
-	err = writeMedCoSensitiveTagged(taggedValues, keyForSensitiveIDs)
+	err = l.writeMedCoSensitiveTagged(taggedValues, keyForSensitiveIDs, loaded)
 	parsingTime += time.Since(startParsing)
 
 	log.LLvl1("Parsing all ontology files took (", parsingTime, ")")
@@ -851,7 +1034,7 @@ func GenerateOntologyFiles(group *onet.Roster, entryPointIdx int, fOntClinical,
 }
 
 // GenerateDataFiles generates the .csv files that 'belong' to the dataset (demodata)
-func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
+func (l *Loader) GenerateDataFiles() error {
 	parsingTime := time.Duration(0)
 	startParsing := time.Now()
 
@@ -867,26 +1050,45 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 	ontValuesSmallCopy := make(map[ConceptPath]bool) // reduced set of ontology data to ensure that no repeated elements are added to the concept dimension table
 	visitMapping := make(map[string]int64)           // map a sample ID to a numeric ID
 	patientMapping := make(map[string]int64)         // map a patient ID to a numeric ID
+	sampleToPatient := make(map[string]string)       // map a sample ID to its patient ID
 	toTraverseIndex := make([]int, 0)                // the indexes of the columns that matter
 
-	if err := writeDemodataProviderDimension(); err != nil {
-		return err
+	// the patients, samples and concepts already in the databases are not written again
+	if l.State != nil {
+		for patientID, num := range l.State.Patients {
+			patientMapping[patientID] = num
+		}
+		for sampleID, num := range l.State.Samples {
+			visitMapping[sampleID] = num
+			sampleToPatient[sampleID] = l.State.SamplePatients[sampleID]
+		}
+		pid, eid = l.State.MaxPatientNum+1, l.State.MaxEncounterNum+1
+		l.TextSearchIndex = l.State.MaxTextSearchIndex + 1
+		l.markLoadedConcepts(ontValuesSmallCopy)
+	}
+
+	if l.State == nil || l.State.Provider == false {
+		if err := l.writeDemodataProviderDimension(); err != nil {
+			return err
+		}
 	}
 
 	// load clinical
-	reader := csv.NewReader(fClinical)
+	reader := csv.NewReader(l.Clinical)
 	reader.Comma = '\t'
 
 	first := true
 	headerClinical := make([]string, 0)
+	line := int64(0)
 	for {
 		// read just one record, but we could ReadAll() as well
 		record, err := reader.Read()
+		line++
 		// end-of-file is fitted into err
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return loader.NewInputError(l.Clinical.Name(), err)
 		}
 
 		// if it is not a commented line
@@ -915,10 +1117,10 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 				if _, ok := patientMapping[record[pidIndex]]; ok == false {
 					patientMapping[record[pidIndex]] = pid
 
-					if err := writeDemodataPatientMapping(record[pidIndex], patientMapping[record[pidIndex]]); err != nil {
+					if err := l.writeDemodataPatientMapping(record[pidIndex], patientMapping[record[pidIndex]]); err != nil {
 						return err
 					}
-					if err := writeDemodataPatientDimension(group, patientMapping[record[pidIndex]]); err != nil {
+					if err := l.writeDemodataPatientDimension(patientMapping[record[pidIndex]]); err != nil {
 						return err
 					}
 
@@ -928,11 +1130,12 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 				// sample not yet exists
 				if _, ok := visitMapping[record[eidIndex]]; ok == false {
 					visitMapping[record[eidIndex]] = eid
+					sampleToPatient[record[eidIndex]] = record[pidIndex]
 
-					if err := writeDemodataEncounterMapping(record[eidIndex], record[pidIndex], visitMapping[record[eidIndex]]); err != nil {
+					if err := l.writeDemodataEncounterMapping(record[eidIndex], record[pidIndex], visitMapping[record[eidIndex]]); err != nil {
 						return err
 					}
-					if err := writeDemodataVisitDimension(visitMapping[record[eidIndex]], patientMapping[record[pidIndex]]); err != nil {
+					if err := l.writeDemodataVisitDimension(visitMapping[record[eidIndex]], patientMapping[record[pidIndex]]); err != nil {
 						return err
 					}
 
@@ -954,18 +1157,18 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 					}
 
 					// check if it exists in the ontology
-					if _, ok := OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == true {
+					if _, ok := l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == true {
 						// sensitive
-						if OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}].Identifier != "C" {
+						if l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}].Identifier != "C" {
 							// if concept path does not exist
 							if _, ok := ontValuesSmallCopy[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == false {
-								if err := writeDemodataConceptDimensionTaggedConcepts(headerClinical[j], record[i]); err != nil {
+								if err := l.writeDemodataConceptDimensionTaggedConcepts(headerClinical[j], record[i]); err != nil {
 									return err
 								}
 								ontValuesSmallCopy[ConceptPath{Field: headerClinical[j], Record: record[i]}] = true
 							}
 
-							if err := writeDemodataObservationFactEnc(OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}].Value,
+							if err := l.writeDemodataObservationFactEnc(l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}].Value,
 								patientMapping[record[pidIndex]],
 								visitMapping[record[eidIndex]]); err != nil {
 								return err
@@ -974,21 +1177,20 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 						} else {
 							// if concept path does not exist
 							if _, ok := ontValuesSmallCopy[ConceptPath{Field: headerClinical[j], Record: record[i]}]; ok == false {
-								if err := writeDemodataConceptDimensionCleartextConcepts(headerClinical[j], record[i]); err != nil {
+								if err := l.writeDemodataConceptDimensionCleartextConcepts(headerClinical[j], record[i]); err != nil {
 									return err
 								}
 								ontValuesSmallCopy[ConceptPath{Field: headerClinical[j], Record: record[i]}] = true
 							}
 
-							if err := writeDemodataObservationFactClear(OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}].Value,
+							if err := l.writeDemodataObservationFactClear(l.OntValues[ConceptPath{Field: headerClinical[j], Record: record[i]}].Value,
 								patientMapping[record[pidIndex]],
 								visitMapping[record[eidIndex]]); err != nil {
 								return err
 							}
 						}
 					} else {
-						log.Fatal("There are elements in the dataset that do not belong to the existing ontology")
-						return err
+						return loader.NewError(loader.ErrMissingOntologyElement, errors.New(headerClinical[j]+"="+record[i])).InFile(l.Clinical.Name(), line)
 					}
 					j++
 				}
@@ -996,27 +1198,125 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 			}
 		}
 	}
-	fClinical.Close()
+	l.Clinical.Close()
 
 	log.LLvl1("Finished parsing the clinical dataset...")
 
 	// load genomic
-	reader = csv.NewReader(fGenomic)
+	if l.GenomicFormat == FormatVCF {
+		if err := l.generateVCFObservations(sampleToPatient, patientMapping, visitMapping, ontValuesSmallCopy); err != nil {
+			return err
+		}
+	} else if err := l.generateMAFObservations(patientMapping, visitMapping, ontValuesSmallCopy); err != nil {
+		return err
+	}
+	l.Genomic.Close()
+
+	parsingTime += time.Since(startParsing)
+	log.LLvl1("Finished parsing the genomic dataset...")
+	log.LLvl1("Parsing all dataset files took (", parsingTime, ")")
+
+	log.LLvl1("The End. Only loading left...")
+
+	return nil
+}
+
+// parseMAFOntology adds the variants of the genomic ontology (MAF) to the sensitive IDs
+func (l *Loader) parseMAFOntology(allSensitiveIDs map[int64]SensitiveIDValue) error {
+	reader := csv.NewReader(l.OntGenomic)
 	reader.Comma = '\t'
 
-	first = true
+	first := true
 	headerGenomic := make([]string, 0)
 	// this arrays stores the indexes of the fields we need to use to generate a genomic id
 	indexGenVariant := make(map[string]int)
+
+	progress := int64(0)
+	discarded := 0
 	for {
 		// read just one record, but we could ReadAll() as well
 		record, err := reader.Read()
+		progress++
 
 		// end-of-file is fitted into err
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return loader.NewInputError(l.OntGenomic.Name(), err)
+		}
+
+		// for every 100,000 rows parsed print a message
+		if progress%100000 == 0 {
+			log.LLvl1("Continuing parsing the genomic ontology... (", progress, ")")
+		}
+
+		// if it is not a commented line
+		if len(record) > 0 && string(record[0]) != "" && string(record[0][0:1]) != "#" {
+
+			// the HEADER
+			if first == true {
+				for i, el := range record {
+					// the fields we need to generate the genomic id
+					if val, ok := TranslationDic[el]; ok {
+						indexGenVariant[val] = i
+					}
+					headerGenomic = append(headerGenomic, el)
+
+				}
+				first = false
+			} else {
+				if err := l.checkBuild(indexGenVariant, record); err != nil {
+					return err.InFile(l.OntGenomic.Name(), progress)
+				}
+
+				// the number of genomic ids does not match the number of distinct mutation because the variants that cannot be encoded are discarded
+				genomicID, err := l.generateGenomicID(indexGenVariant, record)
+				if errors.Is(err, identifiers.ErrIDCollision) || errors.Is(err, identifiers.ErrMissingAllelesKey) {
+					return err.(*loader.Error).InFile(l.OntGenomic.Name(), progress)
+				} else if err != nil {
+					discarded++
+					continue
+				}
+
+				// if genomic id already exist we don't need to add it to the medco_ont.genomic_annotations
+				if _, ok := allSensitiveIDs[genomicID]; ok == false {
+					allSensitiveIDs[genomicID] = l.sensitiveVariant(genomicID, generateMedCoOntologyGenomicAnnotation(headerGenomic, record))
+				}
+			}
+
+		}
+
+	}
+
+	if discarded > 0 {
+		log.Warn("Discarded", discarded, "variants of the genomic ontology that cannot be encoded")
+	}
+
+	return nil
+}
+
+// generateMAFObservations writes the observations of the genomic dataset (MAF)
+func (l *Loader) generateMAFObservations(patientMapping, visitMapping map[string]int64, ontValuesSmallCopy map[ConceptPath]bool) error {
+	reader := csv.NewReader(l.Genomic)
+	reader.Comma = '\t'
+
+	first := true
+	headerGenomic := make([]string, 0)
+	// this arrays stores the indexes of the fields we need to use to generate a genomic id
+	indexGenVariant := make(map[string]int)
+	line := int64(0)
+	// patient_id and encounter_id (sample_id) column indexes
+	pidIndex, eidIndex := 0, 0
+	for {
+		// read just one record, but we could ReadAll() as well
+		record, err := reader.Read()
+		line++
+
+		// end-of-file is fitted into err
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return loader.NewInputError(l.Genomic.Name(), err)
 		}
 
 		// if it is not a commented line
@@ -1040,28 +1340,34 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 				}
 				first = false
 			} else {
-				genomicID, err := generateGenomicID(indexGenVariant, record)
+				if err := l.checkBuild(indexGenVariant, record); err != nil {
+					return err.InFile(l.Genomic.Name(), line)
+				}
+
+				genomicID, err := l.generateGenomicID(indexGenVariant, record)
+				if errors.Is(err, identifiers.ErrIDCollision) || errors.Is(err, identifiers.ErrMissingAllelesKey) {
+					return err.(*loader.Error).InFile(l.Genomic.Name(), line)
+				}
 
 				if err == nil {
 
 					// check if it exists in the ontology
-					if _, ok := OntValues[ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}]; ok == true {
+					if _, ok := l.OntValues[ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}]; ok == true {
 						// if concept path does not exist
 						if _, ok := ontValuesSmallCopy[ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}]; ok == false {
-							if err := writeDemodataConceptDimensionTaggedConcepts(strconv.FormatInt(genomicID, 10), ""); err != nil {
+							if err := l.writeDemodataConceptDimensionTaggedConcepts(strconv.FormatInt(genomicID, 10), ""); err != nil {
 								return err
 							}
 							ontValuesSmallCopy[ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}] = true
 						}
 
-						if err := writeDemodataObservationFactEnc(OntValues[ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}].Value,
+						if err := l.writeDemodataObservationFactEnc(l.OntValues[ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}].Value,
 							patientMapping[record[pidIndex]],
 							visitMapping[record[eidIndex]]); err != nil {
 							return err
 						}
 					} else {
-						log.Fatal("There are elements in the dataset that do not belong to the existing ontology")
-						return err
+						return loader.NewError(loader.ErrMissingOntologyElement, errors.New("genomic variant "+strconv.FormatInt(genomicID, 10))).InFile(l.Genomic.Name(), line)
 					}
 				}
 			}
@@ -1069,31 +1375,32 @@ func GenerateDataFiles(group *onet.Roster, fClinical, fGenomic *os.File) error {
 		}
 	}
 
-	fGenomic.Close()
-
-	parsingTime += time.Since(startParsing)
-	log.LLvl1("Finished parsing the genomic dataset...")
-	log.LLvl1("Parsing all dataset files took (", parsingTime, ")")
-
-	log.LLvl1("The End. Only loading left...")
-
 	return nil
 }
 
-func writeMedCoOntologyEncHeader() error {
+func (l *Loader) writeMedCoOntologyEncHeader() error {
 	clinicalSensitive := `"2","\medco\clinical\sensitive\","MedCo Clinical Sensitive Ontology","N","CA","0",,,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\clinical\sensitive\","MedCo Clinical Sensitive Ontology","\medco\clinical\sensitive\","NOW()","NOW()","NOW()",,"ENC_ID","@",,,,` + "\n"
 
-	_, err := FileHandlers[0].WriteString(clinicalSensitive)
+	_, err := l.writeString(0, clinicalSensitive)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoOntologyEnc():", err)
-		return err
+		return l.outputError(0, err)
 	}
 
 	return nil
 }
 
-func writeMedCoOntologyEnc(el string) error {
+// valueSensitive returns true if the value of the clinical field is sensitive (the values of a partially sensitive field
+// are decided one by one by the Policy)
+func (l *Loader) valueSensitive(field, value string) bool {
+	decision := l.SensitivityDecisions[field]
+	if !decision.Partial {
+		return decision.Sensitive
+	}
+	return l.Policy.Value(field, value).Sensitive
+}
+
+func (l *Loader) writeMedCoOntologyEnc(el string) error {
 	el = SanitizeHeader(el)
 
 	/*clinicalSensitive := `INSERT INTO medco_ont.clinical_sensitive VALUES (3, '\medco\clinical\sensitive\` + el + `\', '` + el + `', 'N', 'CA', NULL, NULL, NULL, 'concept_cd', 'concept_dimension', 'concept_path', 'T', 'LIKE',
@@ -1102,17 +1409,16 @@ func writeMedCoOntologyEnc(el string) error {
 
 	clinicalSensitive := `"3","\medco\clinical\sensitive\` + el + `\","` + el + `","N","CA",,,,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\clinical\sensitive\` + el + `\","Sensitive field encrypted by Unlynx","\medco\clinical\sensitive\` + el + `\","NOW()",,,,"ENC_ID","@",,,,` + "\n"
 
-	_, err := FileHandlers[0].WriteString(clinicalSensitive)
+	_, err := l.writeString(0, clinicalSensitive)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoOntologyEnc():", err)
-		return err
+		return l.outputError(0, err)
 	}
 
 	return nil
 }
 
-func writeMedCoOntologyLeafEnc(field, el string, id int64) error {
+func (l *Loader) writeMedCoOntologyLeafEnc(field, el string, id int64) error {
 	field = SanitizeHeader(field)
 
 	/*clinicalSensitive := `INSERT INTO medco_ont.clinical_sensitive VALUES (4, '\medco\clinical\sensitive\` + field + `\` + el + `\', '` + el + `', 'N', 'LA', NULL, 'ENC_ID:` + strconv.FormatInt(id, 10) + `', NULL, 'concept_cd', 'concept_dimension', 'concept_path', 'T', 'LIKE',
@@ -1121,30 +1427,28 @@ func writeMedCoOntologyLeafEnc(field, el string, id int64) error {
 
 	clinicalSensitive := `"4","\medco\clinical\sensitive\` + field + `\` + el + `\","` + el + `","N","LA",,"ENC_ID:` + strconv.FormatInt(id, 10) + `",,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\clinical\sensitive\` + field + `\` + el + `\","Sensitive value encrypted by Unlynx","\medco\clinical\sensitive\` + field + `\` + el + `\","NOW()",,,,"ENC_ID","@",,,,` + "\n"
 
-	_, err := FileHandlers[0].WriteString(clinicalSensitive)
+	_, err := l.writeString(0, clinicalSensitive)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoOntologyLeafEnc():", err)
-		return err
+		return l.outputError(0, err)
 	}
 
 	return nil
 }
 
-func writeMedCoOntologyClearHeader() error {
+func (l *Loader) writeMedCoOntologyClearHeader() error {
 	clinical := `"2","\medco\clinical\nonsensitive\","MedCo Clinical Non-Sensitive Ontology","N","CA","0",,,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\clinical\nonsensitive\","MedCo Clinical Non-Sensitive Ontology","\medco\clinical\nonsensitive\","NOW()","NOW()","NOW()",,"CLEAR","@",,,,` + "\n"
 
-	_, err := FileHandlers[1].WriteString(clinical)
+	_, err := l.writeString(1, clinical)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoOntologyClear():", err)
-		return err
+		return l.outputError(1, err)
 	}
 
 	return nil
 }
 
-func writeMedCoOntologyClear(el string) error {
+func (l *Loader) writeMedCoOntologyClear(el string) error {
 	el = SanitizeHeader(el)
 
 	/*clinical := `INSERT INTO medco_ont.clinical_non_sensitive VALUES (3, '\medco\clinical\nonsensitive\` + el + `\', '` + el + `', 'N', 'CA', NULL, NULL, NULL, 'concept_cd', 'concept_dimension', 'concept_path', 'T', 'LIKE',
@@ -1153,17 +1457,16 @@ func writeMedCoOntologyClear(el string) error {
 
 	clinical := `"3","\medco\clinical\nonsensitive\` + el + `\","` + el + `","N","CA",,,,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\clinical\nonsensitive\` + el + `\","Non-sensitive field","\medco\clinical\nonsensitive\` + el + `\","NOW()",,,,"CLEAR","@",,,,` + "\n"
 
-	_, err := FileHandlers[1].WriteString(clinical)
+	_, err := l.writeString(1, clinical)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoOntologyClear():", err)
-		return err
+		return l.outputError(1, err)
 	}
 
 	return nil
 }
 
-func writeMedCoOntologyLeafClear(field, el string, id int64) error {
+func (l *Loader) writeMedCoOntologyLeafClear(field, el string, id int64) error {
 	field = SanitizeHeader(field)
 
 	/*clinical := `INSERT INTO medco_ont.clinical_non_sensitive VALUES (4, '\medco\clinical\nonsensitive\` + field + `\` + el + `\', '` + el + `', 'N', 'LA', NULL, 'CLEAR:` + strconv.FormatInt(id, 10) + `', NULL, 'concept_cd', 'concept_dimension', 'concept_path', 'T', 'LIKE',
@@ -1172,30 +1475,23 @@ func writeMedCoOntologyLeafClear(field, el string, id int64) error {
 
 	clinical := `"4","\medco\clinical\nonsensitive\` + field + `\` + el + `\","` + el + `","N","LA",,"CLEAR:` + strconv.FormatInt(id, 10) + `",,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\clinical\nonsensitive\` + field + `\` + el + `\","Non-sensitive value","\medco\clinical\sensitive\` + field + `\` + el + `\","NOW()",,,,"CLEAR","@",,,,` + "\n"
 
-	_, err := FileHandlers[1].WriteString(clinical)
+	_, err := l.writeString(1, clinical)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoOntologyLeafClear():", err)
-		return err
+		return l.outputError(1, err)
 	}
 
 	return nil
 }
 
-func generateGenomicID(indexGenVariant map[string]int, record []string) (int64, error) {
-
-	// if the ref and alt are too big ignore them (for now....)
-	if len(record[indexGenVariant["RA"]]) > 6 || len(record[indexGenVariant["TSA1"]]) > 6 {
-		return int64(-1), errors.New("reference and/or Alternate base size is bigger than the maximum allowed")
-	}
-
+func (l *Loader) generateGenomicID(indexGenVariant map[string]int, record []string) (int64, error) {
 	// generate id
 	aux, err := strconv.ParseInt(record[indexGenVariant["SP"]], 10, 64)
 	if err != nil {
 		return int64(-1), err
 	}
 
-	id, err := identifiers.GetVariantID(record[indexGenVariant["CHR"]], aux, record[indexGenVariant["RA"]], record[indexGenVariant["TSA1"]])
+	id, err := l.variantIDs.GetVariantID(record[indexGenVariant["CHR"]], aux, record[indexGenVariant["RA"]], record[indexGenVariant["TSA1"]])
 	if err != nil {
 		return int64(-1), err
 	}
@@ -1204,6 +1500,22 @@ func generateGenomicID(indexGenVariant map[string]int, record []string) (int64,
 
 }
 
+// checkBuild checks that the assembly of the variant (the NCBI_Build column, if any) is the assembly of the loader
+func (l *Loader) checkBuild(indexGenVariant map[string]int, record []string) *loader.Error {
+	index, ok := indexGenVariant["BUILD"]
+	if !ok || record[index] == "" || record[index] == "NA" {
+		return nil
+	}
+
+	assembly, err := identifiers.NormalizeAssembly(record[index])
+	if err != nil {
+		return err.(*loader.Error)
+	} else if assembly != l.Assembly {
+		return loader.NewError(loader.ErrInputFormat, errors.New("variant of assembly "+assembly+" in a dataset of assembly "+l.Assembly))
+	}
+	return nil
+}
+
 func generateMedCoOntologyGenomicAnnotation(fields []string, record []string) string {
 	// genomic info
 	chr, sp, ra, tsa1, tsa2 := "?", "?", "?", "?", "?"
@@ -1269,19 +1581,17 @@ func generateMedCoOntologyGenomicAnnotation(fields []string, record []string) st
 	return annotation
 }
 
-func writeMedCoOntologyGenomicAnnotations(listSensitiveIDs []int64, listEncryptedElements *libunlynx.CipherVector, annotations []string) error {
+func (l *Loader) writeMedCoOntologyGenomicAnnotations(listSensitiveIDs []int64, listEncryptedElements *libunlynx.CipherVector, annotations []string) error {
 	for i, annotation := range annotations {
 		if annotation != "NA" && annotation != "" {
 			ciphertextStr, err := (*listEncryptedElements)[i].Serialize()
 			if err != nil {
-				log.Fatal("Serialization error in the writeMedCoOntologyGenomicAnnotations():", err)
-				return err
+				return loader.NewError(loader.ErrSerialization, err)
 			}
 
-			_, err = FileHandlers[2].WriteString(`"` + strconv.FormatInt(listSensitiveIDs[i], 10) + `","` + ciphertextStr + `",` + annotation)
+			_, err = l.writeString(2, `"`+strconv.FormatInt(listSensitiveIDs[i], 10)+`","`+ciphertextStr+`",`+annotation)
 			if err != nil {
-				log.Fatal("Error in the writeMedCoOntologyGenomicAnnotations():", err)
-				return err
+				return l.outputError(2, err)
 			}
 		}
 	}
@@ -1336,55 +1646,87 @@ func EncryptElements(list []int64, group *onet.Roster) *libunlynx.CipherVector {
 }
 
 // TagElements tags the genomic ids to allow for the comparison
-func TagElements(listEncryptedElements *libunlynx.CipherVector, group *onet.Roster, entryPointIdx int) ([]libunlynx.GroupingKey, error) {
+func (l *Loader) TagElements(listEncryptedElements *libunlynx.CipherVector) ([]libunlynx.GroupingKey, error) {
 	// TAGGING
 	start := time.Now()
-	client := servicesmedco.NewMedCoClient(group.List[entryPointIdx], strconv.Itoa(entryPointIdx))
-	_, result, tr, err := client.SendSurveyDDTRequestTerms(
-		group, // Roster
-		servicesmedco.SurveyID("tagging_loading_phase"), // SurveyID
-		*listEncryptedElements,                          // Encrypted query terms to tag
-		false,                                           // compute proofs?
-		Testing,
-	)
-
+	result, err := loader.TagElements(l.Roster, l.EntryPointIdx, l.surveyID, *listEncryptedElements, l.Testing, l.Tagging)
 	if err != nil {
-		log.Fatal("Error during DDT:", err)
 		return nil, err
 	}
 
-	totalTime := time.Since(start)
+	log.LLvl1("Finished tagging the sensitive data... (", time.Since(start), ")")
 
-	log.LLvl1("DDT took: exec -", tr.MapTR[servicesmedco.TaggingTimeExec], "commun -", tr.MapTR[servicesmedco.TaggingTimeCommunication])
+	return result, nil
+}
 
-	log.LLvl1("Finished tagging the sensitive data... (", totalTime, ")")
+// encryptAndTag encrypts and tags the genomic ids. The ciphertexts and tags are kept in the checkpoint: the ids that
+// were all tagged before it are not encrypted and tagged again.
+func (l *Loader) encryptAndTag(list []int64) (*libunlynx.CipherVector, []libunlynx.GroupingKey, error) {
+	if terms, ok := l.checkpoint.Terms(list); ok {
+		listEncryptedElements := make(libunlynx.CipherVector, len(terms))
+		taggedValues := make([]libunlynx.GroupingKey, len(terms))
+		for i, term := range terms {
+			if err := listEncryptedElements[i].Deserialize(term.Ciphertext); err != nil {
+				return nil, nil, loader.NewError(loader.ErrSerialization, err)
+			}
+			taggedValues[i] = libunlynx.GroupingKey(term.Tag)
+		}
+		return &listEncryptedElements, taggedValues, nil
+	}
 
-	return result, nil
+	listEncryptedElements := EncryptElements(list, l.Roster)
+	taggedValues, err := l.TagElements(listEncryptedElements)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if l.checkpoint != nil {
+		terms := make([]loader.Term, len(taggedValues))
+		for i, tag := range taggedValues {
+			ciphertext, err := (*listEncryptedElements)[i].Serialize()
+			if err != nil {
+				return nil, nil, loader.NewError(loader.ErrSerialization, err)
+			}
+			terms[i] = loader.Term{Ciphertext: ciphertext, Tag: string(tag)}
+		}
+		if err := l.checkpoint.AddTerms(list, terms); err != nil {
+			return nil, nil, err
+		}
+	}
+	return listEncryptedElements, taggedValues, nil
 }
 
-func writeMedCoSensitiveTaggedHeader() error {
+func (l *Loader) writeMedCoSensitiveTaggedHeader() error {
 	sensitive := `"1","\medco\tagged\","MedCo Sensitive Tagged Ontology","N","CA","0",,,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\tagged\","MedCo Sensitive Tagged Ontology","\medco\tagged\","NOW()","NOW()","NOW()",,"TAG_ID","@",,,,` + "\n"
 
-	_, err := FileHandlers[3].WriteString(sensitive)
+	_, err := l.writeString(3, sensitive)
 
 	if err != nil {
-		log.Fatal("Error in the writeMedCoSensitiveTagged():", err)
-		return err
+		return l.outputError(3, err)
 	}
 
 	return nil
 }
 
-func writeMedCoSensitiveTagged(list []libunlynx.GroupingKey, keyForSensitiveIDs []ConceptPath) error {
+func (l *Loader) writeMedCoSensitiveTagged(list []libunlynx.GroupingKey, keyForSensitiveIDs []ConceptPath, loaded []bool) error {
 
 	if len(list) != len(keyForSensitiveIDs) {
-		log.Fatal("The number of sensitive elements does not match the number of 'KeyForSensitiveID's.")
-		return errors.New("")
+		return loader.NewError(loader.ErrDDT, fmt.Errorf("%d tags received for %d sensitive elements", len(list), len(keyForSensitiveIDs)))
 	}
 
 	tagIDs := make(map[int64]bool)
 
 	for i, el := range list {
+		// the elements already in the databases keep their TAG_ID (the tagging is deterministic)
+		if l.State != nil {
+			if tagID, ok := l.State.TagIDs[string(el)]; ok {
+				l.OntValues[keyForSensitiveIDs[i]] = ConceptID{Identifier: string(el), Value: tagID}
+				continue
+			} else if loaded[i] {
+				return loader.NewError(loader.ErrDDT, errors.New("the tag of "+keyForSensitiveIDs[i].Field+" is not in the databases (were they loaded by another collective authority?)"))
+			}
+		}
+
 		// generate a tagID with 32bits (cannot be repeated)
 		ok := false
 		var tagID uint32
@@ -1394,14 +1736,13 @@ func writeMedCoSensitiveTagged(list []libunlynx.GroupingKey, keyForSensitiveIDs
 			b, err := GenerateRandomBytes(4)
 
 			if err != nil {
-				log.Fatal("Error while generating random number", err)
-				return err
+				return loader.NewError(loader.ErrRandomness, err)
 			}
 
 			tagID = binary.BigEndian.Uint32(b)
 
 			// if random tag does not exist yet
-			if _, okTagID := tagIDs[int64(tagID)]; okTagID == false {
+			if _, okTagID := tagIDs[int64(tagID)]; okTagID == false && (l.State == nil || l.State.hasTagID(int64(tagID)) == false) {
 				tagIDs[int64(tagID)] = true
 				ok = true
 			}
@@ -1412,72 +1753,67 @@ func writeMedCoSensitiveTagged(list []libunlynx.GroupingKey, keyForSensitiveIDs
 
 		sensitive := `"2","\medco\tagged\` + string(el) + `\","""","N","LA",,"TAG_ID:` + strconv.FormatInt(int64(tagID), 10) + `",,"concept_cd","concept_dimension","concept_path","T","LIKE","\medco\tagged\` + string(el) + `\",,,"NOW()",,,,"TAG_ID","@",,,,` + "\n"
 
-		_, err := FileHandlers[3].WriteString(sensitive)
+		_, err := l.writeString(3, sensitive)
 
 		if err != nil {
-			log.Fatal("Error in the writeMedCoSensitiveTagged():", err)
-			return err
+			return l.outputError(3, err)
 		}
 
-		OntValues[keyForSensitiveIDs[i]] = ConceptID{Identifier: string(el), Value: int64(tagID)}
+		l.OntValues[keyForSensitiveIDs[i]] = ConceptID{Identifier: string(el), Value: int64(tagID)}
 	}
 	return nil
 }
 
-func writeDemodataConceptDimensionCleartextConcepts(field, el string) error {
-	/*cleartextConcepts := `INSERT INTO i2b2demodata.concept_dimension VALUES ('\medco\clinical\nonsensitive\` + field + `\` + record + `\', 'CLEAR:` + strconv.FormatInt(OntValues[ConceptPath{Field: field, Record: record}].Value, 10) + `', '` + record + `', NULL, NULL, NULL, 'NOW()', NULL, NULL);` + "\n"*/
+func (l *Loader) writeDemodataConceptDimensionCleartextConcepts(field, el string) error {
+	/*cleartextConcepts := `INSERT INTO i2b2demodata.concept_dimension VALUES ('\medco\clinical\nonsensitive\` + field + `\` + record + `\', 'CLEAR:` + strconv.FormatInt(l.OntValues[ConceptPath{Field: field, Record: record}].Value, 10) + `', '` + record + `', NULL, NULL, NULL, 'NOW()', NULL, NULL);` + "\n"*/
 
-	cleartextConcepts := `"\medco\clinical\nonsensitive\` + SanitizeHeader(field) + `\` + el + `\","CLEAR:` + strconv.FormatInt(OntValues[ConceptPath{Field: field, Record: el}].Value, 10) + `","` + el + `",,,,"NOW()",,` + "\n"
+	cleartextConcepts := `"\medco\clinical\nonsensitive\` + SanitizeHeader(field) + `\` + el + `\","CLEAR:` + strconv.FormatInt(l.OntValues[ConceptPath{Field: field, Record: el}].Value, 10) + `","` + el + `",,,,"NOW()",,` + "\n"
 
-	_, err := FileHandlers[4].WriteString(cleartextConcepts)
+	_, err := l.writeString(4, cleartextConcepts)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataConceptDimensionCleartextConcepts():", err)
-		return err
+		return l.outputError(4, err)
 	}
 
 	return nil
 
 }
 
-func writeDemodataConceptDimensionTaggedConcepts(field string, el string) error {
+func (l *Loader) writeDemodataConceptDimensionTaggedConcepts(field string, el string) error {
 
-	/*taggedConcepts := `INSERT INTO i2b2demodata.concept_dimension VALUES ('\medco\tagged\` + OntValues[ConceptPath{Field: field, Record: el}].Identifier + `\', 'TAG_ID:` + strconv.FormatInt(OntValues[ConceptPath{Field: field, Record: el}].Value, 10) + `', NULL, NULL, NULL, NULL, 'NOW()', NULL, NULL);` + "\n"*/
+	/*taggedConcepts := `INSERT INTO i2b2demodata.concept_dimension VALUES ('\medco\tagged\` + l.OntValues[ConceptPath{Field: field, Record: el}].Identifier + `\', 'TAG_ID:` + strconv.FormatInt(l.OntValues[ConceptPath{Field: field, Record: el}].Value, 10) + `', NULL, NULL, NULL, NULL, 'NOW()', NULL, NULL);` + "\n"*/
 
-	taggedConcepts := `"\medco\tagged\` + OntValues[ConceptPath{Field: field, Record: el}].Identifier + `\","TAG_ID:` + strconv.FormatInt(OntValues[ConceptPath{Field: field, Record: el}].Value, 10) + `",,,,,"NOW()",,` + "\n"
+	taggedConcepts := `"\medco\tagged\` + l.OntValues[ConceptPath{Field: field, Record: el}].Identifier + `\","TAG_ID:` + strconv.FormatInt(l.OntValues[ConceptPath{Field: field, Record: el}].Value, 10) + `",,,,,"NOW()",,` + "\n"
 
-	_, err := FileHandlers[4].WriteString(taggedConcepts)
+	_, err := l.writeString(4, taggedConcepts)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataConceptDimensionTaggedConcepts():", err)
-		return err
+		return l.outputError(4, err)
 	}
 
 	return nil
 }
 
-func writeDemodataPatientMapping(el string, id int64) error {
+func (l *Loader) writeDemodataPatientMapping(el string, id int64) error {
 
 	/*chuv := `INSERT INTO i2b2demodata.patient_mapping VALUES ('` + el + `', 'chuv', ` + strconv.FormatInt(id, 10) + `, NULL, 'Demo', NULL, NULL, NULL, 'NOW()', NULL, 1);` + "\n"*/
 
 	chuv := `"` + el + `","chuv","` + strconv.FormatInt(id, 10) + `",,"Demo",,,,"NOW()",,"1"` + "\n"
 
-	_, err := FileHandlers[5].WriteString(chuv)
+	_, err := l.writeString(5, chuv)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataPatientMapping()-Chuv:", err)
-		return err
+		return l.outputError(5, err)
 	}
 
 	/*hive := `INSERT INTO i2b2demodata.patient_mapping VALUES ('` + strconv.FormatInt(id, 10) + `', 'HIVE', ` + strconv.FormatInt(id, 10) + `, 'A', 'HIVE', NULL, 'NOW()', 'NOW()', 'NOW()', 'edu.harvard.i2b2.crc', 1);` + "\n"*/
 
 	hive := `"` + strconv.FormatInt(id, 10) + `","HIVE","` + strconv.FormatInt(id, 10) + `","A","HIVE",,"NOW()","NOW()","NOW()","edu.harvard.i2b2.crc","1"` + "\n"
 
-	_, err = FileHandlers[5].WriteString(hive)
+	_, err = l.writeString(5, hive)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataPatientMapping()-Hive:", err)
-		return err
+		return l.outputError(5, err)
 	}
 
 	return nil
@@ -1485,123 +1821,115 @@ func writeDemodataPatientMapping(el string, id int64) error {
 }
 
 // TODO: No dummy data. Basically all flags are
-func writeDemodataPatientDimension(group *onet.Roster, id int64) error {
+func (l *Loader) writeDemodataPatientDimension(id int64) error {
 
-	encryptedFlag := libunlynx.EncryptInt(group.Aggregate, 1)
+	encryptedFlag := libunlynx.EncryptInt(l.Roster.Aggregate, 1)
 	encryptedFlagString, err := encryptedFlag.Serialize()
 	if err != nil {
-		log.Fatal("Serialization error in the writeDemodataPatientDimension():", err)
-		return err
+		return loader.NewError(loader.ErrSerialization, err)
 	}
 
 	/*patientDimension := `INSERT INTO i2b2demodata.patient_dimension VALUES (` + strconv.FormatInt(id, 10) + `, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, 'NOW()', NULL, 1, '` + base64.StdEncoding.EncodeToString(b) + `');` + "\n"*/
 
 	patientDimension := `"` + strconv.FormatInt(id, 10) + `",,,,,,,,,,,,,,,,"NOW()",,"1","` + encryptedFlagString + `"` + "\n"
 
-	_, err = FileHandlers[6].WriteString(patientDimension)
+	_, err = l.writeString(6, patientDimension)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataPatientDimension()-Hive:", err)
-		return err
+		return l.outputError(6, err)
 	}
 
 	return nil
 }
 
-func writeDemodataEncounterMapping(sampleID, patientID string, id int64) error {
+func (l *Loader) writeDemodataEncounterMapping(sampleID, patientID string, id int64) error {
 
 	/*encounterChuv := `INSERT INTO i2b2demodata.encounter_mapping VALUES ('` + sampleID + `', 'chuv', 'Demo', ` + strconv.FormatInt(id, 10) + `, '` + patientID + `', 'chuv', NULL, NULL, NULL, NULL, 'NOW()', NULL, 1);` + "\n"*/
 
 	encounterChuv := `"` + sampleID + `","chuv","Demo","` + strconv.FormatInt(id, 10) + `","` + patientID + `","chuv",,,,,"NOW()",,"1"` + "\n"
 
-	_, err := FileHandlers[7].WriteString(encounterChuv)
+	_, err := l.writeString(7, encounterChuv)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataEncounterMapping()-Chuv:", err)
-		return err
+		return l.outputError(7, err)
 	}
 
 	/*encounterHive := `INSERT INTO i2b2demodata.encounter_mapping VALUES ('` + strconv.FormatInt(id, 10) + `', 'HIVE', 'HIVE', ` + strconv.FormatInt(id, 10) + `, '` + sampleID + `', 'chuv', 'A', NULL, 'NOW()', 'NOW()', 'NOW()', 'edu.harvard.i2b2.crc', 1);` + "\n"*/
 
 	encounterHive := `"` + strconv.FormatInt(id, 10) + `","HIVE","HIVE","` + strconv.FormatInt(id, 10) + `","` + sampleID + `","chuv","A",,"NOW()","NOW()","NOW()","edu.harvard.i2b2.crc","1"` + "\n"
 
-	_, err = FileHandlers[7].WriteString(encounterHive)
+	_, err = l.writeString(7, encounterHive)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataEncounterMapping()-Chuv:", err)
-		return err
+		return l.outputError(7, err)
 	}
 
 	return nil
 }
 
-func writeDemodataVisitDimension(idV, idP int64) error {
+func (l *Loader) writeDemodataVisitDimension(idV, idP int64) error {
 
 	/*visit := `INSERT INTO i2b2demodata.visit_dimension VALUES (` + strconv.FormatInt(idV, 10) + `, ` + strconv.FormatInt(idP, 10) + `, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, NULL, 'NOW()', 'chuv', 1);` + "\n"*/
 
 	visit := `"` + strconv.FormatInt(idV, 10) + `","` + strconv.FormatInt(idP, 10) + `",,,,,,,,,,,"NOW()","chuv","1"` + "\n"
 
-	_, err := FileHandlers[8].WriteString(visit)
+	_, err := l.writeString(8, visit)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataVisitDimension():", err)
-		return err
+		return l.outputError(8, err)
 	}
 
 	return nil
 }
 
-func writeDemodataProviderDimension() error {
+func (l *Loader) writeDemodataProviderDimension() error {
 
 	/*provider := `INSERT INTO i2b2demodata.provider_dimension VALUES ('chuv', '\medco\institutions\chuv\', 'chuv', NULL, NULL, NULL, 'NOW()', NULL, 1);` + "\n"*/
 
 	provider := `"chuv","\medco\institutions\chuv\","chuv",,,,"NOW()",,"1"` + "\n"
 
-	_, err := FileHandlers[9].WriteString(provider)
+	_, err := l.writeString(9, provider)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodateProviderDimension():", err)
-		return err
+		return l.outputError(9, err)
 	}
 
 	return nil
 }
 
-func writeDemodataObservationFactClear(el, idP, idV int64) error {
+func (l *Loader) writeDemodataObservationFactClear(el, idP, idV int64) error {
 
 	/*clear := `INSERT INTO i2b2demodata.observation_fact VALUES (` + strconv.FormatInt(idP, 10) + `, ` + strconv.FormatInt(idV, 10), 10) + `,
 	'CLEAR:` + strconv.FormatInt(el, 10) + `', 'chuv', 'NOW()', '@', 1, NULL, NULL, NULL, NULL, NULL, NULL, NULL,
-	'chuv', NULL, NULL, NULL, NULL, 'NOW()', NULL, 1, ` + strconv.FormatInt(TextSearchIndex, 10) + `);` + "\n"*/
+	'chuv', NULL, NULL, NULL, NULL, 'NOW()', NULL, 1, ` + strconv.FormatInt(l.TextSearchIndex, 10) + `);` + "\n"*/
 
-	clear := `"` + strconv.FormatInt(idP, 10) + `","` + strconv.FormatInt(idV, 10) + `","CLEAR:` + strconv.FormatInt(el, 10) + `","chuv","NOW()","@","1",,,,,,,,"chuv",,,,,"NOW()",,"1","` + strconv.FormatInt(TextSearchIndex, 10) + `"` + "\n"
+	clear := `"` + strconv.FormatInt(idP, 10) + `","` + strconv.FormatInt(idV, 10) + `","CLEAR:` + strconv.FormatInt(el, 10) + `","chuv","NOW()","@","1",,,,,,,,"chuv",,,,,"NOW()",,"1","` + strconv.FormatInt(l.TextSearchIndex, 10) + `"` + "\n"
 
-	_, err := FileHandlers[10].WriteString(clear)
+	_, err := l.writeString(10, clear)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataObservationFactClear():", err)
-		return err
+		return l.outputError(10, err)
 	}
 
-	TextSearchIndex++
+	l.TextSearchIndex++
 
 	return nil
 }
 
-func writeDemodataObservationFactEnc(el int64, idP, idV int64) error {
+func (l *Loader) writeDemodataObservationFactEnc(el int64, idP, idV int64) error {
 
 	/*encrypted := `INSERT INTO i2b2demodata.observation_fact VALUES (` + strconv.FormatInt(idP, 10) + `, ` + strconv.FormatInt(idV, 10) + `, 'TAG_ID:` + strconv.FormatInt(el, 10) + `',
-	'chuv', 'NOW()', '@', 1, NULL, NULL, NULL, NULL, NULL, NULL, NULL, 'chuv', NULL, NULL, NULL, NULL, 'NOW()', NULL, 1, ` + strconv.FormatInt(TextSearchIndex, 10) + `);` + "\n"*/
+	'chuv', 'NOW()', '@', 1, NULL, NULL, NULL, NULL, NULL, NULL, NULL, 'chuv', NULL, NULL, NULL, NULL, 'NOW()', NULL, 1, ` + strconv.FormatInt(l.TextSearchIndex, 10) + `);` + "\n"*/
 
-	encrypted := `"` + strconv.FormatInt(idP, 10) + `","` + strconv.FormatInt(idV, 10) + `","TAG_ID:` + strconv.FormatInt(el, 10) + `","chuv","NOW()","@","` + strconv.FormatInt(TextSearchIndex, 10) + `",,,,,,,,"chuv",,,,,"NOW()",,"1","` + strconv.FormatInt(TextSearchIndex, 10) + `"` + "\n"
+	encrypted := `"` + strconv.FormatInt(idP, 10) + `","` + strconv.FormatInt(idV, 10) + `","TAG_ID:` + strconv.FormatInt(el, 10) + `","chuv","NOW()","@","` + strconv.FormatInt(l.TextSearchIndex, 10) + `",,,,,,,,"chuv",,,,,"NOW()",,"1","` + strconv.FormatInt(l.TextSearchIndex, 10) + `"` + "\n"
 
-	_, err := FileHandlers[10].WriteString(encrypted)
+	_, err := l.writeString(10, encrypted)
 
 	if err != nil {
-		log.Fatal("Error in the writeDemodataObservationFactEnc():", err)
-		return err
+		return l.outputError(10, err)
 	}
 
-	TextSearchIndex++
+	l.TextSearchIndex++
 
 	return nil
 
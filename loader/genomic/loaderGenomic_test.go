@@ -2,6 +2,7 @@ package loadergenomic_test
 
 import (
 	"encoding/base64"
+	"errors"
 	"github.com/ldsec/medco-loader/loader"
 	"github.com/ldsec/medco-loader/loader/genomic"
 	"github.com/ldsec/unlynx/lib"
@@ -9,7 +10,10 @@ import (
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -69,46 +73,43 @@ func getRoster(groupFilePath string) (*onet.Roster, *onet.LocalTest, error) {
 	}
 }
 
-func generateFiles(t *testing.T, el *onet.Roster, entryPointIdx int) {
-	log.SetDebugVisible(1)
+// setupData copies the test dataset (testdata/) in a temporary folder used as the DefaultDataPath of the test
+func setupData(t *testing.T) {
+	dir := t.TempDir()
+	err := filepath.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, strings.TrimPrefix(path, "testdata"))
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, content, 0600)
+	})
+	assert.Nil(t, err)
+
+	dataPath := DefaultDataPath
+	DefaultDataPath = dir + "/"
+	t.Cleanup(func() { DefaultDataPath = dataPath })
+}
 
-	clinicalOntology = DefaultDataPath + clinicalOntology
-	genomicOntology = DefaultDataPath + genomicOntology
+var dbSettings = loader.DBSettings{DBhost: "localhost", DBport: 5434, DBname: "medcodeployment", DBuser: "postgres", DBpassword: "prigen2017"}
 
-	fOntologyClinical, err := os.Open(clinicalOntology)
+func newLoader(t *testing.T, el *onet.Roster, entryPointIdx int) *loadergenomic.Loader {
+	fOntologyClinical, err := os.Open(DefaultDataPath + clinicalOntology)
 	assert.True(t, err == nil, err)
-	fOntologyGenomic, err := os.Open(genomicOntology)
+	fOntologyGenomic, err := os.Open(DefaultDataPath + genomicOntology)
 	assert.True(t, err == nil, err)
 
-	clinicalFile = DefaultDataPath + clinicalFile
-	genomicFile = DefaultDataPath + genomicFile
-
-	fClinical, err := os.Open(clinicalFile)
+	fClinical, err := os.Open(DefaultDataPath + clinicalFile)
 	assert.True(t, err == nil, err)
-	fGenomic, err := os.Open(genomicFile)
+	fGenomic, err := os.Open(DefaultDataPath + genomicFile)
 	assert.True(t, err == nil, err)
 
-	// init global variables
-	loadergenomic.FileHandlers = make([]*os.File, 0)
-	loadergenomic.Testing = true
-	loadergenomic.OntValues = make(map[loadergenomic.ConceptPath]loadergenomic.ConceptID)
-	loadergenomic.TextSearchIndex = int64(1)
-	loadergenomic.OutputFilePath = DefaultDataPath + "genomic/"
-
-	for i := range loadergenomic.FilePathsOntology {
-		loadergenomic.FilePathsOntology[i] = loadergenomic.OutputFilePath + loadergenomic.FilePathsOntology[i]
-		fp, err := os.Create(loadergenomic.FilePathsOntology[i])
-		assert.True(t, err == nil, err)
-		loadergenomic.FileHandlers = append(loadergenomic.FileHandlers, fp)
-	}
-
-	for i := range loadergenomic.FilePathsData {
-		loadergenomic.FilePathsData[i] = loadergenomic.OutputFilePath + loadergenomic.FilePathsData[i]
-		fp, err := os.Create(loadergenomic.FilePathsData[i])
-		assert.True(t, err == nil, err)
-		loadergenomic.FileHandlers = append(loadergenomic.FileHandlers, fp)
-	}
-
 	mapSensitive := make(map[string]struct{}, 2) // DO NOT FORGET!! to modify the '11' value depending on the number of sensitive attributes
 	/*mapSensitive["AJCC_PATHOLOGIC_TUMOR_STAGE"] = struct{}{}
 	mapSensitive["CANCER_TYPE"] = struct{}{}
@@ -122,23 +123,40 @@ func generateFiles(t *testing.T, el *onet.Roster, entryPointIdx int) {
 	mapSensitive["VITAL_STATUS"] = struct{}{}
 	mapSensitive["CLIN_M_STAGE"] = struct{}{}*/
 
-	loadergenomic.AllSensitive = true
-
-	err = loadergenomic.GenerateOntologyFiles(el, entryPointIdx, fOntologyClinical, fOntologyGenomic, mapSensitive)
+	l, err := loadergenomic.NewLoader(loadergenomic.Options{
+		Roster:              el,
+		EntryPointIdx:       entryPointIdx,
+		Testing:             true,
+		OntClinical:         fOntologyClinical,
+		OntGenomic:          fOntologyGenomic,
+		Clinical:            fClinical,
+		Genomic:             fGenomic,
+		OutputPath:          DefaultDataPath + "genomic/",
+		AllSensitive:        true,
+		SensitiveAttributes: mapSensitive,
+		I2B2DB:              dbSettings,
+		GaDB:                dbSettings,
+		Assembly:            "GRCh37",
+	})
 	assert.True(t, err == nil, err)
+	return l
+}
 
-	err = loadergenomic.GenerateDataFiles(el, fClinical, fGenomic)
+func generateFiles(t *testing.T, el *onet.Roster, entryPointIdx int) {
+	log.SetDebugVisible(1)
+
+	l := newLoader(t, el, entryPointIdx)
+
+	err := l.CreateOutputFiles()
 	assert.True(t, err == nil, err)
 
-	for _, f := range loadergenomic.FileHandlers {
-		f.Close()
-	}
+	err = l.GenerateOntologyFiles()
+	assert.True(t, err == nil, err)
 
-	fClinical.Close()
-	fGenomic.Close()
+	err = l.GenerateDataFiles()
+	assert.True(t, err == nil, err)
 
-	fOntologyClinical.Close()
-	fOntologyGenomic.Close()
+	l.CloseOutputFiles()
 }
 
 func TestSanitizeHeader(t *testing.T) {
@@ -156,13 +174,64 @@ func TestSanitizeHeader(t *testing.T) {
 }
 
 func TestGenerateFilesLocalTest(t *testing.T) {
+	setupData(t)
 	el, local, err := getRoster("")
 	assert.True(t, err == nil, err)
 	generateFiles(t, el, 0)
 	local.CloseAll()
 }
 
+func TestMissingOntologyElement(t *testing.T) {
+	setupData(t)
+	el, local, err := getRoster("")
+	assert.True(t, err == nil, err)
+	defer local.CloseAll()
+
+	output, err := ioutil.TempDir(DefaultDataPath+"genomic", "converted_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(output)
+
+	// the dataset has a cancer type (on line 10) that is not in the ontology
+	content, err := ioutil.ReadFile(DefaultDataPath + clinicalFile)
+	assert.Nil(t, err)
+	content = append(content, []byte("TCGA-09\tTCGA-09-01\tUnknown\t48\tLIVING\n")...)
+	assert.Nil(t, ioutil.WriteFile(output+"/clinical.csv", content, 0644))
+
+	opts := loadergenomic.Options{Roster: el, Testing: true, Assembly: "GRCh37", OutputPath: output + "/", AllSensitive: true}
+	for _, f := range []struct {
+		file **os.File
+		path string
+	}{
+		{&opts.OntClinical, DefaultDataPath + clinicalOntology},
+		{&opts.OntGenomic, DefaultDataPath + genomicOntology},
+		{&opts.Clinical, output + "/clinical.csv"},
+		{&opts.Genomic, DefaultDataPath + genomicFile},
+	} {
+		*f.file, err = os.Open(f.path)
+		assert.Nil(t, err)
+	}
+
+	l, err := loadergenomic.NewLoader(opts)
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.CreateOutputFiles())
+	defer l.CloseOutputFiles()
+	assert.Nil(t, l.GenerateOntologyFiles())
+
+	err = l.GenerateDataFiles()
+	var e *loader.Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, loader.ErrMissingOntologyElement, e.Kind)
+	assert.Equal(t, output+"/clinical.csv", e.Path)
+	assert.Equal(t, int64(10), e.Line)
+
+	// missing input file
+	err = loadergenomic.ReplayDataset(output+"/missing.csv", 2)
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+}
+
 func TestGeneratePubKey(t *testing.T) {
+	setupData(t)
 	el, _, err := getRoster(DefaultDataPath + "genomic/group.toml")
 	assert.True(t, err == nil, err)
 
@@ -183,20 +252,194 @@ func TestGenerateFilesGroupFile(t *testing.T) {
 
 func TestReplayDataset(t *testing.T) {
 	t.Skip()
-	err := loadergenomic.ReplayDataset(genomicFile, 2)
+	err := loadergenomic.ReplayDataset(DefaultDataPath+genomicFile, 2)
 	assert.True(t, err == nil)
 }
 
-func TestGenerateLoadingScript(t *testing.T) {
-	dbSettings := loader.DBSettings{DBhost: "localhost", DBport: 5434, DBname: "medcodeployment", DBuser: "postgres", DBpassword: "prigen2017"}
-	err := loadergenomic.GenerateLoadingOntologyScript(dbSettings, dbSettings)
-	assert.True(t, err == nil)
-	err = loadergenomic.GenerateLoadingDataScript(dbSettings)
-	assert.True(t, err == nil)
+func TestNewLoader(t *testing.T) {
+	// the output paths must not depend on the loaders created before
+	for i := 0; i < 2; i++ {
+		l, err := loadergenomic.NewLoader(loadergenomic.Options{Assembly: "GRCh37", OutputPath: DefaultDataPath + "genomic/"})
+		assert.Nil(t, err)
+		assert.Equal(t, DefaultDataPath+"genomic/"+loadergenomic.FileNamesOntology[0], l.FilePathsOntology[0])
+		assert.Equal(t, DefaultDataPath+"genomic/"+loadergenomic.FileNamesData[6], l.FilePathsData[6])
+	}
+
+	l, err := loadergenomic.NewLoader(loadergenomic.Options{Assembly: "hg38"})
+	assert.Nil(t, err)
+	assert.Equal(t, "GRCh38", l.Assembly)
+
+	_, err = loadergenomic.NewLoader(loadergenomic.Options{OutputPath: DefaultDataPath + "genomic/"})
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+}
+
+func TestAssemblyMismatch(t *testing.T) {
+	setupData(t)
+	el, local, err := getRoster("")
+	assert.True(t, err == nil, err)
+	defer local.CloseAll()
+
+	output, err := ioutil.TempDir(DefaultDataPath+"genomic", "converted_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(output)
+
+	// MAF file with an NCBI_Build column and VCF file with a ##reference line, both of GRCh38
+	content, err := ioutil.ReadFile(DefaultDataPath + genomicOntology)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	lines[0] += "\tNCBI_Build"
+	for i := 1; i < len(lines); i++ {
+		lines[i] += "\tGRCh37"
+	}
+	lines[len(lines)-1] = strings.Replace(lines[len(lines)-1], "GRCh37", "GRCh38", 1)
+	content = []byte(strings.Join(lines, "\n") + "\n")
+	assert.Nil(t, ioutil.WriteFile(output+"/mutations.csv", content, 0644))
+	assert.Nil(t, ioutil.WriteFile(output+"/variants.vcf", []byte("##reference=GRCh38\n"+vcfFile[strings.Index(vcfFile, "#CHROM"):]), 0644))
+
+	for _, c := range []struct {
+		format, path string
+		line         int64
+	}{
+		{loadergenomic.FormatMAF, output + "/mutations.csv", int64(len(lines))},
+		{loadergenomic.FormatVCF, output + "/variants.vcf", 0},
+	} {
+		opts := loadergenomic.Options{Roster: el, Testing: true, Assembly: "GRCh37", OutputPath: output + "/", AllSensitive: true, GenomicFormat: c.format}
+		opts.OntClinical, err = os.Open(DefaultDataPath + clinicalOntology)
+		assert.Nil(t, err)
+		opts.OntGenomic, err = os.Open(c.path)
+		assert.Nil(t, err)
+
+		l, err := loadergenomic.NewLoader(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, l.CreateOutputFiles())
+
+		err = l.GenerateOntologyFiles()
+		var e *loader.Error
+		assert.True(t, errors.As(err, &e), c.format)
+		assert.Equal(t, loader.ErrInputFormat, e.Kind)
+		assert.Equal(t, c.path, e.Path)
+		assert.Equal(t, c.line, e.Line)
+		l.CloseOutputFiles()
+	}
+}
+
+func TestGenerateLoadingStatements(t *testing.T) {
+	l, err := loadergenomic.NewLoader(loadergenomic.Options{Assembly: "GRCh37", OutputPath: DefaultDataPath + "genomic/", I2B2DB: dbSettings, GaDB: dbSettings})
+	assert.Nil(t, err)
+
+	statements := l.GenerateLoadingOntologyStatements()
+	assert.Contains(t, statements, loader.CopyStatement(loadergenomic.TablenamesOntology[0], l.FilePathsOntology[0], false))
+	assert.Contains(t, statements[len(statements)-1].SQL, `OWNER TO "postgres"`)
+
+	statements = l.GenerateLoadingAnnotationsStatements()
+	assert.Contains(t, statements, loader.CopyStatement(loadergenomic.TablenamesOntology[2], l.FilePathsOntology[2], false))
+	// the assembly of the replaced annotations is emptied and recorded before loading the annotations
+	for i, s := range statements {
+		if s.Table == loadergenomic.ANNOTATIONS+"assembly" && !strings.HasPrefix(s.SQL, "TRUNCATE") {
+			assert.Equal(t, loader.TruncateStatement(loadergenomic.ANNOTATIONS+"assembly"), statements[i-1])
+			assert.NotContains(t, s.SQL, "RAISE EXCEPTION")
+			assert.Contains(t, s.SQL, `VALUES ('GRCh37')`)
+			assert.Equal(t, loader.TruncateStatement(loadergenomic.TablenamesOntology[2]), statements[i+1])
+		}
+	}
+	assert.NotContains(t, statements[len(statements)-1].SQL, `\$`)
+
+	statements = l.GenerateLoadingDataStatements()
+	assert.Equal(t, 2*len(loadergenomic.TablenamesData), len(statements))
+	for i, table := range loadergenomic.TablenamesData {
+		assert.Equal(t, loader.TruncateStatement(table), statements[2*i])
+		assert.Equal(t, loader.CopyStatement(table, l.FilePathsData[i], false), statements[2*i+1])
+	}
+
+	// nothing is truncated when appending
+	l.Append = true
+	statements = append(l.GenerateLoadingOntologyStatements(), l.GenerateLoadingAnnotationsStatements()...)
+	statements = append(statements, l.GenerateLoadingDataStatements()...)
+	for _, table := range append(loadergenomic.TablenamesOntology[:], loadergenomic.TablenamesData[:]...) {
+		assert.NotContains(t, statements, loader.TruncateStatement(table))
+	}
+	assert.NotContains(t, statements, loader.TruncateStatement(loadergenomic.ANNOTATIONS+"assembly"))
+	// the assembly of the annotations appended to is checked
+	for _, s := range statements {
+		if s.Table == loadergenomic.ANNOTATIONS+"assembly" {
+			assert.Contains(t, s.SQL, `<> 'GRCh37'`)
+		}
+	}
+	assert.Contains(t, statements, loader.CopyStatement(loadergenomic.TablenamesData[6], l.FilePathsData[6], false))
 }
 
 func TestLoadDataFiles(t *testing.T) {
 	t.Skip()
-	err := loadergenomic.LoadDataFiles()
+	l, err := loadergenomic.NewLoader(loadergenomic.Options{Assembly: "GRCh37", OutputPath: DefaultDataPath + "genomic/", I2B2DB: dbSettings})
+	assert.Nil(t, err)
+	err = l.LoadDataFiles()
 	assert.True(t, err == nil)
 }
+
+func TestWriteLoadingSummary(t *testing.T) {
+	setupData(t)
+	el, local, err := getRoster("")
+	assert.True(t, err == nil, err)
+	generateFiles(t, el, 0)
+	local.CloseAll()
+
+	l, err := loadergenomic.NewLoader(loadergenomic.Options{Assembly: "GRCh37", OutputPath: DefaultDataPath + "genomic/", I2B2DB: dbSettings, GaDB: dbSettings})
+	assert.Nil(t, err)
+	assert.Nil(t, l.WriteLoadingSummary())
+
+	summary, err := ioutil.ReadFile(l.OutputPath + loadergenomic.FileNameSummary)
+	assert.Nil(t, err)
+	assert.Contains(t, string(summary), "TRUNCATE "+loadergenomic.TablenamesData[6]+"\n")
+	assert.Contains(t, string(summary), "LOAD     "+loadergenomic.TablenamesData[6]+" <- "+l.FilePathsData[6])
+}
+
+func TestSensitivityPolicy(t *testing.T) {
+	setupData(t)
+	el, local, err := getRoster("")
+	assert.True(t, err == nil, err)
+	defer local.CloseAll()
+
+	output, err := ioutil.TempDir(DefaultDataPath+"genomic", "converted_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(output)
+
+	// only the melanomas are sensitive among the cancer types
+	policy := &loader.Policy{Rules: []loader.Rule{
+		{Name: "melanoma", Fields: []string{"CANCER_TYPE"}, Values: []string{"Melanoma"}},
+		{Name: "status", Fields: []string{"*_STATUS"}},
+	}}
+	opts := loadergenomic.Options{Roster: el, Testing: true, Assembly: "GRCh37", OutputPath: output + "/", Policy: policy}
+	for _, f := range []struct {
+		file **os.File
+		path string
+	}{
+		{&opts.OntClinical, DefaultDataPath + clinicalOntology},
+		{&opts.OntGenomic, DefaultDataPath + genomicOntology},
+		{&opts.Clinical, DefaultDataPath + clinicalFile},
+		{&opts.Genomic, DefaultDataPath + genomicFile},
+	} {
+		*f.file, err = os.Open(f.path)
+		assert.Nil(t, err)
+	}
+
+	l, err := loadergenomic.NewLoader(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, l.CreateOutputFiles())
+	assert.Nil(t, l.GenerateOntologyFiles())
+	assert.Nil(t, l.GenerateDataFiles())
+	l.CloseOutputFiles()
+
+	assert.True(t, l.SensitivityDecisions["CANCER_TYPE"].Partial)
+	assert.True(t, l.SensitivityDecisions["VITAL_STATUS"].Sensitive)
+	assert.False(t, l.SensitivityDecisions["AGE"].Sensitive)
+
+	sensitive, err := ioutil.ReadFile(output + "/" + loadergenomic.FileNamesOntology[0])
+	assert.Nil(t, err)
+	clear, err := ioutil.ReadFile(output + "/" + loadergenomic.FileNamesOntology[1])
+	assert.Nil(t, err)
+	assert.Contains(t, string(sensitive), `\medco\clinical\sensitive\Cancer Type\Melanoma\`)
+	assert.Contains(t, string(clear), `\medco\clinical\nonsensitive\Cancer Type\Lung\`)
+	assert.NotContains(t, string(sensitive), `\Cancer Type\Lung\`)
+	assert.Contains(t, string(sensitive), `\medco\clinical\sensitive\Vital Status\`)
+	assert.Contains(t, string(clear), `\medco\clinical\nonsensitive\Age\`)
+}
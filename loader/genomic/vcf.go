@@ -0,0 +1,378 @@
+package loadergenomic
+
+import (
+	"bufio"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/identifiers"
+	"go.dedis.ch/onet/v3/log"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The genomic formats supported by the loader
+const (
+	// FormatMAF is the cBioPortal mutation annotation format (one tab-separated line per sample and variant, see TranslationDic)
+	FormatMAF = "maf"
+	// FormatVCF is the variant call format (one line per variant with the genotypes of all samples)
+	FormatVCF = "vcf"
+)
+
+// VCFAnnotationsToQuery defines the INFO fields of a VCF file that fill the columns of the genomic annotations table
+// which can be queried
+var VCFAnnotationsToQuery = map[string]string{
+	"PROTEIN_CHANGE":    "protein_change",
+	"MA:protein.change": "protein_change",
+	"HUGO_GENE_SYMBOL":  "hugo_gene_symbol",
+	"Hugo_Symbol":       "hugo_gene_symbol",
+	"GENE":              "hugo_gene_symbol",
+}
+
+// VCFVariant is an alternate allele of a line of a VCF file
+type VCFVariant struct {
+	Chromosome string
+	Position   int64
+	Ref        string
+	Alt        string
+	// the INFO fields (KEY=VALUE or KEY for the flags) in the order of the file
+	Info []string
+	// the samples that carry the alternate allele and their zygosity (Homozygous or Heterozygous)
+	Samples  []string
+	Zygosity []string
+}
+
+// VCFReader reads the variants of a multi-sample VCF file
+type VCFReader struct {
+	reader *bufio.Reader
+	path   string
+	// Samples are the names of the samples (the columns after FORMAT)
+	Samples []string
+	// Reference is the reference genome declared by the ##reference (or ##assembly) meta-information line, if any
+	Reference string
+	// Line is the number of the last line read
+	Line int64
+}
+
+// NewVCFReader creates a reader of the VCF file path (the meta-information and header lines are read)
+func NewVCFReader(r io.Reader, path string) (*VCFReader, error) {
+	vr := &VCFReader{reader: bufio.NewReader(r), path: path}
+
+	for {
+		line, err := vr.readLine()
+		if err == io.EOF {
+			return nil, vr.inputError(errors.New("missing #CHROM header"))
+		} else if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(line, "##reference=") || strings.HasPrefix(line, "##assembly=") {
+			vr.Reference = line[strings.Index(line, "=")+1:]
+		}
+		if strings.HasPrefix(line, "##") {
+			continue
+		}
+		if !strings.HasPrefix(line, "#CHROM") {
+			return nil, vr.inputError(errors.New("missing #CHROM header"))
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) > 9 {
+			vr.Samples = fields[9:]
+		}
+		return vr, nil
+	}
+}
+
+// Read returns the variants (one per alternate allele) of the next line, io.EOF at the end of the file
+func (vr *VCFReader) Read() ([]VCFVariant, error) {
+	line, err := vr.readLine()
+	for err == nil && line == "" {
+		line, err = vr.readLine()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// CHROM POS ID REF ALT QUAL FILTER INFO FORMAT samples...
+	fields := strings.Split(line, "\t")
+	if len(fields) < 8 || (len(vr.Samples) > 0 && len(fields) != 9+len(vr.Samples)) {
+		return nil, vr.inputError(errors.New("expected " + strconv.Itoa(9+len(vr.Samples)) + " fields, found " + strconv.Itoa(len(fields))))
+	}
+
+	pos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, vr.inputError(err)
+	}
+
+	info := make([]string, 0)
+	if fields[7] != "." {
+		info = strings.Split(fields[7], ";")
+	}
+
+	alts := strings.Split(fields[4], ",")
+	variants := make([]VCFVariant, len(alts))
+	for i, alt := range alts {
+		variants[i] = VCFVariant{Chromosome: NormalizeChromosome(fields[0]), Info: info, Samples: make([]string, 0), Zygosity: make([]string, 0)}
+		variants[i].Position, variants[i].Ref, variants[i].Alt = NormalizeAlleles(pos, fields[3], alt)
+	}
+
+	if len(vr.Samples) == 0 {
+		return variants, nil
+	}
+
+	gtIndex := -1
+	for i, key := range strings.Split(fields[8], ":") {
+		if key == "GT" {
+			gtIndex = i
+		}
+	}
+	if gtIndex < 0 {
+		return nil, vr.inputError(errors.New("missing GT field"))
+	}
+
+	for s, sample := range vr.Samples {
+		data := strings.Split(fields[9+s], ":")
+		if gtIndex >= len(data) {
+			continue
+		}
+
+		// the alleles of the genotype (e.g. 0/1 or 1|2), . if missing
+		alleles := strings.FieldsFunc(data[gtIndex], func(r rune) bool { return r == '/' || r == '|' })
+		for i := range alts {
+			carried := 0
+			for _, allele := range alleles {
+				if allele == strconv.Itoa(i+1) {
+					carried++
+				}
+			}
+			if carried == 0 {
+				continue
+			}
+
+			variants[i].Samples = append(variants[i].Samples, sample)
+			if carried == len(alleles) {
+				variants[i].Zygosity = append(variants[i].Zygosity, "Homozygous")
+			} else {
+				variants[i].Zygosity = append(variants[i].Zygosity, "Heterozygous")
+			}
+		}
+	}
+
+	return variants, nil
+}
+
+// readLine reads the next line of the file (without the end of line)
+func (vr *VCFReader) readLine() (string, error) {
+	line, err := vr.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	} else if err == io.EOF {
+		return "", err
+	} else if err != nil {
+		return "", loader.NewInputError(vr.path, err)
+	}
+	vr.Line++
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (vr *VCFReader) inputError(err error) error {
+	return loader.NewError(loader.ErrInputFormat, err).InFile(vr.path, vr.Line)
+}
+
+// NormalizeChromosome converts the name of a chromosome of a VCF file (e.g. chr1, chrX or MT) to the notation of the
+// variant identifiers (1, X or M)
+func NormalizeChromosome(chromosome string) string {
+	chromosome = strings.TrimPrefix(strings.TrimPrefix(chromosome, "chr"), "Chr")
+	if chromosome == "MT" {
+		return "M"
+	}
+	return chromosome
+}
+
+// NormalizeAlleles converts an allele of a VCF file to the notation of the MAF files: the bases shared by the reference
+// and alternate alleles (the padding base of the indels) are removed and an empty allele is written -. The position of
+// the deletions and substitutions is moved to their first base, the one of the insertions stays on the preceding base.
+func NormalizeAlleles(position int64, ref, alt string) (int64, string, string) {
+	trimmed := 0
+	for trimmed < len(ref) && trimmed < len(alt) && ref[trimmed] == alt[trimmed] {
+		trimmed++
+	}
+	ref, alt = ref[trimmed:], alt[trimmed:]
+
+	if ref == "" {
+		ref = "-"
+		if trimmed > 0 {
+			position += int64(trimmed - 1)
+		}
+	} else {
+		position += int64(trimmed)
+	}
+	if alt == "" {
+		alt = "-"
+	}
+	return position, ref, alt
+}
+
+// newVCFReader creates a reader of a VCF file of the loader and checks its reference genome (the references which are
+// not a known assembly, e.g. the path of a FASTA file, are not checked)
+func (l *Loader) newVCFReader(file *os.File) (*VCFReader, error) {
+	reader, err := NewVCFReader(file, file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if assembly, err := identifiers.NormalizeAssembly(reader.Reference); err == nil && assembly != l.Assembly {
+		return nil, loader.NewError(loader.ErrInputFormat, errors.New("reference "+reader.Reference+" in a dataset of assembly "+l.Assembly)).InFile(file.Name(), 0)
+	}
+	return reader, nil
+}
+
+// parseVCFOntology adds the variants of the genomic ontology (VCF) to the sensitive IDs
+func (l *Loader) parseVCFOntology(allSensitiveIDs map[int64]SensitiveIDValue) error {
+	reader, err := l.newVCFReader(l.OntGenomic)
+	if err != nil {
+		return err
+	}
+
+	discarded := 0
+	for {
+		variants, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// for every 100,000 rows parsed print a message
+		if reader.Line%100000 == 0 {
+			log.LLvl1("Continuing parsing the genomic ontology... (", reader.Line, ")")
+		}
+
+		for _, variant := range variants {
+			// as for the MAF files, the variants that cannot be encoded (e.g. on an unknown chromosome) are discarded
+			genomicID, err := l.variantIDs.GetVariantID(variant.Chromosome, variant.Position, variant.Ref, variant.Alt)
+			if errors.Is(err, identifiers.ErrIDCollision) || errors.Is(err, identifiers.ErrMissingAllelesKey) {
+				return err.(*loader.Error).InFile(l.OntGenomic.Name(), reader.Line)
+			} else if err != nil {
+				discarded++
+				continue
+			}
+
+			// if genomic id already exist we don't need to add it to the medco_ont.genomic_annotations
+			if _, ok := allSensitiveIDs[genomicID]; ok == false {
+				allSensitiveIDs[genomicID] = l.sensitiveVariant(genomicID, generateVCFGenomicAnnotation(variant))
+			}
+		}
+	}
+
+	if discarded > 0 {
+		log.Warn("Discarded", discarded, "variants of the genomic ontology that cannot be encoded")
+	}
+
+	return nil
+}
+
+// generateVCFObservations writes the observations of the genomic dataset (VCF): one per sample carrying a variant
+func (l *Loader) generateVCFObservations(sampleToPatient map[string]string, patientMapping, visitMapping map[string]int64, ontValuesSmallCopy map[ConceptPath]bool) error {
+	reader, err := l.newVCFReader(l.Genomic)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range reader.Samples {
+		if _, ok := sampleToPatient[sample]; ok == false {
+			return loader.NewError(loader.ErrInputFormat, errors.New("sample "+sample+" is not in the clinical dataset")).InFile(l.Genomic.Name(), reader.Line)
+		}
+	}
+
+	for {
+		variants, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		for _, variant := range variants {
+			genomicID, err := l.variantIDs.GetVariantID(variant.Chromosome, variant.Position, variant.Ref, variant.Alt)
+			if errors.Is(err, identifiers.ErrIDCollision) || errors.Is(err, identifiers.ErrMissingAllelesKey) {
+				return err.(*loader.Error).InFile(l.Genomic.Name(), reader.Line)
+			} else if err != nil || len(variant.Samples) == 0 {
+				continue
+			}
+
+			cp := ConceptPath{Field: strconv.FormatInt(genomicID, 10), Record: ""}
+			// check if it exists in the ontology
+			if _, ok := l.OntValues[cp]; ok == false {
+				return loader.NewError(loader.ErrMissingOntologyElement, errors.New("genomic variant "+cp.Field)).InFile(l.Genomic.Name(), reader.Line)
+			}
+
+			// if concept path does not exist
+			if _, ok := ontValuesSmallCopy[cp]; ok == false {
+				if err := l.writeDemodataConceptDimensionTaggedConcepts(cp.Field, ""); err != nil {
+					return err
+				}
+				ontValuesSmallCopy[cp] = true
+			}
+
+			for _, sample := range variant.Samples {
+				if err := l.writeDemodataObservationFactEnc(l.OntValues[cp].Value,
+					patientMapping[sampleToPatient[sample]],
+					visitMapping[sample]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// generateVCFGenomicAnnotation generates the annotation of a variant in the same layout as
+// generateMedCoOntologyGenomicAnnotation: the variant name, the annotations to be queried and the zygosity (of the samples
+// carrying the variant) followed by the INFO fields
+func generateVCFGenomicAnnotation(variant VCFVariant) string {
+	ra, alt := variant.Ref, variant.Alt
+	if ra == "-" {
+		ra = "?"
+	}
+	if alt == "-" {
+		alt = "?"
+	}
+
+	queryFields := map[string]string{"protein_change": "", "hugo_gene_symbol": ""}
+	otherFields := make([]string, 0)
+	for _, field := range variant.Info {
+		tokens := strings.SplitN(field, "=", 2)
+		if column, ok := VCFAnnotationsToQuery[tokens[0]]; ok == true && len(tokens) == 2 {
+			queryFields[column] = tokens[1]
+		} else {
+			otherFields = append(otherFields, SanitizeHeader(tokens[0])+strings.TrimPrefix(field, tokens[0]))
+		}
+	}
+
+	zygosity := make([]string, 0)
+	for _, z := range []string{"Heterozygous", "Homozygous"} {
+		for _, el := range variant.Zygosity {
+			if el == z {
+				zygosity = append(zygosity, z)
+				break
+			}
+		}
+	}
+	if len(zygosity) == 0 {
+		zygosity = append(zygosity, "Unknown")
+	}
+
+	annotations := strings.Join(append(zygosity, otherFields...), ";")
+	return `"` + variant.Chromosome + `:` + strconv.FormatInt(variant.Position, 10) + `:` + ra + `>` + alt + `","` +
+		escapeCSV(queryFields["protein_change"]) + `","` + escapeCSV(queryFields["hugo_gene_symbol"]) + `","` +
+		escapeCSV(annotations) + `"` + "\n"
+}
+
+// escapeCSV escapes the double quotes of a quoted .csv field
+func escapeCSV(field string) string {
+	return strings.Replace(field, `"`, `""`, -1)
+}
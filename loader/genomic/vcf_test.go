@@ -0,0 +1,148 @@
+package loadergenomic_test
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/genomic"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var vcfFile = `##fileformat=VCFv4.2
+##INFO=<ID=GENE,Number=1,Type=String,Description="Gene">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	TCGA-01-01	TCGA-02-01	TCGA-03-01
+chr1	100	.	A	G,T	50	PASS	GENE=BRAF;PROTEIN_CHANGE=V600E;DP=12	GT:DP	0/1:3	1|1:4	1/2:5
+chrMT	200	rs1	ACT	A	50	PASS	.	GT	0/0	./.	0/1
+2	300	.	C	CGG	50	PASS	SOMATIC	GT	1/1	0/0	0/0
+3	400	.	G	GACGTACGTAC	50	PASS	.	GT	0/0	0/1	0/0
+`
+
+func TestVCFReader(t *testing.T) {
+	reader, err := loadergenomic.NewVCFReader(strings.NewReader(vcfFile), "test.vcf")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"TCGA-01-01", "TCGA-02-01", "TCGA-03-01"}, reader.Samples)
+
+	// multi-allelic line
+	variants, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(variants))
+	assert.Equal(t, loadergenomic.VCFVariant{Chromosome: "1", Position: 100, Ref: "A", Alt: "G",
+		Info:     []string{"GENE=BRAF", "PROTEIN_CHANGE=V600E", "DP=12"},
+		Samples:  []string{"TCGA-01-01", "TCGA-02-01", "TCGA-03-01"},
+		Zygosity: []string{"Heterozygous", "Homozygous", "Heterozygous"}}, variants[0])
+	assert.Equal(t, "T", variants[1].Alt)
+	assert.Equal(t, []string{"TCGA-03-01"}, variants[1].Samples)
+
+	// deletion (the missing genotypes are skipped)
+	variants, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(variants))
+	assert.Equal(t, "M", variants[0].Chromosome)
+	assert.Equal(t, int64(201), variants[0].Position)
+	assert.Equal(t, "CT", variants[0].Ref)
+	assert.Equal(t, "-", variants[0].Alt)
+	assert.Equal(t, []string{"TCGA-03-01"}, variants[0].Samples)
+
+	// insertion
+	variants, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), variants[0].Position)
+	assert.Equal(t, "-", variants[0].Ref)
+	assert.Equal(t, "GG", variants[0].Alt)
+	assert.Equal(t, []string{"SOMATIC"}, variants[0].Info)
+	assert.Equal(t, []string{"Homozygous"}, variants[0].Zygosity)
+
+	// long insertion
+	variants, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "ACGTACGTAC", variants[0].Alt)
+
+	_, err = reader.Read()
+	assert.Equal(t, io.EOF, err)
+
+	// malformed files
+	_, err = loadergenomic.NewVCFReader(strings.NewReader("##fileformat=VCFv4.2\n"), "test.vcf")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+
+	reader, err = loadergenomic.NewVCFReader(strings.NewReader(strings.Replace(vcfFile, "\t1|1:4", "", 1)), "test.vcf")
+	assert.Nil(t, err)
+	_, err = reader.Read()
+	var e *loader.Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, int64(4), e.Line)
+}
+
+func TestNormalizeAlleles(t *testing.T) {
+	for _, c := range []struct {
+		pos           int64
+		ref, alt      string
+		expPos        int64
+		expRef, expAl string
+	}{
+		{100, "A", "G", 100, "A", "G"},
+		{100, "AC", "A", 101, "C", "-"},
+		{100, "A", "ATT", 100, "-", "TT"},
+		{100, "ACG", "ATG", 101, "CG", "TG"},
+	} {
+		pos, ref, alt := loadergenomic.NormalizeAlleles(c.pos, c.ref, c.alt)
+		assert.Equal(t, c.expPos, pos)
+		assert.Equal(t, c.expRef, ref)
+		assert.Equal(t, c.expAl, alt)
+	}
+
+	assert.Equal(t, "1", loadergenomic.NormalizeChromosome("chr1"))
+	assert.Equal(t, "X", loadergenomic.NormalizeChromosome("X"))
+	assert.Equal(t, "M", loadergenomic.NormalizeChromosome("chrMT"))
+}
+
+func TestGenerateFilesVCF(t *testing.T) {
+	setupData(t)
+	el, local, err := getRoster("")
+	assert.True(t, err == nil, err)
+	defer local.CloseAll()
+
+	output, err := ioutil.TempDir(DefaultDataPath+"genomic", "converted_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(output)
+	assert.Nil(t, ioutil.WriteFile(output+"/variants.vcf", []byte(vcfFile), 0644))
+
+	opts := loadergenomic.Options{Roster: el, Testing: true, Assembly: "GRCh37", OutputPath: output + "/", AllSensitive: true, GenomicFormat: loadergenomic.FormatVCF,
+		AllelesKey: []byte("site key")}
+	for _, f := range []struct {
+		file **os.File
+		path string
+	}{
+		{&opts.OntClinical, DefaultDataPath + clinicalOntology},
+		{&opts.OntGenomic, output + "/variants.vcf"},
+		{&opts.Clinical, DefaultDataPath + clinicalFile},
+		{&opts.Genomic, output + "/variants.vcf"},
+	} {
+		*f.file, err = os.Open(f.path)
+		assert.Nil(t, err)
+	}
+
+	l, err := loadergenomic.NewLoader(opts)
+	assert.Nil(t, err)
+
+	assert.Nil(t, l.CreateOutputFiles())
+	assert.Nil(t, l.GenerateOntologyFiles())
+	assert.Nil(t, l.GenerateDataFiles())
+	l.CloseOutputFiles()
+
+	annotations, err := ioutil.ReadFile(output + "/" + loadergenomic.FileNamesOntology[2])
+	assert.Nil(t, err)
+	assert.Contains(t, string(annotations), `"1:100:A>G","V600E","BRAF","Heterozygous;Homozygous;Dp=12"`)
+	assert.Contains(t, string(annotations), `"M:201:CT>?","","","Heterozygous"`)
+	assert.Contains(t, string(annotations), `"2:300:?>GG","","","Homozygous;Somatic"`)
+	// the long alleles are encoded as well
+	assert.Contains(t, string(annotations), `"3:400:?>ACGTACGTAC","","","Heterozygous"`)
+
+	// 7 genomic observations (1:100:A>G is carried by the 3 samples) after the 20 clinical ones
+	facts, err := ioutil.ReadFile(output + "/" + loadergenomic.FileNamesData[6])
+	assert.Nil(t, err)
+	assert.Equal(t, 7+20, len(strings.Split(strings.TrimSpace(string(facts)), "\n")))
+}
@@ -0,0 +1,70 @@
+package loaderi2b2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ldsec/medco-loader/loader"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// The phases of the loading recorded in the checkpoint (the tagging of the sensitive elements is recorded by
+// EncryptAndTag as it goes)
+const (
+	phaseConvert = "convert"
+	phaseLoad    = "load"
+)
+
+// openCheckpoint opens the checkpoint of the loading in the CheckpointDir. It is keyed to the aggregate key of the
+// collective authority, the input files and the settings that change the converted files.
+func (l *Loader) openCheckpoint() error {
+	keys := make([]string, 0, len(l.InputFilePaths))
+	for key := range l.InputFilePaths {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	inputs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		// the dummy_to_patient.csv is not read if the dummies are generated
+		if key == "DUMMY_TO_PATIENT" && l.Dummies > 0 {
+			continue
+		}
+		inputs = append(inputs, l.InputFilePaths[key])
+	}
+
+	key, err := loader.CheckpointKey(l.Roster.Aggregate, inputs,
+		l.Policy.String(), strconv.FormatBool(l.Empty), strconv.FormatBool(l.Delta),
+		strconv.Itoa(l.Dummies), strconv.Itoa(l.DummyClusters), string(l.DummyStrategy),
+		hashSecret(l.PermutationKey), hashSecret(l.MappingKey), l.MappingSchema)
+	if err != nil {
+		return err
+	}
+
+	l.checkpoint, err = loader.OpenCheckpoint(l.CheckpointDir, key, l.Resume)
+	return err
+}
+
+// convertedFiles returns the files written by the conversion (the converted files and the mapping files)
+func (l *Loader) convertedFiles() []string {
+	files := make([]string, 0, len(l.OutputFilePaths))
+	for file, fI := range l.OutputFilePaths {
+		if file == "LOADING_SUMMARY" {
+			continue
+		}
+		if _, err := os.Stat(fI.Path); err == nil {
+			files = append(files, fI.Path)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// hashSecret returns a hash of a secret that can be written in the checkpoint (empty if there is no secret)
+func hashSecret(secret []byte) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(secret)
+	return hex.EncodeToString(h[:])
+}
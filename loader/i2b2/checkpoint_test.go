@@ -0,0 +1,50 @@
+package loaderi2b2_test
+
+import (
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+
+	dir, err := ioutil.TempDir("", "checkpoint_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	load := func(resume bool) *loaderi2b2.Loader {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, AllSensitive: true, ConvertOnly: true,
+			CheckpointDir: dir, Resume: resume})
+		assert.Nil(t, err)
+		assert.Nil(t, l.Load())
+		return l
+	}
+	read := func(path string) string {
+		content, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		return string(content)
+	}
+
+	_, err = loaderi2b2.NewLoader(loaderi2b2.Options{Resume: true})
+	assert.NotNil(t, err)
+
+	l := load(false)
+	observations := read(l.OutputFilePaths["OBSERVATION_FACT"].Path)
+	assert.NotEmpty(t, read(filepath.Join(dir, "terms.csv")))
+
+	// the conversion is not done again (the patients would get other numbers)
+	load(true)
+	assert.Equal(t, observations, read(l.OutputFilePaths["OBSERVATION_FACT"].Path))
+
+	// a converted file changed: the conversion is done again but the sensitive concepts are not tagged again (the
+	// collective authority is not needed)
+	assert.Nil(t, ioutil.WriteFile(l.OutputFilePaths["OBSERVATION_FACT"].Path, []byte(observations+"\n"), 0644))
+	local.CloseAll()
+	load(true)
+	assert.NotEqual(t, observations+"\n", read(l.OutputFilePaths["OBSERVATION_FACT"].Path))
+}
@@ -0,0 +1,218 @@
+package loaderi2b2
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"strconv"
+	"strings"
+)
+
+// TaggedPath is the NodeEncryptID and TAG_ID of a sensitive concept or modifier
+type TaggedPath struct {
+	NodeEncryptID int64
+	TagID         int64
+}
+
+// State is what the previous loads left in the database and in the output folder, a delta load (see Options.Delta)
+// builds upon it: the patients, encounters, concepts and modifiers already loaded keep their numbers and TAG_IDs and
+// are not written (nor tagged) again, the new ones are numbered after the loaded ones.
+type State struct {
+	// PatientNums and EncounterNums are the (new) patient_num and encounter_num of the patient_dimension and
+	// visit_dimension
+	PatientNums   map[string]struct{}
+	EncounterNums map[string]struct{}
+	// ConceptPaths and ModifierPaths are the paths of the concept_dimension and modifier_dimension
+	ConceptPaths  map[string]struct{}
+	ModifierPaths map[string]struct{}
+	// TagIDs are the TAG_IDs of the sensitive_tagged table
+	TagIDs map[int64]struct{}
+
+	// MapNewPatientNum, MapNewEncounterNum, Concepts and Modifiers are read from the private files of the previous
+	// conversion (see ReadPreviousConversion), restricted to the elements that were actually loaded
+	MapNewPatientNum   map[string]string
+	MapNewEncounterNum map[VisitDimensionPK]VisitDimensionPK
+	Concepts           map[string]TaggedPath
+	Modifiers          map[string]TaggedPath
+
+	// the first values available for the new elements
+	NextPatientNum      int64
+	NextEncounterNum    int64
+	NextEncryptID       int64
+	NextTagID           int64
+	NextTextSearchIndex int64
+}
+
+// NewState creates the state of an empty database
+func NewState() *State {
+	return &State{
+		PatientNums:        make(map[string]struct{}),
+		EncounterNums:      make(map[string]struct{}),
+		ConceptPaths:       make(map[string]struct{}),
+		ModifierPaths:      make(map[string]struct{}),
+		TagIDs:             make(map[int64]struct{}),
+		MapNewPatientNum:   make(map[string]string),
+		MapNewEncounterNum: make(map[VisitDimensionPK]VisitDimensionPK),
+		Concepts:           make(map[string]TaggedPath),
+		Modifiers:          make(map[string]TaggedPath),
+	}
+}
+
+// ReadState reads the content of the i2b2 database (the elements of the previous loads)
+func ReadState(i2b2DB loader.DBSettings) (*State, error) {
+	s := NewState()
+
+	db, err := sql.Open("postgres", i2b2DB.ConnectionString())
+	if err != nil {
+		return nil, &loader.LoadError{Err: err}
+	}
+	defer db.Close()
+
+	// scanKey adds the first column of the rows to a set
+	scanKey := func(set map[string]struct{}) func(rows *sql.Rows) error {
+		return func(rows *sql.Rows) error {
+			var key string
+			err := rows.Scan(&key)
+			set[key] = struct{}{}
+			return err
+		}
+	}
+
+	queries := []struct {
+		table, query string
+		scan         func(rows *sql.Rows) error
+	}{
+		{I2B2DEMODATA + "patient_dimension", "SELECT patient_num FROM " + I2B2DEMODATA + "patient_dimension", scanKey(s.PatientNums)},
+		{I2B2DEMODATA + "patient_dimension", "SELECT COALESCE(MAX(patient_num) + 1, 0) FROM " + I2B2DEMODATA + "patient_dimension", func(rows *sql.Rows) error {
+			return rows.Scan(&s.NextPatientNum)
+		}},
+		{I2B2DEMODATA + "visit_dimension", "SELECT encounter_num FROM " + I2B2DEMODATA + "visit_dimension", scanKey(s.EncounterNums)},
+		{I2B2DEMODATA + "visit_dimension", "SELECT COALESCE(MAX(encounter_num) + 1, 0) FROM " + I2B2DEMODATA + "visit_dimension", func(rows *sql.Rows) error {
+			return rows.Scan(&s.NextEncounterNum)
+		}},
+		{I2B2DEMODATA + "concept_dimension", "SELECT concept_path FROM " + I2B2DEMODATA + "concept_dimension", scanKey(s.ConceptPaths)},
+		{I2B2DEMODATA + "modifier_dimension", "SELECT modifier_path FROM " + I2B2DEMODATA + "modifier_dimension", scanKey(s.ModifierPaths)},
+		{ONT + "sensitive_tagged", "SELECT c_basecode FROM " + ONT + "sensitive_tagged WHERE c_basecode LIKE 'TAG_ID:%'", func(rows *sql.Rows) error {
+			var basecode string
+			if err := rows.Scan(&basecode); err != nil {
+				return err
+			}
+			return s.AddTagID(basecode)
+		}},
+		{I2B2DEMODATA + "observation_fact", "SELECT COALESCE(MAX(text_search_index) + 1, 0) FROM " + I2B2DEMODATA + "observation_fact", func(rows *sql.Rows) error {
+			return rows.Scan(&s.NextTextSearchIndex)
+		}},
+	}
+	for _, q := range queries {
+		if err := loader.QueryRows(db, q.table, q.query, q.scan); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// AddTagID adds the TAG_ID of a row (c_basecode TAG_ID:<id>) of the sensitive_tagged table
+func (s *State) AddTagID(basecode string) error {
+	id, err := strconv.ParseInt(strings.TrimPrefix(basecode, "TAG_ID:"), 10, 64)
+	if err != nil {
+		return err
+	}
+	s.TagIDs[id] = struct{}{}
+	if id >= s.NextTagID {
+		s.NextTagID = id + 1
+	}
+	return nil
+}
+
+// ReadPreviousConversion reads the mappings of the previous conversion (see MappingFiles): the patient and encounter
+// mappings and the tagged paths. Only the elements loaded in the database are kept: the others are converted again.
+func (l *Loader) ReadPreviousConversion() error {
+	s := l.State
+
+	lines, err := l.readMapping("NEW_PATIENT_NUM")
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, ok := s.PatientNums[line[1]]; ok {
+			s.MapNewPatientNum[line[0]] = line[1]
+		}
+	}
+
+	if len(s.PatientNums) > 0 && len(s.MapNewPatientNum) == 0 {
+		return loader.NewError(loader.ErrInputFormat, errors.New("the mappings of the patients already loaded are missing"))
+	}
+
+	lines, err = l.readMapping("NEW_ENCOUNTER_NUM")
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, ok := s.EncounterNums[line[2]]; ok {
+			s.MapNewEncounterNum[VisitDimensionPK{EncounterNum: line[0], PatientNum: line[1]}] = VisitDimensionPK{EncounterNum: line[2], PatientNum: line[3]}
+		}
+	}
+
+	path := l.OutputFilePaths["TAGGED_PATHS"].Path
+	lines, err = l.readMapping("TAGGED_PATHS")
+	if err != nil {
+		return err
+	}
+	for i, line := range lines {
+		var tp TaggedPath
+		if tp.NodeEncryptID, err = strconv.ParseInt(line[2], 10, 64); err != nil {
+			return loader.NewError(loader.ErrInputFormat, err).InFile(path, int64(i+2))
+		}
+		if tp.TagID, err = strconv.ParseInt(line[3], 10, 64); err != nil {
+			return loader.NewError(loader.ErrInputFormat, err).InFile(path, int64(i+2))
+		}
+
+		// the NodeEncryptIDs of the elements that were not loaded are not reused either
+		if tp.NodeEncryptID >= s.NextEncryptID {
+			s.NextEncryptID = tp.NodeEncryptID + 1
+		}
+		if _, ok := s.TagIDs[tp.TagID]; !ok {
+			continue
+		}
+
+		switch line[0] {
+		case "concept":
+			s.Concepts[line[1]] = tp
+		case "modifier":
+			s.Modifiers[line[1]] = tp
+		default:
+			return loader.NewError(loader.ErrInputFormat, errors.New("unknown type "+strconv.Quote(line[0]))).InFile(path, int64(i+2))
+		}
+	}
+
+	return nil
+}
+
+// writeTaggedPaths writes the NodeEncryptID and TAG_ID of the sensitive concepts and modifiers (of this conversion and
+// of the previous ones) in their mapping file
+func (l *Loader) writeTaggedPaths() error {
+	concepts := make(map[string]TaggedPath)
+	for concept, tp := range l.State.Concepts {
+		concepts[concept] = tp
+	}
+	for concept, el := range l.MapConceptPathToTag {
+		concepts[concept] = TaggedPath{NodeEncryptID: l.MapConceptPathToEncryptID[concept], TagID: el.TagID}
+	}
+	modifiers := make(map[string]TaggedPath)
+	for modifier, tp := range l.State.Modifiers {
+		modifiers[modifier] = tp
+	}
+	for modifier, el := range l.MapModifierPathToTag {
+		modifiers[modifier] = TaggedPath{NodeEncryptID: l.MapModifierPathToEncryptID[modifier], TagID: el.TagID}
+	}
+
+	records := make([][]string, 0, len(concepts)+len(modifiers))
+	for concept, tp := range concepts {
+		records = append(records, []string{"concept", concept, strconv.FormatInt(tp.NodeEncryptID, 10), strconv.FormatInt(tp.TagID, 10)})
+	}
+	for modifier, tp := range modifiers {
+		records = append(records, []string{"modifier", modifier, strconv.FormatInt(tp.NodeEncryptID, 10), strconv.FormatInt(tp.TagID, 10)})
+	}
+	return l.writeMapping("TAGGED_PATHS", records)
+}
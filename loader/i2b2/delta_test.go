@@ -0,0 +1,260 @@
+package loaderi2b2_test
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readCSV reads a .csv file (with its header, the converted patient_dimension has an additional encrypted flag)
+func readCSV(t *testing.T, path string) [][]string {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	assert.Nil(t, err)
+	return records
+}
+
+// writeCSV writes the header and the records of the original file that are kept
+func writeCSV(t *testing.T, path string, records [][]string, keep func(record []string) bool) {
+	if len(records) == 0 {
+		t.Fatalf("no header to write in %s", path)
+	}
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	assert.Nil(t, w.Write(records[0]))
+	for _, record := range records[1:] {
+		if keep(record) {
+			assert.Nil(t, w.Write(record))
+		}
+	}
+	w.Flush()
+	assert.Nil(t, w.Error())
+}
+
+// column returns the values of a column of a converted file
+func column(t *testing.T, path, name string) []string {
+	records := readCSV(t, path)
+	index := -1
+	for i, header := range records[0] {
+		if header == name {
+			index = i
+		}
+	}
+	assert.NotEqual(t, -1, index, name)
+
+	values := make([]string, 0)
+	for _, record := range records[1:] {
+		values = append(values, record[index])
+	}
+	return values
+}
+
+// readState reads the state of the database the converted files would be loaded in
+func readState(t *testing.T, l *loaderi2b2.Loader) *loaderi2b2.State {
+	s := loaderi2b2.NewState()
+
+	next := func(values []string, set map[string]struct{}) int64 {
+		n := int64(0)
+		for _, value := range values {
+			v, err := strconv.ParseInt(value, 10, 64)
+			assert.Nil(t, err)
+			if v >= n {
+				n = v + 1
+			}
+			if set != nil {
+				set[value] = struct{}{}
+			}
+		}
+		return n
+	}
+	s.NextPatientNum = next(column(t, l.OutputFilePaths["PATIENT_DIMENSION"].Path, "patient_num"), s.PatientNums)
+	s.NextEncounterNum = next(column(t, l.OutputFilePaths["VISIT_DIMENSION"].Path, "encounter_num"), s.EncounterNums)
+	s.NextTextSearchIndex = next(column(t, l.OutputFilePaths["OBSERVATION_FACT"].Path, "text_search_index"), nil)
+
+	for _, path := range column(t, l.OutputFilePaths["CONCEPT_DIMENSION"].Path, "concept_path") {
+		s.ConceptPaths[path] = struct{}{}
+	}
+	for _, path := range column(t, l.OutputFilePaths["MODIFIER_DIMENSION"].Path, "modifier_path") {
+		s.ModifierPaths[path] = struct{}{}
+	}
+	for _, basecode := range column(t, l.OutputFilePaths["SENSITIVE_TAGGED"].Path, "c_basecode") {
+		assert.Nil(t, s.AddTagID(basecode))
+	}
+	return s
+}
+
+func TestDeltaConversion(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	dir, err := ioutil.TempDir(loaderi2b2.DefaultDataPath+"i2b2", "delta_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "converted"), 0755))
+
+	original := func(name string) [][]string {
+		return readCSV(t, loaderi2b2.DefaultDataPath+"i2b2/original/"+name)
+	}
+	num := func(value string) int64 {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		return n
+	}
+	flu := `\i2b2\Diagnoses\Flu\`
+
+	// the first load has the 15 first patients (and their visits 101 to 126) and an ontology without the flu, the
+	// delta adds the 5 last patients, a new visit of a patient with a dummy (and their observations) and the flu
+	for _, name := range []string{"modifier_dimension.csv", "concept_dimension.csv", "dummy_to_patient.csv", "table_access.csv"} {
+		writeCSV(t, filepath.Join(dir, name), original(name), func([]string) bool { return true })
+	}
+	writeCSV(t, filepath.Join(dir, "ontology_first.csv"), original("i2b2.csv"), func(r []string) bool { return r[1] != flu })
+	writeCSV(t, filepath.Join(dir, "ontology_delta.csv"), original("i2b2.csv"), func([]string) bool { return true })
+	writeCSV(t, filepath.Join(dir, "patients_first.csv"), original("patient_dimension.csv"), func(r []string) bool { return num(r[0]) <= 1000000015 })
+	writeCSV(t, filepath.Join(dir, "patients_delta.csv"), original("patient_dimension.csv"), func(r []string) bool { return num(r[0]) >= 1000000015 })
+	writeCSV(t, filepath.Join(dir, "visits_first.csv"), original("visit_dimension.csv"), func(r []string) bool { return num(r[0]) <= 126 })
+
+	visits := original("visit_dimension.csv")
+	newVisit := append([]string{"138", "1000000002"}, visits[3][2:]...)
+	writeCSV(t, filepath.Join(dir, "visits_delta.csv"), append(visits, newVisit), func(r []string) bool { return num(r[0]) >= 125 })
+
+	observations := original("observation_fact.csv")
+	writeCSV(t, filepath.Join(dir, "observations_first.csv"), observations, func(r []string) bool { return num(r[1]) <= 1000000015 || num(r[1]) >= 2000000000 })
+	newObservation := append([]string{"138", "1000000002", "ICD9:487"}, observations[1][3:]...)
+	dummyObservation := append([]string{"", "2000000001", "ICD9:487"}, observations[1][3:]...)
+	writeCSV(t, filepath.Join(dir, "observations_delta.csv"), append(observations, newObservation, dummyObservation), func(r []string) bool {
+		return (num(r[1]) > 1000000015 && num(r[1]) < 2000000000) || r[0] == "138" || (r[0] == "" && r[1] == "2000000001" && r[2] == "ICD9:487" && r[5] == observations[1][5])
+	})
+
+	newDeltaLoader := func(suffix string, delta bool) *loaderi2b2.Loader {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{
+			Roster:    el,
+			Testing:   true,
+			Directory: dir,
+			Files: loaderi2b2.Files{
+				Ontology:          []string{"ontology_" + suffix + ".csv"},
+				TableAccess:       "table_access.csv",
+				DummyToPatient:    "dummy_to_patient.csv",
+				PatientDimension:  "patients_" + suffix + ".csv",
+				VisitDimension:    "visits_" + suffix + ".csv",
+				ConceptDimension:  "concept_dimension.csv",
+				ModifierDimension: "modifier_dimension.csv",
+				ObservationFact:   "observations_" + suffix + ".csv",
+				OutputFolder:      "converted/",
+				MappingFolder:     "mappings/",
+			},
+			AllSensitive: true,
+			Delta:        delta,
+		})
+		assert.Nil(t, err)
+		return l
+	}
+	convert := func(l *loaderi2b2.Loader) {
+		assert.Nil(t, l.ConvertLocalOntology())
+		assert.Nil(t, l.GenerateMedCoOntology())
+		assert.Nil(t, l.ParseDummyToPatient())
+		assert.Nil(t, l.ParsePatientDimension(publicKey))
+		assert.Nil(t, l.ConvertPatientDimension(publicKey, false))
+		assert.Nil(t, l.ParseVisitDimension())
+		assert.Nil(t, l.ConvertVisitDimension(false))
+		assert.Nil(t, l.ParseConceptDimension())
+		assert.Nil(t, l.ConvertConceptDimension())
+		assert.Nil(t, l.ParseModifierDimension())
+		assert.Nil(t, l.ConvertModifierDimension())
+		assert.Nil(t, l.ParseObservationFact())
+		assert.Nil(t, l.ConvertObservationFact())
+	}
+
+	first := newDeltaLoader("first", false)
+	convert(first)
+	state := readState(t, first)
+	assert.Equal(t, 20, len(state.PatientNums))
+	assert.Equal(t, int64(20), state.NextPatientNum)
+
+	l := newDeltaLoader("delta", true)
+	l.State = state
+	assert.Nil(t, l.ReadPreviousConversion())
+	assert.Equal(t, first.MapNewPatientNum, state.MapNewPatientNum)
+	assert.Equal(t, first.MapNewEncounterNum, state.MapNewEncounterNum)
+	assert.Equal(t, len(first.MapConceptPathToTag), len(state.Concepts))
+	convert(l)
+
+	// the patients and encounters already loaded keep their numbers, the new ones are numbered after them
+	for old, newNum := range first.MapNewPatientNum {
+		assert.Equal(t, newNum, l.MapNewPatientNum[old])
+	}
+	for old, newNum := range first.MapNewEncounterNum {
+		assert.Equal(t, newNum, l.MapNewEncounterNum[old])
+	}
+	patients := column(t, l.OutputFilePaths["PATIENT_DIMENSION"].Path, "patient_num")
+	assert.Equal(t, 5, len(patients))
+	for _, patient := range patients {
+		assert.True(t, num(patient) >= state.NextPatientNum)
+	}
+	assert.Equal(t, 25, len(readCSV(t, l.OutputFilePaths["NEW_PATIENT_NUM"].Path))-1)
+
+	// visits 127 to 138 and the copy of visit 138 for the dummy of the patient
+	encounters := column(t, l.OutputFilePaths["VISIT_DIMENSION"].Path, "encounter_num")
+	assert.Equal(t, 13, len(encounters))
+	for _, encounter := range encounters {
+		assert.True(t, num(encounter) >= state.NextEncounterNum)
+	}
+	assert.Contains(t, l.MapNewEncounterNum, loaderi2b2.VisitDimensionPK{EncounterNum: "138", PatientNum: "2000000001"})
+
+	// only the flu is tagged (and added to the sensitive_tagged and concept_dimension), the other concepts keep their
+	// NodeEncryptID and TAG_ID
+	tagged := column(t, l.OutputFilePaths["SENSITIVE_TAGGED"].Path, "c_basecode")
+	assert.Equal(t, []string{"TAG_ID:" + strconv.FormatInt(state.NextTagID, 10)}, tagged)
+	assert.Equal(t, 1, len(column(t, l.OutputFilePaths["CONCEPT_DIMENSION"].Path, "concept_path")))
+	assert.Empty(t, column(t, l.OutputFilePaths["MODIFIER_DIMENSION"].Path, "modifier_path"))
+	for concept, tag := range first.MapConceptPathToTag {
+		assert.Equal(t, tag.TagID, l.MapConceptPathToTag[concept].TagID)
+		assert.Equal(t, first.MapConceptPathToEncryptID[concept], l.MapConceptPathToEncryptID[concept])
+	}
+	assert.True(t, l.MapConceptPathToEncryptID[flu] >= state.NextEncryptID)
+	assert.Equal(t, len(l.MapConceptPathToTag)+len(l.MapModifierPathToTag), len(readCSV(t, l.OutputFilePaths["TAGGED_PATHS"].Path))-1)
+
+	// the observations continue the text_search_index
+	indexes := column(t, l.OutputFilePaths["OBSERVATION_FACT"].Path, "text_search_index")
+	assert.NotEmpty(t, indexes)
+	for _, index := range indexes {
+		assert.True(t, num(index) >= state.NextTextSearchIndex)
+	}
+	assert.Contains(t, column(t, l.OutputFilePaths["OBSERVATION_FACT"].Path, "concept_cd"), "TAG_ID:"+strconv.FormatInt(state.NextTagID, 10))
+
+	// the data tables are not emptied (nor the table_access, see TestTableAccessStatements)
+	for _, s := range l.GenerateLoadingDataStatements() {
+		if strings.HasPrefix(s.SQL, "TRUNCATE") {
+			assert.True(t, strings.HasPrefix(s.Table, loaderi2b2.I2B2METADATA) || strings.HasPrefix(s.Table, loaderi2b2.ONT), s.Table)
+			assert.NotEqual(t, l.OutputFilePaths["SENSITIVE_TAGGED"].TableName, s.Table)
+			assert.NotEqual(t, l.OutputFilePaths["TABLE_ACCESS"].TableName, s.Table)
+		}
+	}
+}
+
+func TestDeltaGeneratedDummies(t *testing.T) {
+	setupData(t)
+
+	// the dummies generated by a previous load would not get copies of the new visits and facts of their original
+	// patient (which is not recorded), and new dummies would be added for the same patients at each delta
+	_, err := loaderi2b2.NewLoader(loaderi2b2.Options{Dummies: 7})
+	assert.Nil(t, err)
+	_, err = loaderi2b2.NewLoader(loaderi2b2.Options{Dummies: 7, Delta: true})
+	assert.True(t, errors.Is(err, loader.ErrInputFormat), err)
+	_, err = loaderi2b2.NewLoader(loaderi2b2.Options{Delta: true})
+	assert.Nil(t, err)
+}
@@ -0,0 +1,404 @@
+package loaderi2b2
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// dummyPrefix prefixes the (original) patient_num of the generated dummies
+const dummyPrefix = "dummy_"
+
+// kMeansIterations is the maximum number of iterations of the clustering of the patients
+const kMeansIterations = 50
+
+// DummyObservation is the concept and modifier of an observation of a generated dummy: the other fields are copied from
+// an observation of its original patient (see ConvertObservationFact)
+type DummyObservation struct {
+	ConceptCD  string
+	ModifierCD string
+}
+
+// GeneratedDummy is a dummy generated by GenerateDummies: it gets as many observations as its original patient (whose
+// concepts and modifiers are drawn from its cluster by ConvertObservationFact)
+type GeneratedDummy struct {
+	Observations int
+	cluster      *dummyCluster
+}
+
+// dummyCluster is a group of similar patients: its dummies copy the observations of its members and get concepts drawn
+// from the observations of the whole cluster
+type dummyCluster struct {
+	members      []string
+	total        map[DummyObservation]int64
+	observations []DummyObservation
+	cumulative   []int64
+}
+
+// sketchSize is the number of buckets of the patientSketch
+const sketchSize = 64
+
+// patientSketch is the (normalized) vector of the concepts of the observations of a patient, hashed into a fixed number
+// of buckets so that its size does not depend on the number of concepts
+type patientSketch [sketchSize]float32
+
+// add counts an observation of a concept in the sketch (the sign of the hash limits the bias of the collisions)
+func (v *patientSketch) add(conceptCD string) {
+	h := fnv.New64a()
+	h.Write([]byte(conceptCD))
+	x := h.Sum64()
+	if x>>63 == 0 {
+		v[x%sketchSize]++
+	} else {
+		v[x%sketchSize]--
+	}
+}
+
+// normalize scales the sketch to a unit vector
+func (v *patientSketch) normalize() {
+	norm := 0.0
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	if norm == 0 {
+		return
+	}
+	norm = math.Sqrt(norm)
+	for i := range v {
+		v[i] = float32(float64(v[i]) / norm)
+	}
+}
+
+// GenerateDummies generates Options.Dummies dummy patients instead of reading them from the dummy_to_patient.csv. The
+// patients (of the patient_dimension, with at least one observation that a dummy can copy) are clustered by their
+// concepts (k-means with Options.DummyClusters clusters) and the dummies are spread over the clusters in proportion to
+// their size. Each dummy copies an original patient drawn from its cluster (TableDummyToPatient) and gets as many
+// observations (TableGeneratedDummies), whose concepts and modifiers are drawn from the observations of the cluster
+// when they are written (see drawDummyObservations).
+// It must be called after ParsePatientDimension, ParseVisitDimension and the conversion of the concept and modifier
+// dimensions (the observations they ignore, or whose visit does not exist, are not taken into account).
+// The observation_fact.csv is read twice so that only a sketch of the concepts of each patient is kept in memory (and
+// the distribution of the observations of each cluster).
+func (l *Loader) GenerateDummies() error {
+	l.TableDummyToPatient = make(map[string]string)
+	l.TableGeneratedDummies = make(map[string]GeneratedDummy)
+
+	patients, sketches, counts, err := l.readPatientSketches()
+	if err != nil {
+		return err
+	}
+	if len(patients) == 0 {
+		return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], errors.New("no patient has observations, the dummies cannot be generated"))
+	}
+
+	rnd, err := l.newRand("dummies")
+	if err != nil {
+		return err
+	}
+	clusters := clusterPatients(patients, sketches, l.dummyClusters(len(patients)), rnd)
+	if err := l.addClusterObservations(clusters); err != nil {
+		return err
+	}
+
+	next := 0
+	for i, dummies := range allocateDummies(clusters, l.Dummies) {
+		c := clusters[i]
+		for j := 0; j < dummies; j++ {
+			dummy := dummyPrefix + strconv.Itoa(next)
+			next++
+
+			original := c.members[rnd.Intn(len(c.members))]
+			l.TableDummyToPatient[dummy] = original
+			l.TableGeneratedDummies[dummy] = GeneratedDummy{Observations: counts[original], cluster: c}
+		}
+	}
+
+	return nil
+}
+
+// drawDummyObservations calls write for each observation of a generated dummy, with a concept and a modifier drawn from
+// its cluster. Each dummy has its own stream of randomness so that the observations are reproducible in keyed mode.
+func (l *Loader) drawDummyObservations(dummy string, write func(obs DummyObservation) error) error {
+	d := l.TableGeneratedDummies[dummy]
+	rnd, err := l.newRand("dummy_obs:" + dummy)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < d.Observations; i++ {
+		if err := write(d.cluster.draw(rnd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dummyClusters returns the number of clusters of the patients: Options.DummyClusters or sqrt(#patients / 2)
+func (l *Loader) dummyClusters(patients int) int {
+	k := l.DummyClusters
+	if k <= 0 {
+		k = int(math.Ceil(math.Sqrt(float64(patients) / 2)))
+	}
+	if k > patients {
+		k = patients
+	}
+	return k
+}
+
+// readCopyableObservations calls read for each observation of the patients of the patient_dimension that a dummy can
+// copy (see ParseObservationFact), without keeping the observation_fact.csv in memory
+func (l *Loader) readCopyableObservations(read func(line []string)) error {
+	path := l.InputFilePaths["OBSERVATION_FACT"]
+	csvInputFile, err := os.Open(path)
+	if err != nil {
+		return loader.NewInputError(path, err)
+	}
+	defer csvInputFile.Close()
+
+	reader := csv.NewReader(bufio.NewReader(csvInputFile))
+	reader.ReuseRecord = true
+
+	// skip header
+	if _, err := reader.Read(); err != nil {
+		return loader.NewInputError(path, err)
+	}
+
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return loader.NewInputError(path, err)
+		}
+		if len(line) < 6 {
+			return loader.NewInputError(path, errors.New("missing fields in observation"))
+		}
+
+		if _, ok := l.TablePatientDimension[PatientDimensionPK{PatientNum: line[1]}]; !ok {
+			continue
+		}
+		// the observations that are not converted (or not indexed for the dummies) are not copied either
+		if !l.copyableObservation(line, nil) {
+			continue
+		}
+		read(line)
+	}
+	return nil
+}
+
+// readPatientSketches reads the sketch of the concepts and the number of observations of the patients that have
+// observations a dummy can copy. The patients are returned in order (with their sketch).
+func (l *Loader) readPatientSketches() ([]string, []patientSketch, map[string]int, error) {
+	index := make(map[string]int)
+	unordered := make([]patientSketch, 0)
+	counts := make(map[string]int)
+	err := l.readCopyableObservations(func(line []string) {
+		i, ok := index[line[1]]
+		if !ok {
+			i = len(unordered)
+			index[line[1]] = i
+			unordered = append(unordered, patientSketch{})
+		}
+		unordered[i].add(line[2])
+		counts[line[1]]++
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	patients := make([]string, 0, len(index))
+	for patient := range index {
+		patients = append(patients, patient)
+	}
+	sort.Strings(patients)
+	sketches := make([]patientSketch, len(patients))
+	for i, patient := range patients {
+		sketches[i] = unordered[index[patient]]
+		sketches[i].normalize()
+	}
+	return patients, sketches, counts, nil
+}
+
+// addClusterObservations reads the (concept, modifier) of the observations of the members of the clusters to build
+// their distributions
+func (l *Loader) addClusterObservations(clusters []*dummyCluster) error {
+	byPatient := make(map[string]*dummyCluster)
+	for _, c := range clusters {
+		c.total = make(map[DummyObservation]int64)
+		for _, member := range c.members {
+			byPatient[member] = c
+		}
+	}
+
+	err := l.readCopyableObservations(func(line []string) {
+		if c, ok := byPatient[line[1]]; ok {
+			c.total[DummyObservation{ConceptCD: line[2], ModifierCD: line[5]}]++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range clusters {
+		c.addObservations()
+	}
+	return nil
+}
+
+// clusterPatients groups the patients in k clusters (k-means++ over the sketches of their concepts)
+func clusterPatients(patients []string, vectors []patientSketch, k int, rnd *rand.Rand) []*dummyCluster {
+	// k-means++ initialization: each centroid is drawn with a probability proportional to its distance to the others
+	centroids := []patientSketch{vectors[rnd.Intn(len(vectors))]}
+	distances := make([]float64, len(vectors))
+	for len(centroids) < k {
+		total := 0.0
+		for i := range vectors {
+			distances[i] = distance(&vectors[i], &centroids[nearest(&vectors[i], centroids)])
+			total += distances[i]
+		}
+		if total == 0 {
+			break
+		}
+		target := rnd.Float64() * total
+		chosen := len(vectors) - 1
+		for i, d := range distances {
+			if target < d {
+				chosen = i
+				break
+			}
+			target -= d
+		}
+		centroids = append(centroids, vectors[chosen])
+	}
+
+	labels := make([]int, len(vectors))
+	for iteration := 0; iteration < kMeansIterations; iteration++ {
+		changed := false
+		for i := range vectors {
+			if best := nearest(&vectors[i], centroids); best != labels[i] {
+				labels[i] = best
+				changed = true
+			}
+		}
+		if !changed && iteration > 0 {
+			break
+		}
+
+		sizes := make([]int, len(centroids))
+		sums := make([][sketchSize]float64, len(centroids))
+		for i, v := range vectors {
+			sizes[labels[i]]++
+			for b, x := range v {
+				sums[labels[i]][b] += float64(x)
+			}
+		}
+		for j := range centroids {
+			// an empty cluster keeps its centroid
+			if sizes[j] == 0 {
+				continue
+			}
+			for b := range sums[j] {
+				centroids[j][b] = float32(sums[j][b] / float64(sizes[j]))
+			}
+		}
+	}
+
+	clusters := make([]*dummyCluster, 0, len(centroids))
+	byLabel := make(map[int]*dummyCluster)
+	for i, patient := range patients {
+		c, ok := byLabel[labels[i]]
+		if !ok {
+			c = &dummyCluster{}
+			byLabel[labels[i]] = c
+			clusters = append(clusters, c)
+		}
+		c.members = append(c.members, patient)
+	}
+	return clusters
+}
+
+// addObservations builds the distribution of the (concept, modifier) of the observations of the members of the cluster
+// from their counts
+func (c *dummyCluster) addObservations() {
+	c.observations = make([]DummyObservation, 0, len(c.total))
+	for obs := range c.total {
+		c.observations = append(c.observations, obs)
+	}
+	sort.Slice(c.observations, func(i, j int) bool {
+		if c.observations[i].ConceptCD != c.observations[j].ConceptCD {
+			return c.observations[i].ConceptCD < c.observations[j].ConceptCD
+		}
+		return c.observations[i].ModifierCD < c.observations[j].ModifierCD
+	})
+
+	c.cumulative = make([]int64, len(c.observations))
+	sum := int64(0)
+	for i, obs := range c.observations {
+		sum += c.total[obs]
+		c.cumulative[i] = sum
+	}
+	c.total = nil
+}
+
+// draw returns a (concept, modifier) of the cluster, with the probability of its number of observations
+func (c *dummyCluster) draw(rnd *rand.Rand) DummyObservation {
+	target := rnd.Int63n(c.cumulative[len(c.cumulative)-1])
+	return c.observations[sort.Search(len(c.cumulative), func(i int) bool { return c.cumulative[i] > target })]
+}
+
+// allocateDummies spreads the dummies over the clusters in proportion to their size (largest remainder method)
+func allocateDummies(clusters []*dummyCluster, dummies int) []int {
+	patients := 0
+	for _, c := range clusters {
+		patients += len(c.members)
+	}
+
+	allocation := make([]int, len(clusters))
+	remainders := make([]float64, len(clusters))
+	allocated := 0
+	for i, c := range clusters {
+		share := float64(dummies) * float64(len(c.members)) / float64(patients)
+		allocation[i] = int(share)
+		remainders[i] = share - float64(allocation[i])
+		allocated += allocation[i]
+	}
+
+	order := make([]int, len(clusters))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for i := 0; allocated < dummies; i++ {
+		allocation[order[i%len(order)]]++
+		allocated++
+	}
+	return allocation
+}
+
+// nearest returns the index of the centroid closest to v
+func nearest(v *patientSketch, centroids []patientSketch) int {
+	best, bestDistance := 0, math.Inf(1)
+	for j := range centroids {
+		if d := distance(v, &centroids[j]); d < bestDistance {
+			best, bestDistance = j, d
+		}
+	}
+	return best
+}
+
+// distance returns the squared euclidean distance between two sketches
+func distance(a, b *patientSketch) float64 {
+	d := 0.0
+	for i := range a {
+		x := float64(a[i]) - float64(b[i])
+		d += x * x
+	}
+	return d
+}
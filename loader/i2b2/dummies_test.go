@@ -0,0 +1,168 @@
+package loaderi2b2_test
+
+import (
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestGenerateDummies(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	generate := func(key string, withoutVisits ...string) *loaderi2b2.Loader {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, AllSensitive: true, PermutationKey: []byte(key), Dummies: 7, DummyClusters: 3})
+		assert.Nil(t, err)
+		assert.Nil(t, l.ConvertLocalOntology())
+		assert.Nil(t, l.GenerateMedCoOntology())
+		assert.Nil(t, l.ParseConceptDimension())
+		assert.Nil(t, l.ConvertConceptDimension())
+		assert.Nil(t, l.ParseModifierDimension())
+		assert.Nil(t, l.ConvertModifierDimension())
+		assert.Nil(t, l.ParsePatientDimension(publicKey))
+		assert.Nil(t, l.ParseVisitDimension())
+		for pk := range l.TableVisitDimension {
+			for _, patient := range withoutVisits {
+				if pk.PatientNum == patient {
+					delete(l.TableVisitDimension, pk)
+				}
+			}
+		}
+		assert.Nil(t, l.GenerateDummies())
+		return l
+	}
+
+	// each dummy copies a real patient (and has as many observations) but its concepts are drawn from its cluster
+	l := generate("site secret")
+	counts := make(map[string]int)
+	concepts := make(map[loaderi2b2.DummyObservation]struct{})
+	for _, record := range readCSV(t, loaderi2b2.DefaultDataPath+"i2b2/original/observation_fact.csv")[1:] {
+		_, ignoredConcept := l.ListConceptsToIgnore[record[2]]
+		_, ignoredModifier := l.ListModifiersToIgnore[record[5]]
+		_, visit := l.TableVisitDimension[loaderi2b2.VisitDimensionPK{EncounterNum: record[0], PatientNum: record[1]}]
+		if !ignoredConcept && !ignoredModifier && visit {
+			counts[record[1]]++
+			concepts[loaderi2b2.DummyObservation{ConceptCD: record[2], ModifierCD: record[5]}] = struct{}{}
+		}
+	}
+
+	assert.Equal(t, 7, len(l.TableDummyToPatient))
+	assert.Equal(t, 7, len(l.TableGeneratedDummies))
+	for dummy, original := range l.TableDummyToPatient {
+		assert.Contains(t, l.TablePatientDimension, loaderi2b2.PatientDimensionPK{PatientNum: original})
+		assert.Equal(t, counts[original], l.TableGeneratedDummies[dummy].Observations)
+	}
+
+	// the generation is reproducible in keyed mode
+	same := generate("site secret")
+	assert.Equal(t, l.TableDummyToPatient, same.TableDummyToPatient)
+	assert.Equal(t, l.TableGeneratedDummies, same.TableGeneratedDummies)
+
+	// the patients whose observations have no visit are not copied (they would have no observation to copy)
+	originals := make([]string, 0)
+	for _, original := range l.TableDummyToPatient {
+		originals = append(originals, original)
+	}
+	other := generate("site secret", originals...)
+	for _, original := range other.TableDummyToPatient {
+		assert.NotContains(t, originals, original)
+	}
+
+	// the dummies go through the conversion like the ones of the dummy_to_patient.csv
+	assert.Nil(t, l.ConvertPatientDimension(publicKey, false))
+	assert.Nil(t, l.ConvertVisitDimension(false))
+	assert.Nil(t, l.ParseObservationFact())
+	assert.Nil(t, l.ConvertObservationFact())
+
+	assert.Equal(t, len(l.TablePatientDimension)+7, len(readCSV(t, l.OutputFilePaths["PATIENT_DIMENSION"].Path))-1)
+	converted := make(map[string]int)
+	for _, patient := range column(t, l.OutputFilePaths["OBSERVATION_FACT"].Path, "patient_num") {
+		converted[patient]++
+	}
+	for dummy, original := range l.TableDummyToPatient {
+		assert.Equal(t, converted[l.MapNewPatientNum[original]], converted[l.MapNewPatientNum[dummy]], dummy)
+		assert.NotZero(t, converted[l.MapNewPatientNum[dummy]], dummy)
+	}
+
+	// their concepts and modifiers are drawn from the observations of the real patients
+	dummies := make(map[string]struct{})
+	for dummy := range l.TableDummyToPatient {
+		dummies[l.MapNewPatientNum[dummy]] = struct{}{}
+	}
+	untag := make(map[string]string)
+	for code, tag := range l.MapConceptCodeToTag {
+		untag["TAG_ID:"+strconv.FormatInt(tag, 10)] = code
+	}
+	for code, tag := range l.MapModifierCodeToTag {
+		untag["TAG_ID:"+strconv.FormatInt(tag, 10)] = code
+	}
+	code := func(value string) string {
+		if code, ok := untag[value]; ok {
+			return code
+		}
+		return value
+	}
+	facts := readCSV(t, l.OutputFilePaths["OBSERVATION_FACT"].Path)
+	for _, record := range facts[1:] {
+		if _, ok := dummies[record[1]]; ok {
+			assert.Contains(t, concepts, loaderi2b2.DummyObservation{ConceptCD: code(record[2]), ModifierCD: code(record[5])})
+		}
+	}
+
+	// and reproducible in keyed mode
+	assert.Nil(t, same.ConvertPatientDimension(publicKey, false))
+	assert.Nil(t, same.ConvertVisitDimension(false))
+	assert.Nil(t, same.ParseObservationFact())
+	assert.Nil(t, same.ConvertObservationFact())
+	assert.Equal(t, facts, readCSV(t, same.OutputFilePaths["OBSERVATION_FACT"].Path))
+}
+
+func TestDummyStrategies(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	_, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, DummyStrategy: "unknown"})
+	assert.NotNil(t, err)
+
+	for _, strategy := range loaderi2b2.DummyStrategies {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, AllSensitive: true, DummyStrategy: strategy})
+		assert.Nil(t, err)
+		assert.Nil(t, l.ConvertLocalOntology())
+		assert.Nil(t, l.GenerateMedCoOntology())
+		assert.Nil(t, l.ParseDummyToPatient())
+		assert.Nil(t, l.ParsePatientDimension(publicKey))
+		assert.Nil(t, l.ConvertPatientDimension(publicKey, false))
+		assert.Nil(t, l.ParseVisitDimension())
+		assert.Nil(t, l.ConvertVisitDimension(false))
+		assert.Nil(t, l.ParseConceptDimension())
+		assert.Nil(t, l.ConvertConceptDimension())
+		assert.Nil(t, l.ParseModifierDimension())
+		assert.Nil(t, l.ConvertModifierDimension())
+		assert.Nil(t, l.ParseObservationFact())
+		assert.Nil(t, l.ConvertObservationFact(), strategy)
+
+		// every dummy observation (whose concept and modifier are converted) gives a fact
+		intended := make(map[string]int64)
+		for _, record := range readCSV(t, loaderi2b2.DefaultDataPath+"i2b2/original/observation_fact.csv")[1:] {
+			_, dummy := l.TableDummyToPatient[record[1]]
+			_, ignoredConcept := l.ListConceptsToIgnore[record[2]]
+			_, ignoredModifier := l.ListModifiersToIgnore[record[5]]
+			if dummy && !ignoredConcept && !ignoredModifier {
+				intended[record[1]]++
+			}
+		}
+		assert.NotEmpty(t, intended)
+		assert.Equal(t, intended, l.DummyFacts, strategy)
+
+		converted := make(map[string]int64)
+		for _, patient := range column(t, l.OutputFilePaths["OBSERVATION_FACT"].Path, "patient_num") {
+			converted[patient]++
+		}
+		for dummy, n := range intended {
+			assert.Equal(t, n, converted[l.MapNewPatientNum[dummy]], strategy)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package loaderi2b2
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"math/rand"
+)
+
+// DummyStrategy is how the observations of the dummies are synthesized from the observations of their original patient.
+// Whatever the strategy, a dummy gets one fact per dummy observation (of the observation_fact.csv or generated): only
+// its concept and modifier are kept, the other fields (encounter, dates, values...) are copied from an observation of
+// the original patient.
+type DummyStrategy string
+
+const (
+	// DummyWithoutReplacement copies the observations of the original patient in a random order, each one once before
+	// any is copied again (default)
+	DummyWithoutReplacement DummyStrategy = "without_replacement"
+	// DummyWithReplacement copies observations of the original patient drawn independently
+	DummyWithReplacement DummyStrategy = "with_replacement"
+	// DummyPerEncounter copies the observations of the original patient in their order, so that the encounters of the
+	// dummy have as many facts as the ones of the original patient
+	DummyPerEncounter DummyStrategy = "per_encounter"
+	// DummyConceptDistribution copies an observation of the original patient with the same concept if there is one (its
+	// values are coherent with the concept), an observation drawn from all of them otherwise
+	DummyConceptDistribution DummyStrategy = "concept_distribution"
+)
+
+// DummyStrategies are the available strategies
+var DummyStrategies = []DummyStrategy{DummyWithoutReplacement, DummyWithReplacement, DummyPerEncounter, DummyConceptDistribution}
+
+// checkDummyStrategy checks that the strategy exists (empty means DummyWithoutReplacement)
+func checkDummyStrategy(strategy DummyStrategy) error {
+	if strategy == "" {
+		return nil
+	}
+	for _, s := range DummyStrategies {
+		if s == strategy {
+			return nil
+		}
+	}
+	return loader.NewError(loader.ErrInputFormat, errors.New("unknown dummy strategy "+string(strategy)))
+}
+
+// conceptKey is the key of the observations of a patient with a concept in the ObservationIndex (DummyConceptDistribution)
+func conceptKey(patientNum, conceptCD string) string {
+	return patientNum + "\x00" + conceptCD
+}
+
+// copyableObservation tells whether an observation (raw .csv record) can be copied by the dummies of its patient: its
+// concept and modifier are converted and all the dummies have a copy of its visit. The dummies get a copy of the visits
+// of the visit_dimension.csv; in delta mode a visit loaded before is only copied by the dummies that got a copy of it in
+// a previous load (none of the dummies generated by GenerateDummies, which pass no dummies).
+func (l *Loader) copyableObservation(line []string, dummies []string) bool {
+	if _, ok := l.ListConceptsToIgnore[line[2]]; ok {
+		return false
+	}
+	if _, ok := l.ListModifiersToIgnore[line[5]]; ok {
+		return false
+	}
+	if _, ok := l.TableVisitDimension[VisitDimensionPK{EncounterNum: line[0], PatientNum: line[1]}]; ok {
+		return true
+	}
+	for _, dummy := range dummies {
+		if _, ok := l.State.MapNewEncounterNum[VisitDimensionPK{EncounterNum: line[0], PatientNum: dummy}]; !ok {
+			return false
+		}
+	}
+	return len(dummies) > 0
+}
+
+// dummySource draws the observations of the original patient that a dummy copies
+type dummySource struct {
+	strategy DummyStrategy
+	index    *ObservationIndex
+	original string
+	count    int64
+	rnd      *rand.Rand
+	sampler  *ObservationSampler
+	next     int64
+}
+
+// newDummySource creates the source of the observations of a dummy, it fails if its original patient has no observation
+// to copy
+func (l *Loader) newDummySource(dummy, original string) (*dummySource, error) {
+	s := &dummySource{
+		strategy: l.DummyStrategy,
+		index:    l.ObservationsIndex,
+		original: original,
+		count:    l.ObservationsIndex.Count(original),
+	}
+	rnd, err := l.newRand("observation_fact:" + dummy)
+	if err != nil {
+		return nil, err
+	}
+	s.rnd = rnd
+	if s.strategy == "" {
+		s.strategy = DummyWithoutReplacement
+	}
+	if s.count == 0 {
+		return nil, loader.NewError(loader.ErrInputFormat, errors.New("the original patient "+original+" of the dummy "+dummy+" has no observation to copy"))
+	}
+	return s, nil
+}
+
+// draw returns the observation (the raw .csv record) of the original patient copied by a dummy observation
+func (s *dummySource) draw(conceptCD string) ([]string, error) {
+	key, i := s.original, int64(0)
+
+	switch s.strategy {
+	case DummyWithReplacement:
+		i = s.rnd.Int63n(s.count)
+	case DummyPerEncounter:
+		i = s.next % s.count
+		s.next++
+	case DummyConceptDistribution:
+		if n := s.index.Count(conceptKey(s.original, conceptCD)); n > 0 {
+			key, i = conceptKey(s.original, conceptCD), s.rnd.Int63n(n)
+		} else {
+			i = s.rnd.Int63n(s.count)
+		}
+	default:
+		// once all the observations have been copied they are drawn again in another order
+		var ok bool
+		if s.sampler != nil {
+			i, ok = s.sampler.Next()
+		}
+		if !ok {
+			s.sampler = NewObservationSampler(s.count, s.rnd)
+			i, _ = s.sampler.Next()
+		}
+	}
+
+	return s.index.Get(key, i)
+}
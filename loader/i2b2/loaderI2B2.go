@@ -1,15 +1,22 @@
 package loaderi2b2
 
 import (
+	"bufio"
+	cryptorand "crypto/rand"
 	"encoding/csv"
+	"encoding/hex"
+	"errors"
 	"github.com/ldsec/medco-loader/loader"
-	"github.com/ldsec/medco-unlynx/services"
 	"github.com/ldsec/unlynx/lib"
+	"github.com/lib/pq"
 	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
-	"math/rand"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -23,19 +30,6 @@ func init() {
 	} else {
 		DefaultDataPath = dpath
 	}
-
-	addDataPathToFiles()
-}
-
-func addDataPathToFiles() {
-	for k, v := range InputFilePaths {
-		InputFilePaths[k] = DefaultDataPath + v
-	}
-	for k, v := range OutputFilePaths {
-		tmp := OutputFilePaths[k]
-		tmp.Path = DefaultDataPath + v.Path
-		OutputFilePaths[k] = tmp
-	}
 }
 
 // DefaultDataPath is the default path for the data folder
@@ -52,6 +46,8 @@ type Files struct {
 	ModifierDimension string
 	ObservationFact   string
 	OutputFolder      string
+	// MappingFolder is where the mapping files are written (see MappingFiles), the output folder if empty
+	MappingFolder string
 }
 
 // FileInfo contains the tablename where the .csv should be loaded and the output path
@@ -69,52 +65,32 @@ const I2B2DEMODATA = "i2b2demodata_i2b2."
 // ONT path to medco_ont schema
 const ONT = "medco_ont."
 
-// The different paths and handlers for all the files both for input and/or output
+// The different paths (relative to DefaultDataPath) of the default dataset, both for input and/or output
 var (
-	OntologyFilesPaths = []string{
+	defaultOntologyFilesPaths = []string{
 		"ONTOLOGY_BIRN",
 		"ONTOLOGY_CUSTOM_META",
 		"ONTOLOGY_ICD10_ICD9",
 		"ONTOLOGY_I2B2",
 	}
 
-	InputFilePaths = map[string]string{
+	defaultInputFilePaths = map[string]string{
 		"ONTOLOGY_BIRN":        "i2b2/original/birn.csv",
 		"ONTOLOGY_CUSTOM_META": "i2b2/original/custom_meta.csv",
 		"ONTOLOGY_ICD10_ICD9":  "i2b2/original/icd10_icd9.csv",
 		"ONTOLOGY_I2B2":        "i2b2/original/i2b2.csv",
 
-		"TABLE_ACCESS":      "i2b2/original/table_access.csv",
-		"DUMMY_TO_PATIENT":  "i2b2/original/dummy_to_patient.csv",
-		"PATIENT_DIMENSION": "i2b2/original/patient_dimension.csv",
-		"VISIT_DIMENSION":   "i2b2/original/visit_dimension.csv",
-		"CONCEPT_DIMENSION": "i2b2/original/concept_dimension.csv",
-		"OBSERVATION_FACT":  "i2b2/original/observation_fact.csv",
-	}
-
-	OutputFilePaths = map[string]FileInfo{
-		"TABLE_ACCESS":     {TableName: ONT + "table_access", Path: "i2b2/converted/table_access.csv"},
-		"SENSITIVE_TAGGED": {TableName: ONT + "sensitive_tagged", Path: "i2b2/converted/sensitive_tagged.csv"},
-
-		"LOCAL_BIRN":        {TableName: I2B2METADATA + "birn", Path: "i2b2/converted/local_birn.csv"},
-		"LOCAL_CUSTOM_META": {TableName: I2B2METADATA + "custom_meta", Path: "i2b2/converted/local_custom_meta.csv"},
-		"LOCAL_ICD10_ICD9":  {TableName: I2B2METADATA + "icd10_icd9", Path: "i2b2/converted/local_icd10_icd9.csv"},
-		"LOCAL_I2B2":        {TableName: I2B2METADATA + "i2b2", Path: "i2b2/converted/local_i2b2.csv"},
-
-		"MEDCO_BIRN":        {TableName: ONT + "birn", Path: "i2b2/converted/medco_birn.csv"},
-		"MEDCO_CUSTOM_META": {TableName: ONT + "custom_meta", Path: "i2b2/converted/medco_custom_meta.csv"},
-		"MEDCO_ICD10_ICD9":  {TableName: ONT + "icd10_icd9", Path: "i2b2/converted/medco_icd10_icd9.csv"},
-		"MEDCO_I2B2":        {TableName: ONT + "i2b2", Path: "i2b2/converted/medco_i2b2.csv"},
-
-		"PATIENT_DIMENSION": {TableName: I2B2DEMODATA + "patient_dimension", Path: "i2b2/converted/patient_dimension.csv"},
-		"NEW_PATIENT_NUM":   {TableName: "", Path: "i2b2/converted/new_patient_num.csv"},
-		"VISIT_DIMENSION":   {TableName: I2B2DEMODATA + "visit_dimension", Path: "i2b2/converted/visit_dimension.csv"},
-		"NEW_ENCOUNTER_NUM": {TableName: "", Path: "i2b2/converted/new_encounter_num.csv"},
-		"CONCEPT_DIMENSION": {TableName: I2B2DEMODATA + "concept_dimension", Path: "i2b2/converted/concept_dimension.csv"},
-		"OBSERVATION_FACT":  {TableName: I2B2DEMODATA + "observation_fact", Path: "i2b2/converted/observation_fact.csv"},
+		"TABLE_ACCESS":       "i2b2/original/table_access.csv",
+		"DUMMY_TO_PATIENT":   "i2b2/original/dummy_to_patient.csv",
+		"PATIENT_DIMENSION":  "i2b2/original/patient_dimension.csv",
+		"VISIT_DIMENSION":    "i2b2/original/visit_dimension.csv",
+		"CONCEPT_DIMENSION":  "i2b2/original/concept_dimension.csv",
+		"MODIFIER_DIMENSION": "i2b2/original/modifier_dimension.csv",
+		"OBSERVATION_FACT":   "i2b2/original/observation_fact.csv",
 	}
 
-	FileBashPath = "24-load-i2b2-data.sh"
+	defaultOutputFolder  = "i2b2/converted/"
+	defaultMappingFolder = "i2b2/mappings/"
 )
 
 const (
@@ -124,204 +100,597 @@ const (
 	Header = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n"
 )
 
+// Options are the settings of the conversion (and loading) of an i2b2 dataset
+type Options struct {
+	Roster        *onet.Roster // collective authority
+	EntryPointIdx int          // index (in the roster) of the server used to tag the sensitive concepts
+	Testing       bool         // whether the tagging runs on a local test roster
+
+	// Directory is the folder of the dataset and Files the paths of its files (relative to Directory). If Directory is
+	// empty the default dataset in DefaultDataPath is converted.
+	Directory string
+	Files     Files
+
+	// Policy decides which concepts and modifiers are sensitive. If it is nil the policy of AllSensitive and
+	// SensitiveConcepts is used.
+	Policy            *loader.Policy
+	AllSensitive      bool                // all concepts are considered sensitive
+	SensitiveConcepts map[string]struct{} // paths of the sensitive concepts (their children are also sensitive)
+
+	I2B2DB      loader.DBSettings
+	Empty       bool // empty the patient and visit dimension tables
+	ConvertOnly bool // only convert the data and write a summary of the loading instead of loading it
+	Verify      bool // once loaded, compare the tables with the converted files (see Loader.VerifyDataFiles)
+
+	// PermutationKey is the secret of the site from which the permutations of the patient_num, encounter_num and
+	// TAG_IDs are derived, so that the same data always gets the same numbers. If empty the permutations are drawn from
+	// crypto/rand.
+	PermutationKey []byte
+
+	// MappingKey encrypts the mapping files (see MappingFiles) and the sensitivity report (the key of each file is
+	// derived from it with scrypt, so it may be a passphrase). MappingSchema stores the mappings in the tables of this
+	// (restricted) schema instead, which must be a plain lowercase identifier: the files are then only written in a
+	// private folder until they are loaded (in the CheckpointDir if there is one, so that a resumed loading does not
+	// convert the data again)
+	MappingKey    []byte
+	MappingSchema string
+	// PlaintextMappings allows writing the mapping files and the sensitivity report in plaintext in the output folder,
+	// which must then not be shared. Without a mapping folder or key (or schema for the mappings) the loader refuses to
+	// run otherwise.
+	PlaintextMappings bool
+
+	// Delta adds the data to the previous loads instead of replacing it: the patients and encounters already loaded
+	// keep their numbers (read from the mappings of the previous conversion, see MappingFiles), the new ones
+	// get numbers that are not used yet, and only the new sensitive concepts and modifiers are tagged. The ontology
+	// files must be complete (the ontology tables are replaced), the other files only need to hold the new data.
+	Delta bool
+
+	// Dummies is the number of dummy patients generated by the loader (see GenerateDummies) instead of being read from
+	// the dummy_to_patient.csv, DummyClusters the number of clusters of patients they are drawn from (0 for a default
+	// that depends on the number of patients). The dummies cannot be generated in delta mode.
+	Dummies       int
+	DummyClusters int
+	// DummyStrategy is how the observations of the dummies are synthesized (DummyWithoutReplacement if empty)
+	DummyStrategy DummyStrategy
+
+	// CheckpointDir is the folder where the results of the phases of the loading are persisted (see loader.Checkpoint),
+	// Resume skips the phases completed by a previous run with the same input files and settings
+	CheckpointDir string
+	Resume        bool
+
+	// Tagging are the settings of the tagging of the sensitive concepts and modifiers
+	Tagging loader.TaggingOptions
+}
+
+// Loader converts and loads an i2b2 dataset. It holds the whole state of the conversion, so that independent loaders
+// can run concurrently in the same process.
+type Loader struct {
+	Options
+
+	// the different paths for all the files both for input and/or output
+	OntologyFilesPaths []string
+	InputFilePaths     map[string]string
+	OutputFilePaths    map[string]FileInfo
+
+	// State is what the previous loads left in the database (empty unless Delta is set)
+	State *State
+
+	// surveyID identifies the tagging of this loader in the collective authority
+	surveyID string
+	// checkpoint persists the results of the phases of the loading (nil without CheckpointDir)
+	checkpoint *loader.Checkpoint
+
+	// SensitivityDecisions are the decisions of the Policy about the concept and modifier paths met during the conversion
+	SensitivityDecisions map[string]loader.Decision
+	// ListConceptsToIgnore lists concepts that appear in the concept_dimension and not in the ontology (which is kind of strange)
+	ListConceptsToIgnore map[string]struct{}
+	// IDConcepts used to assign IDs (NodeEncryptIDs) to be encrypted to the different concepts
+	IDConcepts int64
+	// TagIDConceptsUsed used to keep track of the number of TAG_IDs that have been used
+	TagIDConceptsUsed int64
+
+	// HeaderTableAccess contains all the headers for the table_access table
+	HeaderTableAccess []string
+	// TableTableAccess is the table that contains all data from the table_access table
+	TableTableAccess []TableAccess
+
+	// TablesMedCoOntology distinguishes between the different medco ontology tables
+	TablesMedCoOntology map[string]MedCoTableInfo
+	// HeaderMedCoOntology contains all the headers for the medco table
+	HeaderMedCoOntology []string
+
+	// TableLocalOntologyClear is the local ontology table (it maps the concept path to a concept) with only the NON_SENSITIVE concepts
+	TableLocalOntologyClear map[string]*LocalOntology
+	// TableLocalModifiersClear is the local ontology table with only the NON_SENSITIVE modifiers
+	TableLocalModifiersClear map[ModifierPK]*LocalOntology
+	// MapConceptPathToTag maps a sensitive concept path to its respective tag and tag_id
+	MapConceptPathToTag map[string]TagAndID
+	// MapSynonymPathToPrimary maps the path of a synonym of a sensitive concept to the path of its original concept
+	MapSynonymPathToPrimary map[string]string
+	// MapConceptPathToEncryptID maps a sensitive concept path to its NodeEncryptID
+	MapConceptPathToEncryptID map[string]int64
+	// MapModifierPathToTag maps a sensitive modifier path to its respective tag and tag_id
+	MapModifierPathToTag map[string]TagAndID
+	// MapModifierPathToEncryptID maps a sensitive modifier path to its NodeEncryptID (a modifier applied to several concepts is encrypted only once)
+	MapModifierPathToEncryptID map[string]int64
+	// HeaderLocalOntology contains all the headers for the i2b2 table
+	HeaderLocalOntology []string
+
+	// ObservationsIndex indexes (on disk) the observations of the original patients that have dummies
+	ObservationsIndex *ObservationIndex
+	// HeaderObservationFact contains all the headers for the observation_fact table
+	HeaderObservationFact []string
+	// TextSearchIndex counter used to fill up the last column of observation_fact table
+	TextSearchIndex int64
+
+	// TableDummyToPatient contains all dummies and the original patient that is associated with them
+	TableDummyToPatient map[string]string
+	// TableGeneratedDummies contains the number of observations and the cluster of the generated dummies (see
+	// GenerateDummies), their concepts and modifiers are only drawn when they are written
+	TableGeneratedDummies map[string]GeneratedDummy
+	// DummyFacts is the number of observations written for each dummy by ConvertObservationFact
+	DummyFacts map[string]int64
+
+	// MapNewPatientNum keeps track of the mapping between the old patient_num and the new one
+	MapNewPatientNum map[string]string
+	// TablePatientDimension is patient_dimension table
+	TablePatientDimension map[PatientDimensionPK]PatientDimension
+	// HeaderPatientDimension contains all the headers for the Patient_Dimension table
+	HeaderPatientDimension []string
+
+	// MapNewEncounterNum maps [old_patient_num old_encounter_num] -> [new_patient_num new_encounter_num].
+	// For the dummies the [old_patient_num old_encounter_num] refers to the original values
+	MapNewEncounterNum map[VisitDimensionPK]VisitDimensionPK
+	// MapPatientVisits maps a patient_num to all its encounter_nums
+	MapPatientVisits map[string][]string
+	// MaxVisits keeps track of the maximum number of visits of all the patients
+	MaxVisits int
+	// TableVisitDimension is visit_dimension table
+	TableVisitDimension map[VisitDimensionPK]VisitDimension
+	// HeaderVisitDimension contains all the headers for the visit_dimension table
+	HeaderVisitDimension []string
+
+	// TableConceptDimension is concept_dimension table
+	TableConceptDimension map[*ConceptDimensionPK]ConceptDimension
+	// HeaderConceptDimension contains all the headers for the concept_dimension table
+	HeaderConceptDimension []string
+	// MapConceptCodeToTag maps the concept code (in the concept dimension) to the tag ID value (for the sensitive terms)
+	MapConceptCodeToTag map[string]int64
+
+	// TableModifierDimension is modifier_dimension table
+	TableModifierDimension map[*ModifierDimensionPK]ModifierDimension
+	// HeaderModifierDimension contains all the headers for the modifier_dimension table
+	HeaderModifierDimension []string
+	// MapModifierCodeToTag maps the modifier code to the tag ID value (for the sensitive modifiers)
+	MapModifierCodeToTag map[string]int64
+	// ListModifiersToIgnore lists modifiers that appear in the modifier_dimension and not in the ontology but have a sensitive parent
+	ListModifiersToIgnore map[string]struct{}
+
+	// ReportConcepts and ReportModifiers classify the concepts and modifiers of the concept_dimension and
+	// modifier_dimension, ConceptObservations and ModifierObservations count the observations of the dataset per
+	// concept_cd and modifier_cd and DroppedObservations the ones with an ignored concept or modifier (see
+	// WriteSensitivityReport)
+	ReportConcepts       []ReportEntry
+	ReportModifiers      []ReportEntry
+	ConceptObservations  map[string]int64
+	ModifierObservations map[string]int64
+	DroppedObservations  int64
+}
+
+// NewLoader creates a loader for the dataset described by the options
+func NewLoader(opts Options) (*Loader, error) {
+	l := &Loader{
+		Options:              opts,
+		OntologyFilesPaths:   make([]string, 0),
+		InputFilePaths:       make(map[string]string),
+		OutputFilePaths:      make(map[string]FileInfo),
+		SensitivityDecisions: make(map[string]loader.Decision),
+		State:                NewState(),
+	}
+
+	id := make([]byte, 8)
+	if _, err := cryptorand.Read(id); err != nil {
+		return nil, loader.NewError(loader.ErrRandomness, err)
+	}
+	l.surveyID = "tagging_loading_phase_" + hex.EncodeToString(id)
+
+	if err := checkDummyStrategy(opts.DummyStrategy); err != nil {
+		return nil, err
+	}
+	// the originals of the dummies generated by the previous loads are not recorded: they could not get copies of the
+	// new visits and facts of their original, and new dummies for the same patients would set them apart
+	if opts.Dummies > 0 && opts.Delta {
+		return nil, loader.NewError(loader.ErrInputFormat, errors.New("the dummies cannot be generated in delta mode"))
+	}
+	if err := loader.CheckResume(opts.CheckpointDir, opts.Resume); err != nil {
+		return nil, err
+	}
+
+	if l.Policy == nil {
+		sensitive := make([]string, 0, len(opts.SensitiveConcepts))
+		for concept := range opts.SensitiveConcepts {
+			sensitive = append(sensitive, concept)
+		}
+		l.Policy = loader.NewListPolicy(opts.AllSensitive, sensitive)
+	}
+	if err := l.Policy.Compile(); err != nil {
+		return nil, err
+	}
+
+	// default dataset
+	if opts.Directory == "" {
+		l.OntologyFilesPaths = append(l.OntologyFilesPaths, defaultOntologyFilesPaths...)
+		for k, v := range defaultInputFilePaths {
+			l.InputFilePaths[k] = DefaultDataPath + v
+		}
+		l.generateOutputFiles(DefaultDataPath + defaultOutputFolder)
+		l.generateMappingFiles(DefaultDataPath + defaultMappingFolder)
+		l.generateReportFile(DefaultDataPath + defaultMappingFolder)
+		return l, l.checkMappings(true)
+	}
+
+	// change input filepaths
+	if len(opts.Files.Ontology) == 0 {
+		return nil, loader.NewError(loader.ErrInputFormat, errors.New("no ontology files were selected for conversion"))
+	}
+
+	for _, name := range opts.Files.Ontology {
+		tokens := strings.Split(name, "/")
+		ontologyName := "ONTOLOGY_" + strings.ToUpper(strings.Split(tokens[len(tokens)-1], ".")[0])
+		l.InputFilePaths[ontologyName] = opts.Directory + "/" + name
+		l.OntologyFilesPaths = append(l.OntologyFilesPaths, ontologyName)
+	}
+	l.InputFilePaths["TABLE_ACCESS"] = opts.Directory + "/" + opts.Files.TableAccess
+	l.InputFilePaths["PATIENT_DIMENSION"] = opts.Directory + "/" + opts.Files.PatientDimension
+	l.InputFilePaths["VISIT_DIMENSION"] = opts.Directory + "/" + opts.Files.VisitDimension
+	l.InputFilePaths["CONCEPT_DIMENSION"] = opts.Directory + "/" + opts.Files.ConceptDimension
+	// the modifier_dimension is optional (i2b2 data without modifiers)
+	if opts.Files.ModifierDimension != "" {
+		l.InputFilePaths["MODIFIER_DIMENSION"] = opts.Directory + "/" + opts.Files.ModifierDimension
+	}
+	l.InputFilePaths["OBSERVATION_FACT"] = opts.Directory + "/" + opts.Files.ObservationFact
+	l.InputFilePaths["DUMMY_TO_PATIENT"] = opts.Directory + "/" + opts.Files.DummyToPatient
+
+	// change output filepaths
+	l.generateOutputFiles(opts.Directory + "/" + opts.Files.OutputFolder)
+	if opts.Files.MappingFolder != "" {
+		l.generateMappingFiles(opts.Directory + "/" + opts.Files.MappingFolder)
+		l.generateReportFile(opts.Directory + "/" + opts.Files.MappingFolder)
+	} else {
+		l.generateMappingFiles(opts.Directory + "/" + opts.Files.OutputFolder)
+		l.generateReportFile(opts.Directory + "/" + opts.Files.OutputFolder)
+	}
+
+	return l, l.checkMappings(opts.Files.MappingFolder != "")
+}
+
+// checkMappings checks that the mappings and the sensitivity report can be written where they are expected. They are
+// only written in plaintext next to the converted files if PlaintextMappings is set (with a warning).
+func (l *Loader) checkMappings(separateFolder bool) error {
+	// the mapping tables are named <schema>.<mapping> in the statements, the schema cannot need quoting
+	if l.MappingSchema != "" && !plainIdentifier.MatchString(l.MappingSchema) {
+		return loader.NewError(loader.ErrInputFormat, errors.New("invalid mapping schema "+l.MappingSchema+" (lowercase letters, digits and underscores only)"))
+	}
+	if l.MappingSchema != "" && l.ConvertOnly {
+		return loader.NewError(loader.ErrInputFormat, errors.New("the mappings can only be stored in the database schema "+l.MappingSchema+" when loading the data"))
+	}
+	if !separateFolder && len(l.MappingKey) == 0 {
+		files := "the sensitivity report"
+		if l.MappingSchema == "" {
+			files = "the mapping files (" + strings.ToLower(strings.Join(MappingFiles, ", ")) + ") and the sensitivity report"
+		}
+		if !l.PlaintextMappings {
+			return loader.NewError(loader.ErrInputFormat, errors.New(files+" would be written in plaintext in the output folder: "+
+				"set a MappingFolder or a mapping key, or explicitly allow plaintext mappings"))
+		}
+		log.Warn(strings.ToUpper(files[:1]) + files[1:] + " are written in plaintext in the output folder: it must not be shared")
+	}
+	return nil
+}
+
 // MAIN function
 
-func generateOutputFiles(folderPath string) {
+func (l *Loader) generateOutputFiles(folderPath string) {
 	// fixed demodata tables
-	OutputFilePaths["PATIENT_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "patient_dimension", Path: folderPath + "patient_dimension.csv"}
-	OutputFilePaths["NEW_PATIENT_NUM"] = FileInfo{TableName: "", Path: folderPath + "new_patient_num.csv"}
-	OutputFilePaths["VISIT_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "visit_dimension", Path: folderPath + "visit_dimension.csv"}
-	OutputFilePaths["NEW_ENCOUNTER_NUM"] = FileInfo{TableName: "", Path: folderPath + "new_encounter_num.csv"}
-	OutputFilePaths["CONCEPT_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "concept_dimension", Path: folderPath + "concept_dimension.csv"}
-	OutputFilePaths["OBSERVATION_FACT"] = FileInfo{TableName: I2B2DEMODATA + "observation_fact", Path: folderPath + "observation_fact.csv"}
+	l.OutputFilePaths["PATIENT_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "patient_dimension", Path: folderPath + "patient_dimension.csv"}
+	l.OutputFilePaths["VISIT_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "visit_dimension", Path: folderPath + "visit_dimension.csv"}
+	l.OutputFilePaths["CONCEPT_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "concept_dimension", Path: folderPath + "concept_dimension.csv"}
+	l.OutputFilePaths["OBSERVATION_FACT"] = FileInfo{TableName: I2B2DEMODATA + "observation_fact", Path: folderPath + "observation_fact.csv"}
+	if _, ok := l.InputFilePaths["MODIFIER_DIMENSION"]; ok {
+		l.OutputFilePaths["MODIFIER_DIMENSION"] = FileInfo{TableName: I2B2DEMODATA + "modifier_dimension", Path: folderPath + "modifier_dimension.csv"}
+	}
 
 	// fixed ontology tables
-	OutputFilePaths["TABLE_ACCESS"] = FileInfo{TableName: ONT + "table_access", Path: folderPath + "table_access.csv"}
-	OutputFilePaths["SENSITIVE_TAGGED"] = FileInfo{TableName: ONT + "sensitive_tagged", Path: folderPath + "sensitive_tagged.csv"}
+	l.OutputFilePaths["TABLE_ACCESS"] = FileInfo{TableName: ONT + "table_access", Path: folderPath + "table_access.csv"}
+	l.OutputFilePaths["SENSITIVE_TAGGED"] = FileInfo{TableName: ONT + "sensitive_tagged", Path: folderPath + "sensitive_tagged.csv"}
 
-	for key, path := range InputFilePaths {
+	// summary of the loading (convert-only mode)
+	l.OutputFilePaths["LOADING_SUMMARY"] = FileInfo{TableName: "", Path: folderPath + "loading_summary.txt"}
+
+	for key, path := range l.InputFilePaths {
 		if strings.HasPrefix(key, "ONTOLOGY_") {
 			rawKey := strings.Split(key, "ONTOLOGY_")[1]
 			tokens := strings.Split(path, "/")
 
-			OutputFilePaths["LOCAL_"+rawKey] = FileInfo{TableName: I2B2METADATA + strings.ToLower(rawKey), Path: folderPath + "local_" + tokens[len(tokens)-1]}
-			OutputFilePaths["MEDCO_"+rawKey] = FileInfo{TableName: ONT + strings.ToLower(rawKey), Path: folderPath + "medco_" + tokens[len(tokens)-1]}
+			l.OutputFilePaths["LOCAL_"+rawKey] = FileInfo{TableName: I2B2METADATA + strings.ToLower(rawKey), Path: folderPath + "local_" + tokens[len(tokens)-1]}
+			l.OutputFilePaths["MEDCO_"+rawKey] = FileInfo{TableName: ONT + strings.ToLower(rawKey), Path: folderPath + "medco_" + tokens[len(tokens)-1]}
 		}
 	}
 }
 
-// LoadI2B2Data it's the main function that performs a full conversion and loading of the I2B2 data
-func LoadI2B2Data(el *onet.Roster, entryPointIdx int, directory string, files Files, allSensitive bool, mapSensitive map[string]struct{}, i2b2DB loader.DBSettings, empty bool) error {
-	InputFilePaths = make(map[string]string)
-	OutputFilePaths = make(map[string]FileInfo)
-	OntologyFilesPaths = make([]string, 0)
+// Load performs a full conversion and loading of the i2b2 data. If ConvertOnly is set the data is not loaded, instead a
+// summary of the loading is written in the output folder.
+func (l *Loader) Load() error {
+	log.Lvl2("--- Started v1 Data Conversion ---")
 
-	if allSensitive {
-		AllSensitive = true
-	} else {
-		ListSensitiveConcepts = mapSensitive
+	// the mappings stored in the database are only written to disk (in a private folder) until they are loaded
+	done := false
+	if l.MappingSchema != "" {
+		dir, err := l.privateMappingFolder()
+		if err != nil {
+			return err
+		}
+		l.generateMappingFiles(dir + "/")
+		// they are kept for the resumption of a failed loading (without a checkpoint it cannot be resumed)
+		defer func() {
+			if done || l.CheckpointDir == "" {
+				os.RemoveAll(dir)
+			}
+		}()
 	}
 
-	// change input filepaths
-	if len(files.Ontology) == 0 {
-		log.Fatal("No Ontology files were selected for conversion")
+	if l.CheckpointDir != "" {
+		err := l.openCheckpoint()
+		if err != nil {
+			return err
+		}
 	}
 
-	for _, name := range files.Ontology {
-		tokens := strings.Split(name, "/")
-		ontologyName := "ONTOLOGY_" + strings.ToUpper(strings.Split(tokens[len(tokens)-1], ".")[0])
-		InputFilePaths[ontologyName] = directory + "/" + name
-		OntologyFilesPaths = append(OntologyFilesPaths, ontologyName)
+	if !l.checkpoint.Done(phaseConvert) {
+		err := l.Convert()
+		if err != nil {
+			return err
+		}
+		err = l.checkpoint.Complete(phaseConvert, l.convertedFiles())
+		if err != nil {
+			return err
+		}
+	} else {
+		// the loading replaces the rows of the table_access of the converted file
+		err := l.ParseTableAccess()
+		if err != nil {
+			return err
+		}
 	}
-	InputFilePaths["TABLE_ACCESS"] = directory + "/" + files.TableAccess
-	InputFilePaths["PATIENT_DIMENSION"] = directory + "/" + files.PatientDimension
-	InputFilePaths["VISIT_DIMENSION"] = directory + "/" + files.VisitDimension
-	InputFilePaths["CONCEPT_DIMENSION"] = directory + "/" + files.ConceptDimension
-	InputFilePaths["OBSERVATION_FACT"] = directory + "/" + files.ObservationFact
-	InputFilePaths["DUMMY_TO_PATIENT"] = directory + "/" + files.DummyToPatient
 
-	// change output filepaths
-	generateOutputFiles(directory + "/" + files.OutputFolder)
+	if l.ConvertOnly {
+		err := l.WriteLoadingSummary()
+		if err != nil {
+			log.Error("Error while writing the loading summary", err)
+			return err
+		}
 
-	log.Lvl2("--- Started v1 Data Conversion ---")
+		log.Lvl2("--- Finished writing loading summary", l.OutputFilePaths["LOADING_SUMMARY"].Path, "---")
+		return nil
+	}
 
-	err := ParseTableAccess()
+	err := l.checkpoint.Run(phaseLoad, l.LoadDataFiles)
 	if err != nil {
+		log.Error("Error while loading data", err)
 		return err
 	}
 
-	err = ConvertTableAccess()
-	if err != nil {
-		return err
+	log.Lvl2("--- Finished loading data ---")
+
+	if l.Verify {
+		err = l.VerifyDataFiles()
+		if err != nil {
+			log.Error("Error while verifying the loaded data", err)
+			return err
+		}
+
+		log.Lvl2("--- Finished verifying the loaded data ---")
 	}
 
-	log.Lvl2("--- Finished converting TABLE_ACCESS ---")
+	done = true
+	return nil
+}
 
-	err = ConvertLocalOntology(el, entryPointIdx)
-	if err != nil {
-		return err
+// privateMappingFolder creates the private folder where the mappings stored in the MappingSchema are written until they
+// are loaded: a folder of the CheckpointDir (kept if the loading fails, for its resumption) or a temporary one
+func (l *Loader) privateMappingFolder() (string, error) {
+	if l.CheckpointDir == "" {
+		dir, err := ioutil.TempDir("", "medco_mappings_")
+		if err != nil {
+			return "", loader.NewError(loader.ErrOutput, err)
+		}
+		return dir, nil
 	}
 
-	log.Lvl2("--- Finished converting LOCAL_ONTOLOGY ---")
+	dir := filepath.Join(l.CheckpointDir, "mappings")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", loader.NewError(loader.ErrOutput, err).InFile(dir, 0)
+	}
+	return dir, nil
+}
 
-	err = GenerateMedCoOntology()
+// Convert converts the i2b2 data (reading what the previous loads left in the database first if Delta is set)
+func (l *Loader) Convert() error {
+	if l.Delta {
+		state, err := ReadState(l.I2B2DB)
+		if err != nil {
+			log.Error("Error while reading the database", err)
+			return err
+		}
+		l.State = state
+
+		err = l.ReadPreviousConversion()
+		if err != nil {
+			log.Error("Error while reading the previous conversion", err)
+			return err
+		}
+
+		log.Lvl2("--- Finished reading the previous loads ---")
+	}
+
+	err := l.ParseTableAccess()
 	if err != nil {
 		return err
 	}
 
-	log.Lvl2("--- Finished generating MEDCO_ONTOLOGY ---")
-
-	err = ParseDummyToPatient()
+	err = l.ConvertTableAccess()
 	if err != nil {
 		return err
 	}
 
-	err = ParsePatientDimension(el.Aggregate)
+	log.Lvl2("--- Finished converting TABLE_ACCESS ---")
+
+	err = l.ConvertLocalOntology()
 	if err != nil {
 		return err
 	}
-	err = ConvertPatientDimension(el.Aggregate, empty)
+
+	log.Lvl2("--- Finished converting LOCAL_ONTOLOGY ---")
+
+	err = l.GenerateMedCoOntology()
 	if err != nil {
 		return err
 	}
 
-	log.Lvl2("--- Finished converting PATIENT_DIMENSION ---")
+	log.Lvl2("--- Finished generating MEDCO_ONTOLOGY ---")
 
-	err = ParseVisitDimension()
+	// the concepts and modifiers to ignore are known before the generation of the dummies
+	err = l.ParseConceptDimension()
 	if err != nil {
 		return err
 	}
-	err = ConvertVisitDimension(empty)
+	err = l.ConvertConceptDimension()
 	if err != nil {
 		return err
 	}
 
-	log.Lvl2("--- Finished converting VISIT_DIMENSION ---")
+	log.Lvl2("--- Finished converting CONCEPT_DIMENSION ---")
+
+	if _, ok := l.InputFilePaths["MODIFIER_DIMENSION"]; ok {
+		err = l.ParseModifierDimension()
+		if err != nil {
+			return err
+		}
+		err = l.ConvertModifierDimension()
+		if err != nil {
+			return err
+		}
+
+		log.Lvl2("--- Finished converting MODIFIER_DIMENSION ---")
+	}
 
-	err = ParseConceptDimension()
+	err = l.ParsePatientDimension(l.Roster.Aggregate)
 	if err != nil {
 		return err
 	}
-	err = ConvertConceptDimension()
+	// the visits are known before the generation of the dummies (only the observations of existing visits are copied)
+	err = l.ParseVisitDimension()
 	if err != nil {
 		return err
 	}
-
-	log.Lvl2("--- Finished converting CONCEPT_DIMENSION ---")
-
-	err = ParseObservationFact()
+	if l.Dummies > 0 {
+		err = l.GenerateDummies()
+	} else {
+		err = l.ParseDummyToPatient()
+	}
 	if err != nil {
 		return err
 	}
-	err = ConvertObservationFact()
+	err = l.ConvertPatientDimension(l.Roster.Aggregate, l.Empty)
 	if err != nil {
 		return err
 	}
 
-	log.Lvl2("--- Finished converting OBSERVATION_FACT ---")
+	log.Lvl2("--- Finished converting PATIENT_DIMENSION ---")
 
-	err = GenerateLoadingDataScript(i2b2DB)
+	err = l.ConvertVisitDimension(l.Empty)
 	if err != nil {
-		log.Fatal("Error while generating the loading data .sh file", err)
 		return err
 	}
 
-	log.Lvl2("--- Finished generating loading script ---")
+	log.Lvl2("--- Finished converting VISIT_DIMENSION ---")
 
-	err = LoadDataFiles()
+	err = l.ParseObservationFact()
 	if err != nil {
-		log.Fatal("Error while loading data", err)
 		return err
 	}
-
-	log.Lvl2("--- Finished loading data ---")
-
-	return nil
-}
-
-// GenerateLoadingDataScript creates a load dataset .sql script (deletes the data in the corresponding tables and reloads the new 'protected' data)
-func GenerateLoadingDataScript(i2b2DB loader.DBSettings) error {
-	fp, err := os.Create(FileBashPath)
+	err = l.ConvertObservationFact()
 	if err != nil {
 		return err
 	}
 
-	loading := `#!/usr/bin/env bash` + "\n" + "\n" + `PGPASSWORD=` + i2b2DB.DBpassword + ` psql -v ON_ERROR_STOP=1 -h "` + i2b2DB.DBhost +
-		`" -U "` + i2b2DB.DBuser + `" -p ` + strconv.FormatInt(int64(i2b2DB.DBport), 10) + ` -d "` + i2b2DB.DBname + `" <<-EOSQL` + "\n"
+	log.Lvl2("--- Finished converting OBSERVATION_FACT ---")
 
-	loading += "BEGIN;\n"
+	return l.WriteSensitivityReport()
+}
 
-	loading += "TRUNCATE TABLE " + I2B2DEMODATA + "patient_mapping;\n" +
-		"TRUNCATE TABLE " + I2B2DEMODATA + "encounter_mapping;\n" +
-		"TRUNCATE TABLE " + I2B2DEMODATA + "concept_dimension;\n" +
-		"TRUNCATE TABLE " + I2B2DEMODATA + "patient_dimension;\n" +
-		"TRUNCATE TABLE " + I2B2DEMODATA + "visit_dimension;\n" +
-		"TRUNCATE TABLE " + I2B2DEMODATA + "observation_fact;\n"
+// GenerateLoadingDataStatements creates the list of statements to load the dataset (deletes the data in the corresponding tables and reloads the new 'protected' data).
+// In delta mode the data tables are not emptied, only the ontology tables are replaced.
+func (l *Loader) GenerateLoadingDataStatements() []loader.Statement {
+	statements := make([]loader.Statement, 0)
+	if !l.Delta {
+		statements = append(statements,
+			loader.TruncateStatement(I2B2DEMODATA+"patient_mapping"),
+			loader.TruncateStatement(I2B2DEMODATA+"encounter_mapping"),
+			loader.TruncateStatement(I2B2DEMODATA+"concept_dimension"),
+			loader.TruncateStatement(I2B2DEMODATA+"patient_dimension"),
+			loader.TruncateStatement(I2B2DEMODATA+"visit_dimension"),
+			loader.TruncateStatement(I2B2DEMODATA+"observation_fact"))
+	}
 
-	loading += `\copy ` + OutputFilePaths["CONCEPT_DIMENSION"].TableName + ` FROM '` + OutputFilePaths["CONCEPT_DIMENSION"].Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n" +
-		`\copy ` + OutputFilePaths["PATIENT_DIMENSION"].TableName + ` FROM '` + OutputFilePaths["PATIENT_DIMENSION"].Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n" +
-		`\copy ` + OutputFilePaths["VISIT_DIMENSION"].TableName + ` FROM '` + OutputFilePaths["VISIT_DIMENSION"].Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n" +
-		`\copy ` + OutputFilePaths["OBSERVATION_FACT"].TableName + ` FROM '` + OutputFilePaths["OBSERVATION_FACT"].Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n"
+	for _, file := range []string{"CONCEPT_DIMENSION", "PATIENT_DIMENSION", "VISIT_DIMENSION", "OBSERVATION_FACT"} {
+		statements = append(statements, loader.CopyStatement(l.OutputFilePaths[file].TableName, l.OutputFilePaths[file].Path, true))
+	}
 
-	loading += "\n"
+	if fI, ok := l.OutputFilePaths["MODIFIER_DIMENSION"]; ok {
+		if !l.Delta {
+			statements = append(statements, loader.TruncateStatement(fI.TableName))
+		}
+		statements = append(statements, loader.CopyStatement(fI.TableName, fI.Path, true))
+	}
+
+	// sort the files to always load the tables in the same order
+	files := make([]string, 0, len(l.OutputFilePaths))
+	for file := range l.OutputFilePaths {
+		files = append(files, file)
+	}
+	sort.Strings(files)
 
-	for file, fI := range OutputFilePaths {
+	for _, file := range files {
 		if strings.HasPrefix(file, "LOCAL_") {
-			loading += "TRUNCATE TABLE " + fI.TableName + ";\n"
-			loading += `\copy ` + fI.TableName + ` FROM '` + fI.Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n"
+			fI := l.OutputFilePaths[file]
+			statements = append(statements, loader.TruncateStatement(fI.TableName), loader.CopyStatement(fI.TableName, fI.Path, true))
 		}
 	}
 
-	loading += `\copy ` + OutputFilePaths["TABLE_ACCESS"].TableName + ` FROM '` + OutputFilePaths["TABLE_ACCESS"].Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n"
-	loading += "TRUNCATE TABLE " + OutputFilePaths["SENSITIVE_TAGGED"].TableName + ";\n"
-	loading += `\copy ` + OutputFilePaths["SENSITIVE_TAGGED"].TableName + ` FROM '` + OutputFilePaths["SENSITIVE_TAGGED"].Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n"
-	loading += "\n"
+	// the table_access is shared with the other loaders (e.g. the ontologies of the v0 loader): only the rows of the
+	// tables of the converted file are replaced (it is complete, also in delta mode)
+	fI := l.OutputFilePaths["TABLE_ACCESS"]
+	if len(l.TableTableAccess) > 0 {
+		codes := make([]string, 0, len(l.TableTableAccess))
+		for _, ta := range l.TableTableAccess {
+			codes = append(codes, pq.QuoteLiteral(ta.TableCD))
+		}
+		statements = append(statements, loader.Statement{Table: fI.TableName,
+			SQL: "DELETE FROM " + fI.TableName + " WHERE c_table_cd IN (" + strings.Join(codes, ", ") + ");"})
+	}
+	statements = append(statements, loader.CopyStatement(fI.TableName, fI.Path, true))
+	if !l.Delta {
+		statements = append(statements, loader.TruncateStatement(l.OutputFilePaths["SENSITIVE_TAGGED"].TableName))
+	}
+	statements = append(statements, loader.CopyStatement(l.OutputFilePaths["SENSITIVE_TAGGED"].TableName, l.OutputFilePaths["SENSITIVE_TAGGED"].Path, true))
 
 	// Create MedCo Table
 
-	for file, fI := range OutputFilePaths {
+	for _, file := range files {
 		if strings.HasPrefix(file, "MEDCO_") {
-			loading += `CREATE TABLE IF NOT EXISTS ` + fI.TableName + ` (
+			fI := l.OutputFilePaths[file]
+			statements = append(statements, loader.Statement{Table: fI.TableName, SQL: `CREATE TABLE IF NOT EXISTS ` + fI.TableName + ` (
         				C_HLEVEL NUMERIC(22,0),
         				C_FULLNAME VARCHAR(900),
         				C_NAME VARCHAR(2000),
@@ -346,35 +715,60 @@ func GenerateLoadingDataScript(i2b2DB loader.DBSettings) error {
         				M_APPLIED_PATH VARCHAR(900),
         				M_EXCLUSION_CD VARCHAR(900));
         				
-						ALTER TABLE ` + fI.TableName + ` OWNER TO i2b2;` + "\n"
+						ALTER TABLE ` + fI.TableName + ` OWNER TO i2b2;`})
 
-			loading += "TRUNCATE TABLE " + fI.TableName + ";\n"
-			loading += `\copy ` + fI.TableName + ` FROM '` + fI.Path + `' ESCAPE '"' DELIMITER ',' CSV HEADER;` + "\n"
+			statements = append(statements, loader.TruncateStatement(fI.TableName), loader.CopyStatement(fI.TableName, fI.Path, true))
 		}
 	}
-	loading += "COMMIT;\n"
-	loading += "EOSQL"
 
-	_, err = fp.WriteString(loading)
+	return append(statements, l.mappingStatements()...)
+}
+
+// LoadDataFiles loads the new converted data into the database in a single transaction
+func (l *Loader) LoadDataFiles() error {
+	return loader.ExecuteStatements(l.I2B2DB, l.GenerateLoadingDataStatements())
+}
+
+// VerifyDataFiles compares the tables loaded by LoadDataFiles with the converted files (row counts and checksums) and
+// checks that a sample of the TAG_IDs of the observations are in the sensitive_tagged table. It returns an error of the
+// category ErrDBLoad if they do not match.
+func (l *Loader) VerifyDataFiles() error {
+	var verification loader.Verification
+	var err error
+
+	verification.Tables, err = loader.VerifyStatements(l.I2B2DB, l.GenerateLoadingDataStatements())
+	if err != nil {
+		return err
+	}
+	facts := loader.CopyStatement(l.OutputFilePaths["OBSERVATION_FACT"].TableName, l.OutputFilePaths["OBSERVATION_FACT"].Path, true)
+	verification.TagsChecked, verification.MissingTags, err = loader.VerifyTags(l.I2B2DB, facts, l.OutputFilePaths["SENSITIVE_TAGGED"].TableName)
 	if err != nil {
 		return err
 	}
 
-	fp.Close()
-
-	return nil
+	log.Lvl2("Verification of the loaded data:\n" + verification.String())
+	return verification.Err()
 }
 
-// LoadDataFiles executes the loading script for the new converted data
-func LoadDataFiles() error {
-	return loader.ExecuteScript(FileBashPath)
+// WriteLoadingSummary writes a summary of what would be truncated and loaded (without connecting to the database)
+func (l *Loader) WriteLoadingSummary() error {
+	summary, err := loader.LoadingSummary(l.I2B2DB, l.GenerateLoadingDataStatements())
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(l.OutputFilePaths["LOADING_SUMMARY"].Path, []byte(summary), 0644)
+	if err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["LOADING_SUMMARY"].Path, 0)
+	}
+	return nil
 }
 
-func readCSV(filename string) ([][]string, error) {
-	csvInputFile, err := os.Open(InputFilePaths[filename])
+// readCSV reads the whole input file filename (the first line is the header)
+func (l *Loader) readCSV(filename string) ([][]string, error) {
+	path := l.InputFilePaths[filename]
+	csvInputFile, err := os.Open(path)
 	if err != nil {
-		log.Fatal("Error opening [" + strings.ToLower(InputFilePaths[filename]) + "].csv")
-		return nil, err
+		return nil, loader.NewInputError(path, err)
 	}
 	defer csvInputFile.Close()
 
@@ -383,8 +777,10 @@ func readCSV(filename string) ([][]string, error) {
 
 	lines, err := reader.ReadAll()
 	if err != nil {
-		log.Fatal("Error reading [" + strings.ToLower(filename) + "].csv")
-		return nil, err
+		return nil, loader.NewInputError(path, err)
+	}
+	if len(lines) == 0 {
+		return nil, loader.NewInputError(path, errors.New("missing header"))
 	}
 
 	return lines, nil
@@ -427,38 +823,36 @@ func StripByLevel(conceptPath string, number int, order bool) string {
 	return "\\" + conceptPathFinal + "\\"
 }
 
-// HasSensitiveParents is a function that checks if a node whether in the LocalOntology or ConceptDimension has any siblings which are sensitive.
-func HasSensitiveParents(conceptPath string) (string, bool) {
-	if AllSensitive == true {
-		return "", true
-	}
-
-	temp := conceptPath
+// HasSensitiveParents checks whether a concept or modifier path (in the LocalOntology or ConceptDimension) is sensitive
+// according to the Policy, i.e. whether itself or one of its parents is matched by a rule. It returns the path matched
+// by the rule (empty if all the concepts are sensitive).
+func (l *Loader) HasSensitiveParents(conceptPath string) (string, bool) {
+	decision := l.Sensitivity(conceptPath)
+	return decision.Match, decision.Sensitive
+}
 
-	isSensitive := false
-	for temp != "" {
-		if _, ok := ListSensitiveConcepts[temp]; ok {
-			isSensitive = true
-			ListSensitiveConcepts[conceptPath] = struct{}{}
-			break
-		}
-		temp = StripByLevel(temp, 1, false)
+// Sensitivity returns the decision of the Policy about a concept or modifier path (recorded in SensitivityDecisions)
+func (l *Loader) Sensitivity(conceptPath string) loader.Decision {
+	decision, ok := l.SensitivityDecisions[conceptPath]
+	if !ok {
+		decision = l.Policy.Concept(conceptPath)
+		l.SensitivityDecisions[conceptPath] = decision
+		log.Lvl3("Sensitivity of", conceptPath+":", decision)
 	}
-	return temp, isSensitive
+	return decision
 }
 
 // TABLE_ACCESS.csv parser
 
 // ParseTableAccess reads and parses the table_access.csv.
-func ParseTableAccess() error {
-	lines, err := readCSV("TABLE_ACCESS")
+func (l *Loader) ParseTableAccess() error {
+	lines, err := l.readCSV("TABLE_ACCESS")
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 
-	HeaderTableAccess = make([]string, 0)
-	TableTableAccess = make([]TableAccess, 0)
+	l.HeaderTableAccess = make([]string, 0)
+	l.TableTableAccess = make([]TableAccess, 0)
 
 	/* structure of table_access.csv (in order):
 
@@ -489,35 +883,34 @@ func ParseTableAccess() error {
 	*/
 
 	for _, header := range lines[0] {
-		HeaderTableAccess = append(HeaderTableAccess, header)
+		l.HeaderTableAccess = append(l.HeaderTableAccess, header)
 	}
 
 	//skip header
 	for _, line := range lines[1:] {
-		TableTableAccess = append(TableTableAccess, TableAccessFromString(line))
+		l.TableTableAccess = append(l.TableTableAccess, TableAccessFromString(line))
 	}
 
 	return nil
 }
 
 // ConvertTableAccess converts the old xxxx.csv table_access file
-func ConvertTableAccess() error {
+func (l *Loader) ConvertTableAccess() error {
 	// two new files are generated: one to store the non-sensitive data and another to store the sensitive data
-	csvOutputFile, err := os.Create(OutputFilePaths["TABLE_ACCESS"].Path)
+	csvOutputFile, err := os.Create(l.OutputFilePaths["TABLE_ACCESS"].Path)
 	if err != nil {
-		log.Fatal("Error opening [TABLE_ACCESS].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["TABLE_ACCESS"].Path, 0)
 	}
 	defer csvOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderTableAccess {
+	for _, header := range l.HeaderTableAccess {
 		headerString += "\"" + header + "\","
 	}
 	// remove the last ,
 	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
-	for _, ta := range TableTableAccess {
+	for _, ta := range l.TableTableAccess {
 		csvOutputFile.WriteString(ta.ToCSVText() + "\n")
 	}
 
@@ -528,14 +921,14 @@ func ConvertTableAccess() error {
 // DUMMY_TO_PATIENT.csv parser
 
 // ParseDummyToPatient reads and parses the dummy_to_patient.csv.
-func ParseDummyToPatient() error {
-	lines, err := readCSV("DUMMY_TO_PATIENT")
+func (l *Loader) ParseDummyToPatient() error {
+	lines, err := l.readCSV("DUMMY_TO_PATIENT")
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 
-	TableDummyToPatient = make(map[string]string)
+	l.TableDummyToPatient = make(map[string]string)
+	l.TableGeneratedDummies = nil
 
 	/* structure of patient_dimension.csv (in order):
 
@@ -546,7 +939,7 @@ func ParseDummyToPatient() error {
 
 	//skip header
 	for _, line := range lines[1:] {
-		TableDummyToPatient[line[0]] = line[1]
+		l.TableDummyToPatient[line[0]] = line[1]
 	}
 
 	return nil
@@ -555,9 +948,9 @@ func ParseDummyToPatient() error {
 // MEDCO ontology converter
 
 // GenerateMedCoOntology generates all files for the medco ontology (these may include multiples tables)
-func GenerateMedCoOntology() error {
+func (l *Loader) GenerateMedCoOntology() error {
 	// initialize container structs and counters
-	HeaderMedCoOntology = []string{"c_hlevel",
+	l.HeaderMedCoOntology = []string{"c_hlevel",
 		"c_fullname",
 		"c_name",
 		"c_synonym_cd",
@@ -614,39 +1007,43 @@ func GenerateMedCoOntology() error {
 
 	*/
 
-	for _, key := range OntologyFilesPaths {
-		err := generateNewMedCoTable(strings.Split(key, "ONTOLOGY_")[1])
+	for _, key := range l.OntologyFilesPaths {
+		err := l.generateNewMedCoTable(strings.Split(key, "ONTOLOGY_")[1])
 		if err != nil {
-			log.Fatal("Error generating [" + key + "].csv")
 			return err
 		}
 	}
 	return nil
 }
 
-func generateNewMedCoTable(rawName string) error {
-	csvOutputFile, err := os.Create(OutputFilePaths["MEDCO_"+rawName].Path)
+func (l *Loader) generateNewMedCoTable(rawName string) error {
+	csvOutputFile, err := os.Create(l.OutputFilePaths["MEDCO_"+rawName].Path)
 	if err != nil {
-		log.Fatal("Error opening [" + rawName + "].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["MEDCO_"+rawName].Path, 0)
 	}
 	defer csvOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderMedCoOntology {
+	for _, header := range l.HeaderMedCoOntology {
 		headerString += "\"" + header + "\","
 	}
 	// remove the last ,
 	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
-	UpdateChildrenEncryptIDs(rawName) //updates the ChildrenEncryptIDs of the internal and parent nodes
+	l.UpdateChildrenEncryptIDs(rawName) //updates the ChildrenEncryptIDs of the internal and parent nodes
 
-	for _, so := range TablesMedCoOntology[rawName].Clear {
+	for _, so := range l.TablesMedCoOntology[rawName].Clear {
+		csvOutputFile.WriteString(so.ToCSVText() + "\n")
+	}
+	for _, so := range l.TablesMedCoOntology[rawName].ClearModifiers {
 		csvOutputFile.WriteString(so.ToCSVText() + "\n")
 	}
 
-	// copy the sensitive concept codes to the new csv files (it does not include the modifier concepts)
-	for _, so := range TablesMedCoOntology[rawName].Sensitive {
+	// copy the sensitive concept and modifier codes to the new csv files
+	for _, so := range l.TablesMedCoOntology[rawName].Sensitive {
+		csvOutputFile.WriteString(so.ToCSVText() + "\n")
+	}
+	for _, so := range l.TablesMedCoOntology[rawName].SensitiveModifiers {
 		csvOutputFile.WriteString(so.ToCSVText() + "\n")
 	}
 
@@ -654,8 +1051,8 @@ func generateNewMedCoTable(rawName string) error {
 }
 
 // UpdateChildrenEncryptIDs updates the parent and internal concept nodes with the IDs of their respective children (name identifies the name of the ontology table)
-func UpdateChildrenEncryptIDs(name string) {
-	for _, so := range TablesMedCoOntology[name].Sensitive {
+func (l *Loader) UpdateChildrenEncryptIDs(name string) {
+	for _, so := range l.TablesMedCoOntology[name].Sensitive {
 		path := so.Fullname
 		for true {
 			path = StripByLevel(path, 1, false)
@@ -663,62 +1060,76 @@ func UpdateChildrenEncryptIDs(name string) {
 				break
 			}
 
-			if val, ok := TablesMedCoOntology[name].Sensitive[path]; ok {
+			if val, ok := l.TablesMedCoOntology[name].Sensitive[path]; ok {
 				val.ChildrenEncryptIDs = append(val.ChildrenEncryptIDs, so.NodeEncryptID)
 			}
 
 		}
 	}
+
+	// the modifiers are only children of the modifiers with the same applied path
+	for pk, so := range l.TablesMedCoOntology[name].SensitiveModifiers {
+		path := pk.Fullname
+		for true {
+			path = StripByLevel(path, 1, false)
+			if path == "" {
+				break
+			}
+
+			if val, ok := l.TablesMedCoOntology[name].SensitiveModifiers[ModifierPK{Fullname: path, AppliedPath: pk.AppliedPath}]; ok {
+				val.ChildrenEncryptIDs = append(val.ChildrenEncryptIDs, so.NodeEncryptID)
+			}
+		}
+	}
 }
 
 // LOCAL ontology converter
 
 // ConvertLocalOntology reads and parses all local ontology tables and generates the corresponding .csv(s) (local, medco and adapter_mappings)
-func ConvertLocalOntology(group *onet.Roster, entryPointIdx int) error {
-	// initialize container structs and counters
-	IDConcepts = 0
-	TagIDConceptsUsed = 0
-	TablesMedCoOntology = make(map[string]MedCoTableInfo)
-	MapConceptPathToTag = make(map[string]TagAndID)
-
-	for _, key := range OntologyFilesPaths {
-		rawName := strings.Split(key, "ONTOLOGY_")[1]
-		err := ParseLocalTable(group, entryPointIdx, key)
+func (l *Loader) ConvertLocalOntology() error {
+	// initialize container structs and counters (the new IDs follow the ones of the previous loads)
+	l.IDConcepts = l.State.NextEncryptID
+	l.TagIDConceptsUsed = l.State.NextTagID
+	l.TablesMedCoOntology = make(map[string]MedCoTableInfo)
+	l.MapConceptPathToTag = make(map[string]TagAndID)
+	l.MapConceptPathToEncryptID = make(map[string]int64)
+	l.MapModifierPathToTag = make(map[string]TagAndID)
+	l.MapModifierPathToEncryptID = make(map[string]int64)
+	l.MapSynonymPathToPrimary = make(map[string]string)
+	l.MapModifierCodeToTag = make(map[string]int64)
+	l.ListModifiersToIgnore = make(map[string]struct{})
+
+	for _, key := range l.OntologyFilesPaths {
+		err := l.ParseLocalTable(key)
 		if err != nil {
-			log.Fatal("Error parsing [" + strings.ToLower(rawName) + "].csv")
 			return err
 		}
-		err = ConvertClearLocalTable(rawName)
+		err = l.ConvertClearLocalTable(strings.Split(key, "ONTOLOGY_")[1])
 		if err != nil {
-			log.Fatal("Error converting [" + strings.ToLower(rawName) + "].csv")
 			return err
 		}
 	}
 
-	err := ConvertSensitiveLocalTable()
-	if err != nil {
-		log.Fatal("Error converting [sensitive_tagged].csv")
-		return err
-	}
-
-	return nil
+	return l.ConvertSensitiveLocalTable()
 }
 
 // ParseLocalTable reads and parses the xxxx.csv (part of the local ontology)
 // The medco ontology is also generated based on the local ontology. Each local table (in i2b2metadata is replicated in the medco_ont, with some minor changes)
-func ParseLocalTable(group *onet.Roster, entryPointIdx int, name string) error {
-	lines, err := readCSV(name)
+func (l *Loader) ParseLocalTable(name string) error {
+	lines, err := l.readCSV(name)
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 	rawName := strings.Split(name, "ONTOLOGY_")[1]
 
-	HeaderLocalOntology = make([]string, 0)
-	TableLocalOntologyClear = make(map[string]*LocalOntology)
+	l.HeaderLocalOntology = make([]string, 0)
+	l.TableLocalOntologyClear = make(map[string]*LocalOntology)
+	l.TableLocalModifiersClear = make(map[ModifierPK]*LocalOntology)
 
 	listConceptCD := make([]string, 0)
 	allSensitiveConceptIDs := make([]int64, 0)
+	listModifierCD := make([]string, 0)
+	allSensitiveModifierIDs := make([]int64, 0)
 
 	/* structure of i2b2.csv (in order):
 
@@ -756,201 +1167,297 @@ func ParseLocalTable(group *onet.Roster, entryPointIdx int, name string) error {
 	*/
 
 	for _, header := range lines[0] {
-		HeaderLocalOntology = append(HeaderLocalOntology, header)
+		l.HeaderLocalOntology = append(l.HeaderLocalOntology, header)
 	}
 
 	plainCode := false
-	if HeaderLocalOntology[len(HeaderLocalOntology)-1] == "plain_code" {
+	if l.HeaderLocalOntology[len(l.HeaderLocalOntology)-1] == "plain_code" {
 		plainCode = true
 	}
 
 	// the pcori_basecode
-	HeaderPatientDimension = append(HeaderPatientDimension, "pcori_basecode")
+	l.HeaderPatientDimension = append(l.HeaderPatientDimension, "pcori_basecode")
+
+	// adds a concept or modifier to the local and medco ontology tables (sensitive ones are registered to be tagged)
+	addEntry := func(lo *LocalOntology, so *MedCoOntology) {
+		modifier := strings.ToLower(so.FactTableColumn) == "modifier_cd"
+
+		_, sensitive := l.HasSensitiveParents(lo.Fullname)
+
+		// if it is sensitive or has a sensitive parent
+		if sensitive && modifier {
+			// the same modifier can be applied to several concepts: it is only encrypted and tagged once
+			if loaded, ok := l.State.Modifiers[lo.Fullname]; ok {
+				// already tagged by a previous load (the empty tag is not written again)
+				l.MapModifierPathToTag[lo.Fullname] = TagAndID{TagID: loaded.TagID}
+				l.MapModifierPathToEncryptID[lo.Fullname] = loaded.NodeEncryptID
+			} else if _, ok := l.MapModifierPathToTag[lo.Fullname]; !ok {
+				l.MapModifierPathToTag[lo.Fullname] = TagAndID{Tag: libunlynx.GroupingKey("-1"), TagID: -1}
+				l.MapModifierPathToEncryptID[lo.Fullname] = l.IDConcepts
+				listModifierCD = append(listModifierCD, lo.Fullname)
+				allSensitiveModifierIDs = append(allSensitiveModifierIDs, l.IDConcepts)
+				l.IDConcepts++
+			}
+			so.NodeEncryptID = l.MapModifierPathToEncryptID[lo.Fullname]
+
+			l.getMedCoTable(rawName).SensitiveModifiers[ModifierPK{Fullname: so.Fullname, AppliedPath: so.AppliedPath}] = so
+		} else if sensitive {
+			if loaded, ok := l.State.Concepts[lo.Fullname]; ok {
+				// already tagged by a previous load (the empty tag is not written again)
+				so.NodeEncryptID = loaded.NodeEncryptID
+				l.MapConceptPathToTag[lo.Fullname] = TagAndID{TagID: loaded.TagID}
+				l.MapConceptPathToEncryptID[lo.Fullname] = loaded.NodeEncryptID
+			} else {
+				so.NodeEncryptID = l.IDConcepts
+
+				// if the ID does not yet exist
+				if _, ok := l.MapConceptPathToTag[lo.Fullname]; !ok {
+					l.MapConceptPathToTag[lo.Fullname] = TagAndID{Tag: libunlynx.GroupingKey("-1"), TagID: -1}
+					l.MapConceptPathToEncryptID[lo.Fullname] = l.IDConcepts
+					listConceptCD = append(listConceptCD, lo.Fullname)
+					allSensitiveConceptIDs = append(allSensitiveConceptIDs, l.IDConcepts)
+				}
+
+				l.IDConcepts++
+			}
+
+			l.getMedCoTable(rawName).Sensitive[so.Fullname] = so
+		} else if modifier {
+			// add a new entry to the local and medco ontology tables
+			l.TableLocalModifiersClear[ModifierPK{Fullname: lo.Fullname, AppliedPath: lo.AppliedPath}] = lo
+			l.getMedCoTable(rawName).ClearModifiers[ModifierPK{Fullname: so.Fullname, AppliedPath: so.AppliedPath}] = so
+		} else {
+			// add a new entry to the local and medco ontology tables
+			l.TableLocalOntologyClear[lo.Fullname] = lo
+			l.getMedCoTable(rawName).Clear[so.Fullname] = so
+		}
+	}
+
+	// the synonyms (N = original, Y = synonym) are converted once all the original concepts (identified by their basecode) are known
+	synonyms := make([]*LocalOntology, 0)
+	primaryConcepts := make(map[string]*MedCoOntology)
 
 	//skip header
-	for _, line := range lines[1:] {
+	for i, line := range lines[1:] {
 		lo := LocalOntologyFromString(line, plainCode)
 
-		// TODO for now we remove all synonyms from the i2b2 local ontology
-		// if it is the original concept (N = original, Y = synonym)
-		if strings.ToLower(lo.SynonymCD) == "n" || strings.ToLower(lo.SynonymCD) == "" {
-			// create entry for medco ontology (direct copy)
-			so := MedCoOntologyFromLocalConcept(lo)
-
-			_, sensitive := HasSensitiveParents(lo.Fullname)
-
-			// if it is sensitive or has a sensitive parent
-			if sensitive {
-
-				//TODO for now we remove all modifiers
-				if strings.ToLower(so.FactTableColumn) != "modifier_cd" {
-					so.NodeEncryptID = IDConcepts
-
-					if _, ok := TablesMedCoOntology[rawName]; ok {
-						TablesMedCoOntology[rawName].Sensitive[so.Fullname] = so
-					} else {
-						sensitive := make(map[string]*MedCoOntology)
-						clear := make(map[string]*MedCoOntology)
-						sensitive[so.Fullname] = so
-						TablesMedCoOntology[rawName] = MedCoTableInfo{Clear: clear, Sensitive: sensitive}
-					}
-
-					// if the ID does not yet exist
-					if _, ok := MapConceptPathToTag[lo.Fullname]; !ok {
-						MapConceptPathToTag[lo.Fullname] = TagAndID{Tag: libunlynx.GroupingKey(-1), TagID: -1}
-						listConceptCD = append(listConceptCD, lo.Fullname)
-						allSensitiveConceptIDs = append(allSensitiveConceptIDs, IDConcepts)
-					}
-
-					IDConcepts++
-				}
-			} else {
+		// the first visual attribute defines the type of the node (the encrypted type of the sensitive ones)
+		if lo.VisualAttributes == "" || !strings.ContainsAny(lo.VisualAttributes[:1], "CFLMDOR") {
+			return loader.NewError(loader.ErrInputFormat, errors.New("invalid c_visualattributes "+strconv.Quote(lo.VisualAttributes))).InFile(l.InputFilePaths[name], int64(i+2))
+		}
 
-				//TODO for now we remove all modifiers
-				if strings.ToLower(so.FactTableColumn) != "modifier_cd" {
-					// add a new entry to the local ontology table
-					TableLocalOntologyClear[lo.Fullname] = lo
-					// add a new entry to the medco ontology table
-					if _, ok := TablesMedCoOntology[rawName]; ok {
-						TablesMedCoOntology[rawName].Clear[so.Fullname] = so
-					} else {
-						sensitive := make(map[string]*MedCoOntology)
-						clear := make(map[string]*MedCoOntology)
-						clear[so.Fullname] = so
-						TablesMedCoOntology[rawName] = MedCoTableInfo{Clear: clear, Sensitive: sensitive}
-					}
-
-					TablesMedCoOntology[rawName].Clear[so.Fullname] = so
-				}
-			}
+		if strings.ToLower(lo.SynonymCD) == "y" {
+			synonyms = append(synonyms, lo)
+			continue
+		}
+
+		// create entry for medco ontology (direct copy)
+		so := MedCoOntologyFromLocalConcept(lo)
+		if strings.ToLower(so.FactTableColumn) != "modifier_cd" && so.BaseCode != "" {
+			primaryConcepts[so.BaseCode] = so
 		}
+		addEntry(lo, so)
 	}
 
-	// if there are sensitive concepts
-	if len(allSensitiveConceptIDs) > 0 {
-		taggedConceptValues, err := EncryptAndTag(allSensitiveConceptIDs, group, entryPointIdx)
+	// a synonym follows its original concept: if the original concept is sensitive, the synonym gets the same NodeEncryptID
+	// (and therefore the same tag and TAG_ID)
+	for _, lo := range synonyms {
+		so := MedCoOntologyFromLocalConcept(lo)
+
+		primary, ok := primaryConcepts[so.BaseCode]
+		if !ok {
+			addEntry(lo, so)
+		} else if _, sensitive := l.getMedCoTable(rawName).Sensitive[primary.Fullname]; sensitive {
+			so.NodeEncryptID = primary.NodeEncryptID
+			l.getMedCoTable(rawName).Sensitive[so.Fullname] = so
+			l.MapSynonymPathToPrimary[lo.Fullname] = primary.Fullname
+		} else {
+			l.TableLocalOntologyClear[lo.Fullname] = lo
+			l.getMedCoTable(rawName).Clear[so.Fullname] = so
+		}
+	}
+
+	// if there are sensitive concepts or modifiers (they are tagged together)
+	if len(allSensitiveConceptIDs)+len(allSensitiveModifierIDs) > 0 {
+		taggedValues, err := l.EncryptAndTag(append(allSensitiveConceptIDs, allSensitiveModifierIDs...))
 		if err != nil {
 			return err
 		}
 
 		// re-randomize TAG_IDs
-		rand.Seed(time.Now().UnixNano())
-		perm := rand.Perm(len(MapConceptPathToTag))
+		keys := make([]string, 0, len(taggedValues))
+		for _, concept := range listConceptCD {
+			keys = append(keys, "concept:"+concept)
+		}
+		for _, modifier := range listModifierCD {
+			keys = append(keys, "modifier:"+modifier)
+		}
+		perm, err := l.permute("tag_id", keys)
+		if err != nil {
+			return err
+		}
 
-		// 'populate' map (Concept codes)
+		// 'populate' maps (concept and modifier codes)
 		// we create a permutation of [0, n] and then add #concepts_already_parsed
 		for i, concept := range listConceptCD {
-			var tmp = MapConceptPathToTag[concept]
-			tmp.TagID = TagIDConceptsUsed + int64(perm[i])
-			tmp.Tag = taggedConceptValues[i]
-			MapConceptPathToTag[concept] = tmp
+			var tmp = l.MapConceptPathToTag[concept]
+			tmp.TagID = l.TagIDConceptsUsed + int64(perm[i])
+			tmp.Tag = taggedValues[i]
+			l.MapConceptPathToTag[concept] = tmp
 		}
+		for i, modifier := range listModifierCD {
+			j := len(listConceptCD) + i
+			var tmp = l.MapModifierPathToTag[modifier]
+			tmp.TagID = l.TagIDConceptsUsed + int64(perm[j])
+			tmp.Tag = taggedValues[j]
+			l.MapModifierPathToTag[modifier] = tmp
+		}
+
+		l.TagIDConceptsUsed += int64(len(taggedValues))
+	}
 
-		TagIDConceptsUsed += int64(len(MapConceptPathToTag))
+	// the modifier codes of the ontology are used to tag the modifier_cd of the observations
+	for pk, so := range l.getMedCoTable(rawName).SensitiveModifiers {
+		if so.BaseCode != "" {
+			l.MapModifierCodeToTag[so.BaseCode] = l.MapModifierPathToTag[pk.Fullname].TagID
+		}
 	}
 
 	return nil
 }
 
-// EncryptAndTag encrypts the elements and tags them to allow for the future comparison
-func EncryptAndTag(list []int64, group *onet.Roster, entryPointIdx int) ([]libunlynx.GroupingKey, error) {
+// getMedCoTable returns the medco ontology table rawName (it is created if it does not exist yet)
+func (l *Loader) getMedCoTable(rawName string) MedCoTableInfo {
+	if table, ok := l.TablesMedCoOntology[rawName]; ok {
+		return table
+	}
+
+	table := MedCoTableInfo{
+		Clear:              make(map[string]*MedCoOntology),
+		Sensitive:          make(map[string]*MedCoOntology),
+		ClearModifiers:     make(map[ModifierPK]*MedCoOntology),
+		SensitiveModifiers: make(map[ModifierPK]*MedCoOntology),
+	}
+	l.TablesMedCoOntology[rawName] = table
+	return table
+}
+
+// EncryptAndTag encrypts the elements and tags them to allow for the future comparison. The tags are kept in the
+// checkpoint: the elements that were all tagged before it are not tagged again.
+func (l *Loader) EncryptAndTag(list []int64) ([]libunlynx.GroupingKey, error) {
+	if terms, ok := l.checkpoint.Terms(list); ok {
+		result := make([]libunlynx.GroupingKey, len(terms))
+		for i, term := range terms {
+			result[i] = libunlynx.GroupingKey(term.Tag)
+		}
+		return result, nil
+	}
 
 	// ENCRYPTION
 	start := time.Now()
 	listEncryptedElements := make(libunlynx.CipherVector, len(list))
 
 	for i := int64(0); i < int64(len(list)); i++ {
-		listEncryptedElements[i] = *libunlynx.EncryptInt(group.Aggregate, list[i])
+		listEncryptedElements[i] = *libunlynx.EncryptInt(l.Roster.Aggregate, list[i])
 	}
 	log.Lvl2("Finished encrypting the sensitive data... ["+strconv.FormatInt(int64(len(listEncryptedElements)), 10)+"] (", time.Since(start), ")")
 
 	// TAGGING
 	start = time.Now()
-	client := servicesmedco.NewMedCoClient(group.List[entryPointIdx], strconv.Itoa(entryPointIdx))
-	_, result, tr, err := client.SendSurveyDDTRequestTerms(
-		group, // Roster
-		servicesmedco.SurveyID("tagging_loading_phase"), // SurveyID
-		listEncryptedElements,                           // Encrypted query terms to tag
-		false,                                           // compute proofs?
-		Testing,
-	)
-
+	result, err := loader.TagElements(l.Roster, l.EntryPointIdx, l.surveyID, listEncryptedElements, l.Testing, l.Tagging)
 	if err != nil {
-		log.Fatal("Error during DDT:", err)
 		return nil, err
 	}
 
-	totalTime := time.Since(start)
-
-	log.Lvl2("DDT took: execution -", tr.MapTR[servicesmedco.TaggingTimeExec], "communication -", tr.MapTR[servicesmedco.TaggingTimeCommunication])
+	log.Lvl2("Finished tagging the sensitive data... (", time.Since(start), ")")
 
-	log.Lvl2("Finished tagging the sensitive data... (", totalTime, ")")
+	terms := make([]loader.Term, len(result))
+	for i, tag := range result {
+		terms[i] = loader.Term{Tag: string(tag)}
+	}
+	if err := l.checkpoint.AddTerms(list, terms); err != nil {
+		return nil, err
+	}
 
 	return result, nil
 }
 
 // ConvertClearLocalTable converts the old xxxx.csv local ontology file
-func ConvertClearLocalTable(rawName string) error {
+func (l *Loader) ConvertClearLocalTable(rawName string) error {
 	// two new files are generated: one to store the non-sensitive data and another to store the sensitive data
-	csvClearOutputFile, err := os.Create(OutputFilePaths["LOCAL_"+rawName].Path)
+	csvClearOutputFile, err := os.Create(l.OutputFilePaths["LOCAL_"+rawName].Path)
 	if err != nil {
-		log.Fatal("Error opening [" + strings.ToLower(rawName) + "].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["LOCAL_"+rawName].Path, 0)
 	}
 	defer csvClearOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderLocalOntology {
+	for _, header := range l.HeaderLocalOntology {
 		headerString += "\"" + header + "\","
 	}
 	// remove the last ,
 	csvClearOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
 	// non-sensitive
-	for _, lo := range TableLocalOntologyClear {
+	for _, lo := range l.TableLocalOntologyClear {
+		csvClearOutputFile.WriteString(lo.ToCSVText() + "\n")
+	}
+	for _, lo := range l.TableLocalModifiersClear {
 		csvClearOutputFile.WriteString(lo.ToCSVText() + "\n")
 	}
 
 	return nil
 }
 
-// ConvertSensitiveLocalTable generates the sensitive_tagged file
-func ConvertSensitiveLocalTable() error {
-	csvSensitiveOutputFile, err := os.Create(OutputFilePaths["SENSITIVE_TAGGED"].Path)
+// ConvertSensitiveLocalTable generates the sensitive_tagged file (with the concepts and modifiers that were not loaded
+// before) and the tagged_paths file
+func (l *Loader) ConvertSensitiveLocalTable() error {
+	csvSensitiveOutputFile, err := os.Create(l.OutputFilePaths["SENSITIVE_TAGGED"].Path)
 	if err != nil {
-		log.Fatal("Error opening [sensitive_tagged].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["SENSITIVE_TAGGED"].Path, 0)
 	}
 	defer csvSensitiveOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderLocalOntology {
+	for _, header := range l.HeaderLocalOntology {
 		headerString += "\"" + header + "\","
 	}
 	// remove the last ,
 	csvSensitiveOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
 	// sensitive concepts
-	for _, el := range MapConceptPathToTag {
-		csvSensitiveOutputFile.WriteString(LocalOntologySensitiveConceptToCSVText(&el.Tag, el.TagID) + "\n")
+	for _, el := range l.MapConceptPathToTag {
+		if el.Tag != "" {
+			csvSensitiveOutputFile.WriteString(LocalOntologySensitiveConceptToCSVText(&el.Tag, el.TagID) + "\n")
+		}
 	}
 
-	return nil
+	// sensitive modifiers
+	for _, el := range l.MapModifierPathToTag {
+		if el.Tag != "" {
+			csvSensitiveOutputFile.WriteString(LocalOntologySensitiveModifierToCSVText(&el.Tag, el.TagID) + "\n")
+		}
+	}
+
+	return l.writeTaggedPaths()
 }
 
 // PATIENT_DIMENSION.CSV converter
 
 // ParsePatientDimension reads and parses the patient_dimension.csv. This also means adding the encrypted flag.
-func ParsePatientDimension(pk kyber.Point) error {
-	lines, err := readCSV("PATIENT_DIMENSION")
+func (l *Loader) ParsePatientDimension(pk kyber.Point) error {
+	lines, err := l.readCSV("PATIENT_DIMENSION")
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 
-	TablePatientDimension = make(map[PatientDimensionPK]PatientDimension)
-	HeaderPatientDimension = make([]string, 0)
-	MapNewPatientNum = make(map[string]string)
+	l.TablePatientDimension = make(map[PatientDimensionPK]PatientDimension)
+	l.HeaderPatientDimension = make([]string, 0)
+	// the patients of the previous loads keep their patient_num
+	l.MapNewPatientNum = make(map[string]string)
+	for oldNum, newNum := range l.State.MapNewPatientNum {
+		l.MapNewPatientNum[oldNum] = newNum
+	}
 
 	/* structure of patient_dimension.csv (in order):
 
@@ -984,55 +1491,75 @@ func ParsePatientDimension(pk kyber.Point) error {
 	*/
 
 	for _, header := range lines[0] {
-		HeaderPatientDimension = append(HeaderPatientDimension, header)
+		l.HeaderPatientDimension = append(l.HeaderPatientDimension, header)
 	}
 
 	//skip header
 	for _, line := range lines[1:] {
-		pdk, pd := PatientDimensionFromString(line, pk)
-		TablePatientDimension[pdk] = pd
+		pdk, pd := PatientDimensionFromString(line, l.HeaderPatientDimension, pk)
+		l.TablePatientDimension[pdk] = pd
 	}
 
 	return nil
 }
 
-// ConvertPatientDimension converts the old patient_dimension.csv file
+// ConvertPatientDimension converts the old patient_dimension.csv file (the patients that were already loaded are skipped)
 // If emtpy is set to true all other data except the patient_num and encrypted_dummy_flag are set to empty
-func ConvertPatientDimension(pk kyber.Point, empty bool) error {
-	csvOutputFile, err := os.Create(OutputFilePaths["PATIENT_DIMENSION"].Path)
+func (l *Loader) ConvertPatientDimension(pk kyber.Point, empty bool) error {
+	csvOutputFile, err := os.Create(l.OutputFilePaths["PATIENT_DIMENSION"].Path)
 	if err != nil {
-		log.Fatal("Error opening [patient_dimension].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["PATIENT_DIMENSION"].Path, 0)
 	}
 	defer csvOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderPatientDimension {
+	for _, header := range l.HeaderPatientDimension {
 		headerString += "\"" + header + "\","
 	}
 
-	// re-randomize the patient_num
-	totalNbrPatients := len(TablePatientDimension) + len(TableDummyToPatient)
-	rand.Seed(time.Now().UnixNano())
-	perm := rand.Perm(totalNbrPatients)
+	newPatients := make([]PatientDimension, 0)
+	for _, pd := range l.TablePatientDimension {
+		if _, ok := l.MapNewPatientNum[pd.PK.PatientNum]; !ok {
+			newPatients = append(newPatients, pd)
+		}
+	}
+	newDummies := make([]string, 0)
+	for dummyNum := range l.TableDummyToPatient {
+		if _, ok := l.MapNewPatientNum[dummyNum]; !ok {
+			newDummies = append(newDummies, dummyNum)
+		}
+	}
+
+	// re-randomize the patient_num (the new patients are numbered after the ones of the previous loads)
+	keys := make([]string, 0, len(newPatients)+len(newDummies))
+	for _, pd := range newPatients {
+		keys = append(keys, pd.PK.PatientNum)
+	}
+	perm, err := l.permute("patient_num", append(keys, newDummies...))
+	if err != nil {
+		return err
+	}
+	newNum := func(i int) string {
+		return strconv.FormatInt(l.State.NextPatientNum+int64(perm[i]), 10)
+	}
 
 	// remove the last ,
 	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
 	i := 0
-	for _, pd := range TablePatientDimension {
-		MapNewPatientNum[pd.PK.PatientNum] = strconv.FormatInt(int64(perm[i]), 10)
-		pd.PK.PatientNum = strconv.FormatInt(int64(perm[i]), 10)
+	for _, pd := range newPatients {
+		l.MapNewPatientNum[pd.PK.PatientNum] = newNum(i)
+		pd.PK.PatientNum = newNum(i)
 		csvOutputFile.WriteString(pd.ToCSVText(empty) + "\n")
 		i++
 	}
 
 	// add dummies
-	for dummyNum, patientNum := range TableDummyToPatient {
-		MapNewPatientNum[dummyNum] = strconv.FormatInt(int64(perm[i]), 10)
+	for _, dummyNum := range newDummies {
+		l.MapNewPatientNum[dummyNum] = newNum(i)
 
-		patient := TablePatientDimension[PatientDimensionPK{PatientNum: patientNum}]
-		patient.PK.PatientNum = strconv.FormatInt(int64(perm[i]), 10)
+		patient := l.TablePatientDimension[PatientDimensionPK{PatientNum: l.TableDummyToPatient[dummyNum]}]
+		patient.PK.PatientNum = newNum(i)
 		ef := libunlynx.EncryptInt(pk, 0)
 		patient.EncryptedFlag = *ef
 
@@ -1040,38 +1567,33 @@ func ConvertPatientDimension(pk kyber.Point, empty bool) error {
 		i++
 	}
 
-	// write MapNewPatientNum to csv
-	csvOutputNewPatientNumFile, err := os.Create(OutputFilePaths["NEW_PATIENT_NUM"].Path)
-	if err != nil {
-		log.Fatal("Error opening [new_patient_num].csv")
-		return err
-	}
-	defer csvOutputNewPatientNumFile.Close()
-
-	csvOutputNewPatientNumFile.WriteString("\"old_patient_num\",\"new_patient_num\"\n")
-
-	for key, value := range MapNewPatientNum {
-		csvOutputNewPatientNumFile.WriteString("\"" + key + "\"," + "\"" + value + "\"\n")
+	// write MapNewPatientNum to the (private) mapping file
+	records := make([][]string, 0, len(l.MapNewPatientNum))
+	for key, value := range l.MapNewPatientNum {
+		records = append(records, []string{key, value})
 	}
 
-	return nil
+	return l.writeMapping("NEW_PATIENT_NUM", records)
 }
 
 // VISIT_DIMENSION.CSV converter
 
 // ParseVisitDimension reads and parses the visit_dimension.csv.
-func ParseVisitDimension() error {
-	lines, err := readCSV("VISIT_DIMENSION")
+func (l *Loader) ParseVisitDimension() error {
+	lines, err := l.readCSV("VISIT_DIMENSION")
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 
-	TableVisitDimension = make(map[VisitDimensionPK]VisitDimension)
-	HeaderVisitDimension = make([]string, 0)
-	MapNewEncounterNum = make(map[VisitDimensionPK]VisitDimensionPK)
-	MapPatientVisits = make(map[string][]string)
-	MaxVisits = 0
+	l.TableVisitDimension = make(map[VisitDimensionPK]VisitDimension)
+	l.HeaderVisitDimension = make([]string, 0)
+	// the encounters of the previous loads keep their encounter_num
+	l.MapNewEncounterNum = make(map[VisitDimensionPK]VisitDimensionPK)
+	for oldPK, newPK := range l.State.MapNewEncounterNum {
+		l.MapNewEncounterNum[oldPK] = newPK
+	}
+	l.MapPatientVisits = make(map[string][]string)
+	l.MaxVisits = 0
 
 	/* structure of visit_dimension.csv (in order):
 
@@ -1101,111 +1623,126 @@ func ParseVisitDimension() error {
 	*/
 
 	for _, header := range lines[0] {
-		HeaderVisitDimension = append(HeaderVisitDimension, header)
+		l.HeaderVisitDimension = append(l.HeaderVisitDimension, header)
 	}
 
 	//skip header
 	for _, line := range lines[1:] {
-		vdk, vd := VisitDimensionFromString(line)
-		TableVisitDimension[vdk] = vd
+		vdk, vd := VisitDimensionFromString(line, l.HeaderVisitDimension)
+		l.TableVisitDimension[vdk] = vd
 
 		// if patient does not exist
-		if _, ok := MapPatientVisits[vdk.PatientNum]; !ok {
+		if _, ok := l.MapPatientVisits[vdk.PatientNum]; !ok {
 			// create array and add the encounter
 			tmp := make([]string, 0)
 			tmp = append(tmp, vdk.EncounterNum)
-			MapPatientVisits[vdk.PatientNum] = tmp
+			l.MapPatientVisits[vdk.PatientNum] = tmp
 		} else {
 			// append encounter to array
-			MapPatientVisits[vdk.PatientNum] = append(MapPatientVisits[vdk.PatientNum], vdk.EncounterNum)
+			l.MapPatientVisits[vdk.PatientNum] = append(l.MapPatientVisits[vdk.PatientNum], vdk.EncounterNum)
 		}
 
-		if MaxVisits < len(MapPatientVisits[vdk.PatientNum]) {
-			MaxVisits = len(MapPatientVisits[vdk.PatientNum])
+		if l.MaxVisits < len(l.MapPatientVisits[vdk.PatientNum]) {
+			l.MaxVisits = len(l.MapPatientVisits[vdk.PatientNum])
 		}
 	}
 
 	return nil
 }
 
-// ConvertVisitDimension converts the old visit_dimension.csv file. The means re-randomizing the encounter_num.
+// ConvertVisitDimension converts the old visit_dimension.csv file. The means re-randomizing the encounter_num (the
+// encounters that were already loaded are skipped).
 // If emtpy is set to true all other data except the patient_num and encounter_num are set to empty
-func ConvertVisitDimension(empty bool) error {
+func (l *Loader) ConvertVisitDimension(empty bool) error {
 
-	csvOutputFile, err := os.Create(OutputFilePaths["VISIT_DIMENSION"].Path)
+	csvOutputFile, err := os.Create(l.OutputFilePaths["VISIT_DIMENSION"].Path)
 	if err != nil {
-		log.Fatal("Error opening [visit_dimension].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["VISIT_DIMENSION"].Path, 0)
 	}
 	defer csvOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderVisitDimension {
+	for _, header := range l.HeaderVisitDimension {
 		headerString += "\"" + header + "\","
 	}
 
-	// re-randomize the encounter_num
-	totalNbrVisits := len(TableVisitDimension) + len(TableDummyToPatient)*MaxVisits
-	rand.Seed(time.Now().UnixNano())
-	perm := rand.Perm(totalNbrVisits)
+	newVisits := make([]VisitDimension, 0)
+	for _, vd := range l.TableVisitDimension {
+		if _, ok := l.MapNewEncounterNum[vd.PK]; !ok {
+			newVisits = append(newVisits, vd)
+		}
+	}
+	// the visits of the dummies are copies of the visits of their original patient
+	newDummyVisits := make([]VisitDimensionPK, 0)
+	for dummyNum, patientNum := range l.TableDummyToPatient {
+		for _, el := range l.MapPatientVisits[patientNum] {
+			if _, ok := l.MapNewEncounterNum[VisitDimensionPK{EncounterNum: el, PatientNum: dummyNum}]; !ok {
+				newDummyVisits = append(newDummyVisits, VisitDimensionPK{EncounterNum: el, PatientNum: dummyNum})
+			}
+		}
+	}
+
+	// re-randomize the encounter_num (the new encounters are numbered after the ones of the previous loads)
+	keys := make([]string, 0, len(newVisits)+len(newDummyVisits))
+	for _, vd := range newVisits {
+		keys = append(keys, vd.PK.EncounterNum+":"+vd.PK.PatientNum)
+	}
+	for _, pk := range newDummyVisits {
+		keys = append(keys, pk.EncounterNum+":"+pk.PatientNum)
+	}
+	perm, err := l.permute("encounter_num", keys)
+	if err != nil {
+		return err
+	}
+	newNum := func(i int) string {
+		return strconv.FormatInt(l.State.NextEncounterNum+int64(perm[i]), 10)
+	}
 
 	// remove the last ,
 	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
 	i := 0
-	for _, vd := range TableVisitDimension {
-		MapNewEncounterNum[VisitDimensionPK{EncounterNum: vd.PK.EncounterNum, PatientNum: vd.PK.PatientNum}] = VisitDimensionPK{EncounterNum: strconv.FormatInt(int64(perm[i]), 10), PatientNum: MapNewPatientNum[vd.PK.PatientNum]}
-		vd.PK.EncounterNum = strconv.FormatInt(int64(perm[i]), 10)
-		vd.PK.PatientNum = MapNewPatientNum[vd.PK.PatientNum]
+	for _, vd := range newVisits {
+		l.MapNewEncounterNum[VisitDimensionPK{EncounterNum: vd.PK.EncounterNum, PatientNum: vd.PK.PatientNum}] = VisitDimensionPK{EncounterNum: newNum(i), PatientNum: l.MapNewPatientNum[vd.PK.PatientNum]}
+		vd.PK.EncounterNum = newNum(i)
+		vd.PK.PatientNum = l.MapNewPatientNum[vd.PK.PatientNum]
 		csvOutputFile.WriteString(vd.ToCSVText(empty) + "\n")
 		i++
 	}
 
 	// add dummies
-	for dummyNum, patientNum := range TableDummyToPatient {
-		listPatientVisits := MapPatientVisits[patientNum]
-
-		for _, el := range listPatientVisits {
-			MapNewEncounterNum[VisitDimensionPK{EncounterNum: el, PatientNum: dummyNum}] = VisitDimensionPK{EncounterNum: strconv.FormatInt(int64(perm[i]), 10), PatientNum: MapNewPatientNum[dummyNum]}
-			visit := TableVisitDimension[VisitDimensionPK{EncounterNum: el, PatientNum: patientNum}]
-			visit.PK.EncounterNum = strconv.FormatInt(int64(perm[i]), 10)
-			visit.PK.PatientNum = MapNewPatientNum[dummyNum]
-			csvOutputFile.WriteString(visit.ToCSVText(empty) + "\n")
-			i++
-		}
-	}
-
-	// write MapNewEncounterNum to csv
-	csvOutputNewEncounterNumFile, err := os.Create(OutputFilePaths["NEW_ENCOUNTER_NUM"].Path)
-	if err != nil {
-		log.Fatal("Error opening [new_encounter_num].csv")
-		return err
+	for _, pk := range newDummyVisits {
+		l.MapNewEncounterNum[pk] = VisitDimensionPK{EncounterNum: newNum(i), PatientNum: l.MapNewPatientNum[pk.PatientNum]}
+		visit := l.TableVisitDimension[VisitDimensionPK{EncounterNum: pk.EncounterNum, PatientNum: l.TableDummyToPatient[pk.PatientNum]}]
+		visit.PK.EncounterNum = newNum(i)
+		visit.PK.PatientNum = l.MapNewPatientNum[pk.PatientNum]
+		csvOutputFile.WriteString(visit.ToCSVText(empty) + "\n")
+		i++
 	}
-	defer csvOutputNewEncounterNumFile.Close()
-
-	csvOutputNewEncounterNumFile.WriteString("\"old_encounter_num\",\"old_patient_num\",\"new_encounter_num\",\"new_patient_num\"\n")
 
-	for key, value := range MapNewEncounterNum {
-		csvOutputNewEncounterNumFile.WriteString("\"" + key.EncounterNum + "\"," + "\"" + key.PatientNum + "\"," + "\"" + value.EncounterNum + "\"," + "\"" + value.PatientNum + "\"\n")
+	// write MapNewEncounterNum to the (private) mapping file
+	records := make([][]string, 0, len(l.MapNewEncounterNum))
+	for key, value := range l.MapNewEncounterNum {
+		records = append(records, []string{key.EncounterNum, key.PatientNum, value.EncounterNum, value.PatientNum})
 	}
 
-	return nil
+	return l.writeMapping("NEW_ENCOUNTER_NUM", records)
 }
 
 // CONCEPT_DIMENSION.CSV converter
 
 // ParseConceptDimension reads and parses the concept_dimension.csv.
-func ParseConceptDimension() error {
-	lines, err := readCSV("CONCEPT_DIMENSION")
+func (l *Loader) ParseConceptDimension() error {
+	lines, err := l.readCSV("CONCEPT_DIMENSION")
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 
-	ListConceptsToIgnore = make(map[string]struct{})
-	TableConceptDimension = make(map[*ConceptDimensionPK]ConceptDimension)
-	HeaderConceptDimension = make([]string, 0)
-	MapConceptCodeToTag = make(map[string]int64)
+	l.ListConceptsToIgnore = make(map[string]struct{})
+	l.ReportConcepts = make([]ReportEntry, 0)
+	l.TableConceptDimension = make(map[*ConceptDimensionPK]ConceptDimension)
+	l.HeaderConceptDimension = make([]string, 0)
+	l.MapConceptCodeToTag = make(map[string]int64)
 
 	/* structure of concept_dimension.csv (in order):
 
@@ -1226,69 +1763,176 @@ func ParseConceptDimension() error {
 	*/
 
 	for _, header := range lines[0] {
-		HeaderConceptDimension = append(HeaderConceptDimension, header)
+		l.HeaderConceptDimension = append(l.HeaderConceptDimension, header)
 	}
 
 	//skip header
 	for _, line := range lines[1:] {
 		cdk, cd := ConceptDimensionFromString(line)
-		TableConceptDimension[cdk] = cd
+		l.TableConceptDimension[cdk] = cd
 	}
 
 	return nil
 }
 
 // ConvertConceptDimension converts the old concept_dimension.csv file
-func ConvertConceptDimension() error {
-	csvOutputFile, err := os.Create(OutputFilePaths["CONCEPT_DIMENSION"].Path)
+func (l *Loader) ConvertConceptDimension() error {
+	csvOutputFile, err := os.Create(l.OutputFilePaths["CONCEPT_DIMENSION"].Path)
 	if err != nil {
-		log.Fatal("Error opening [concept_dimension].csv")
-		return err
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["CONCEPT_DIMENSION"].Path, 0)
 	}
 	defer csvOutputFile.Close()
 
 	headerString := ""
-	for _, header := range HeaderConceptDimension {
+	for _, header := range l.HeaderConceptDimension {
 		headerString += "\"" + header + "\","
 	}
 	// remove the last ,
 	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
 
-	for _, cd := range TableConceptDimension {
+	for _, cd := range l.TableConceptDimension {
+		// the non-sensitive concepts already loaded are skipped
+		_, loaded := l.State.ConceptPaths[cd.PK.ConceptPath]
+
 		// if the concept is non-sensitive -> keep it as it is
-		if _, ok := TableLocalOntologyClear[cd.PK.ConceptPath]; ok {
-			csvOutputFile.WriteString(cd.ToCSVText() + "\n")
+		if _, ok := l.TableLocalOntologyClear[cd.PK.ConceptPath]; ok {
+			if !loaded {
+				csvOutputFile.WriteString(cd.ToCSVText() + "\n")
+			}
+			l.reportConcept(false, cd.PK.ConceptPath, cd.ConceptCD, ClassificationClear)
 			// if the concept is sensitive -> fetch its encrypted tag and tag_id
-		} else if _, ok := MapConceptPathToTag[cd.PK.ConceptPath]; ok {
-			temp := MapConceptPathToTag[cd.PK.ConceptPath].Tag
-			csvOutputFile.WriteString(ConceptDimensionSensitiveToCSVText(&temp, MapConceptPathToTag[cd.PK.ConceptPath].TagID) + "\n")
-			MapConceptCodeToTag[cd.ConceptCD] = MapConceptPathToTag[cd.PK.ConceptPath].TagID
+		} else if _, ok := l.MapConceptPathToTag[cd.PK.ConceptPath]; ok {
+			// (its row is already loaded if it was tagged by a previous load)
+			temp := l.MapConceptPathToTag[cd.PK.ConceptPath].Tag
+			if temp != "" {
+				csvOutputFile.WriteString(ConceptDimensionSensitiveToCSVText(&temp, l.MapConceptPathToTag[cd.PK.ConceptPath].TagID) + "\n")
+			}
+			l.MapConceptCodeToTag[cd.ConceptCD] = l.MapConceptPathToTag[cd.PK.ConceptPath].TagID
+			l.reportConcept(false, cd.PK.ConceptPath, cd.ConceptCD, ClassificationSensitive)
+			// if the concept is a synonym of a sensitive concept -> its code is tagged like the original concept (which has its own row)
+		} else if primary, ok := l.MapSynonymPathToPrimary[cd.PK.ConceptPath]; ok {
+			l.MapConceptCodeToTag[cd.ConceptCD] = l.MapConceptPathToTag[primary].TagID
+			l.reportConcept(false, cd.PK.ConceptPath, cd.ConceptCD, ClassificationSensitive)
 			// if the concept does not exist in the LocalOntology and none of his siblings is sensitive
-		} else if _, ok := HasSensitiveParents(cd.PK.ConceptPath); !ok {
-			csvOutputFile.WriteString(cd.ToCSVText() + "\n")
+		} else if _, ok := l.HasSensitiveParents(cd.PK.ConceptPath); !ok {
+			if !loaded {
+				csvOutputFile.WriteString(cd.ToCSVText() + "\n")
+			}
+			l.reportConcept(false, cd.PK.ConceptPath, cd.ConceptCD, ClassificationClear)
 		} else {
-			ListConceptsToIgnore[cd.ConceptCD] = struct{}{}
+			l.ListConceptsToIgnore[cd.ConceptCD] = struct{}{}
+			l.reportConcept(false, cd.PK.ConceptPath, cd.ConceptCD, ClassificationIgnored)
 		}
 	}
 
 	return nil
 }
 
-// OBSERVATION_FACT.CSV converter
+// MODIFIER_DIMENSION.CSV converter
 
-// ParseObservationFact reads and parses the observation_fact_old.csv.
-func ParseObservationFact() error {
-	lines, err := readCSV("OBSERVATION_FACT")
+// ParseModifierDimension reads and parses the modifier_dimension.csv.
+func (l *Loader) ParseModifierDimension() error {
+	lines, err := l.readCSV("MODIFIER_DIMENSION")
 	if err != nil {
-		log.Fatal("Error in readCSV()")
 		return err
 	}
 
-	TableObservationFact = make(map[*ObservationFactPK]ObservationFact)
-	HeaderObservationFact = make([]string, 0)
-	MapPatientObs = make(map[string][]*ObservationFactPK)
-	MapDummyObs = make(map[string][]*ObservationFactPK)
-	TextSearchIndex = 0
+	l.ListModifiersToIgnore = make(map[string]struct{})
+	l.ReportModifiers = make([]ReportEntry, 0)
+	l.TableModifierDimension = make(map[*ModifierDimensionPK]ModifierDimension)
+	l.HeaderModifierDimension = make([]string, 0)
+
+	/* structure of modifier_dimension.csv (in order):
+
+	// PK
+	"modifier_path",
+
+	// MANDATORY FIELDS
+	"modifier_cd",
+	"name_char",
+	"modifier_blob",
+
+	// ADMIN FIELDS
+	"update_date",
+	"download_date",
+	"import_date",
+	"sourcesystem_cd",
+	"upload_id"
+	*/
+
+	for _, header := range lines[0] {
+		l.HeaderModifierDimension = append(l.HeaderModifierDimension, header)
+	}
+
+	//skip header
+	for _, line := range lines[1:] {
+		mdk, md := ModifierDimensionFromString(line)
+		l.TableModifierDimension[mdk] = md
+	}
+
+	return nil
+}
+
+// ConvertModifierDimension converts the old modifier_dimension.csv file
+func (l *Loader) ConvertModifierDimension() error {
+	csvOutputFile, err := os.Create(l.OutputFilePaths["MODIFIER_DIMENSION"].Path)
+	if err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["MODIFIER_DIMENSION"].Path, 0)
+	}
+	defer csvOutputFile.Close()
+
+	headerString := ""
+	for _, header := range l.HeaderModifierDimension {
+		headerString += "\"" + header + "\","
+	}
+	// remove the last ,
+	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
+
+	for _, md := range l.TableModifierDimension {
+		// the non-sensitive modifiers already loaded are skipped
+		_, loaded := l.State.ModifierPaths[md.PK.ModifierPath]
+
+		// if the modifier is sensitive -> fetch its encrypted tag and tag_id
+		if _, ok := l.MapModifierPathToTag[md.PK.ModifierPath]; ok {
+			// (its row is already loaded if it was tagged by a previous load)
+			temp := l.MapModifierPathToTag[md.PK.ModifierPath].Tag
+			if temp != "" {
+				csvOutputFile.WriteString(ModifierDimensionSensitiveToCSVText(&temp, l.MapModifierPathToTag[md.PK.ModifierPath].TagID) + "\n")
+			}
+			l.MapModifierCodeToTag[md.ModifierCD] = l.MapModifierPathToTag[md.PK.ModifierPath].TagID
+			l.reportConcept(true, md.PK.ModifierPath, md.ModifierCD, ClassificationSensitive)
+			// if the modifier is non-sensitive or does not exist in the LocalOntology and none of his siblings is sensitive
+		} else if _, ok := l.HasSensitiveParents(md.PK.ModifierPath); !ok {
+			if !loaded {
+				csvOutputFile.WriteString(md.ToCSVText() + "\n")
+			}
+			l.reportConcept(true, md.PK.ModifierPath, md.ModifierCD, ClassificationClear)
+		} else {
+			l.ListModifiersToIgnore[md.ModifierCD] = struct{}{}
+			l.reportConcept(true, md.PK.ModifierPath, md.ModifierCD, ClassificationIgnored)
+		}
+	}
+
+	return nil
+}
+
+// OBSERVATION_FACT.CSV converter
+
+// ParseObservationFact reads the observation_fact_old.csv (without keeping it in memory) and indexes on disk the
+// observations of the original patients that have dummies.
+func (l *Loader) ParseObservationFact() error {
+	csvInputFile, err := os.Open(l.InputFilePaths["OBSERVATION_FACT"])
+	if err != nil {
+		return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], err)
+	}
+	defer csvInputFile.Close()
+
+	reader := csv.NewReader(bufio.NewReader(csvInputFile))
+	reader.Comma = ','
+	reader.ReuseRecord = true
+
+	l.HeaderObservationFact = make([]string, 0)
+	l.TextSearchIndex = 0
 
 	/* structure of observation_fact_old.csv (in order):
 
@@ -1321,109 +1965,240 @@ func ParseObservationFact() error {
 	"upload_id",
 	"text_search_index"
 
-	// EXTRA FIELDS (added during dummy generation)
+	// EXTRA FIELDS (added by the external dummy generation, not by GenerateDummies)
 	"cluster_label"
 	*/
 
-	for _, header := range lines[0] {
-		HeaderObservationFact = append(HeaderObservationFact, header)
+	header, err := reader.Read()
+	if err != nil {
+		return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], err)
+	}
+	for _, h := range header {
+		l.HeaderObservationFact = append(l.HeaderObservationFact, h)
 	}
 	// remove "cluster_label"
-	HeaderObservationFact = HeaderObservationFact[:len(HeaderObservationFact)-1]
+	if l.HeaderObservationFact[len(l.HeaderObservationFact)-1] == "cluster_label" {
+		l.HeaderObservationFact = l.HeaderObservationFact[:len(l.HeaderObservationFact)-1]
+	}
 
-	//skip header
-	for _, line := range lines[1:] {
-		ofk, of := ObservationFactFromString(line)
+	// the patients whose observations are copied by the dummies (and their dummies)
+	originalPatients := make(map[string][]string)
+	for dummy, patient := range l.TableDummyToPatient {
+		originalPatients[patient] = append(originalPatients[patient], dummy)
+	}
+	// the observations of visits loaded before that not all the dummies of their patient have a copy of
+	skipped := 0
+
+	if l.ObservationsIndex != nil {
+		l.ObservationsIndex.Close()
+	}
+	l.ObservationsIndex, err = NewObservationIndex(filepath.Dir(l.OutputFilePaths["OBSERVATION_FACT"].Path))
+	if err != nil {
+		return loader.NewError(loader.ErrOutput, err)
+	}
+
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], err)
+		}
 
 		//TODO do not consider observations where the concept is not mapped in the ontology
-		if _, ok := ListConceptsToIgnore[ofk.ConceptCD]; !ok {
-			TableObservationFact[ofk] = of
-
-			// if patient does not exist
-			if _, ok := MapPatientObs[ofk.PatientNum]; !ok {
-				// create array and add the observation
-				tmp := make([]*ObservationFactPK, 0)
-				tmp = append(tmp, ofk)
-				MapPatientObs[ofk.PatientNum] = tmp
-			} else {
-				// append encounter to array
-				MapPatientObs[ofk.PatientNum] = append(MapPatientObs[ofk.PatientNum], ofk)
+		dummies, ok := originalPatients[line[1]]
+		if !ok {
+			continue
+		}
+		if !l.copyableObservation(line, dummies) {
+			if _, loaded := l.State.MapNewEncounterNum[VisitDimensionPK{EncounterNum: line[0], PatientNum: line[1]}]; loaded {
+				skipped++
 			}
-
-			// if dummy
-			if originalPatient, ok := TableDummyToPatient[ofk.PatientNum]; ok {
-				MapDummyObs[ofk.PatientNum] = MapPatientObs[originalPatient]
+			continue
+		}
+		err = l.ObservationsIndex.Add(line[1], line)
+		if err != nil {
+			return loader.NewError(loader.ErrOutput, err)
+		}
+		if l.DummyStrategy == DummyConceptDistribution {
+			err = l.ObservationsIndex.Add(conceptKey(line[1], line[2]), line)
+			if err != nil {
+				return loader.NewError(loader.ErrOutput, err)
 			}
 		}
 	}
 
+	if err := l.ObservationsIndex.Build(); err != nil {
+		return loader.NewError(loader.ErrOutput, err)
+	}
+	if skipped > 0 {
+		log.Warn(strconv.Itoa(skipped) + " observations of visits loaded before are not copied by the dummies: " +
+			"not all the dummies of their patient have a copy of the visit")
+	}
 	return nil
 }
 
-// ConvertObservationFact converts the old observation.csv file
-func ConvertObservationFact() error {
-	rand.Seed(time.Now().UnixNano())
+// ConvertObservationFact converts the old observation.csv file row by row
+func (l *Loader) ConvertObservationFact() error {
+	defer func() {
+		l.ObservationsIndex.Close()
+		l.ObservationsIndex = nil
+	}()
 
-	csvOutputFile, err := os.Create(OutputFilePaths["OBSERVATION_FACT"].Path)
+	csvInputFile, err := os.Open(l.InputFilePaths["OBSERVATION_FACT"])
 	if err != nil {
-		log.Fatal("Error opening [observation_fact].csv")
-		return err
+		return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], err)
+	}
+	defer csvInputFile.Close()
+
+	reader := csv.NewReader(bufio.NewReader(csvInputFile))
+	reader.Comma = ','
+	reader.ReuseRecord = true
+
+	csvOutputFile, err := os.Create(l.OutputFilePaths["OBSERVATION_FACT"].Path)
+	if err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["OBSERVATION_FACT"].Path, 0)
 	}
 	defer csvOutputFile.Close()
+	writer := bufio.NewWriter(csvOutputFile)
 
 	headerString := ""
-	for _, header := range HeaderObservationFact {
+	for _, header := range l.HeaderObservationFact {
 		headerString += "\"" + header + "\","
 	}
 	// remove the last ,
-	csvOutputFile.WriteString(headerString[:len(headerString)-1] + "\n")
+	writer.WriteString(headerString[:len(headerString)-1] + "\n")
+
+	// skip header
+	if _, err := reader.Read(); err != nil {
+		return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], err)
+	}
+
+	// one source per dummy to draw the observations of its original patient (see DummyStrategy)
+	sources := make(map[string]*dummySource)
+	intended := make(map[string]int64)
+	l.DummyFacts = make(map[string]int64)
+	l.ConceptObservations = make(map[string]int64)
+	l.ModifierObservations = make(map[string]int64)
+	l.DroppedObservations = 0
+
+	// convert converts an observation (a line of the observation_fact.csv or of a generated dummy)
+	convert := func(line []string) error {
+		_, of := ObservationFactFromString(line, l.TextSearchIndex)
+		l.TextSearchIndex++
+
+		//TODO do not consider observations where the concept is not mapped in the ontology
+		if _, ok := l.ListConceptsToIgnore[of.PK.ConceptCD]; ok {
+			return nil
+		}
+		if _, ok := l.ListModifiersToIgnore[of.PK.ModifierCD]; ok {
+			return nil
+		}
 
-	for _, of := range TableObservationFact {
 		copyObs := of
 
 		// if dummy observation
-		if _, ok := TableDummyToPatient[of.PK.PatientNum]; ok {
-			// 1. choose a random observation from the original patient
+		if originalPatient, ok := l.TableDummyToPatient[of.PK.PatientNum]; ok {
+			// 1. choose an observation from the original patient
 			// 2. copy the data
 			// 3. change patient_num and encounter_num
-			listObs := MapDummyObs[of.PK.PatientNum]
+			source, ok := sources[of.PK.PatientNum]
+			if !ok {
+				var err error
+				source, err = l.newDummySource(of.PK.PatientNum, originalPatient)
+				if err != nil {
+					return err
+				}
+				sources[of.PK.PatientNum] = source
+			}
+			intended[of.PK.PatientNum]++
 
-			// TODO: find out why this can be 0 (the generation should not allow this
-			if len(listObs) == 0 {
-				continue
+			record, err := source.draw(of.PK.ConceptCD)
+			if err != nil {
+				return loader.NewError(loader.ErrOutput, err)
 			}
-			index := rand.Intn(len(listObs))
 
-			copyObs = TableObservationFact[listObs[index]]
+			_, copyObs = ObservationFactFromString(record, 0)
 			// change patient_num and encounter_num
-			tmp := MapNewEncounterNum[VisitDimensionPK{EncounterNum: copyObs.PK.EncounterNum, PatientNum: of.PK.PatientNum}]
+			tmp := l.MapNewEncounterNum[VisitDimensionPK{EncounterNum: copyObs.PK.EncounterNum, PatientNum: of.PK.PatientNum}]
 			copyObs.PK = regenerateObservationPK(copyObs.PK, tmp.PatientNum, tmp.EncounterNum)
-			// keep the same concept (and text_search_index) that was already there
+			// keep the same concept, modifier (and text_search_index) that was already there
 			copyObs.PK.ConceptCD = of.PK.ConceptCD
+			copyObs.PK.ModifierCD = of.PK.ModifierCD
 			copyObs.AdminColumns.TextSearchIndex = of.AdminColumns.TextSearchIndex
 
-			// delete observation from the list (so we don't choose it again)
-			listObs[index] = listObs[len(listObs)-1]
-			listObs = listObs[:len(listObs)-1]
-			MapDummyObs[of.PK.PatientNum] = listObs
-
 		} else { // if real observation
 			// change patient_num and encounter_num
-			tmp := MapNewEncounterNum[VisitDimensionPK{EncounterNum: of.PK.EncounterNum, PatientNum: of.PK.PatientNum}]
+			tmp := l.MapNewEncounterNum[VisitDimensionPK{EncounterNum: of.PK.EncounterNum, PatientNum: of.PK.PatientNum}]
 			copyObs.PK = regenerateObservationPK(copyObs.PK, tmp.PatientNum, tmp.EncounterNum)
 		}
 
 		// if the concept is sensitive we replace its code with the correspondent tag ID
-		if _, ok := MapConceptCodeToTag[copyObs.PK.ConceptCD]; ok {
-			copyObs.PK.ConceptCD = "TAG_ID:" + strconv.FormatInt(MapConceptCodeToTag[copyObs.PK.ConceptCD], 10)
+		if _, ok := l.MapConceptCodeToTag[copyObs.PK.ConceptCD]; ok {
+			copyObs.PK.ConceptCD = "TAG_ID:" + strconv.FormatInt(l.MapConceptCodeToTag[copyObs.PK.ConceptCD], 10)
+		}
+		// same for the modifier
+		if _, ok := l.MapModifierCodeToTag[copyObs.PK.ModifierCD]; ok {
+			copyObs.PK.ModifierCD = "TAG_ID:" + strconv.FormatInt(l.MapModifierCodeToTag[copyObs.PK.ModifierCD], 10)
 		}
 
-		// TODO: connected with the previous TODO
+		// the observations of visits that do not exist are dropped (never the ones of the dummies)
 		if copyObs.PK.EncounterNum != "" {
-			csvOutputFile.WriteString(copyObs.ToCSVText() + "\n")
+			writer.WriteString(copyObs.ToCSVText() + "\n")
+			if _, ok := l.TableDummyToPatient[of.PK.PatientNum]; ok {
+				l.DummyFacts[of.PK.PatientNum]++
+			}
+		}
+		return nil
+	}
+
+	// the text_search_index follows the one of the previous loads
+	l.TextSearchIndex = l.State.NextTextSearchIndex
+	for {
+		line, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return loader.NewInputError(l.InputFilePaths["OBSERVATION_FACT"], err)
+		}
+		l.countObservation(line)
+		if err := convert(line); err != nil {
+			return err
 		}
 	}
 
+	// the observations of the generated dummies only have a concept and a modifier (drawn from their cluster as they are
+	// written), the rest is copied
+	dummies := make([]string, 0, len(l.TableGeneratedDummies))
+	for dummy := range l.TableGeneratedDummies {
+		dummies = append(dummies, dummy)
+	}
+	sort.Strings(dummies)
+	line := make([]string, len(l.HeaderObservationFact))
+	for _, dummy := range dummies {
+		err := l.drawDummyObservations(dummy, func(obs DummyObservation) error {
+			line[1], line[2], line[5] = dummy, obs.ConceptCD, obs.ModifierCD
+			return convert(line)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(l.OutputFilePaths["OBSERVATION_FACT"].Path, 0)
+	}
+
+	// every dummy must have got one fact per dummy observation
+	facts := int64(0)
+	for dummy, n := range intended {
+		if l.DummyFacts[dummy] != n {
+			return loader.NewError(loader.ErrOutput, errors.New("the dummy "+dummy+" got "+strconv.FormatInt(l.DummyFacts[dummy], 10)+
+				" facts instead of "+strconv.FormatInt(n, 10)))
+		}
+		facts += n
+	}
+	log.Lvl2("Dummy observations:", len(l.TableDummyToPatient), "dummies got their", facts, "facts")
 	return nil
 }
 
@@ -1,6 +1,8 @@
 package loaderi2b2_test
 
 import (
+	"encoding/csv"
+	"errors"
 	"github.com/ldsec/medco-loader/loader"
 	"github.com/ldsec/medco-loader/loader/i2b2"
 	"github.com/ldsec/unlynx/lib"
@@ -9,7 +11,13 @@ import (
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -60,50 +68,133 @@ func setupEncryptEnv() {
 	_, publicKey = libunlynx.GenKey()
 }
 
+// setupData copies the test dataset (testdata/) in a temporary folder used as the DefaultDataPath of the test
+func setupData(t *testing.T) {
+	dir := t.TempDir()
+	err := filepath.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, strings.TrimPrefix(path, "testdata"))
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, content, 0600)
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "i2b2", "converted"), 0700))
+
+	dataPath := loaderi2b2.DefaultDataPath
+	loaderi2b2.DefaultDataPath = dir + "/"
+	t.Cleanup(func() { loaderi2b2.DefaultDataPath = dataPath })
+}
+
+// newLoader creates a loader of the default dataset (the given concepts are sensitive)
+func newLoader(t *testing.T, sensitive ...string) *loaderi2b2.Loader {
+	sensitiveConcepts := make(map[string]struct{})
+	for _, concept := range sensitive {
+		sensitiveConcepts[concept] = struct{}{}
+	}
+
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, SensitiveConcepts: sensitiveConcepts})
+	assert.Nil(t, err)
+	return l
+}
+
 func TestConvertTableAccess(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
+	l := newLoader(t)
 
-	assert.Nil(t, loaderi2b2.ParseTableAccess())
-	assert.Nil(t, loaderi2b2.ConvertTableAccess())
+	assert.Nil(t, l.ParseTableAccess())
+	assert.Nil(t, l.ConvertTableAccess())
 }
 
 func TestParseDummyToPatient(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
+	l := newLoader(t)
 
-	assert.Nil(t, loaderi2b2.ParseDummyToPatient())
+	assert.Nil(t, l.ParseDummyToPatient())
 }
 
 func TestConvertPatientDimension(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
 	setupEncryptEnv()
+	l := newLoader(t)
 
-	loaderi2b2.ParseDummyToPatient()
+	l.ParseDummyToPatient()
 
-	assert.Nil(t, loaderi2b2.ParsePatientDimension(publicKey))
-	assert.Nil(t, loaderi2b2.ConvertPatientDimension(publicKey, false))
+	assert.Nil(t, l.ParsePatientDimension(publicKey))
+	assert.Nil(t, l.ConvertPatientDimension(publicKey, false))
 
 	local.CloseAll()
 }
 
 func TestConvertVisitDimension(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
 	setupEncryptEnv()
+	l := newLoader(t)
 
-	loaderi2b2.ParseDummyToPatient()
+	l.ParseDummyToPatient()
 
-	loaderi2b2.ParsePatientDimension(publicKey)
-	loaderi2b2.ConvertPatientDimension(publicKey, false)
+	l.ParsePatientDimension(publicKey)
+	l.ConvertPatientDimension(publicKey, false)
 
-	assert.Nil(t, loaderi2b2.ParseVisitDimension())
-	assert.Nil(t, loaderi2b2.ConvertVisitDimension(false))
+	assert.Nil(t, l.ParseVisitDimension())
+	assert.Nil(t, l.ConvertVisitDimension(false))
 
 	local.CloseAll()
 }
 
+func TestPermutationKey(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	convert := func(key string) (map[string]string, map[loaderi2b2.VisitDimensionPK]loaderi2b2.VisitDimensionPK) {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, PermutationKey: []byte(key)})
+		assert.Nil(t, err)
+		assert.Nil(t, l.ParseDummyToPatient())
+		assert.Nil(t, l.ParsePatientDimension(publicKey))
+		assert.Nil(t, l.ConvertPatientDimension(publicKey, false))
+		assert.Nil(t, l.ParseVisitDimension())
+		assert.Nil(t, l.ConvertVisitDimension(false))
+		return l.MapNewPatientNum, l.MapNewEncounterNum
+	}
+
+	// the same key always gives the same numbers, another key (or none) other ones
+	patients, encounters := convert("site secret")
+	samePatients, sameEncounters := convert("site secret")
+	assert.Equal(t, patients, samePatients)
+	assert.Equal(t, encounters, sameEncounters)
+	otherPatients, otherEncounters := convert("other secret")
+	assert.NotEqual(t, patients, otherPatients)
+	assert.NotEqual(t, encounters, otherEncounters)
+	randomPatients, _ := convert("")
+	assert.NotEqual(t, patients, randomPatients)
+
+	// the new patient_num are a permutation of [0, #patients)
+	nums := make(map[string]struct{})
+	for _, num := range patients {
+		nums[num] = struct{}{}
+	}
+	for i := 0; i < len(patients); i++ {
+		assert.Contains(t, nums, strconv.Itoa(i))
+	}
+}
+
 func TestUpdateChildrenEncryptIDs(t *testing.T) {
-	loaderi2b2.TablesMedCoOntology = make(map[string]loaderi2b2.MedCoTableInfo)
+	l := newLoader(t)
+	l.TablesMedCoOntology = make(map[string]loaderi2b2.MedCoTableInfo)
 	tableMedCoOntologyConceptEnc := make(map[string]*loaderi2b2.MedCoOntology)
-	loaderi2b2.TablesMedCoOntology["test"] = loaderi2b2.MedCoTableInfo{Sensitive: tableMedCoOntologyConceptEnc}
+	l.TablesMedCoOntology["test"] = loaderi2b2.MedCoTableInfo{Sensitive: tableMedCoOntologyConceptEnc}
 
 	so0 := loaderi2b2.MedCoOntology{Fullname: "\\a\\", NodeEncryptID: 0}
 	so1 := loaderi2b2.MedCoOntology{Fullname: "\\a\\b\\", NodeEncryptID: 1}
@@ -117,13 +208,13 @@ func TestUpdateChildrenEncryptIDs(t *testing.T) {
 	tableMedCoOntologyConceptEnc["\\a\\c\\d"] = &so3
 	tableMedCoOntologyConceptEnc["\\a\\c\\f"] = &so4
 
-	loaderi2b2.UpdateChildrenEncryptIDs("test")
+	l.UpdateChildrenEncryptIDs("test")
 
-	assert.Equal(t, 4, len(loaderi2b2.TablesMedCoOntology["test"].Sensitive["\\a\\"].ChildrenEncryptIDs))
-	assert.Equal(t, 0, len(loaderi2b2.TablesMedCoOntology["test"].Sensitive["\\a\\b\\"].ChildrenEncryptIDs))
-	assert.Equal(t, 2, len(loaderi2b2.TablesMedCoOntology["test"].Sensitive["\\a\\c\\"].ChildrenEncryptIDs))
-	assert.Equal(t, 0, len(loaderi2b2.TablesMedCoOntology["test"].Sensitive["\\a\\c\\d"].ChildrenEncryptIDs))
-	assert.Equal(t, 0, len(loaderi2b2.TablesMedCoOntology["test"].Sensitive["\\a\\c\\f"].ChildrenEncryptIDs))
+	assert.Equal(t, 4, len(l.TablesMedCoOntology["test"].Sensitive["\\a\\"].ChildrenEncryptIDs))
+	assert.Equal(t, 0, len(l.TablesMedCoOntology["test"].Sensitive["\\a\\b\\"].ChildrenEncryptIDs))
+	assert.Equal(t, 2, len(l.TablesMedCoOntology["test"].Sensitive["\\a\\c\\"].ChildrenEncryptIDs))
+	assert.Equal(t, 0, len(l.TablesMedCoOntology["test"].Sensitive["\\a\\c\\d"].ChildrenEncryptIDs))
+	assert.Equal(t, 0, len(l.TablesMedCoOntology["test"].Sensitive["\\a\\c\\f"].ChildrenEncryptIDs))
 }
 
 func TestStripByLevel(t *testing.T) {
@@ -158,79 +249,326 @@ func TestStripByLevel(t *testing.T) {
 }
 
 func TestConvertOntology(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
 	setupEncryptEnv()
-	loaderi2b2.Testing = true
+	l := newLoader(t, `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`)
 
-	loaderi2b2.ListSensitiveConcepts = make(map[string]struct{})
-	loaderi2b2.ListSensitiveConcepts[`\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`] = struct{}{}
+	assert.Nil(t, l.ConvertLocalOntology())
+	assert.Nil(t, l.GenerateMedCoOntology())
 
-	assert.Nil(t, loaderi2b2.ConvertLocalOntology(el, 0))
-	assert.Nil(t, loaderi2b2.GenerateMedCoOntology())
+	local.CloseAll()
+}
+
+func TestSensitivityPolicy(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	policy := &loader.Policy{Rules: []loader.Rule{{
+		Name:     "benign",
+		Concepts: []string{`\i2b2\Diagnoses\*\Benign*\`},
+		Except:   []string{`**\(216.0) Lip\`},
+	}}}
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, Policy: policy})
+	assert.Nil(t, err)
+	assert.Nil(t, l.ConvertLocalOntology())
+
+	skin := `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`
+	match, sensitive := l.HasSensitiveParents(skin + `(216.1) Eyelid\`)
+	assert.True(t, sensitive)
+	assert.Equal(t, `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\`, match)
+	assert.True(t, l.SensitivityDecisions[skin+`(216.0) Lip\`].Excluded)
+	assert.False(t, l.SensitivityDecisions[`\i2b2\Diagnoses\Neoplasms (140-239)\`].Sensitive)
+}
+
+func TestConvertSynonyms(t *testing.T) {
+	setupData(t)
+	log.SetDebugVisible(2)
+	setupEncryptEnv()
+
+	primary := `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\(216.1) Eyelid\`
+	synonym := `\i2b2\Diagnoses\Synonyms\Eyelid skin\`
+
+	// the synonym of a non-sensitive concept stays in clear
+	l := newLoader(t)
+	assert.Nil(t, l.ConvertLocalOntology())
+	assert.Contains(t, l.TablesMedCoOntology["I2B2"].Clear, synonym)
+	assert.Contains(t, l.TableLocalOntologyClear, synonym)
+
+	// the synonym of a sensitive concept shares its NodeEncryptID (and therefore its tag)
+	l = newLoader(t, `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`)
+	assert.Nil(t, l.ConvertLocalOntology())
+
+	sensitive := l.TablesMedCoOntology["I2B2"].Sensitive
+	assert.Contains(t, sensitive, synonym)
+	assert.Equal(t, sensitive[primary].NodeEncryptID, sensitive[synonym].NodeEncryptID)
+	assert.NotContains(t, l.TableLocalOntologyClear, synonym)
+	assert.NotContains(t, l.MapConceptPathToTag, synonym)
+	assert.Equal(t, primary, l.MapSynonymPathToPrimary[synonym])
 
 	local.CloseAll()
 }
 
 func TestConvertConceptDimension(t *testing.T) {
+	setupData(t)
+	log.SetDebugVisible(2)
+	setupEncryptEnv()
+	l := newLoader(t, `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`)
+
+	assert.Nil(t, l.ConvertLocalOntology())
+	assert.Nil(t, l.GenerateMedCoOntology())
+
+	assert.Nil(t, l.ParseConceptDimension())
+	assert.Nil(t, l.ConvertConceptDimension())
+
+	local.CloseAll()
+
+}
+
+func TestConvertModifierDimension(t *testing.T) {
+	setupData(t)
+	log.SetDebugVisible(2)
+	setupEncryptEnv()
+	l := newLoader(t, `\Dose\High\`)
+
+	assert.Nil(t, l.ConvertLocalOntology())
+	assert.Nil(t, l.GenerateMedCoOntology())
+
+	// only the sensitive modifier is tagged (with its own TAG_ID)
+	assert.Equal(t, 1, len(l.MapModifierPathToTag))
+	assert.Contains(t, l.MapModifierPathToTag, `\Dose\High\`)
+	assert.NotContains(t, l.MapModifierPathToTag, `\Dose\`)
+	assert.Equal(t, l.MapModifierPathToTag[`\Dose\High\`].TagID, l.MapModifierCodeToTag["MOD:HIGH"])
+
+	assert.Nil(t, l.ParseModifierDimension())
+	assert.Nil(t, l.ConvertModifierDimension())
+	assert.Empty(t, l.ListModifiersToIgnore)
+
+	local.CloseAll()
+}
+
+func TestConcurrentLoaders(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
 	setupEncryptEnv()
-	loaderi2b2.Testing = true
 
-	loaderi2b2.ListSensitiveConcepts = make(map[string]struct{})
-	loaderi2b2.ListSensitiveConcepts[`\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`] = struct{}{}
+	// two loads of the same dataset with different sensitive concepts (and output folders) do not share any state
+	sensitive := [][]string{{`\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`}, {}}
+	loaders := make([]*loaderi2b2.Loader, len(sensitive))
+	for i := range loaders {
+		output, err := ioutil.TempDir(loaderi2b2.DefaultDataPath+"i2b2", "converted_")
+		assert.Nil(t, err)
+		defer os.RemoveAll(output)
+
+		sensitiveConcepts := make(map[string]struct{})
+		for _, concept := range sensitive[i] {
+			sensitiveConcepts[concept] = struct{}{}
+		}
 
-	assert.Nil(t, loaderi2b2.ConvertLocalOntology(el, 0))
-	assert.Nil(t, loaderi2b2.GenerateMedCoOntology())
+		loaders[i], err = loaderi2b2.NewLoader(loaderi2b2.Options{
+			Roster:    el,
+			Testing:   true,
+			Directory: loaderi2b2.DefaultDataPath + "i2b2",
+			Files: loaderi2b2.Files{
+				Ontology:     []string{"original/i2b2.csv"},
+				TableAccess:  "original/table_access.csv",
+				OutputFolder: filepath.Base(output) + "/",
+			},
+			SensitiveConcepts: sensitiveConcepts,
+			PlaintextMappings: true,
+		})
+		assert.Nil(t, err)
+	}
 
-	assert.Nil(t, loaderi2b2.ParseConceptDimension())
-	assert.Nil(t, loaderi2b2.ConvertConceptDimension())
+	var wg sync.WaitGroup
+	for _, l := range loaders {
+		wg.Add(1)
+		go func(l *loaderi2b2.Loader) {
+			defer wg.Done()
+			assert.Nil(t, l.ConvertLocalOntology())
+			assert.Nil(t, l.GenerateMedCoOntology())
+		}(l)
+	}
+	wg.Wait()
+
+	assert.NotEmpty(t, loaders[0].MapConceptPathToTag)
+	assert.Empty(t, loaders[1].MapConceptPathToTag)
+	assert.NotEqual(t, loaders[0].OutputFilePaths["LOCAL_I2B2"].Path, loaders[1].OutputFilePaths["LOCAL_I2B2"].Path)
 
 	local.CloseAll()
+}
+
+func TestInputErrors(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+
+	dir, err := ioutil.TempDir(loaderi2b2.DefaultDataPath+"i2b2", "input_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// an ontology element with an unknown visual attribute (on the second line of the file)
+	f, err := os.Open(loaderi2b2.DefaultDataPath + "i2b2/original/i2b2.csv")
+	assert.Nil(t, err)
+	lines, err := csv.NewReader(f).ReadAll()
+	assert.Nil(t, err)
+	f.Close()
+	lines[1][4] = "XA "
+
+	f, err = os.Create(filepath.Join(dir, "bad.csv"))
+	assert.Nil(t, err)
+	assert.Nil(t, csv.NewWriter(f).WriteAll(lines[:2]))
+	f.Close()
+
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{
+		Roster:    el,
+		Testing:   true,
+		Directory: dir,
+		Files:     loaderi2b2.Files{Ontology: []string{"bad.csv"}, TableAccess: "missing.csv", OutputFolder: "converted/", MappingFolder: "private/"},
+	})
+	assert.Nil(t, err)
+
+	err = l.ParseTableAccess()
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	err = l.ConvertLocalOntology()
+	var e *loader.Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, loader.ErrInputFormat, e.Kind)
+	assert.Equal(t, dir+"/bad.csv", e.Path)
+	assert.Equal(t, int64(2), e.Line)
+
+	// at least one ontology file is needed
+	_, err = loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Directory: dir})
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
 
+	local.CloseAll()
 }
 
 func TestConvertAll(t *testing.T) {
+	setupData(t)
 	log.SetDebugVisible(2)
 	setupEncryptEnv()
-	loaderi2b2.Testing = true
-	loaderi2b2.AllSensitive = false
+	l := newLoader(t, `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`)
 
-	loaderi2b2.ListSensitiveConcepts = make(map[string]struct{})
-	loaderi2b2.ListSensitiveConcepts[`\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`] = struct{}{}
-
-	assert.Nil(t, loaderi2b2.ConvertLocalOntology(el, 0))
+	assert.Nil(t, l.ConvertLocalOntology())
 
 	log.LLvl1("--- Finished converting LOCAL_ONTOLOGY ---")
 
-	assert.Nil(t, loaderi2b2.GenerateMedCoOntology())
+	assert.Nil(t, l.GenerateMedCoOntology())
 
 	log.LLvl1("--- Finished generating MEDCO_ONTOLOGY ---")
 
-	assert.Nil(t, loaderi2b2.ParseDummyToPatient())
+	assert.Nil(t, l.ParseDummyToPatient())
 
-	assert.Nil(t, loaderi2b2.ParsePatientDimension(publicKey))
-	assert.Nil(t, loaderi2b2.ConvertPatientDimension(publicKey, true))
+	assert.Nil(t, l.ParsePatientDimension(publicKey))
+	assert.Nil(t, l.ConvertPatientDimension(publicKey, true))
 
 	log.LLvl1("--- Finished converting PATIENT_DIMENSION ---")
 
-	assert.Nil(t, loaderi2b2.ParseVisitDimension())
-	assert.Nil(t, loaderi2b2.ConvertVisitDimension(true))
+	assert.Nil(t, l.ParseVisitDimension())
+	assert.Nil(t, l.ConvertVisitDimension(true))
 
 	log.LLvl1("--- Finished converting VISIT_DIMENSION ---")
 
-	assert.Nil(t, loaderi2b2.ParseConceptDimension())
-	assert.Nil(t, loaderi2b2.ConvertConceptDimension())
+	assert.Nil(t, l.ParseConceptDimension())
+	assert.Nil(t, l.ConvertConceptDimension())
 
 	log.LLvl1("--- Finished converting CONCEPT_DIMENSION ---")
 
-	assert.Nil(t, loaderi2b2.ParseObservationFact())
-	assert.Nil(t, loaderi2b2.ConvertObservationFact())
+	assert.Nil(t, l.ParseModifierDimension())
+	assert.Nil(t, l.ConvertModifierDimension())
+
+	log.LLvl1("--- Finished converting MODIFIER_DIMENSION ---")
+
+	assert.Nil(t, l.ParseObservationFact())
+	assert.Nil(t, l.ConvertObservationFact())
 
 	log.LLvl1("--- Finished converting OBSERVATION_FACT ---")
 
 	local.CloseAll()
 }
 
-func TestGenerateLoadingDataScript(t *testing.T) {
-	assert.Nil(t, loaderi2b2.GenerateLoadingDataScript(loader.DBSettings{DBhost: "localhost", DBport: 5434, DBname: "i2b2medcosrv0", DBuser: "i2b2", DBpassword: "i2b2"}))
+func TestGenerateLoadingDataStatements(t *testing.T) {
+	l := newLoader(t)
+	statements := l.GenerateLoadingDataStatements()
+
+	// all tables are copied from their converted file after being emptied (only the rows of the tables of the converted
+	// file are deleted from the table_access)
+	copied := make(map[string]bool)
+	for _, s := range statements {
+		if s.IsCopy() {
+			assert.NotEmpty(t, s.Table)
+			assert.True(t, s.Header)
+			copied[s.Table] = true
+		} else if strings.HasPrefix(s.SQL, "TRUNCATE") {
+			assert.False(t, copied[s.Table], "table "+s.Table+" truncated after being loaded")
+		}
+	}
+	for file, fI := range l.OutputFilePaths {
+		if fI.TableName != "" {
+			assert.True(t, copied[fI.TableName], file+" is not loaded")
+		}
+	}
+	assert.Equal(t, "TRUNCATE TABLE i2b2demodata_i2b2.patient_mapping;", statements[0].SQL)
+}
+
+func TestTableAccessStatements(t *testing.T) {
+	setupData(t)
+
+	deleteRows := regexp.MustCompile(`^DELETE FROM (\S+) WHERE c_table_cd IN \((.*)\);$`)
+	for _, delta := range []bool{false, true} {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Delta: delta})
+		assert.Nil(t, err)
+		assert.Nil(t, l.ParseTableAccess())
+		assert.Nil(t, l.ConvertTableAccess())
+
+		// the table_access already has the ontologies of the v0 loader and an older root of a converted one, the loading
+		// statements are played on its c_table_cd
+		rows := map[string]int{"CLINICAL_SENSITIVE": 1, "CLINICAL_NON_SENSITIVE": 1, "GENOMIC": 1, "i2b2": 1}
+		for _, s := range l.GenerateLoadingDataStatements() {
+			if s.Table != l.OutputFilePaths["TABLE_ACCESS"].TableName {
+				continue
+			}
+			if s.IsCopy() {
+				for _, code := range column(t, s.Path, "c_table_cd") {
+					rows[code]++
+				}
+				continue
+			}
+			assert.False(t, strings.HasPrefix(s.SQL, "TRUNCATE"), "the table_access is emptied")
+			deleted := deleteRows.FindStringSubmatch(s.SQL)
+			if assert.NotNil(t, deleted, s.SQL) {
+				assert.Equal(t, s.Table, deleted[1])
+				for _, code := range strings.Split(deleted[2], ", ") {
+					delete(rows, strings.Trim(code, "'"))
+				}
+			}
+		}
+
+		// the rows of the other loaders survive the load, the converted ones are replaced
+		assert.Equal(t, map[string]int{"CLINICAL_SENSITIVE": 1, "CLINICAL_NON_SENSITIVE": 1, "GENOMIC": 1,
+			"i2b2": 1, "BIRN": 1, "CUSTOM_META": 1, "ICD10_ICD9": 1}, rows, "delta: %v", delta)
+	}
+}
+
+func TestWriteLoadingSummary(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{
+		Roster:      el,
+		Testing:     true,
+		I2B2DB:      loader.DBSettings{DBhost: "localhost", DBport: 5434, DBname: "i2b2medcosrv0", DBuser: "i2b2", DBpassword: "i2b2"},
+		ConvertOnly: true,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, l.Load())
+
+	summary, err := ioutil.ReadFile(l.OutputFilePaths["LOADING_SUMMARY"].Path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(summary), "TRUNCATE i2b2demodata_i2b2.observation_fact\n")
+	assert.Contains(t, string(summary), "LOAD     i2b2demodata_i2b2.observation_fact <- "+l.OutputFilePaths["OBSERVATION_FACT"].Path)
 }
@@ -0,0 +1,205 @@
+package loaderi2b2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MappingFiles are the private files of a conversion: the mappings between the original and the new patient_num and
+// encounter_num (which also tell the dummies apart) and the NodeEncryptIDs and TAG_IDs of the sensitive paths. They are
+// written in a mapping folder, encrypted with a key or stored in a schema (see Options), and only in plaintext in the
+// output folder if PlaintextMappings is set.
+var MappingFiles = []string{"NEW_PATIENT_NUM", "NEW_ENCOUNTER_NUM", "TAGGED_PATHS"}
+
+// mappingHeaders are the columns of the mapping files (and tables)
+var mappingHeaders = map[string][]string{
+	"NEW_PATIENT_NUM":   {"old_patient_num", "new_patient_num"},
+	"NEW_ENCOUNTER_NUM": {"old_encounter_num", "old_patient_num", "new_encounter_num", "new_patient_num"},
+	"TAGGED_PATHS":      {"type", "path", "node_encrypt_id", "tag_id"},
+}
+
+// mappingSaltSize is the size of the random salt of the key derivation, stored at the beginning of each encrypted
+// mapping file
+const mappingSaltSize = 16
+
+// plainIdentifier matches the names of schemas that can be used unquoted in the statements and table names
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// generateMappingFiles sets the paths (and tables) of the mapping files
+func (l *Loader) generateMappingFiles(folderPath string) {
+	for _, file := range MappingFiles {
+		name := strings.ToLower(file)
+		fI := FileInfo{TableName: "", Path: folderPath + name + ".csv"}
+		if l.MappingSchema != "" {
+			fI.TableName = l.MappingSchema + "." + name
+		} else if len(l.MappingKey) > 0 {
+			fI.Path += ".enc"
+		}
+		l.OutputFilePaths[file] = fI
+	}
+}
+
+// mappingCipher returns the AES-GCM cipher of a mapping file. Its key is derived from the MappingKey (which may be a
+// passphrase) and the salt of the file with scrypt.
+func (l *Loader) mappingCipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(l.MappingKey, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeMapping writes a mapping file (only readable by its owner), encrypted if there is a MappingKey
+func (l *Loader) writeMapping(file string, records [][]string) error {
+	path := l.OutputFilePaths[file].Path
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(mappingHeaders[file])
+	writer.WriteAll(records)
+	if err := writer.Error(); err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(path, 0)
+	}
+	return l.writePrivateFile(path, buf.Bytes(), len(l.MappingKey) > 0 && l.MappingSchema == "")
+}
+
+// writePrivateFile writes a file only readable by its owner (creating its folder), encrypted with a key derived from
+// the MappingKey if encrypt is set
+func (l *Loader) writePrivateFile(path string, content []byte, encrypt bool) error {
+	if encrypt {
+		salt := make([]byte, mappingSaltSize)
+		if _, err := cryptorand.Read(salt); err != nil {
+			return loader.NewError(loader.ErrRandomness, err).InFile(path, 0)
+		}
+		aead, err := l.mappingCipher(salt)
+		if err != nil {
+			return loader.NewError(loader.ErrOutput, err).InFile(path, 0)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := cryptorand.Read(nonce); err != nil {
+			return loader.NewError(loader.ErrRandomness, err).InFile(path, 0)
+		}
+		content = aead.Seal(append(salt, nonce...), nonce, content, nil)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(path, 0)
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(path, 0)
+	}
+	return nil
+}
+
+// readMapping reads the records (without the header) of a mapping of the previous conversion, from the mapping file or
+// from the mapping table
+func (l *Loader) readMapping(file string) ([][]string, error) {
+	if l.MappingSchema != "" {
+		return readMappingTable(l.I2B2DB, l.OutputFilePaths[file].TableName, len(mappingHeaders[file]))
+	}
+
+	path := l.OutputFilePaths[file].Path
+	content, err := l.readPrivateFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = len(mappingHeaders[file])
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return nil, loader.NewInputError(path, err)
+	}
+	if len(lines) == 0 {
+		return nil, loader.NewInputError(path, errors.New("missing header"))
+	}
+	return lines[1:], nil
+}
+
+// readPrivateFile reads a file written by writePrivateFile, decrypting it if there is a MappingKey
+func (l *Loader) readPrivateFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, loader.NewInputError(path, err)
+	}
+
+	if len(l.MappingKey) > 0 {
+		if len(content) < mappingSaltSize {
+			return nil, loader.NewInputError(path, errors.New("truncated encrypted file"))
+		}
+		aead, err := l.mappingCipher(content[:mappingSaltSize])
+		if err != nil {
+			return nil, loader.NewInputError(path, err)
+		}
+		content = content[mappingSaltSize:]
+		if len(content) < aead.NonceSize() {
+			return nil, loader.NewInputError(path, errors.New("truncated encrypted file"))
+		}
+		content, err = aead.Open(nil, content[:aead.NonceSize()], content[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, loader.NewInputError(path, errors.New("cannot decrypt the file (wrong mapping key?)"))
+		}
+	}
+	return content, nil
+}
+
+// readMappingTable reads all the rows of a mapping table (the columns are read as text)
+func readMappingTable(i2b2DB loader.DBSettings, table string, columns int) ([][]string, error) {
+	db, err := sql.Open("postgres", i2b2DB.ConnectionString())
+	if err != nil {
+		return nil, &loader.LoadError{Err: err}
+	}
+	defer db.Close()
+
+	records := make([][]string, 0)
+	err = loader.QueryRows(db, table, "SELECT * FROM "+table, func(rows *sql.Rows) error {
+		record := make([]string, columns)
+		dest := make([]interface{}, columns)
+		for i := range record {
+			dest[i] = &record[i]
+		}
+		records = append(records, record)
+		return rows.Scan(dest...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// mappingStatements creates the statements loading the mappings into their tables (they hold all the mappings, also the
+// ones of the previous loads)
+func (l *Loader) mappingStatements() []loader.Statement {
+	statements := make([]loader.Statement, 0)
+	if l.MappingSchema == "" {
+		return statements
+	}
+
+	statements = append(statements, loader.ExecStatement(`CREATE SCHEMA IF NOT EXISTS `+pq.QuoteIdentifier(l.MappingSchema)+`;
+		REVOKE ALL ON SCHEMA `+pq.QuoteIdentifier(l.MappingSchema)+` FROM PUBLIC;`))
+	for _, file := range MappingFiles {
+		fI := l.OutputFilePaths[file]
+		statements = append(statements,
+			loader.Statement{Table: fI.TableName, SQL: `CREATE TABLE IF NOT EXISTS ` + fI.TableName + ` (` + strings.Join(mappingHeaders[file], " TEXT, ") + ` TEXT);`},
+			loader.TruncateStatement(fI.TableName),
+			loader.CopyStatement(fI.TableName, fI.Path, true))
+	}
+	return statements
+}
@@ -0,0 +1,170 @@
+package loaderi2b2_test
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMappingFiles(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	dir, err := ioutil.TempDir(loaderi2b2.DefaultDataPath+"i2b2", "mappings_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "converted"), 0755))
+
+	newMappingLoader := func(opts loaderi2b2.Options) (*loaderi2b2.Loader, error) {
+		opts.Roster = el
+		opts.Testing = true
+		opts.Directory = loaderi2b2.DefaultDataPath + "i2b2/original"
+		opts.Files = loaderi2b2.Files{
+			Ontology:          []string{"i2b2.csv"},
+			TableAccess:       "table_access.csv",
+			DummyToPatient:    "dummy_to_patient.csv",
+			PatientDimension:  "patient_dimension.csv",
+			VisitDimension:    "visit_dimension.csv",
+			ConceptDimension:  "concept_dimension.csv",
+			ModifierDimension: "modifier_dimension.csv",
+			ObservationFact:   "observation_fact.csv",
+			OutputFolder:      "../" + filepath.Base(dir) + "/converted/",
+			MappingFolder:     "../" + filepath.Base(dir) + "/private/",
+		}
+		return loaderi2b2.NewLoader(opts)
+	}
+
+	// the mappings are not written in plaintext in the output folder unless it is explicitly allowed
+	plaintext := func(opts loaderi2b2.Options) error {
+		opts.Files = loaderi2b2.Files{Ontology: []string{"i2b2.csv"}, OutputFolder: "converted/"}
+		opts.Directory = dir
+		_, err := loaderi2b2.NewLoader(opts)
+		return err
+	}
+	err = plaintext(loaderi2b2.Options{})
+	assert.True(t, errors.Is(err, loader.ErrInputFormat), err)
+	assert.Nil(t, plaintext(loaderi2b2.Options{PlaintextMappings: true}))
+	// neither is the sensitivity report when the mappings are stored in a schema
+	err = plaintext(loaderi2b2.Options{MappingSchema: "medco_mappings"})
+	assert.True(t, errors.Is(err, loader.ErrInputFormat), err)
+
+	l, err := newMappingLoader(loaderi2b2.Options{MappingKey: []byte("site key"), AllSensitive: true})
+	assert.Nil(t, err)
+	assert.Nil(t, l.ConvertLocalOntology())
+	assert.Nil(t, l.ParseDummyToPatient())
+	assert.Nil(t, l.ParsePatientDimension(publicKey))
+	assert.Nil(t, l.ConvertPatientDimension(publicKey, false))
+	assert.Nil(t, l.ParseVisitDimension())
+	assert.Nil(t, l.ConvertVisitDimension(false))
+
+	// the mappings are encrypted, only readable by their owner and not in the output folder
+	for _, file := range loaderi2b2.MappingFiles {
+		path := l.OutputFilePaths[file].Path
+		assert.Equal(t, filepath.Join(dir, "private"), filepath.Dir(path))
+		assert.True(t, strings.HasSuffix(path, ".csv.enc"), path)
+
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		content, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.NotContains(t, string(content), "patient_num")
+		assert.NotContains(t, string(content), `\i2b2\`)
+	}
+	converted, err := ioutil.ReadDir(filepath.Join(dir, "converted"))
+	assert.Nil(t, err)
+	for _, f := range converted {
+		assert.NotContains(t, []string{"new_patient_num.csv", "new_encounter_num.csv", "tagged_paths.csv"}, f.Name())
+	}
+
+	// a delta load reads them back with the same key
+	loaded := func(l *loaderi2b2.Loader) {
+		for _, newNum := range l.MapNewPatientNum {
+			l.State.PatientNums[newNum] = struct{}{}
+		}
+		for _, newPK := range l.MapNewEncounterNum {
+			l.State.EncounterNums[newPK.EncounterNum] = struct{}{}
+		}
+	}
+	delta, err := newMappingLoader(loaderi2b2.Options{MappingKey: []byte("site key"), Delta: true})
+	assert.Nil(t, err)
+	loaded(l)
+	delta.State = l.State
+	assert.Nil(t, delta.ReadPreviousConversion())
+	assert.Equal(t, l.MapNewPatientNum, delta.State.MapNewPatientNum)
+	assert.Equal(t, l.MapNewEncounterNum, delta.State.MapNewEncounterNum)
+
+	// but not with another one
+	wrong, err := newMappingLoader(loaderi2b2.Options{MappingKey: []byte("other key"), Delta: true})
+	assert.Nil(t, err)
+	wrong.State = l.State
+	assert.NotNil(t, wrong.ReadPreviousConversion())
+
+	// the mappings stored in a schema are loaded in its tables, which cannot be done without loading
+	_, err = newMappingLoader(loaderi2b2.Options{MappingSchema: "medco_mappings", ConvertOnly: true})
+	assert.NotNil(t, err)
+
+	// nor in a schema whose name would have to be quoted
+	_, err = newMappingLoader(loaderi2b2.Options{MappingSchema: `medco_mappings"; DROP SCHEMA i2b2demodata; --`})
+	assert.True(t, errors.Is(err, loader.ErrInputFormat), err)
+
+	schema, err := newMappingLoader(loaderi2b2.Options{MappingSchema: "medco_mappings"})
+	assert.Nil(t, err)
+	copied := make(map[string]bool)
+	for _, s := range schema.GenerateLoadingDataStatements() {
+		if s.IsCopy() {
+			copied[s.Table] = true
+		}
+	}
+	for _, file := range loaderi2b2.MappingFiles {
+		table := schema.OutputFilePaths[file].TableName
+		assert.True(t, strings.HasPrefix(table, "medco_mappings."), table)
+		assert.True(t, copied[table], table)
+	}
+}
+
+func TestMappingSchemaResume(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	dir, err := ioutil.TempDir("", "checkpoint_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the database cannot be reached: the loading fails once the data is converted
+	load := func(resume bool) *loaderi2b2.Loader {
+		l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, AllSensitive: true, MappingSchema: "medco_mappings",
+			I2B2DB:        loader.DBSettings{DBhost: "localhost", DBport: 1, DBname: "i2b2", DBuser: "i2b2", DBpassword: "i2b2"},
+			CheckpointDir: dir, Resume: resume})
+		assert.Nil(t, err)
+		assert.NotNil(t, l.Load())
+		return l
+	}
+
+	// the mapping files are kept (privately) in the checkpoint until they are loaded
+	l := load(false)
+	for _, file := range loaderi2b2.MappingFiles {
+		path := l.OutputFilePaths[file].Path
+		assert.Equal(t, filepath.Join(dir, "mappings"), filepath.Dir(path))
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// so that the conversion is not done again when the loading is resumed
+	observations, err := ioutil.ReadFile(l.OutputFilePaths["OBSERVATION_FACT"].Path)
+	assert.Nil(t, err)
+	load(true)
+	resumed, err := ioutil.ReadFile(l.OutputFilePaths["OBSERVATION_FACT"].Path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(observations), string(resumed))
+}
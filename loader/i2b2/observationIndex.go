@@ -0,0 +1,207 @@
+package loaderi2b2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+)
+
+// ObservationIndex is an on-disk index of the observations of the patients that have dummies. The observations are
+// spooled in a temporary file and grouped by patient in a table of offsets (also on disk), so that only a counter per
+// patient is kept in memory whatever the number of observations.
+type ObservationIndex struct {
+	spool   *os.File
+	offsets *os.File
+
+	// during construction: (patient, offset) pairs in the order in which they were added
+	pairs       *os.File
+	spoolWriter *bufio.Writer
+	pairsWriter *bufio.Writer
+	spoolSize   int64
+
+	patients   map[string]int
+	counts     []int64
+	start      []int64
+	buffer     bytes.Buffer
+	spoolCSV   *csv.Writer
+	offsetByte [8]byte
+}
+
+// NewObservationIndex creates an empty index whose temporary files are stored in dir
+func NewObservationIndex(dir string) (*ObservationIndex, error) {
+	oi := &ObservationIndex{patients: make(map[string]int)}
+
+	var err error
+	for _, f := range []**os.File{&oi.spool, &oi.offsets, &oi.pairs} {
+		*f, err = ioutil.TempFile(dir, "observation_fact_index_")
+		if err != nil {
+			oi.Close()
+			return nil, err
+		}
+	}
+
+	oi.spoolWriter = bufio.NewWriter(oi.spool)
+	oi.pairsWriter = bufio.NewWriter(oi.pairs)
+	oi.spoolCSV = csv.NewWriter(&oi.buffer)
+	return oi, nil
+}
+
+// Add appends an observation (the raw .csv record) of a patient to the index
+func (oi *ObservationIndex) Add(patientNum string, record []string) error {
+	idx, ok := oi.patients[patientNum]
+	if !ok {
+		idx = len(oi.counts)
+		oi.patients[patientNum] = idx
+		oi.counts = append(oi.counts, 0)
+	}
+	oi.counts[idx]++
+
+	oi.buffer.Reset()
+	if err := oi.spoolCSV.Write(record); err != nil {
+		return err
+	}
+	oi.spoolCSV.Flush()
+
+	var pair [12]byte
+	binary.LittleEndian.PutUint32(pair[:4], uint32(idx))
+	binary.LittleEndian.PutUint64(pair[4:], uint64(oi.spoolSize))
+	if _, err := oi.pairsWriter.Write(pair[:]); err != nil {
+		return err
+	}
+
+	n, err := oi.spoolWriter.Write(oi.buffer.Bytes())
+	oi.spoolSize += int64(n)
+	return err
+}
+
+// Build groups the offsets of the observations by patient. It must be called once all observations have been added.
+func (oi *ObservationIndex) Build() error {
+	if err := oi.spoolWriter.Flush(); err != nil {
+		return err
+	}
+	if err := oi.pairsWriter.Flush(); err != nil {
+		return err
+	}
+
+	oi.start = make([]int64, len(oi.counts))
+	total := int64(0)
+	for i, count := range oi.counts {
+		oi.start[i] = total
+		total += count
+	}
+
+	if _, err := oi.pairs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	filled := make([]int64, len(oi.counts))
+	reader := bufio.NewReader(oi.pairs)
+	var pair [12]byte
+	for {
+		if _, err := io.ReadFull(reader, pair[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		idx := binary.LittleEndian.Uint32(pair[:4])
+		if _, err := oi.offsets.WriteAt(pair[4:], (oi.start[idx]+filled[idx])*8); err != nil {
+			return err
+		}
+		filled[idx]++
+	}
+
+	// the pairs are not needed anymore
+	oi.pairs.Close()
+	os.Remove(oi.pairs.Name())
+	oi.pairs = nil
+
+	return nil
+}
+
+// Count returns the number of observations of a patient
+func (oi *ObservationIndex) Count(patientNum string) int64 {
+	if idx, ok := oi.patients[patientNum]; ok {
+		return oi.counts[idx]
+	}
+	return 0
+}
+
+// Get returns the i-th observation (the raw .csv record) of a patient
+func (oi *ObservationIndex) Get(patientNum string, i int64) ([]string, error) {
+	idx := oi.patients[patientNum]
+	if _, err := oi.offsets.ReadAt(oi.offsetByte[:], (oi.start[idx]+i)*8); err != nil {
+		return nil, err
+	}
+	offset := int64(binary.LittleEndian.Uint64(oi.offsetByte[:]))
+
+	reader := csv.NewReader(io.NewSectionReader(oi.spool, offset, oi.spoolSize-offset))
+	reader.FieldsPerRecord = -1
+	return reader.Read()
+}
+
+// Close removes the temporary files of the index (a nil index has none)
+func (oi *ObservationIndex) Close() {
+	if oi == nil {
+		return
+	}
+	for _, f := range []*os.File{oi.spool, oi.offsets, oi.pairs} {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// ObservationSampler draws indexes without replacement from [0, n) following a pseudo-random permutation computed
+// on the fly (Feistel network with cycle walking): its memory footprint does not depend on n.
+type ObservationSampler struct {
+	n    uint64
+	next uint64
+	half uint
+	keys [4]uint64
+}
+
+// NewObservationSampler creates a sampler over [0, n)
+func NewObservationSampler(n int64, rnd *rand.Rand) *ObservationSampler {
+	s := &ObservationSampler{n: uint64(n), half: 1}
+	for (uint64(1) << (2 * s.half)) < s.n {
+		s.half++
+	}
+	for i := range s.keys {
+		s.keys[i] = rnd.Uint64()
+	}
+	return s
+}
+
+// Next returns the next index, false if all indexes have already been drawn
+func (s *ObservationSampler) Next() (int64, bool) {
+	if s.next >= s.n {
+		return 0, false
+	}
+	x := s.permute(s.next)
+	for x >= s.n {
+		x = s.permute(x)
+	}
+	s.next++
+	return int64(x), true
+}
+
+func (s *ObservationSampler) permute(x uint64) uint64 {
+	mask := (uint64(1) << s.half) - 1
+	left, right := x>>s.half, x&mask
+	for _, key := range s.keys {
+		left, right = right, left^(mix(right^key)&mask)
+	}
+	return left<<s.half | right
+}
+
+// mix is the finalizer of splitmix64
+func mix(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
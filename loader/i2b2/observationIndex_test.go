@@ -0,0 +1,60 @@
+package loaderi2b2_test
+
+import (
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestObservationIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "observation_index")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	oi, err := loaderi2b2.NewObservationIndex(dir)
+	assert.Nil(t, err)
+
+	// interleave the observations of the patients
+	for i := 0; i < 30; i++ {
+		patient := strconv.Itoa(i % 3)
+		assert.Nil(t, oi.Add(patient, []string{"enc" + strconv.Itoa(i), patient, "multi\nline, \"quoted\"", ""}))
+	}
+	assert.Nil(t, oi.Build())
+
+	assert.Equal(t, int64(10), oi.Count("1"))
+	assert.Equal(t, int64(0), oi.Count("unknown"))
+
+	for i := int64(0); i < 10; i++ {
+		record, err := oi.Get("2", i)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"enc" + strconv.FormatInt(3*i+2, 10), "2", "multi\nline, \"quoted\"", ""}, record)
+	}
+
+	oi.Close()
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestObservationSampler(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+
+	for _, n := range []int64{0, 1, 2, 3, 17, 1000} {
+		sampler := loaderi2b2.NewObservationSampler(n, rnd)
+		drawn := make(map[int64]struct{})
+		for {
+			index, ok := sampler.Next()
+			if !ok {
+				break
+			}
+			assert.True(t, index >= 0 && index < n)
+			drawn[index] = struct{}{}
+		}
+		// every index is drawn exactly once
+		assert.Equal(t, int(n), len(drawn))
+	}
+}
@@ -0,0 +1,90 @@
+package loaderi2b2
+
+import (
+	"bytes"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+
+	"github.com/ldsec/medco-loader/loader"
+)
+
+// keyedSource is a deterministic rand.Source: its n-th value is derived from HMAC-SHA256(key, domain || n), so the same
+// key and domain always give the same values
+type keyedSource struct {
+	key     []byte
+	domain  string
+	counter uint64
+}
+
+// Int63 returns the next non-negative 63-bit integer
+func (s *keyedSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Uint64 returns the next 64-bit integer
+func (s *keyedSource) Uint64() uint64 {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], s.counter)
+	s.counter++
+	return binary.BigEndian.Uint64(prf(s.key, s.domain, n[:])[:8])
+}
+
+// Seed restarts the stream (the values only depend on the key and the domain)
+func (s *keyedSource) Seed(int64) {
+	s.counter = 0
+}
+
+// prf returns HMAC-SHA256(key, domain || 0 || value)
+func prf(key []byte, domain string, value []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(domain))
+	mac.Write([]byte{0})
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// newRand returns the source of randomness of a step of the conversion (domain, e.g. "observation_fact"): a stream
+// derived from a fresh key read from crypto/rand, or from the PermutationKey in keyed mode
+func (l *Loader) newRand(domain string) (*rand.Rand, error) {
+	key := l.PermutationKey
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		if _, err := cryptorand.Read(key); err != nil {
+			return nil, loader.NewError(loader.ErrRandomness, err)
+		}
+	}
+	return rand.New(&keyedSource{key: key, domain: domain}), nil
+}
+
+// permute returns a permutation of [0, len(keys)): perm[i] is the new position of the element identified by keys[i]. In
+// keyed mode the elements are ranked by the PRF (keyed with PermutationKey) of their key: the permutation only depends
+// on the key, the domain and the set of elements, not on the order in which they are given.
+func (l *Loader) permute(domain string, keys []string) ([]int, error) {
+	if len(l.PermutationKey) == 0 {
+		rnd, err := l.newRand(domain)
+		if err != nil {
+			return nil, err
+		}
+		return rnd.Perm(len(keys)), nil
+	}
+
+	values := make([][]byte, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		values[i] = prf(l.PermutationKey, domain, []byte(key))
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(values[order[a]], values[order[b]]) < 0
+	})
+
+	perm := make([]int, len(keys))
+	for rank, i := range order {
+		perm[i] = rank
+	}
+	return perm, nil
+}
@@ -0,0 +1,143 @@
+package loaderi2b2
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"go.dedis.ch/onet/v3/log"
+	"sort"
+	"strconv"
+)
+
+// The classifications of the concepts and modifiers in the sensitivity report
+const (
+	ClassificationClear     = "clear"
+	ClassificationSensitive = "sensitive"
+	// ClassificationIgnored is the one of the concepts and modifiers that are not in the ontology but are sensitive (by
+	// themselves or through a parent): they cannot be tagged, and their observations are dropped
+	ClassificationIgnored = "ignored"
+)
+
+// sensitivityReportHeader is the header of the sensitivity report
+var sensitivityReportHeader = []string{"type", "path", "code", "classification", "reason", "observations"}
+
+// ReportEntry is the classification of a concept or modifier of the concept_dimension or modifier_dimension, with the
+// reason of the classification (the decision of the Policy, which tells the rule and the path, itself or a parent,
+// that triggered it)
+type ReportEntry struct {
+	Modifier       bool
+	Path           string
+	Code           string
+	Classification string
+	Reason         string
+}
+
+// generateReportFile sets the path of the sensitivity report, in the folder of the mapping files (encrypted if there is a
+// MappingKey)
+func (l *Loader) generateReportFile(folderPath string) {
+	fI := FileInfo{TableName: "", Path: folderPath + "sensitivity_report.csv"}
+	if len(l.MappingKey) > 0 {
+		fI.Path += ".enc"
+	}
+	l.OutputFilePaths["SENSITIVITY_REPORT"] = fI
+}
+
+// reportConcept adds a concept (or modifier) to the sensitivity report. The reason is the decision of the Policy about
+// its path (the one of the original concept for a synonym).
+func (l *Loader) reportConcept(modifier bool, path, code, classification string) {
+	reason := l.Sensitivity(path).String()
+	if primary, ok := l.MapSynonymPathToPrimary[path]; ok && !modifier {
+		reason = "synonym of " + primary + ", " + l.Sensitivity(primary).String()
+	} else if classification == ClassificationIgnored {
+		reason = "not in the ontology, " + reason
+	}
+	entry := ReportEntry{Modifier: modifier, Path: path, Code: code, Classification: classification, Reason: reason}
+	if modifier {
+		l.ReportModifiers = append(l.ReportModifiers, entry)
+	} else {
+		l.ReportConcepts = append(l.ReportConcepts, entry)
+	}
+}
+
+// countObservation counts an observation of the dataset in the sensitivity report (the ones of the dummies are not)
+func (l *Loader) countObservation(line []string) {
+	if _, ok := l.TableDummyToPatient[line[1]]; ok {
+		return
+	}
+	l.ConceptObservations[line[2]]++
+	l.ModifierObservations[line[5]]++
+
+	_, ignoredConcept := l.ListConceptsToIgnore[line[2]]
+	_, ignoredModifier := l.ListModifiersToIgnore[line[5]]
+	if ignoredConcept || ignoredModifier {
+		l.DroppedObservations++
+	}
+}
+
+// WriteSensitivityReport writes the sensitivity report of the conversion: the classification (clear, sensitive or
+// ignored) of every concept and modifier of the concept_dimension and modifier_dimension, the reason of the
+// classification and the number of observations of the dataset with the concept (or modifier). It is written with the
+// mapping files (see checkMappings), only readable by its owner and encrypted if there is a MappingKey: it must not be
+// shared.
+func (l *Loader) WriteSensitivityReport() error {
+	path := l.OutputFilePaths["SENSITIVITY_REPORT"].Path
+
+	entries := append(append([]ReportEntry{}, l.ReportConcepts...), l.ReportModifiers...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Modifier != entries[j].Modifier {
+			return !entries[i].Modifier
+		}
+		return entries[i].Path < entries[j].Path
+	})
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(sensitivityReportHeader)
+
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		entryType, observations := "concept", l.ConceptObservations[entry.Code]
+		if entry.Modifier {
+			entryType, observations = "modifier", l.ModifierObservations[entry.Code]
+		}
+		counts[entry.Classification]++
+		writer.Write([]string{entryType, entry.Path, entry.Code, entry.Classification, entry.Reason, strconv.FormatInt(observations, 10)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return loader.NewError(loader.ErrOutput, err).InFile(path, 0)
+	}
+	if err := l.writePrivateFile(path, buf.Bytes(), len(l.MappingKey) > 0); err != nil {
+		return err
+	}
+
+	log.Lvl2("Sensitivity report:", counts[ClassificationClear], "clear,", counts[ClassificationSensitive], "sensitive and",
+		counts[ClassificationIgnored], "ignored concepts and modifiers (", path, ")")
+	if l.DroppedObservations > 0 {
+		log.Warn(strconv.Itoa(counts[ClassificationIgnored]) + " concepts or modifiers are sensitive but not in the ontology: " +
+			strconv.FormatInt(l.DroppedObservations, 10) + " observations are dropped (see " + path + ")")
+	}
+	return nil
+}
+
+// ReadSensitivityReport reads the records (without the header) of the sensitivity report written by
+// WriteSensitivityReport, decrypting it if there is a MappingKey
+func (l *Loader) ReadSensitivityReport() ([][]string, error) {
+	path := l.OutputFilePaths["SENSITIVITY_REPORT"].Path
+	content, err := l.readPrivateFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = len(sensitivityReportHeader)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, loader.NewInputError(path, err)
+	}
+	if len(records) == 0 {
+		return nil, loader.NewInputError(path, errors.New("missing header"))
+	}
+	return records[1:], nil
+}
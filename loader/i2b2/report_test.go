@@ -0,0 +1,39 @@
+package loaderi2b2_test
+
+import (
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSensitivityReport(t *testing.T) {
+	setupData(t)
+	setupEncryptEnv()
+	defer local.CloseAll()
+
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{Roster: el, Testing: true, ConvertOnly: true,
+		SensitiveConcepts: map[string]struct{}{`\i2b2\Diagnoses\`: {}}})
+	assert.Nil(t, err)
+	assert.Nil(t, l.Load())
+
+	records, err := l.ReadSensitivityReport()
+	assert.Nil(t, err)
+	report := make(map[string][]string)
+	for _, record := range records {
+		report[record[1]] = record
+	}
+	skin := `\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`
+
+	// the rule and the ancestor that made a concept sensitive are reported
+	assert.Equal(t, []string{"concept", skin + `(216.1) Eyelid\`, "ICD9:216.1", "sensitive",
+		`sensitive (rule list: '\i2b2\Diagnoses\' matches '\i2b2\Diagnoses\')`, "48"}, report[skin+`(216.1) Eyelid\`])
+
+	// a sensitive concept that is not in the ontology is ignored, with its observations
+	ignored := report[skin+`Unmapped\`]
+	assert.Equal(t, "ignored", ignored[3])
+	assert.Contains(t, ignored[4], "not in the ontology")
+	assert.Equal(t, "12", ignored[5])
+	assert.Equal(t, int64(12), l.DroppedObservations)
+
+	assert.Equal(t, []string{"modifier", `\Dose\High\`, "MOD:HIGH", "clear", "clear (no rule matches)", "18"}, report[`\Dose\High\`])
+}
@@ -8,34 +8,8 @@ import (
 	"strings"
 )
 
-// ####----HELPER STRUCTS----####
-
-// Testing defines whether we should run the DDT on test environment (locally) or using real nodes
-var Testing bool // testing environment
-
-// ListSensitiveConcepts list all sensitive concepts (paths) - MedCo and LOCAL (the bool is for nothing)
-var ListSensitiveConcepts map[string]struct{}
-
-// ListConceptsToIgnore lists concepts that appear in the concept_dimension and not in the ontology (which is kind of strange)
-var ListConceptsToIgnore map[string]struct{}
-
-// AllSensitive is a flag that defines whether all concepts are to be considered sensitive or not (-allSens flag)
-var AllSensitive = false
-
-// IDConcepts used to assign IDs (NodeEncryptIDs) to be encrypted to the different concepts
-var IDConcepts int64
-
-// TagIDConceptsUsed used to keep track of the number of TAG_IDs that have been used
-var TagIDConceptsUsed int64
-
 // ####----DATA TYPES----####
 
-// HeaderTableAccess contains all the headers for the table_access table
-var HeaderTableAccess []string
-
-// TableTableAccess is the table that contains all data from the table_access table
-var TableTableAccess []TableAccess
-
 // TableAccess is the struct that represents each row of the table_access table
 type TableAccess struct {
 	TableCD          string
@@ -79,13 +53,16 @@ func (ta TableAccess) ToCSVText() string {
 type MedCoTableInfo struct {
 	Clear     map[string]*MedCoOntology
 	Sensitive map[string]*MedCoOntology
-}
 
-// TablesMedCoOntology distinguishes between the different medco ontology tables
-var TablesMedCoOntology map[string]MedCoTableInfo
+	ClearModifiers     map[ModifierPK]*MedCoOntology
+	SensitiveModifiers map[ModifierPK]*MedCoOntology
+}
 
-// HeaderMedCoOntology contains all the headers for the medco table
-var HeaderMedCoOntology []string
+// ModifierPK identifies a modifier in an ontology table (the same modifier can be applied to different concepts)
+type ModifierPK struct {
+	Fullname    string
+	AppliedPath string
+}
 
 // MedCoOntology is the table that contains all concept codes from the medco ontology
 type MedCoOntology struct {
@@ -125,9 +102,13 @@ func (so MedCoOntology) ToCSVText() string {
 			metadata += "<?xml version=\"\"1.0\"\"?><ValueMetadata><Version>MedCo-0.1</Version><EncryptedType>CONCEPT_INTERNAL_NODE</EncryptedType><NodeEncryptID>" + strconv.FormatInt(so.NodeEncryptID, 10) + "</NodeEncryptID>"
 		} else if so.VisualAttributes[:1] == "L" { // else if concept_leaf
 			metadata += "<?xml version=\"\"1.0\"\"?><ValueMetadata><Version>MedCo-0.1</Version><EncryptedType>CONCEPT_LEAF</EncryptedType><NodeEncryptID>" + strconv.FormatInt(so.NodeEncryptID, 10) + "</NodeEncryptID>"
-		} else {
-			log.Fatal("Wrong VisualAttribute")
-		}
+		} else if so.VisualAttributes[:1] == "D" { // else if modifier_parent_node
+			metadata += "<?xml version=\"\"1.0\"\"?><ValueMetadata><Version>MedCo-0.1</Version><EncryptedType>MODIFIER_PARENT_NODE</EncryptedType>"
+		} else if so.VisualAttributes[:1] == "O" { // else if modifier_internal_node
+			metadata += "<?xml version=\"\"1.0\"\"?><ValueMetadata><Version>MedCo-0.1</Version><EncryptedType>MODIFIER_INTERNAL_NODE</EncryptedType><NodeEncryptID>" + strconv.FormatInt(so.NodeEncryptID, 10) + "</NodeEncryptID>"
+		} else if so.VisualAttributes[:1] == "R" { // else if modifier_leaf
+			metadata += "<?xml version=\"\"1.0\"\"?><ValueMetadata><Version>MedCo-0.1</Version><EncryptedType>MODIFIER_LEAF</EncryptedType><NodeEncryptID>" + strconv.FormatInt(so.NodeEncryptID, 10) + "</NodeEncryptID>"
+		} // the other visual attributes are rejected when parsing the local ontology
 
 		// only internal and parent nodes can have children ;)
 		// TODO we are appending all children IDs (split by ;) in a single xml attribute. We should find a cleaner way to do this
@@ -154,9 +135,6 @@ func (so MedCoOntology) ToCSVText() string {
 
 //-------------------------------------//
 
-// TableLocalOntologyClear is the local ontology table (it maps the concept path to a concept) with only the NON_SENSITIVE concepts (it INCLUDES MODIFIER NON-SENSITIVE concepts)
-var TableLocalOntologyClear map[string]*LocalOntology
-
 // TagAndID is a struct that contains both Tag and TagID for a concept or modifier
 type TagAndID struct {
 	Tag   libunlynx.GroupingKey
@@ -169,12 +147,6 @@ type CodeID struct {
 	Code string
 }
 
-// MapConceptPathToTag maps a sensitive concept path to its respective tag and tag_id
-var MapConceptPathToTag map[string]TagAndID
-
-// HeaderLocalOntology contains all the headers for the i2b2 table
-var HeaderLocalOntology []string
-
 // LocalOntology is the table that contains all concept codes from the local ontology (i2b2)
 type LocalOntology struct {
 	HLevel           string
@@ -230,25 +202,16 @@ func LocalOntologySensitiveConceptToCSVText(tag *libunlynx.GroupingKey, tagID in
 	return strings.Replace(finalString, `"\N"`, "", -1)
 }
 
-//-------------------------------------//
-
-// MapPatientObs maps patients to their observations
-var MapPatientObs map[string][]*ObservationFactPK
+// LocalOntologySensitiveModifierToCSVText writes the tagging information of a modifier of the local ontology in a way that can be added to a .csv file - "","","", etc.
+func LocalOntologySensitiveModifierToCSVText(tag *libunlynx.GroupingKey, tagID int64) string {
+	finalString := `"3","\medco\tagged\modifier\` + string(*tag) + `\","","N","RA ","\N","TAG_ID:` + strconv.FormatInt(tagID, 10) + `","\N","modifier_cd","modifier_dimension","modifier_path","T","LIKE","\medco\tagged\modifier\` + string(*tag) +
+		`\","\N","\N","NOW()","\N","\N","\N","TAG_ID","%","\N","\N","\N","\N"`
 
-// MapDummyObs maps dummies to the observation of the original patients they are related too
-var MapDummyObs map[string][]*ObservationFactPK
+	return strings.Replace(finalString, `"\N"`, "", -1)
+}
 
 //-------------------------------------//
 
-// TableObservationFact is observation_fact table
-var TableObservationFact map[*ObservationFactPK]ObservationFact
-
-// HeaderObservationFact contains all the headers for the observation_fact table
-var HeaderObservationFact []string
-
-// TextSearchIndex counter used to fill up the last column of observation_fact table
-var TextSearchIndex int64
-
 // ObservationFact is the fact table of the CRC-I2B2 start schema
 type ObservationFact struct {
 	PK              *ObservationFactPK
@@ -298,20 +261,6 @@ func (lo ObservationFact) ToCSVText() string {
 
 //-------------------------------------//
 
-// TableDummyToPatient contains all dummies and the original patient that is associated with them
-var TableDummyToPatient map[string]string
-
-// MapNewPatientNum keeps track of the mapping between the old patient_num and the new one
-var MapNewPatientNum map[string]string
-
-//-------------------------------------//
-
-// TablePatientDimension is patient_dimension table
-var TablePatientDimension map[PatientDimensionPK]PatientDimension
-
-// HeaderPatientDimension contains all the headers for the Patient_Dimension table
-var HeaderPatientDimension []string
-
 // PatientDimension table represents a patient in the database
 type PatientDimension struct {
 	PK             PatientDimensionPK
@@ -375,24 +324,6 @@ type OptionalFields struct {
 
 //-------------------------------------//
 
-// MapNewEncounterNum maps [old_patient_num old_encounter_num] -> [new_patient_num new_encounter_num].
-// For the dummies the [old_patient_num old_encounter_num] refers to the original values
-var MapNewEncounterNum map[VisitDimensionPK]VisitDimensionPK
-
-// MapPatientVisits maps a patient_num to all its encounter_nums
-var MapPatientVisits map[string][]string
-
-// MaxVisits keeps track of the maximum number of visits of all the patients
-var MaxVisits int
-
-//-------------------------------------//
-
-// TableVisitDimension is visit_dimension table
-var TableVisitDimension map[VisitDimensionPK]VisitDimension
-
-// HeaderVisitDimension contains all the headers for the visit_dimension table
-var HeaderVisitDimension []string
-
 // VisitDimension table represents a visit in the database
 type VisitDimension struct {
 	PK             VisitDimensionPK
@@ -443,15 +374,6 @@ func (vd VisitDimension) ToCSVText(empty bool) string {
 
 //-------------------------------------//
 
-// TableConceptDimension is concept_dimension table
-var TableConceptDimension map[*ConceptDimensionPK]ConceptDimension
-
-// HeaderConceptDimension contains all the headers for the concept_dimension table
-var HeaderConceptDimension []string
-
-// MapConceptCodeToTag maps the concept code (in the concept dimension) to the tag ID value (for the sensitive terms)
-var MapConceptCodeToTag map[string]int64
-
 // ConceptDimension table contains one row for each concept
 type ConceptDimension struct {
 	PK           *ConceptDimensionPK
@@ -483,6 +405,37 @@ func ConceptDimensionSensitiveToCSVText(tag *libunlynx.GroupingKey, tagID int64)
 
 //-------------------------------------//
 
+// ModifierDimension table contains one row for each modifier
+type ModifierDimension struct {
+	PK           *ModifierDimensionPK
+	ModifierCD   string
+	NameChar     string
+	ModifierBlob string
+	AdminColumns AdministrativeColumns
+}
+
+// ModifierDimensionPK is the primary key of the Modifier_Dimension table
+type ModifierDimensionPK struct {
+	ModifierPath string
+}
+
+// ToCSVText writes the ModifierDimension object in a way that can be added to a .csv file - "","","", etc.
+func (md ModifierDimension) ToCSVText() string {
+	acString := "\"" + md.AdminColumns.UpdateDate + "\"," + "\"" + md.AdminColumns.DownloadDate + "\"," + "\"" + md.AdminColumns.ImportDate + "\"," + "\"" + md.AdminColumns.SourceSystemCD + "\"," + "\"" + md.AdminColumns.UploadID + "\""
+	finalString := "\"" + md.PK.ModifierPath + "\"," + "\"" + md.ModifierCD + "\"," + "\"" + md.NameChar + "\"," + "\"" + md.ModifierBlob + "\"," + acString
+
+	return strings.Replace(finalString, `"\N"`, "", -1)
+}
+
+// ModifierDimensionSensitiveToCSVText writes the tagging information of a modifier of the modifier_dimension table in a way that can be added to a .csv file - "","","", etc.
+func ModifierDimensionSensitiveToCSVText(tag *libunlynx.GroupingKey, tagID int64) string {
+	finalString := `"\medco\tagged\modifier\` + string(*tag) + `\","TAG_ID:` + strconv.FormatInt(tagID, 10) + `","\N","\N","\N","\N","NOW()","\N","\N"`
+
+	return strings.Replace(finalString, `"\N"`, "", -1)
+}
+
+//-------------------------------------//
+
 // TableAccessFromString generates a TableAccess struct from a parsed line of a .csv file
 func TableAccessFromString(line []string) TableAccess {
 	ta := TableAccess{
@@ -592,8 +545,8 @@ func LocalOntologyFromString(line []string, plainCode bool) *LocalOntology {
 
 }
 
-// PatientDimensionFromString generates a PatientDimension struct from a parsed line of a .csv file
-func PatientDimensionFromString(line []string, pk kyber.Point) (PatientDimensionPK, PatientDimension) {
+// PatientDimensionFromString generates a PatientDimension struct from a parsed line of a .csv file (header names the optional fields)
+func PatientDimensionFromString(line []string, header []string, pk kyber.Point) (PatientDimensionPK, PatientDimension) {
 	pdk := PatientDimensionPK{
 		PatientNum: line[0],
 	}
@@ -611,7 +564,7 @@ func PatientDimensionFromString(line []string, pk kyber.Point) (PatientDimension
 	of := make([]OptionalFields, 0)
 
 	for i := 4; i < size-5; i++ {
-		of = append(of, OptionalFields{ValType: HeaderPatientDimension[i], Value: line[i]})
+		of = append(of, OptionalFields{ValType: header[i], Value: line[i]})
 	}
 
 	ac := AdministrativeColumns{
@@ -631,8 +584,8 @@ func PatientDimensionFromString(line []string, pk kyber.Point) (PatientDimension
 	return pdk, pd
 }
 
-// VisitDimensionFromString generates a VisitDimension struct from a parsed line of a .csv file
-func VisitDimensionFromString(line []string) (VisitDimensionPK, VisitDimension) {
+// VisitDimensionFromString generates a VisitDimension struct from a parsed line of a .csv file (header names the optional fields)
+func VisitDimensionFromString(line []string, header []string) (VisitDimensionPK, VisitDimension) {
 	vdk := VisitDimensionPK{
 		EncounterNum: line[0],
 		PatientNum:   line[1],
@@ -651,7 +604,7 @@ func VisitDimensionFromString(line []string) (VisitDimensionPK, VisitDimension)
 	of := make([]OptionalFields, 0)
 
 	for i := 5; i < size-5; i++ {
-		of = append(of, OptionalFields{ValType: HeaderPatientDimension[i], Value: line[i]})
+		of = append(of, OptionalFields{ValType: header[i], Value: line[i]})
 	}
 
 	ac := AdministrativeColumns{
@@ -694,15 +647,41 @@ func ConceptDimensionFromString(line []string) (*ConceptDimensionPK, ConceptDime
 	return cdk, cd
 }
 
-// ObservationFactFromString generates a ObservationFact struct from a parsed line of a .csv file
-func ObservationFactFromString(line []string) (*ObservationFactPK, ObservationFact) {
+// ModifierDimensionFromString generates a ModifierDimension struct from a parsed line of a .csv file
+func ModifierDimensionFromString(line []string) (*ModifierDimensionPK, ModifierDimension) {
+	mdk := &ModifierDimensionPK{
+		ModifierPath: strings.Replace(line[0], "\"", "\"\"", -1),
+	}
+
+	md := ModifierDimension{
+		PK:           mdk,
+		ModifierCD:   line[1],
+		NameChar:     strings.Replace(line[2], "\"", "\"\"", -1),
+		ModifierBlob: line[3],
+	}
+
+	ac := AdministrativeColumns{
+		UpdateDate:     line[4],
+		DownloadDate:   line[5],
+		ImportDate:     line[6],
+		SourceSystemCD: line[7],
+		UploadID:       line[8],
+	}
+
+	md.AdminColumns = ac
+
+	return mdk, md
+}
+
+// ObservationFactFromString generates a ObservationFact struct from a parsed line of a .csv file (textSearchIndex fills up its last column)
+func ObservationFactFromString(line []string, textSearchIndex int64) (*ObservationFactPK, ObservationFact) {
 	ofk := &ObservationFactPK{
 		EncounterNum: line[0],
 		PatientNum:   line[1],
 		ConceptCD:    line[2],
 		ProviderID:   line[3],
 		StartDate:    line[4],
-		ModifierCD:   "", //TODO we do not consider modifiers
+		ModifierCD:   line[5],
 		InstanceNum:  line[6],
 	}
 
@@ -726,9 +705,8 @@ func ObservationFactFromString(line []string) (*ObservationFactPK, ObservationFa
 		ImportDate:      line[19],
 		SourceSystemCD:  line[20],
 		UploadID:        line[21],
-		TextSearchIndex: strconv.FormatInt(TextSearchIndex, 10),
+		TextSearchIndex: strconv.FormatInt(textSearchIndex, 10),
 	}
-	TextSearchIndex++
 
 	of.AdminColumns = ac
 
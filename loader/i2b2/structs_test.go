@@ -252,6 +252,36 @@ func TestConceptDimension_ToCSVText(t *testing.T) {
 	assert.Equal(t, `"\medco\tagged\concept\1\","TAG_ID:20",,,,,"NOW()",,`, loaderi2b2.ConceptDimensionSensitiveToCSVText(&tag, 20))
 }
 
+func TestModifierDimension_ToCSVText(t *testing.T) {
+
+	csvString := `"\Dose\High\","MOD:HIGH","High dose","","2007-04-10 00:00:00","2007-04-10 00:00:00","2007-04-10 00:00:00","DEMO",`
+
+	ac := loaderi2b2.AdministrativeColumns{
+		UpdateDate:     "2007-04-10 00:00:00",
+		DownloadDate:   "2007-04-10 00:00:00",
+		ImportDate:     "2007-04-10 00:00:00",
+		SourceSystemCD: "DEMO",
+		UploadID:       "\\N",
+	}
+
+	mdk := &loaderi2b2.ModifierDimensionPK{
+		ModifierPath: "\\Dose\\High\\",
+	}
+
+	md := loaderi2b2.ModifierDimension{
+		PK:           mdk,
+		ModifierCD:   "MOD:HIGH",
+		NameChar:     "High dose",
+		ModifierBlob: "",
+		AdminColumns: ac,
+	}
+
+	assert.Equal(t, csvString, md.ToCSVText())
+
+	tag := libunlynx.GroupingKey("1")
+	assert.Equal(t, `"\medco\tagged\modifier\1\","TAG_ID:20",,,,,"NOW()",,`, loaderi2b2.ModifierDimensionSensitiveToCSVText(&tag, 20))
+}
+
 func TestObservationFact_ToCSVText(t *testing.T) {
 
 	csvString := `"482232","1000000060","Affy:221610_s_at","LCS-I2B2:D000109064","2009-01-16 00:00:00","@","1","N","E","79.30000","",,"","2009-01-16 00:00:00","@","",,"2010-09-28 11:15:00","2010-08-18 09:50:00","2010-09-28 11:40:00","DEMO",,"1"`
@@ -384,8 +414,7 @@ func TestLocalOntologyFromString(t *testing.T) {
 }
 
 func TestPatientDimensionFromString(t *testing.T) {
-	aux := [...]string{"patient_num", "vital_status_cd", "birth_date", "death_date", "sex_cd", "age_in_years_num", "language_cd", "race_cd", "marital_status_cd", "religion_cd", "zip_cd", "statecityzip_path", "income_cd", "patient_blob", "update_date", "download_date", "import_date", "sourcesystem_cd", "upload_id"}
-	loaderi2b2.HeaderPatientDimension = aux[:]
+	header := []string{"patient_num", "vital_status_cd", "birth_date", "death_date", "sex_cd", "age_in_years_num", "language_cd", "race_cd", "marital_status_cd", "religion_cd", "zip_cd", "statecityzip_path", "income_cd", "patient_blob", "update_date", "download_date", "import_date", "sourcesystem_cd", "upload_id"}
 
 	ac := loaderi2b2.AdministrativeColumns{
 		UpdateDate:     "2010-11-04 10:43:00",
@@ -431,7 +460,7 @@ func TestPatientDimensionFromString(t *testing.T) {
 	lines, err := r.ReadAll()
 	assert.Nil(t, err, "Parsing error")
 
-	pdkExpected, pdExpected := loaderi2b2.PatientDimensionFromString(lines[0], pubKey)
+	pdkExpected, pdExpected := loaderi2b2.PatientDimensionFromString(lines[0], header, pubKey)
 	assert.Equal(t, pdkExpected, pdk)
 
 	// place them nil because encryption is randomized
@@ -442,8 +471,7 @@ func TestPatientDimensionFromString(t *testing.T) {
 }
 
 func TestVisitDimensionFromString(t *testing.T) {
-	aux := [...]string{"encounter_num", "patient_num", "active_status_cd", "start_date", "end_date", "inout_cd", "location_cd", "location_path", "length_of_stay", "visit_blob", "update_date", "download_date", "import_date", "sourcesystem_cd", "upload_id"}
-	loaderi2b2.HeaderPatientDimension = aux[:]
+	header := []string{"encounter_num", "patient_num", "active_status_cd", "start_date", "end_date", "inout_cd", "location_cd", "location_path", "length_of_stay", "visit_blob", "update_date", "download_date", "import_date", "sourcesystem_cd", "upload_id"}
 
 	ac := loaderi2b2.AdministrativeColumns{
 		UpdateDate:     "2010-11-04 10:43:00",
@@ -481,7 +509,7 @@ func TestVisitDimensionFromString(t *testing.T) {
 	lines, err := r.ReadAll()
 	assert.Nil(t, err, "Parsing error")
 
-	vdkExpected, vdExpected := loaderi2b2.VisitDimensionFromString(lines[0])
+	vdkExpected, vdExpected := loaderi2b2.VisitDimensionFromString(lines[0], header)
 	assert.Equal(t, vdkExpected, vdk)
 
 	assert.Equal(t, vdExpected, vd)
@@ -521,10 +549,43 @@ func TestConceptDimensionFromString(t *testing.T) {
 	assert.Equal(t, cdExpected, cd)
 }
 
+func TestModifierDimensionFromString(t *testing.T) {
+	csvString := `"\Dose\High\","MOD:HIGH","High dose","","2007-04-10 00:00:00","2007-04-10 00:00:00","2007-04-10 00:00:00","DEMO","\N"`
+
+	ac := loaderi2b2.AdministrativeColumns{
+		UpdateDate:     "2007-04-10 00:00:00",
+		DownloadDate:   "2007-04-10 00:00:00",
+		ImportDate:     "2007-04-10 00:00:00",
+		SourceSystemCD: "DEMO",
+		UploadID:       "\\N",
+	}
+
+	mdk := &loaderi2b2.ModifierDimensionPK{
+		ModifierPath: "\\Dose\\High\\",
+	}
+
+	md := loaderi2b2.ModifierDimension{
+		PK:           mdk,
+		ModifierCD:   "MOD:HIGH",
+		NameChar:     "High dose",
+		ModifierBlob: "",
+		AdminColumns: ac,
+	}
+
+	var csvFile = strings.NewReader(csvString)
+	r := csv.NewReader(csvFile)
+	lines, err := r.ReadAll()
+	assert.Nil(t, err, "Parsing error")
+
+	mdkExpected, mdExpected := loaderi2b2.ModifierDimensionFromString(lines[0])
+
+	assert.Equal(t, *mdkExpected, *mdk)
+	assert.Equal(t, mdExpected, md)
+}
+
 func TestObservationFactFromString(t *testing.T) {
 	csvString := `"482232","1000000060","Affy:221610_s_at","LCS-I2B2:D000109064","2009-01-16 00:00:00","@","1","N","E","79.30000","","\N","","2009-01-16 00:00:00","@","","\N","2010-09-28 11:15:00","2010-08-18 09:50:00","2010-09-28 11:40:00","DEMO","\N","1"
 `
-	loaderi2b2.TextSearchIndex = 0
 
 	ac := loaderi2b2.AdministrativeColumns{
 		UpdateDate:      "2010-09-28 11:15:00",
@@ -541,7 +602,7 @@ func TestObservationFactFromString(t *testing.T) {
 		ConceptCD:    "Affy:221610_s_at",
 		ProviderID:   "LCS-I2B2:D000109064",
 		StartDate:    "2009-01-16 00:00:00",
-		ModifierCD:   "",
+		ModifierCD:   "@",
 		InstanceNum:  "1",
 	}
 
@@ -565,7 +626,7 @@ func TestObservationFactFromString(t *testing.T) {
 	lines, err := r.ReadAll()
 	assert.Nil(t, err, "Parsing error")
 
-	ofkExpected, ofExpected := loaderi2b2.ObservationFactFromString(lines[0])
+	ofkExpected, ofExpected := loaderi2b2.ObservationFactFromString(lines[0], 0)
 
 	assert.Equal(t, ofkExpected, ofk)
 	assert.Equal(t, ofExpected, of)
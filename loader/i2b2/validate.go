@@ -0,0 +1,401 @@
+package loaderi2b2
+
+import (
+	"bufio"
+	"encoding/csv"
+	"github.com/ldsec/medco-loader/loader"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxIssuesPerFile is the number of issues reported per file, the others are only counted
+const maxIssuesPerFile = 100
+
+// DateLayouts are the accepted formats of the dates (columns ending with _date)
+var DateLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04:05.000", "2006-01-02T15:04:05", "2006-01-02"}
+
+// Issue is a problem of an input file found by Validate. Line is the number of the record (1 for the header, 0 if
+// the issue concerns the whole file).
+type Issue struct {
+	Path   string
+	Line   int64
+	Column string
+	Msg    string
+}
+
+func (i Issue) String() string {
+	s := i.Path
+	if i.Line > 0 {
+		s += ":" + strconv.FormatInt(i.Line, 10)
+	}
+	if i.Column != "" {
+		s += ": " + i.Column
+	}
+	return s + ": " + i.Msg
+}
+
+// fileSchema describes the columns of an input file
+type fileSchema struct {
+	// columns are the mandatory columns, in order. If optionalFrom > 0 optional fields can be inserted before
+	// columns[optionalFrom] (the patient and visit dimensions).
+	columns      []string
+	optionalFrom int
+	// extra is a column that can be added at the end (e.g. the cluster_label of the observation_fact)
+	extra string
+
+	keys     []string // columns that cannot be empty
+	integers []string // columns that must be integers (if not empty)
+	paths    []string // columns holding concept paths (\...\)
+}
+
+var adminColumns = []string{"update_date", "download_date", "import_date", "sourcesystem_cd", "upload_id"}
+
+var ontologyColumns = []string{"c_hlevel", "c_fullname", "c_name", "c_synonym_cd", "c_visualattributes", "c_totalnum",
+	"c_basecode", "c_metadataxml", "c_facttablecolumn", "c_tablename", "c_columnname", "c_columndatatype", "c_operator",
+	"c_dimcode", "c_comment", "c_tooltip", "m_applied_path", "update_date", "download_date", "import_date",
+	"sourcesystem_cd", "valuetype_cd", "m_exclusion_cd", "c_path", "c_symbol"}
+
+var validationSchemas = map[string]fileSchema{
+	"TABLE_ACCESS": {
+		columns: []string{"c_table_cd", "c_table_name", "c_protected_access", "c_hlevel", "c_fullname", "c_name",
+			"c_synonym_cd", "c_visualattributes", "c_totalnum", "c_basecode", "c_metadataxml", "c_facttablecolumn",
+			"c_dimtablename", "c_columnname", "c_columndatatype", "c_operator", "c_dimcode", "c_comment", "c_tooltip",
+			"c_entry_date", "c_change_date", "c_status_cd", "valuetype_cd"},
+		keys:  []string{"c_table_cd", "c_table_name", "c_fullname"},
+		paths: []string{"c_fullname"},
+	},
+	"ONTOLOGY": {
+		columns: ontologyColumns,
+		extra:   "plain_code",
+		keys:    []string{"c_hlevel", "c_fullname"},
+		paths:   []string{"c_fullname"},
+	},
+	"DUMMY_TO_PATIENT": {
+		columns:  []string{"dummy", "patient"},
+		keys:     []string{"dummy", "patient"},
+		integers: []string{"dummy", "patient"},
+	},
+	"PATIENT_DIMENSION": {
+		columns:      append([]string{"patient_num", "vital_status_cd", "birth_date", "death_date"}, adminColumns...),
+		optionalFrom: 4,
+		keys:         []string{"patient_num"},
+		integers:     []string{"patient_num"},
+	},
+	"VISIT_DIMENSION": {
+		columns:      append([]string{"encounter_num", "patient_num", "active_status_cd", "start_date", "end_date"}, adminColumns...),
+		optionalFrom: 5,
+		keys:         []string{"encounter_num", "patient_num"},
+		integers:     []string{"encounter_num", "patient_num"},
+	},
+	"CONCEPT_DIMENSION": {
+		columns: append([]string{"concept_path", "concept_cd", "name_char", "concept_blob"}, adminColumns...),
+		keys:    []string{"concept_path", "concept_cd"},
+		paths:   []string{"concept_path"},
+	},
+	"MODIFIER_DIMENSION": {
+		columns: append([]string{"modifier_path", "modifier_cd", "name_char", "modifier_blob"}, adminColumns...),
+		keys:    []string{"modifier_path", "modifier_cd"},
+		paths:   []string{"modifier_path"},
+	},
+	"OBSERVATION_FACT": {
+		columns: append(append([]string{"encounter_num", "patient_num", "concept_cd", "provider_id", "start_date",
+			"modifier_cd", "instance_num", "valtype_cd", "tval_char", "nval_num", "valueflag_cd", "quantity_num",
+			"units_cd", "end_date", "location_cd", "observation_blob", "confidence_num"}, adminColumns...), "text_search_index"),
+		extra:    "cluster_label",
+		keys:     []string{"patient_num", "concept_cd", "modifier_cd"},
+		integers: []string{"encounter_num", "patient_num", "instance_num"},
+	},
+}
+
+// validation holds the elements of the dimensions referenced by the other files
+type validation struct {
+	issues []Issue
+	count  map[string]int
+
+	patients  map[string]struct{}
+	dummies   map[string]struct{}
+	visits    map[VisitDimensionPK]struct{}
+	concepts  map[string]struct{}
+	modifiers map[string]struct{}
+}
+
+func (v *validation) add(path string, line int64, column, msg string) {
+	v.count[path]++
+	if v.count[path] <= maxIssuesPerFile {
+		v.issues = append(v.issues, Issue{Path: path, Line: line, Column: column, Msg: msg})
+	}
+}
+
+// Validate checks the input files before their conversion: their columns (number and names), the mandatory fields, the
+// integers, the dates (see DateLayouts) and the concept paths of each record, and that the observations, visits and
+// dummies reference patients, visits, concepts and modifiers of the dimensions. In Delta mode the references to the
+// patients and visits are not checked (they can be in the database). It returns the issues found (at most
+// maxIssuesPerFile per file, the number of the others is reported), the error is only set if a file cannot be read.
+func (l *Loader) Validate() ([]Issue, error) {
+	v := &validation{
+		count:     make(map[string]int),
+		patients:  make(map[string]struct{}),
+		dummies:   make(map[string]struct{}),
+		visits:    make(map[VisitDimensionPK]struct{}),
+		concepts:  make(map[string]struct{}),
+		modifiers: make(map[string]struct{}),
+	}
+
+	err := l.validateFile(v, "TABLE_ACCESS", "TABLE_ACCESS", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, ontology := range l.OntologyFilesPaths {
+		if err := l.validateFile(v, ontology, "ONTOLOGY", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	err = l.validateFile(v, "PATIENT_DIMENSION", "PATIENT_DIMENSION", func(path string, line int64, get func(string) string) {
+		if _, ok := v.patients[get("patient_num")]; ok {
+			v.add(path, line, "patient_num", "duplicate patient "+get("patient_num"))
+		}
+		v.patients[get("patient_num")] = struct{}{}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Dummies == 0 {
+		err = l.validateFile(v, "DUMMY_TO_PATIENT", "DUMMY_TO_PATIENT", func(path string, line int64, get func(string) string) {
+			if _, ok := v.patients[get("dummy")]; ok {
+				v.add(path, line, "dummy", "the dummy "+get("dummy")+" is a patient of the patient_dimension")
+			}
+			if _, ok := v.dummies[get("dummy")]; ok {
+				v.add(path, line, "dummy", "duplicate dummy "+get("dummy"))
+			}
+			v.dummies[get("dummy")] = struct{}{}
+			l.checkReference(v, v.patients, path, line, "patient", get("patient"), "patient_dimension")
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = l.validateFile(v, "VISIT_DIMENSION", "VISIT_DIMENSION", func(path string, line int64, get func(string) string) {
+		pk := VisitDimensionPK{EncounterNum: get("encounter_num"), PatientNum: get("patient_num")}
+		if _, ok := v.visits[pk]; ok {
+			v.add(path, line, "encounter_num", "duplicate visit "+pk.EncounterNum+" of the patient "+pk.PatientNum)
+		}
+		v.visits[pk] = struct{}{}
+		l.checkReference(v, v.patients, path, line, "patient_num", pk.PatientNum, "patient_dimension")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]struct{})
+	err = l.validateFile(v, "CONCEPT_DIMENSION", "CONCEPT_DIMENSION", func(path string, line int64, get func(string) string) {
+		if _, ok := paths[get("concept_path")]; ok {
+			v.add(path, line, "concept_path", "duplicate concept path "+get("concept_path"))
+		}
+		paths[get("concept_path")] = struct{}{}
+		v.concepts[get("concept_cd")] = struct{}{}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, modifiers := l.InputFilePaths["MODIFIER_DIMENSION"]
+	if modifiers {
+		paths = make(map[string]struct{})
+		err = l.validateFile(v, "MODIFIER_DIMENSION", "MODIFIER_DIMENSION", func(path string, line int64, get func(string) string) {
+			if _, ok := paths[get("modifier_path")]; ok {
+				v.add(path, line, "modifier_path", "duplicate modifier path "+get("modifier_path"))
+			}
+			paths[get("modifier_path")] = struct{}{}
+			v.modifiers[get("modifier_cd")] = struct{}{}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = l.validateFile(v, "OBSERVATION_FACT", "OBSERVATION_FACT", func(path string, line int64, get func(string) string) {
+		patient := get("patient_num")
+		// the observations of the dummies only hold their concept and modifier
+		if _, ok := v.dummies[patient]; ok {
+			return
+		}
+		l.checkReference(v, v.patients, path, line, "patient_num", patient, "patient_dimension")
+		if get("encounter_num") == "" {
+			v.add(path, line, "encounter_num", "missing value")
+		} else if _, ok := v.visits[VisitDimensionPK{EncounterNum: get("encounter_num"), PatientNum: patient}]; !ok && !l.Delta {
+			v.add(path, line, "encounter_num", "the visit "+get("encounter_num")+" of the patient "+patient+" is not in the visit_dimension")
+		}
+		if _, ok := v.concepts[get("concept_cd")]; !ok {
+			v.add(path, line, "concept_cd", get("concept_cd")+" is not in the concept_dimension")
+		}
+		if _, ok := v.modifiers[get("modifier_cd")]; modifiers && !ok && get("modifier_cd") != "@" {
+			v.add(path, line, "modifier_cd", get("modifier_cd")+" is not in the modifier_dimension")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the number of issues that are not reported
+	files := make([]string, 0)
+	for path, count := range v.count {
+		if count > maxIssuesPerFile {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	for _, path := range files {
+		v.issues = append(v.issues, Issue{Path: path, Msg: strconv.Itoa(v.count[path]-maxIssuesPerFile) + " more issues"})
+	}
+
+	return v.issues, nil
+}
+
+// checkReference checks that a value references an element of a dimension (the patients and visits are not checked in
+// Delta mode)
+func (l *Loader) checkReference(v *validation, set map[string]struct{}, path string, line int64, column, value, dimension string) {
+	if _, ok := set[value]; !ok && !l.Delta {
+		v.add(path, line, column, value+" is not in the "+dimension)
+	}
+}
+
+// validateFile checks the columns and the fields of a file and calls row on each record that has the right number of
+// fields (get returns the value of a column)
+func (l *Loader) validateFile(v *validation, file, schemaName string, row func(path string, line int64, get func(column string) string)) error {
+	path := l.InputFilePaths[file]
+	schema := validationSchemas[schemaName]
+
+	f, err := os.Open(path)
+	if err != nil {
+		return loader.NewInputError(path, err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(bufio.NewReader(f))
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		v.add(path, 0, "", "empty file (missing header)")
+		return nil
+	} else if err != nil {
+		return loader.NewInputError(path, err)
+	}
+	header = append([]string(nil), header...)
+	if !schema.checkHeader(header) {
+		v.add(path, 1, "", "the columns should be "+schema.describe()+" instead of "+strings.Join(header, ","))
+		return nil
+	}
+
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		if _, ok := index[column]; !ok {
+			index[column] = i
+		}
+	}
+
+	line := int64(1)
+	var record []string
+	get := func(column string) string {
+		return record[index[column]]
+	}
+	for {
+		record, err = reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return loader.NewInputError(path, err)
+		}
+		line++
+
+		if len(record) != len(header) {
+			v.add(path, line, "", strconv.Itoa(len(record))+" fields instead of "+strconv.Itoa(len(header)))
+			continue
+		}
+
+		for _, column := range schema.keys {
+			if get(column) == "" {
+				v.add(path, line, column, "missing value")
+			}
+		}
+		for _, column := range schema.integers {
+			if value := get(column); value != "" {
+				if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+					v.add(path, line, column, strconv.Quote(value)+" is not an integer")
+				}
+			}
+		}
+		for _, column := range schema.paths {
+			if value := get(column); value != "" && (!strings.HasPrefix(value, `\`) || !strings.HasSuffix(value, `\`)) {
+				v.add(path, line, column, `"`+value+`" must start and end with \`)
+			}
+		}
+		for i, column := range header {
+			if strings.HasSuffix(column, "_date") && record[i] != "" && !isDate(record[i]) {
+				v.add(path, line, column, strconv.Quote(record[i])+" is not a date")
+			}
+		}
+
+		if row != nil {
+			row(path, line, get)
+		}
+	}
+	return nil
+}
+
+// checkHeader checks the columns of a file
+func (s fileSchema) checkHeader(header []string) bool {
+	if s.extra != "" && len(header) == len(s.columns)+1 && header[len(header)-1] == s.extra {
+		header = header[:len(header)-1]
+	}
+	if s.optionalFrom == 0 {
+		return equalColumns(header, s.columns)
+	}
+
+	suffix := len(s.columns) - s.optionalFrom
+	return len(header) >= len(s.columns) &&
+		equalColumns(header[:s.optionalFrom], s.columns[:s.optionalFrom]) &&
+		equalColumns(header[len(header)-suffix:], s.columns[s.optionalFrom:])
+}
+
+// describe returns the expected columns
+func (s fileSchema) describe() string {
+	columns := strings.Join(s.columns, ",")
+	if s.optionalFrom > 0 {
+		columns = strings.Join(s.columns[:s.optionalFrom], ",") + ",[optional fields]," + strings.Join(s.columns[s.optionalFrom:], ",")
+	}
+	if s.extra != "" {
+		columns += "[," + s.extra + "]"
+	}
+	return columns
+}
+
+func equalColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.ToLower(strings.TrimSpace(a[i])) != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isDate checks that a value has one of the DateLayouts
+func isDate(value string) bool {
+	for _, layout := range DateLayouts {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
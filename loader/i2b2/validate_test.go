@@ -0,0 +1,99 @@
+package loaderi2b2_test
+
+import (
+	"github.com/ldsec/medco-loader/loader/i2b2"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	setupData(t)
+	l, err := loaderi2b2.NewLoader(loaderi2b2.Options{})
+	assert.Nil(t, err)
+	issues, err := l.Validate()
+	assert.Nil(t, err)
+	assert.Empty(t, issues)
+
+	dir, err := ioutil.TempDir(loaderi2b2.DefaultDataPath+"i2b2", "validate_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	original := func(name string) [][]string {
+		return readCSV(t, loaderi2b2.DefaultDataPath+"i2b2/original/"+name)
+	}
+	all := func([]string) bool { return true }
+	for _, name := range []string{"i2b2.csv", "table_access.csv", "dummy_to_patient.csv", "modifier_dimension.csv"} {
+		writeCSV(t, filepath.Join(dir, name), original(name), all)
+	}
+
+	// patient 1000000001 has a wrong birth date, 1000000003 is duplicated and 1000000004 has a missing field
+	patients := original("patient_dimension.csv")
+	patients[1][2] = "17/11/1985"
+	patients = append(patients, patients[3], patients[4][:len(patients[4])-1])
+	writeCSV(t, filepath.Join(dir, "patient_dimension.csv"), patients, all)
+
+	// the visits have a renamed column
+	visits := original("visit_dimension.csv")
+	visits[0][2] = "status"
+	writeCSV(t, filepath.Join(dir, "visit_dimension.csv"), visits, all)
+
+	// a concept path without the trailing \
+	concepts := original("concept_dimension.csv")
+	concepts[1][0] = concepts[1][0][:len(concepts[1][0])-1]
+	writeCSV(t, filepath.Join(dir, "concept_dimension.csv"), concepts, all)
+
+	// observations of an unknown patient and concept
+	observations := original("observation_fact.csv")
+	observations[1][1] = "42"
+	observations[2][2] = "ICD9:000"
+	writeCSV(t, filepath.Join(dir, "observation_fact.csv"), observations, all)
+
+	l, err = loaderi2b2.NewLoader(loaderi2b2.Options{
+		Directory: dir,
+		Files: loaderi2b2.Files{
+			Ontology:          []string{"i2b2.csv"},
+			TableAccess:       "table_access.csv",
+			DummyToPatient:    "dummy_to_patient.csv",
+			PatientDimension:  "patient_dimension.csv",
+			VisitDimension:    "visit_dimension.csv",
+			ConceptDimension:  "concept_dimension.csv",
+			ModifierDimension: "modifier_dimension.csv",
+			ObservationFact:   "observation_fact.csv",
+			OutputFolder:      "",
+		},
+		PlaintextMappings: true,
+	})
+	assert.Nil(t, err)
+	issues, err = l.Validate()
+	assert.Nil(t, err)
+
+	found := make(map[loaderi2b2.Issue]bool)
+	for _, issue := range issues {
+		issue.Path = filepath.Base(issue.Path)
+		found[issue] = true
+	}
+	expected := []loaderi2b2.Issue{
+		{Path: "patient_dimension.csv", Line: 2, Column: "birth_date", Msg: `"17/11/1985" is not a date`},
+		{Path: "patient_dimension.csv", Line: 22, Column: "patient_num", Msg: "duplicate patient 1000000003"},
+		{Path: "patient_dimension.csv", Line: 23, Msg: "18 fields instead of 19"},
+		{Path: "concept_dimension.csv", Line: 2, Column: "concept_path", Msg: `"` + concepts[1][0] + `" must start and end with \`},
+		{Path: "observation_fact.csv", Line: 2, Column: "patient_num", Msg: "42 is not in the patient_dimension"},
+		{Path: "observation_fact.csv", Line: 3, Column: "concept_cd", Msg: "ICD9:000 is not in the concept_dimension"},
+	}
+	for _, issue := range expected {
+		assert.True(t, found[issue], issue.String())
+	}
+
+	// the columns of the visits are wrong, their records are not checked
+	header := 0
+	for _, issue := range issues {
+		if filepath.Base(issue.Path) == "visit_dimension.csv" {
+			assert.Equal(t, int64(1), issue.Line)
+			header++
+		}
+	}
+	assert.Equal(t, 1, header)
+}
@@ -0,0 +1,52 @@
+package identifiers
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"strings"
+)
+
+// The supported reference genome assemblies. The variant IDs do not encode the assembly (all the bits are used), so a
+// variant gets the same ID in all the assemblies: the assembly of the variants is instead stored with the genomic
+// annotations, and the loaders refuse to mix assemblies.
+const (
+	AssemblyGRCh37 = "GRCh37"
+	AssemblyGRCh38 = "GRCh38"
+)
+
+// AssemblyAliases maps the (lower case) names commonly given to the assemblies (e.g. in the NCBI_Build column of the MAF
+// files or in the ##reference line of the VCF files) to the assemblies
+var AssemblyAliases = map[string]string{
+	"grch37": AssemblyGRCh37,
+	"37":     AssemblyGRCh37,
+	"hg19":   AssemblyGRCh37,
+	"b37":    AssemblyGRCh37,
+	"grch38": AssemblyGRCh38,
+	"38":     AssemblyGRCh38,
+	"hg38":   AssemblyGRCh38,
+}
+
+// ChromosomeLengths are the lengths (in # bases) of the chromosomes of the assemblies, the positions of the variants
+// cannot exceed them
+var ChromosomeLengths = map[string]map[string]int64{
+	AssemblyGRCh37: {
+		"1": 249250621, "2": 243199373, "3": 198022430, "4": 191154276, "5": 180915260, "6": 171115067,
+		"7": 159138663, "8": 146364022, "9": 141213431, "10": 135534747, "11": 135006516, "12": 133851895,
+		"13": 115169878, "14": 107349540, "15": 102531392, "16": 90354753, "17": 81195210, "18": 78077248,
+		"19": 59128983, "20": 63025520, "21": 48129895, "22": 51304566, "X": 155270560, "Y": 59373566, "M": 16569,
+	},
+	AssemblyGRCh38: {
+		"1": 248956422, "2": 242193529, "3": 198295559, "4": 190214555, "5": 181538259, "6": 170805979,
+		"7": 159345973, "8": 145138636, "9": 138394717, "10": 133797422, "11": 135086622, "12": 133275309,
+		"13": 114364328, "14": 107043718, "15": 101991189, "16": 90338345, "17": 83257441, "18": 80373285,
+		"19": 58617616, "20": 64444167, "21": 46709983, "22": 50818468, "X": 156040895, "Y": 57227415, "M": 16569,
+	},
+}
+
+// NormalizeAssembly returns the assembly named name (an assembly or one of its AssemblyAliases)
+func NormalizeAssembly(name string) (string, error) {
+	if assembly, ok := AssemblyAliases[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return assembly, nil
+	}
+	return "", loader.NewError(loader.ErrInputFormat, errors.New("unknown reference genome assembly "+name+" (expected "+AssemblyGRCh37+" or "+AssemblyGRCh38+")"))
+}
@@ -1,10 +1,15 @@
 package identifiers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-	"go.dedis.ch/onet/v3/log"
+	"fmt"
+	"github.com/ldsec/medco-loader/loader"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -18,6 +23,12 @@ import (
    	12 bits (4'096): reference allele (6 bases)
    	3 bits (8): length in # bases of the alternative allele (mutated)
    	12 bits (4'096): alternative allele (6 bases)
+   Genomic variant with long alleles (more than 6 bases, see VariantIDEncoder):
+   	1 bit (2): flag genomic variant (1)
+   	5 bits (32): chromosome id
+   	28 bits (268'435'456): start position of the mutation (1-based coordinate system)
+   	3 bits (8): flag long alleles (7)
+   	27 bits (134'217'728): keyed hash of the reference and alternative alleles
 */
 
 // IDBitSize size in bits of the identifier.
@@ -30,6 +41,7 @@ const (
 	PosBitSize               = 28
 	AllelesBaseLengthBitSize = 3
 	AllelesBitSize           = 12
+	LongAllelesHashBitSize   = AllelesBitSize + AllelesBaseLengthBitSize + AllelesBitSize
 )
 
 // Regex expressions
@@ -49,6 +61,9 @@ const (
 	 The maximum number of bases supported is  6 -> 12bits and an additional 3 bits are used to encode the length.
 	*/
 	AllelesRegex = "^([ATCG]{1,6}|-)$"
+
+	// LongAllelesRegex are the valid values for the alleles of any length (see VariantIDEncoder)
+	LongAllelesRegex = "^([ATCG]+|-)$"
 )
 
 // Mapping to encode non-numeric chromosome ids.
@@ -61,16 +76,27 @@ const (
 // TypeFlagGenomicVariant encodes the type of id.
 const TypeFlagGenomicVariant = int64(1)
 
+// FlagLongAlleles is the length of the reference allele that flags the variants with long alleles (the length of the
+// encoded alleles is at most 6).
+const FlagLongAlleles = int64(7)
+
+// ErrIDCollision is wrapped by the errors of VariantIDEncoder when different alleles get the same ID
+var ErrIDCollision = errors.New("variant ID collision")
+
+// ErrMissingAllelesKey is wrapped by the errors of VariantIDEncoder when alleles longer than 6 bases are encoded without
+// a key
+var ErrMissingAllelesKey = errors.New("missing key of the hash of the long alleles")
+
 /*
- Possible range of positions values (position in 1-based coordinate system, minimum is 1).
- Result is encoded into bits so the range is rounded to the nearest power of 2.
- According to https://en.wikipedia.org/wiki/Human_genome#Molecular_organization_and_gene_content,
- the chromosome with the higher number of base is #1 with 248'956'422 bases. 2^28 = 268'435'456.
- ==> 28 bits storage
+Possible range of positions values (position in 1-based coordinate system, minimum is 1).
+Result is encoded into bits so the range is rounded to the nearest power of 2.
+According to https://en.wikipedia.org/wiki/Human_genome#Molecular_organization_and_gene_content,
+the chromosome with the higher number of base is #1 with 248'956'422 bases (249'250'621 in GRCh37). 2^28 = 268'435'456.
+==> 28 bits storage (the exact length of the chromosomes of each assembly is checked by VariantIDEncoder)
 */
 const (
 	PositionMin = int64(1)
-	PositionMax = int64(1) << PosBitSize
+	PositionMax = int64(1)<<PosBitSize - 1
 )
 
 // AlleleMaping encodes alleles.
@@ -110,7 +136,7 @@ func GetVariantID(chromosomeID string, startPosition int64, refAlleles, altAllel
 		checkRegex(refAlleles, AllelesRegex, "Invalid reference allele") != nil || checkRegex(altAlleles, AllelesRegex, "Invalid alternate allele") != nil ||
 		startPosition < PositionMin || startPosition > PositionMax || TypeFlagBitSize+ChrBitSize+PosBitSize+2*(AllelesBaseLengthBitSize+AllelesBitSize) != IDBitSize {
 
-		return int64(-1), errors.New("Invalid input: chr=" + chromosomeID + ", pos=" + strconv.FormatInt(startPosition, 10) + ", ref=" + refAlleles + ", alt=" + altAlleles)
+		return int64(-1), loader.NewError(loader.ErrInputFormat, errors.New("chr="+chromosomeID+", pos="+strconv.FormatInt(startPosition, 10)+", ref="+refAlleles+", alt="+altAlleles))
 	}
 
 	// interpret chromosome id (content validated by regex)
@@ -128,8 +154,7 @@ func GetVariantID(chromosomeID string, startPosition int64, refAlleles, altAllel
 			chromosomeIntID = ChromosomeMintID
 			break
 		default:
-			log.Fatal("Invalid Chromosome ID")
-			return int64(-1), err
+			return int64(-1), loader.NewError(loader.ErrInputFormat, errors.New("invalid chromosome ID "+chromosomeID))
 		}
 	}
 
@@ -145,27 +170,36 @@ func GetVariantID(chromosomeID string, startPosition int64, refAlleles, altAllel
 	refAllelesBaseLength := int64(len(refAlleles))
 	altAllelesBaseLength := int64(len(altAlleles))
 
+	refAllelesEncoded, err := EncodeAlleles(refAlleles)
+	if err != nil {
+		return int64(-1), err
+	}
+	altAllelesEncoded, err := EncodeAlleles(altAlleles)
+	if err != nil {
+		return int64(-1), err
+	}
+
 	// generate the variant
 	id := int64(0)
 	id = PushBitsFromRight(id, TypeFlagBitSize, TypeFlagGenomicVariant)
 	id = PushBitsFromRight(id, ChrBitSize, chromosomeIntID)
 	id = PushBitsFromRight(id, PosBitSize, startPosition)
 	id = PushBitsFromRight(id, AllelesBaseLengthBitSize, refAllelesBaseLength)
-	id = PushBitsFromRight(id, AllelesBitSize, EncodeAlleles(refAlleles))
+	id = PushBitsFromRight(id, AllelesBitSize, refAllelesEncoded)
 	id = PushBitsFromRight(id, AllelesBaseLengthBitSize, altAllelesBaseLength)
-	id = PushBitsFromRight(id, AllelesBitSize, EncodeAlleles(altAlleles))
+	id = PushBitsFromRight(id, AllelesBitSize, altAllelesEncoded)
 
 	return id, nil
 }
 
 // EncodeAlleles encodes a string containing alleles.
-func EncodeAlleles(alleles string) int64 {
+func EncodeAlleles(alleles string) (int64, error) {
 	encodedAlleles := int64(0)
 
 	for i := 0; i < len(alleles); i++ {
 		mapV, err := AlleleMaping(alleles[i : i+1])
 		if err != nil {
-			log.Fatal(err)
+			return int64(-1), loader.NewError(loader.ErrInputFormat, errors.New("alleles "+alleles+": "+err.Error()))
 		}
 
 		encodedAlleles = PushBitsFromRight(encodedAlleles, 2, mapV)
@@ -175,7 +209,7 @@ func EncodeAlleles(alleles string) int64 {
 	//padding
 	encodedAlleles = PushBitsFromRight(encodedAlleles, AllelesBitSize-len(alleles)*2, int64(0))
 
-	return encodedAlleles
+	return encodedAlleles, nil
 }
 
 // PushBitsFromRight takes the nbBits rightmost bits of bitsToPush, and push them to the right of origBits.
@@ -201,3 +235,210 @@ func GetMask(nbBits int) int64 {
 
 	return mask
 }
+
+// VariantIDEncoder encodes the genomic variant IDs. Contrary to GetVariantID, it accepts the variants with alleles
+// longer than 6 bases: their alleles are replaced by a keyed hash (HMAC-SHA256 truncated to 27 bits) and flagged by a
+// reference allele length of 7. As the hash can collide, the encoder keeps the alleles of the hashed IDs and refuses to
+// give the same ID to different alleles. The key of the hash is a secret that must be the same on all the nodes (so that
+// a variant gets the same ID everywhere): without it the long alleles cannot be encoded. The positions are checked
+// against the chromosomes of the assembly of the variants. It is not safe for concurrent use.
+type VariantIDEncoder struct {
+	// Assembly is the reference genome assembly of the variants
+	Assembly string
+
+	key         []byte
+	longAlleles map[int64]string
+}
+
+// NewVariantIDEncoder creates an encoder of the variants of assembly (see NormalizeAssembly) hashing the long alleles
+// with key (if empty, only the variants with short alleles can be encoded)
+func NewVariantIDEncoder(assembly string, key []byte) (*VariantIDEncoder, error) {
+	assembly, err := NormalizeAssembly(assembly)
+	if err != nil {
+		return nil, err
+	}
+	return &VariantIDEncoder{Assembly: assembly, key: key, longAlleles: make(map[int64]string)}, nil
+}
+
+// GetVariantID encodes a genomic variant ID to be encrypted, with a hash of the alleles if one of them is longer than 6
+// bases. An error is returned if the position is beyond the end of the chromosome or if the ID was already given to
+// other alleles.
+func (e *VariantIDEncoder) GetVariantID(chromosomeID string, startPosition int64, refAlleles, altAlleles string) (int64, error) {
+	id, long, err := e.encode(chromosomeID, startPosition, refAlleles, altAlleles)
+	if err != nil || !long {
+		return id, err
+	}
+	if err := e.record(id, chromosomeID, startPosition, refAlleles+">"+altAlleles); err != nil {
+		return int64(-1), err
+	}
+	return id, nil
+}
+
+// AddLoadedVariant records the alleles of a variant with long alleles that is already loaded (e.g. in the genomic
+// annotations), so that no other alleles get its ID. The alternate alleles are the candidates for the ones of the
+// variant (the first one with the ID is recorded). An error is returned if other alleles already have the ID or if no
+// candidate has the ID with the key of the encoder (the alleles were hashed with another key).
+func (e *VariantIDEncoder) AddLoadedVariant(id int64, refAlleles string, altAlleles ...string) error {
+	variant, err := ParseVariantID(id)
+	if err != nil {
+		return err
+	}
+	for _, alt := range altAlleles {
+		encoded, long, err := e.encode(variant.Chromosome, variant.Position, refAlleles, alt)
+		if err != nil {
+			return err
+		}
+		if long && encoded == id {
+			return e.record(id, variant.Chromosome, variant.Position, refAlleles+">"+alt)
+		}
+	}
+	return loader.NewError(loader.ErrInputFormat, fmt.Errorf("the loaded variant %d (%s:%d, ref=%s, alt=%s) has another ID with this key",
+		id, variant.Chromosome, variant.Position, refAlleles, strings.Join(altAlleles, " or ")))
+}
+
+// encode encodes a genomic variant ID, and tells whether its alleles are hashed (without recording them)
+func (e *VariantIDEncoder) encode(chromosomeID string, startPosition int64, refAlleles, altAlleles string) (int64, bool, error) {
+	if length, ok := ChromosomeLengths[e.Assembly][chromosomeID]; ok && startPosition > length {
+		return int64(-1), false, loader.NewError(loader.ErrInputFormat, errors.New("chr="+chromosomeID+", pos="+strconv.FormatInt(startPosition, 10)+
+			": position beyond the end of the chromosome in "+e.Assembly))
+	}
+
+	if checkRegex(refAlleles, AllelesRegex, "") == nil && checkRegex(altAlleles, AllelesRegex, "") == nil {
+		id, err := GetVariantID(chromosomeID, startPosition, refAlleles, altAlleles)
+		return id, false, err
+	}
+
+	if checkRegex(refAlleles, LongAllelesRegex, "Invalid reference allele") != nil || checkRegex(altAlleles, LongAllelesRegex, "Invalid alternate allele") != nil {
+		return int64(-1), false, loader.NewError(loader.ErrInputFormat, errors.New("chr="+chromosomeID+", pos="+strconv.FormatInt(startPosition, 10)+", ref="+refAlleles+", alt="+altAlleles))
+	}
+
+	if len(e.key) == 0 {
+		return int64(-1), false, loader.NewError(loader.ErrInputFormat, fmt.Errorf("%w: chr=%s, pos=%d: the alleles longer than 6 bases are hashed with a key shared by all the nodes",
+			ErrMissingAllelesKey, chromosomeID, startPosition))
+	}
+
+	// the flag, chromosome and position are encoded as for the short alleles
+	id, err := GetVariantID(chromosomeID, startPosition, "-", "-")
+	if err != nil {
+		return int64(-1), false, err
+	}
+	id >>= uint(AllelesBaseLengthBitSize + LongAllelesHashBitSize)
+
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write([]byte(refAlleles + ">" + altAlleles))
+	hash := int64(binary.BigEndian.Uint64(mac.Sum(nil)) & uint64(GetMask(LongAllelesHashBitSize)))
+
+	id = PushBitsFromRight(id, AllelesBaseLengthBitSize, FlagLongAlleles)
+	id = PushBitsFromRight(id, LongAllelesHashBitSize, hash)
+	return id, true, nil
+}
+
+// record records the alleles of a hashed ID, an error is returned if other alleles already have the ID
+func (e *VariantIDEncoder) record(id int64, chromosomeID string, startPosition int64, alleles string) error {
+	if other, ok := e.longAlleles[id]; ok && other != alleles {
+		return loader.NewError(loader.ErrInputFormat, fmt.Errorf("%w: chr=%s, pos=%d: the alleles %s and %s have the same ID %d",
+			ErrIDCollision, chromosomeID, startPosition, alleles, other, id))
+	}
+	e.longAlleles[id] = alleles
+	return nil
+}
+
+// Variant is a genomic variant decoded from its ID (see ParseVariantID)
+type Variant struct {
+	TypeFlag   int64
+	Chromosome string
+	Position   int64
+	// the alleles ("-" if empty), unknown ("?") if the variant has long alleles
+	Ref string
+	Alt string
+	// LongAlleles tells whether the alleles are encoded by their hash (AllelesHash)
+	LongAlleles bool
+	AllelesHash int64
+}
+
+// String returns the variant in the notation of the genomic annotations (chromosome:position:ref>alt)
+func (v Variant) String() string {
+	return v.Chromosome + ":" + strconv.FormatInt(v.Position, 10) + ":" + v.Ref + ">" + v.Alt
+}
+
+// ParseVariantID decodes a genomic variant ID, it is the inverse of GetVariantID (and of VariantIDEncoder.GetVariantID
+// except for the long alleles whose hash is returned). An error is returned if the ID does not follow the bit layout.
+func ParseVariantID(id int64) (Variant, error) {
+	bits := uint64(id)
+	popBits := func(nbBits int) int64 {
+		value := int64(bits) & GetMask(nbBits)
+		bits >>= uint(nbBits)
+		return value
+	}
+	invalid := func(reason string) (Variant, error) {
+		return Variant{}, loader.NewError(loader.ErrInputFormat, errors.New("variant ID "+strconv.FormatInt(id, 10)+": "+reason))
+	}
+
+	variant := Variant{}
+
+	// from the right: alt, alt length, ref, ref length (or hash and long alleles flag), position, chromosome, type flag
+	altAlleles, altLength := popBits(AllelesBitSize), popBits(AllelesBaseLengthBitSize)
+	refAlleles, refLength := popBits(AllelesBitSize), popBits(AllelesBaseLengthBitSize)
+	variant.Position = popBits(PosBitSize)
+	chromosomeIntID := popBits(ChrBitSize)
+	variant.TypeFlag = popBits(TypeFlagBitSize)
+
+	if variant.TypeFlag != TypeFlagGenomicVariant {
+		return invalid("wrong type flag " + strconv.FormatInt(variant.TypeFlag, 10))
+	}
+
+	switch chromosomeIntID {
+	case ChromosomeXintID:
+		variant.Chromosome = "X"
+	case ChromosomeYintID:
+		variant.Chromosome = "Y"
+	case ChromosomeMintID:
+		variant.Chromosome = "M"
+	default:
+		if chromosomeIntID < 1 || chromosomeIntID > 23 {
+			return invalid("wrong chromosome " + strconv.FormatInt(chromosomeIntID, 10))
+		}
+		variant.Chromosome = strconv.FormatInt(chromosomeIntID, 10)
+	}
+
+	if variant.Position < PositionMin {
+		return invalid("wrong position " + strconv.FormatInt(variant.Position, 10))
+	}
+
+	if refLength == FlagLongAlleles {
+		variant.LongAlleles = true
+		variant.AllelesHash = PushBitsFromRight(PushBitsFromRight(refAlleles, AllelesBaseLengthBitSize, altLength), AllelesBitSize, altAlleles)
+		variant.Ref, variant.Alt = "?", "?"
+		return variant, nil
+	}
+
+	var err error
+	if variant.Ref, err = DecodeAlleles(refAlleles, refLength); err != nil {
+		return invalid("reference allele: " + err.Error())
+	}
+	if variant.Alt, err = DecodeAlleles(altAlleles, altLength); err != nil {
+		return invalid("alternate allele: " + err.Error())
+	}
+
+	return variant, nil
+}
+
+// DecodeAlleles decodes length alleles encoded by EncodeAlleles ("-" if there are none)
+func DecodeAlleles(encodedAlleles, length int64) (string, error) {
+	if length < 0 || length*2 > AllelesBitSize {
+		return "", errors.New("wrong length " + strconv.FormatInt(length, 10))
+	}
+	if encodedAlleles&GetMask(AllelesBitSize-int(length)*2) != 0 {
+		return "", errors.New("non-zero padding")
+	}
+	if length == 0 {
+		return "-", nil
+	}
+
+	bases := [...]string{"A", "T", "G", "C"}
+	alleles := ""
+	for i := int64(1); i <= length; i++ {
+		alleles += bases[(encodedAlleles>>uint(AllelesBitSize-2*i))&3]
+	}
+	return alleles, nil
+}
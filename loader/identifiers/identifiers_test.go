@@ -1,6 +1,8 @@
 package identifiers_test
 
 import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
 	"github.com/ldsec/medco-loader/loader/identifiers"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -45,18 +47,27 @@ func TestPushBitsFromRight(t *testing.T) {
 	assert.Equal(t, identifiers.PushBitsFromRight(int64(0), 4, int64(7)), int64(7))
 }
 
+func assertEncodedAlleles(t *testing.T, alleles string, expected int64) {
+	res, err := identifiers.EncodeAlleles(alleles)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, res)
+}
+
 func TestEncodeAlleles(t *testing.T) {
-	assert.Equal(t, identifiers.EncodeAlleles("A"), int64(0))
-	assert.Equal(t, identifiers.EncodeAlleles("T"), int64(1024))
-	assert.Equal(t, identifiers.EncodeAlleles("G"), int64(2048))
-	assert.Equal(t, identifiers.EncodeAlleles("C"), int64(3072))
+	assertEncodedAlleles(t, "A", int64(0))
+	assertEncodedAlleles(t, "T", int64(1024))
+	assertEncodedAlleles(t, "G", int64(2048))
+	assertEncodedAlleles(t, "C", int64(3072))
 
-	assert.Equal(t, identifiers.EncodeAlleles("AA"), int64(0))
-	assert.Equal(t, identifiers.EncodeAlleles("ATCG"), int64(480))
-	assert.Equal(t, identifiers.EncodeAlleles("GGTTCA"), int64(2652))
-	assert.Equal(t, identifiers.EncodeAlleles("TGACTA"), int64(1588))
+	assertEncodedAlleles(t, "AA", int64(0))
+	assertEncodedAlleles(t, "ATCG", int64(480))
+	assertEncodedAlleles(t, "GGTTCA", int64(2652))
+	assertEncodedAlleles(t, "TGACTA", int64(1588))
 
-	assert.Equal(t, identifiers.EncodeAlleles("TGACTAT"), int64(0)) //strange!!
+	assertEncodedAlleles(t, "TGACTAT", int64(0)) //strange!!
+
+	_, err := identifiers.EncodeAlleles("ATN")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
 }
 
 func TestGetVariantID(t *testing.T) {
@@ -72,4 +83,166 @@ func TestGetVariantID(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, res, int64(-8934067919247763456))
 
+	_, err = identifiers.GetVariantID("30", int64(6), "AC", "ATTT")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+}
+
+func TestVariantIDEncoder(t *testing.T) {
+	key := []byte("site key")
+	encoder, err := identifiers.NewVariantIDEncoder("GRCh37", key)
+	assert.Nil(t, err)
+
+	// short alleles are encoded as by GetVariantID
+	res, err := encoder.GetVariantID("1", int64(6), "AC", "ATTT")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-8935141653966995120), res)
+
+	// long alleles keep the flag, chromosome and position, and are flagged by a reference length of 7
+	id, err := encoder.GetVariantID("10", int64(2300), "C", "CTTTTTTTT")
+	assert.Nil(t, err)
+	prefix, err := identifiers.GetVariantID("10", int64(2300), "-", "-")
+	assert.Nil(t, err)
+	assert.Equal(t, prefix>>30, id>>30)
+	assert.Equal(t, identifiers.FlagLongAlleles, (id>>27)&identifiers.GetMask(3))
+
+	again, err := encoder.GetVariantID("10", int64(2300), "C", "CTTTTTTTT")
+	assert.Nil(t, err)
+	assert.Equal(t, id, again)
+
+	otherEncoder, err := identifiers.NewVariantIDEncoder("GRCh37", []byte("other key"))
+	assert.Nil(t, err)
+	other, err := otherEncoder.GetVariantID("10", int64(2300), "C", "CTTTTTTTT")
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, other)
+
+	_, err = encoder.GetVariantID("10", int64(2300), "C", "CTTTTNTTT")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+
+	// there is no default key: without one only the short alleles are encoded
+	keyless, err := identifiers.NewVariantIDEncoder("GRCh37", nil)
+	assert.Nil(t, err)
+	_, err = keyless.GetVariantID("1", int64(6), "AC", "ATTT")
+	assert.Nil(t, err)
+	_, err = keyless.GetVariantID("10", int64(2300), "C", "CTTTTTTTT")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+	assert.True(t, errors.Is(err, identifiers.ErrMissingAllelesKey))
+
+	// 2^16 alleles of 8 bases on 27 bits collide
+	bases := "ATGC"
+	for i := 0; i < 1<<16; i++ {
+		alleles := ""
+		for j := 0; j < 8; j++ {
+			alleles += bases[(i>>uint(2*j))&3 : (i>>uint(2*j))&3+1]
+		}
+		if _, err = encoder.GetVariantID("1", int64(100), alleles, "-"); err != nil {
+			break
+		}
+	}
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+	assert.True(t, errors.Is(err, identifiers.ErrIDCollision))
+
+	// the alleles of the loaded variants are recorded: other alleles cannot get their ID
+	seen := make(map[int64]string)
+	collided, loaded, colliding := int64(0), "", ""
+	for i := 0; i < 1<<16 && loaded == ""; i++ {
+		alleles := ""
+		for j := 0; j < 8; j++ {
+			alleles += bases[(i>>uint(2*j))&3 : (i>>uint(2*j))&3+1]
+		}
+		fresh, err := identifiers.NewVariantIDEncoder("GRCh37", key)
+		assert.Nil(t, err)
+		id, err := fresh.GetVariantID("1", int64(100), alleles, "-")
+		assert.Nil(t, err)
+		if previous, ok := seen[id]; ok {
+			collided, loaded, colliding = id, previous, alleles
+		}
+		seen[id] = alleles
+	}
+	assert.NotEmpty(t, loaded)
+
+	appended, err := identifiers.NewVariantIDEncoder("GRCh37", key)
+	assert.Nil(t, err)
+	assert.Nil(t, appended.AddLoadedVariant(collided, loaded, "T", "-"))
+	id, err = appended.GetVariantID("1", int64(100), loaded, "-")
+	assert.Nil(t, err)
+	assert.Equal(t, collided, id)
+	_, err = appended.GetVariantID("1", int64(100), colliding, "-")
+	assert.True(t, errors.Is(err, identifiers.ErrIDCollision))
+
+	// nor can the variants loaded with another key
+	assert.True(t, errors.Is(appended.AddLoadedVariant(other, "C", "CTTTTTTTT"), loader.ErrInputFormat))
+}
+
+func TestParseVariantID(t *testing.T) {
+	for _, v := range []identifiers.Variant{
+		{TypeFlag: 1, Chromosome: "1", Position: 6, Ref: "AC", Alt: "ATTT"},
+		{TypeFlag: 1, Chromosome: "X", Position: 2300, Ref: "-", Alt: "GGTTCA"},
+		{TypeFlag: 1, Chromosome: "23", Position: 999999, Ref: "TAAAC", Alt: "-"},
+	} {
+		id, err := identifiers.GetVariantID(v.Chromosome, v.Position, v.Ref, v.Alt)
+		assert.Nil(t, err)
+		res, err := identifiers.ParseVariantID(id)
+		assert.Nil(t, err)
+		assert.Equal(t, v, res)
+	}
+
+	res, err := identifiers.ParseVariantID(int64(-8935141653966995120))
+	assert.Nil(t, err)
+	assert.Equal(t, "1:6:AC>ATTT", res.String())
+
+	// long alleles
+	encoder, err := identifiers.NewVariantIDEncoder("GRCh38", []byte("site key"))
+	assert.Nil(t, err)
+	id, err := encoder.GetVariantID("M", int64(42), "C", "CTTTTTTTT")
+	assert.Nil(t, err)
+	res, err = identifiers.ParseVariantID(id)
+	assert.Nil(t, err)
+	assert.True(t, res.LongAlleles)
+	assert.Equal(t, "M:42:?>?", res.String())
+	assert.Equal(t, id&identifiers.GetMask(identifiers.LongAllelesHashBitSize), res.AllelesHash)
+
+	// invalid layouts: type flag, chromosome, position, allele length and padding
+	for _, id := range []int64{
+		int64(1),
+		identifiers.PushBitsFromRight(int64(-1), 63, int64(0)),
+		int64(-8935141653966995120) &^ (identifiers.GetMask(28) << 30),
+		int64(-8935141653966995120) | (int64(7) << 12),
+		int64(-8935141653966995120) | int64(1),
+	} {
+		_, err = identifiers.ParseVariantID(id)
+		assert.True(t, errors.Is(err, loader.ErrInputFormat), id)
+	}
+}
+
+func TestAssemblies(t *testing.T) {
+	for _, name := range []string{"GRCh37", "hg19", "37", " b37"} {
+		assembly, err := identifiers.NormalizeAssembly(name)
+		assert.Nil(t, err)
+		assert.Equal(t, identifiers.AssemblyGRCh37, assembly)
+	}
+	assembly, err := identifiers.NormalizeAssembly("HG38")
+	assert.Nil(t, err)
+	assert.Equal(t, identifiers.AssemblyGRCh38, assembly)
+
+	_, err = identifiers.NewVariantIDEncoder("GRCh36", nil)
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+
+	// chromosome 1 is longer in GRCh37
+	grch37, err := identifiers.NewVariantIDEncoder("GRCh37", nil)
+	assert.Nil(t, err)
+	grch38, err := identifiers.NewVariantIDEncoder("hg38", nil)
+	assert.Nil(t, err)
+	_, err = grch37.GetVariantID("1", int64(249000000), "A", "T")
+	assert.Nil(t, err)
+	_, err = grch38.GetVariantID("1", int64(249000000), "A", "T")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+
+	// the maximum position fits in the ID
+	_, err = identifiers.GetVariantID("1", identifiers.PositionMax+1, "A", "T")
+	assert.True(t, errors.Is(err, loader.ErrInputFormat))
+	id, err := identifiers.GetVariantID("1", identifiers.PositionMax, "A", "T")
+	assert.Nil(t, err)
+	variant, err := identifiers.ParseVariantID(id)
+	assert.Nil(t, err)
+	assert.Equal(t, identifiers.PositionMax, variant.Position)
 }
@@ -0,0 +1,343 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policy is the sensitivity policy of a loading: it tells which i2b2 concepts and modifiers (by their path), which
+// clinical fields (by their header, for the v0 loader) and which values of these fields are sensitive. An element is
+// sensitive if all of them are (All) or if at least one rule makes it sensitive: one of the patterns of the rule
+// matches it and none of the exceptions of the rule do.
+//
+// The patterns are globs, where * matches any characters but \ (i.e. within a level of a path), ** any characters and
+// ? a single character but \, or regular expressions prefixed by "re:" (e.g. "re:^CANCER_.*$"). Both must match the
+// whole path, header or value. A concept pattern matches a path if it matches the path or one of its ancestors (the
+// whole subtree of a matched path is sensitive).
+type Policy struct {
+	All   bool   `toml:"all"`
+	Rules []Rule `toml:"rule"`
+
+	compiled bool
+}
+
+// Rule is a rule of a sensitivity policy
+type Rule struct {
+	Name     string   `toml:"name,omitempty"`     // name of the rule in the explanations of the decisions (its number if empty)
+	Concepts []string `toml:"concepts,omitempty"` // patterns of the sensitive concept paths (their subtree is sensitive)
+	Fields   []string `toml:"fields,omitempty"`   // patterns of the sensitive clinical fields
+	Except   []string `toml:"except,omitempty"`   // patterns of the concept paths (and subtrees) or fields not made sensitive
+
+	// Values are the patterns of the sensitive values of the fields (all of them if Values is empty) and ExceptValues the
+	// patterns of the values not made sensitive. A field with one of them is only partially sensitive.
+	Values       []string `toml:"values,omitempty"`
+	ExceptValues []string `toml:"except_values,omitempty"`
+
+	concepts, fields, except, values, exceptValues []*regexp.Regexp
+}
+
+// Decision is the decision of a sensitivity policy about an element, with the rule, the pattern and the path, field or
+// value that made it (to explain it)
+type Decision struct {
+	Sensitive bool
+	Partial   bool   // only some values of the field are sensitive (field decisions only, see Policy.Value)
+	Excluded  bool   // an exception of the rule matched the element
+	Rule      string // rule that made the decision, empty if no rule matched the element
+	Pattern   string // pattern of the rule that matched the element
+	Match     string // what the pattern matched: the concept path or one of its ancestors, the field or the value
+}
+
+// ruleAll is the name of the rule of the decisions of the policies in which all the elements are sensitive
+const ruleAll = "all"
+
+// String explains the decision
+func (d Decision) String() string {
+	switch {
+	case d.Rule == ruleAll:
+		return "sensitive (all the elements are sensitive)"
+	case d.Rule == "":
+		return "clear (no rule matches)"
+	case d.Excluded:
+		return fmt.Sprintf("clear (excepted by rule %s: '%s' matches '%s')", d.Rule, d.Pattern, d.Match)
+	case d.Partial:
+		return fmt.Sprintf("partially sensitive (rule %s: '%s' matches '%s', only some values are sensitive)", d.Rule, d.Pattern, d.Match)
+	default:
+		return fmt.Sprintf("sensitive (rule %s: '%s' matches '%s')", d.Rule, d.Pattern, d.Match)
+	}
+}
+
+// NewListPolicy creates the policy of a list of sensitive concept paths or clinical fields (matched exactly), in which
+// all the elements are sensitive if all is set
+func NewListPolicy(all bool, elements []string) *Policy {
+	p := &Policy{All: all}
+	if len(elements) > 0 {
+		sorted := append([]string(nil), elements...)
+		sort.Strings(sorted)
+		rule := Rule{Name: "list"}
+		for _, element := range sorted {
+			rule.Concepts = append(rule.Concepts, literalPattern(element))
+			rule.Fields = append(rule.Fields, literalPattern(element))
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+	return p
+}
+
+// LoadPolicy reads a sensitivity policy file. A file with the .toml extension holds a Policy, any other file a list of
+// the sensitive concept paths or clinical fields (one per line, "all" if they all are sensitive).
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		md, err := toml.DecodeFile(path, p)
+		if err != nil {
+			return nil, NewInputError(path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, NewInputError(path, fmt.Errorf("unknown setting %s", undecoded[0]))
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, NewInputError(path, err)
+		}
+		defer f.Close()
+
+		all := false
+		elements := make([]string, 0)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "all" {
+				all = true
+				break
+			} else if line != "" {
+				elements = append(elements, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, NewInputError(path, err)
+		}
+		p = NewListPolicy(all, elements)
+	}
+
+	if err := p.Compile(); err != nil {
+		return nil, err.(*Error).InFile(path, 0)
+	}
+	return p, nil
+}
+
+// Compile checks the rules of the policy and compiles their patterns (it is done only once)
+func (p *Policy) Compile() error {
+	if p.compiled {
+		return nil
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = "#" + strconv.Itoa(i+1)
+		}
+		if len(r.Concepts) == 0 && len(r.Fields) == 0 {
+			return NewError(ErrInputFormat, errors.New("rule "+r.Name+" has neither concepts nor fields"))
+		}
+		if (len(r.Values) > 0 || len(r.ExceptValues) > 0) && len(r.Fields) == 0 {
+			return NewError(ErrInputFormat, errors.New("rule "+r.Name+" has values but no fields"))
+		}
+
+		var err error
+		for _, c := range []struct {
+			patterns []string
+			compiled *[]*regexp.Regexp
+		}{
+			{r.Concepts, &r.concepts}, {r.Fields, &r.fields}, {r.Except, &r.except},
+			{r.Values, &r.values}, {r.ExceptValues, &r.exceptValues},
+		} {
+			if *c.compiled, err = compilePatterns(c.patterns); err != nil {
+				return NewError(ErrInputFormat, fmt.Errorf("rule %s: %w", r.Name, err))
+			}
+		}
+	}
+	p.compiled = true
+	return nil
+}
+
+// String returns the policy in the TOML format
+func (p *Policy) String() string {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(p); err != nil {
+		return err.Error()
+	}
+	return buf.String()
+}
+
+// Concept decides whether the concept or modifier path is sensitive
+func (p *Policy) Concept(path string) Decision {
+	if p.All {
+		return Decision{Sensitive: true, Rule: ruleAll}
+	}
+	paths := selfAndAncestors(path)
+
+	var excluded *Decision
+	for _, r := range p.Rules {
+		pattern, match, ok := matchAny(r.Concepts, r.concepts, paths)
+		if !ok {
+			continue
+		}
+		if pattern, match, ok := matchAny(r.Except, r.except, paths); ok {
+			if excluded == nil {
+				excluded = &Decision{Excluded: true, Rule: r.Name, Pattern: pattern, Match: match}
+			}
+			continue
+		}
+		return Decision{Sensitive: true, Rule: r.Name, Pattern: pattern, Match: match}
+	}
+	if excluded != nil {
+		return *excluded
+	}
+	return Decision{}
+}
+
+// Field decides whether the clinical field is sensitive. If only some of its values are, the decision is Partial.
+func (p *Policy) Field(field string) Decision {
+	if p.All {
+		return Decision{Sensitive: true, Rule: ruleAll}
+	}
+
+	var other *Decision
+	for _, r := range p.Rules {
+		pattern, match, ok := matchAny(r.Fields, r.fields, []string{field})
+		if !ok {
+			continue
+		}
+		if pattern, match, ok := matchAny(r.Except, r.except, []string{field}); ok {
+			if other == nil {
+				other = &Decision{Excluded: true, Rule: r.Name, Pattern: pattern, Match: match}
+			}
+			continue
+		}
+		if len(r.Values) > 0 || len(r.ExceptValues) > 0 {
+			// a rule making the whole field sensitive takes precedence
+			if other == nil || other.Excluded {
+				other = &Decision{Partial: true, Rule: r.Name, Pattern: pattern, Match: match}
+			}
+			continue
+		}
+		return Decision{Sensitive: true, Rule: r.Name, Pattern: pattern, Match: match}
+	}
+	if other != nil {
+		return *other
+	}
+	return Decision{}
+}
+
+// Value decides whether the value of the clinical field is sensitive
+func (p *Policy) Value(field, value string) Decision {
+	decision := p.Field(field)
+	if !decision.Partial {
+		return decision
+	}
+
+	var excluded *Decision
+	for _, r := range p.Rules {
+		if len(r.Values) == 0 && len(r.ExceptValues) == 0 {
+			continue
+		}
+		if _, _, ok := matchAny(r.Fields, r.fields, []string{field}); !ok {
+			continue
+		}
+		if _, _, ok := matchAny(r.Except, r.except, []string{field}); ok {
+			continue
+		}
+
+		pattern, match, ok := "**", value, true
+		if len(r.Values) > 0 {
+			pattern, match, ok = matchAny(r.Values, r.values, []string{value})
+		}
+		if !ok {
+			continue
+		}
+		if pattern, match, ok := matchAny(r.ExceptValues, r.exceptValues, []string{value}); ok {
+			if excluded == nil {
+				excluded = &Decision{Excluded: true, Rule: r.Name, Pattern: pattern, Match: match}
+			}
+			continue
+		}
+		return Decision{Sensitive: true, Rule: r.Name, Pattern: pattern, Match: match}
+	}
+	if excluded != nil {
+		return *excluded
+	}
+	return Decision{}
+}
+
+// matchAny returns the first pattern (and its compiled expression) matching one of the candidates, and the candidate
+func matchAny(patterns []string, compiled []*regexp.Regexp, candidates []string) (string, string, bool) {
+	for _, candidate := range candidates {
+		for i, re := range compiled {
+			if re.MatchString(candidate) {
+				return patterns[i], candidate, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// selfAndAncestors returns the concept path followed by the paths of its ancestors (e.g. \a\b\, \a\)
+func selfAndAncestors(path string) []string {
+	levels := strings.Split(strings.Trim(path, `\`), `\`)
+	paths := []string{path}
+	for i := len(levels) - 1; i > 0; i-- {
+		paths = append(paths, `\`+strings.Join(levels[:i], `\`)+`\`)
+	}
+	return paths
+}
+
+// compilePatterns compiles the glob (or "re:" regular expression) patterns into regular expressions matching whole
+// strings
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		expression := ""
+		if strings.HasPrefix(pattern, "re:") {
+			expression = strings.TrimPrefix(pattern, "re:")
+		} else {
+			glob := []rune(pattern)
+			for j := 0; j < len(glob); j++ {
+				switch {
+				case glob[j] == '*' && j+1 < len(glob) && glob[j+1] == '*':
+					expression += ".*"
+					j++
+				case glob[j] == '*':
+					expression += `[^\\]*`
+				case glob[j] == '?':
+					expression += `[^\\]`
+				default:
+					expression += regexp.QuoteMeta(string(glob[j]))
+				}
+			}
+		}
+
+		re, err := regexp.Compile("^(?:" + expression + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// literalPattern returns a pattern matching exactly the string
+func literalPattern(s string) string {
+	if !strings.ContainsAny(s, "*?") && !strings.HasPrefix(s, "re:") {
+		return s
+	}
+	return "re:" + regexp.QuoteMeta(s)
+}
@@ -0,0 +1,90 @@
+package loader_test
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy_")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sensitive.toml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+[[rule]]
+name = "neoplasms"
+concepts = ['\i2b2\Diagnoses\Neoplasms*\']
+except = ['\i2b2\Diagnoses\Neoplasms*\Benign*\']
+
+[[rule]]
+concepts = ['re:\\i2b2\\Procedures\\[0-9]+\\']
+
+[[rule]]
+name = "cancer"
+fields = ["CANCER_TYPE*"]
+values = ["Melanoma", "re:Breast.*"]
+except_values = ["Breast (male)"]
+`), 0644))
+
+	p, err := loader.LoadPolicy(path)
+	assert.Nil(t, err)
+
+	// the subtree of a matched path is sensitive, except the excepted subtrees
+	d := p.Concept(`\i2b2\Diagnoses\Neoplasms (140-239)\Malignant\(172) Melanoma\`)
+	assert.True(t, d.Sensitive)
+	assert.Equal(t, "neoplasms", d.Rule)
+	assert.Equal(t, `\i2b2\Diagnoses\Neoplasms (140-239)\`, d.Match)
+	d = p.Concept(`\i2b2\Diagnoses\Neoplasms (140-239)\Benign neoplasms (210-229)\(216) Benign neoplasm of skin\`)
+	assert.False(t, d.Sensitive)
+	assert.True(t, d.Excluded)
+	assert.Contains(t, d.String(), "excepted by rule neoplasms")
+	assert.False(t, p.Concept(`\i2b2\Diagnoses\`).Sensitive)
+	assert.Equal(t, "clear (no rule matches)", p.Concept(`\i2b2\Demographics\`).String())
+
+	d = p.Concept(`\i2b2\Procedures\42\Surgery\`)
+	assert.True(t, d.Sensitive)
+	assert.Equal(t, "#2", d.Rule)
+	assert.False(t, p.Concept(`\i2b2\Procedures\PRC\`).Sensitive)
+
+	// only some values of the fields are sensitive
+	assert.True(t, p.Field("CANCER_TYPE_DETAILED").Partial)
+	assert.False(t, p.Field("AGE").Sensitive)
+	assert.True(t, p.Value("CANCER_TYPE", "Melanoma").Sensitive)
+	assert.True(t, p.Value("CANCER_TYPE", "Breast (female)").Sensitive)
+	assert.True(t, p.Value("CANCER_TYPE", "Breast (male)").Excluded)
+	assert.False(t, p.Value("CANCER_TYPE", "Lung").Sensitive)
+
+	// a list of exact paths or fields
+	path = filepath.Join(dir, "sensitive.txt")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("\\i2b2\\Diagnoses\\\nVITAL_STATUS*\n"), 0644))
+	p, err = loader.LoadPolicy(path)
+	assert.Nil(t, err)
+	assert.True(t, p.Concept(`\i2b2\Diagnoses\Neoplasms (140-239)\`).Sensitive)
+	assert.True(t, p.Field("VITAL_STATUS*").Sensitive)
+	assert.False(t, p.Field("VITAL_STATUS").Sensitive)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("all\n"), 0644))
+	p, err = loader.LoadPolicy(path)
+	assert.Nil(t, err)
+	assert.True(t, p.Concept(`\i2b2\Demographics\`).Sensitive)
+	assert.True(t, p.Value("AGE", "40").Sensitive)
+
+	// invalid policies
+	for _, policy := range []string{
+		"[[rule]]\nname = \"empty\"\n",
+		"[[rule]]\nconcepts = ['re:(']\n",
+		"[[rule]]\nconcepts = ['\\i2b2\\']\nvalues = ['x']\n",
+		"[[rule]]\nconcept = ['\\i2b2\\']\n",
+	} {
+		path = filepath.Join(dir, "invalid.toml")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(policy), 0644))
+		_, err = loader.LoadPolicy(path)
+		assert.True(t, errors.Is(err, loader.ErrInputFormat), policy)
+	}
+}
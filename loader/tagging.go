@@ -0,0 +1,105 @@
+package loader
+
+import (
+	"fmt"
+	"github.com/ldsec/medco-unlynx/services"
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"strconv"
+	"time"
+)
+
+// The default settings of the tagging
+const (
+	DefaultTaggingBatchSize = 10000
+	DefaultTaggingRetries   = 3
+	DefaultTaggingBackoff   = 5 * time.Second
+	// MaxTaggingBatchSize keeps a DDT request (86 bytes per element, about 4.3MB at most) at less than half of the
+	// default maximum size of the onet messages (network.MaxPacketSize, 10MB)
+	MaxTaggingBatchSize = 50000
+)
+
+// TaggingOptions are the settings of the distributed deterministic tagging of the sensitive elements, which is split
+// into batches (one DDT request each) so that no single message gets too big
+type TaggingOptions struct {
+	BatchSize int           // number of elements per DDT request (DefaultTaggingBatchSize if 0, at most MaxTaggingBatchSize)
+	Retries   int           // number of times a failed batch is sent again (DefaultTaggingRetries if 0, none if negative)
+	Backoff   time.Duration // delay before the first retry of a batch, doubled for each next one (DefaultTaggingBackoff if 0)
+}
+
+// withDefaults returns the options with the default values of the settings that are not set
+func (o TaggingOptions) withDefaults() TaggingOptions {
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultTaggingBatchSize
+	} else if o.BatchSize > MaxTaggingBatchSize {
+		log.Warn("The tagging batch size is lowered to", MaxTaggingBatchSize, "elements")
+		o.BatchSize = MaxTaggingBatchSize
+	}
+	if o.Retries == 0 {
+		o.Retries = DefaultTaggingRetries
+	} else if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = DefaultTaggingBackoff
+	}
+	return o
+}
+
+// TagElements tags the encrypted elements with the collective authority (through its server entryPointIdx). The elements
+// are sent in batches, each one with its own survey ID (surveyID followed by the batch and attempt numbers), and a
+// batch that fails is sent again after a delay. The tags are returned in the order of the elements, as with a single
+// request.
+func TagElements(roster *onet.Roster, entryPointIdx int, surveyID string, elements libunlynx.CipherVector, testing bool, opts TaggingOptions) ([]libunlynx.GroupingKey, error) {
+	opts = opts.withDefaults()
+	start := time.Now()
+	client := servicesmedco.NewMedCoClient(roster.List[entryPointIdx], strconv.Itoa(entryPointIdx))
+
+	batches := (len(elements) + opts.BatchSize - 1) / opts.BatchSize
+	result := make([]libunlynx.GroupingKey, 0, len(elements))
+	var execution, communication time.Duration
+
+	for b := 0; b < batches; b++ {
+		end := (b + 1) * opts.BatchSize
+		if end > len(elements) {
+			end = len(elements)
+		}
+		batch := elements[b*opts.BatchSize : end]
+
+		var tags []libunlynx.GroupingKey
+		var tr servicesmedco.TimeResults
+		var err error
+		backoff := opts.Backoff
+		for attempt := 0; ; attempt++ {
+			id := servicesmedco.SurveyID(surveyID + "_" + strconv.Itoa(b) + "_" + strconv.Itoa(attempt))
+			_, tags, tr, err = client.SendSurveyDDTRequestTerms(
+				roster,  // Roster
+				id,      // SurveyID
+				batch,   // Encrypted query terms to tag
+				false,   // compute proofs? (the service does not return them to the client, they could not be verified)
+				testing, // local test roster?
+			)
+			if err == nil && len(tags) != len(batch) {
+				err = fmt.Errorf("%d tags received for %d elements", len(tags), len(batch))
+			}
+			if err == nil || attempt >= opts.Retries {
+				break
+			}
+			log.Warn(fmt.Sprintf("Tagging of the batch %d/%d failed (%v), retrying in %v", b+1, batches, err, backoff))
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err != nil {
+			return nil, NewError(ErrDDT, fmt.Errorf("batch %d/%d (elements %d to %d): %w", b+1, batches, b*opts.BatchSize, end-1, err))
+		}
+
+		result = append(result, tags...)
+		execution += tr.MapTR[servicesmedco.TaggingTimeExec]
+		communication += tr.MapTR[servicesmedco.TaggingTimeCommunication]
+		log.Lvl1(fmt.Sprintf("Tagged %d/%d sensitive elements (batch %d/%d, %v)", len(result), len(elements), b+1, batches, time.Since(start)))
+	}
+
+	log.Lvl2("DDT took: execution -", execution, "communication -", communication)
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package loader_test
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/ldsec/medco-unlynx/services"
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/assert"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"testing"
+	"time"
+)
+
+func TestTagElements(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(3, true)
+
+	values := []int64{1, 2, 3, 2, 5}
+	elements := make(libunlynx.CipherVector, len(values))
+	for i, v := range values {
+		elements[i] = *libunlynx.EncryptInt(el.Aggregate, v)
+	}
+
+	// the tags of the batches are reassembled in the order of the elements
+	single, err := loader.TagElements(el, 0, "test_single", elements, true, loader.TaggingOptions{BatchSize: len(values)})
+	assert.Nil(t, err)
+	batched, err := loader.TagElements(el, 0, "test_batched", elements, true, loader.TaggingOptions{BatchSize: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, len(values), len(batched))
+	assert.Equal(t, single, batched)
+	assert.Equal(t, batched[1], batched[3])
+	assert.NotEqual(t, batched[0], batched[1])
+
+	empty, err := loader.TagElements(el, 0, "test_empty", libunlynx.CipherVector{}, true, loader.TaggingOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, empty)
+
+	// a batch that still fails after its retries fails the tagging
+	local.CloseAll()
+	_, err = loader.TagElements(el, 0, "test_failure", elements, true, loader.TaggingOptions{BatchSize: 2, Retries: 1, Backoff: time.Millisecond})
+	assert.True(t, errors.Is(err, loader.ErrDDT))
+}
+
+func TestTaggingBatchSize(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	defer local.CloseAll()
+	_, el, _ := local.GenTree(3, true)
+
+	// a full batch (the elements all have the same size) fits in an onet message, with room for its envelope
+	terms := make(libunlynx.CipherVector, loader.MaxTaggingBatchSize)
+	element := *libunlynx.EncryptInt(el.Aggregate, 1)
+	for i := range terms {
+		terms[i] = element
+	}
+	request, err := network.Marshal(&servicesmedco.SurveyDDTRequest{
+		SurveyID: "tagging_loading_phase_0123456789abcdef_1000_3",
+		Roster:   *el,
+		Testing:  true,
+		Terms:    terms,
+	})
+	assert.Nil(t, err)
+	assert.True(t, network.Size(len(request)) < network.MaxPacketSize/2, len(request))
+}
@@ -0,0 +1,374 @@
+package loader
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"math/big"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TagSampleSize is the number of TAG_IDs of the observations checked against the sensitive_tagged table
+const TagSampleSize = 100
+
+// TableCheck is the comparison of a table with the .csv files that were copied into it. The rows are compared through
+// an order-independent checksum of their content, the date and time columns are left out (their text representation
+// depends on the server settings and values such as NOW() are evaluated when loading).
+type TableCheck struct {
+	Table string
+	Paths []string
+	// Replaced is true if the table was truncated before the copy: it must hold exactly the rows of the files, otherwise
+	// (delta or append loading) it must hold at least them
+	Replaced     bool
+	FileRows     int64
+	DBRows       int64
+	FileChecksum uint64
+	DBChecksum   uint64
+	// Missing is the number of rows of the files that are not in the table (only counted if the table was not replaced)
+	Missing int64
+}
+
+// OK returns true if the table holds the rows of the files
+func (c TableCheck) OK() bool {
+	if c.Replaced {
+		return c.FileRows == c.DBRows && c.FileChecksum == c.DBChecksum
+	}
+	return c.Missing == 0
+}
+
+func (c TableCheck) String() string {
+	status := "OK      "
+	if !c.OK() {
+		status = "MISMATCH"
+	}
+	msg := fmt.Sprintf("%s %s: %d rows in the files, %d rows in the database", status, c.Table, c.FileRows, c.DBRows)
+	if c.Replaced {
+		return msg + fmt.Sprintf(" (checksums %016x / %016x)", c.FileChecksum, c.DBChecksum)
+	}
+	return msg + fmt.Sprintf(" (%d rows of the files missing)", c.Missing)
+}
+
+// Verification is the result of the verification of the loaded databases
+type Verification struct {
+	Tables []TableCheck
+	// TagsChecked is the number of TAG_IDs of the observations looked up in the sensitive_tagged table and MissingTags
+	// the ones that were not found
+	TagsChecked int
+	MissingTags []string
+}
+
+// OK returns true if all the tables hold the rows of their files and all the TAG_IDs checked were found
+func (v Verification) OK() bool {
+	for _, c := range v.Tables {
+		if !c.OK() {
+			return false
+		}
+	}
+	return len(v.MissingTags) == 0
+}
+
+// Err returns nil if the verification succeeded, an error of the category ErrDBLoad otherwise
+func (v Verification) Err() error {
+	if v.OK() {
+		return nil
+	}
+	mismatches := make([]string, 0)
+	for _, c := range v.Tables {
+		if !c.OK() {
+			mismatches = append(mismatches, c.Table)
+		}
+	}
+	msg := "the database does not hold the converted files"
+	if len(mismatches) > 0 {
+		msg += ", mismatching tables: " + strings.Join(mismatches, ", ")
+	}
+	if len(v.MissingTags) > 0 {
+		msg += fmt.Sprintf(", %d TAG_IDs missing from sensitive_tagged (e.g. %s)", len(v.MissingTags), v.MissingTags[0])
+	}
+	return NewError(ErrDBLoad, errors.New(msg))
+}
+
+func (v Verification) String() string {
+	summary := ""
+	for _, c := range v.Tables {
+		summary += c.String() + "\n"
+	}
+	summary += fmt.Sprintf("%d TAG_IDs checked in sensitive_tagged, %d missing", v.TagsChecked, len(v.MissingTags))
+	if len(v.MissingTags) > 0 {
+		summary += ": " + strings.Join(v.MissingTags, ", ")
+	}
+	return summary
+}
+
+// VerifyStatements compares the tables filled by the copy statements with their .csv files (the statements must have
+// been executed). The tables copied from several files are compared with all of them.
+func VerifyStatements(dbSettings DBSettings, statements []Statement) ([]TableCheck, error) {
+	db, err := sql.Open("postgres", dbSettings.ConnectionString())
+	if err != nil {
+		return nil, &LoadError{Err: err}
+	}
+	defer db.Close()
+
+	checks := make([]TableCheck, 0)
+	index := make(map[string]int)
+	copies := make(map[string][]Statement)
+	truncated := make(map[string]bool)
+	for _, s := range statements {
+		if !s.IsCopy() {
+			// a table is replaced if it is emptied before its first copy
+			if strings.HasPrefix(s.SQL, "TRUNCATE") {
+				if _, ok := index[s.Table]; !ok {
+					truncated[s.Table] = true
+				}
+			}
+			continue
+		}
+		if _, ok := index[s.Table]; !ok {
+			index[s.Table] = len(checks)
+			checks = append(checks, TableCheck{Table: s.Table, Replaced: truncated[s.Table]})
+		}
+		checks[index[s.Table]].Paths = append(checks[index[s.Table]].Paths, s.Path)
+		copies[s.Table] = append(copies[s.Table], s)
+	}
+
+	for i := range checks {
+		if err := verifyTable(db, &checks[i], copies[checks[i].Table]); err != nil {
+			return nil, err
+		}
+	}
+	return checks, nil
+}
+
+// verifyTable fills the check of a table with its content and the one of its files
+func verifyTable(db *sql.DB, check *TableCheck, copies []Statement) error {
+	schema, table := splitTableName(check.Table)
+	columns, types, err := tableColumnTypes(db, schema, table)
+	if err != nil {
+		return &LoadError{Table: check.Table, Err: err}
+	}
+
+	// the rows of the files that are looked up in the table (if it was not replaced)
+	var fileRows map[uint64]int64
+	if !check.Replaced {
+		fileRows = make(map[uint64]int64)
+	}
+
+	for _, s := range copies {
+		err := readCopiedRows(s, len(columns), func(record []*string) {
+			hash := rowHash(record, types)
+			check.FileRows++
+			check.FileChecksum += hash
+			if fileRows != nil {
+				fileRows[hash]++
+			}
+		})
+		if err != nil {
+			return &LoadError{Table: check.Table, Path: s.Path, Err: err}
+		}
+	}
+	check.Missing = check.FileRows
+
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		selected[i] = pq.QuoteIdentifier(column) + "::text"
+	}
+	query := "SELECT " + strings.Join(selected, ", ") + " FROM " + pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]*string, len(columns))
+
+	return QueryRows(db, check.Table, query, func(rows *sql.Rows) error {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		for i := range values {
+			record[i] = nil
+			if values[i].Valid {
+				record[i] = &values[i].String
+			}
+		}
+		hash := rowHash(record, types)
+		check.DBRows++
+		check.DBChecksum += hash
+		if fileRows != nil && fileRows[hash] > 0 {
+			fileRows[hash]--
+			check.Missing--
+		}
+		return nil
+	})
+}
+
+// readCopiedRows reads the records of a copied .csv file (without its header), they must have as many fields as the
+// table has columns
+func readCopiedRows(s Statement, columns int, process func(record []*string)) error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := NewCSVReader(f)
+	if s.Header {
+		if _, err := reader.Read(); err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	for row := int64(1); ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(record) != columns {
+			return fmt.Errorf("row %d: expected %d fields, found %d", row, columns, len(record))
+		}
+		process(record)
+	}
+}
+
+// rowHash hashes the content of a row (the first 8 bytes of the SHA-256 of its normalized fields), the values are
+// normalized according to the type of their column so that the ones of the .csv files and of the database match
+func rowHash(record []*string, types []string) uint64 {
+	h := sha256.New()
+	for i, field := range record {
+		if isDateType(types[i]) {
+			continue
+		}
+		if field == nil {
+			h.Write([]byte{0})
+			continue
+		}
+		value := NormalizeValue(*field, types[i])
+		h.Write([]byte{1})
+		h.Write([]byte(strconv.Itoa(len(value))))
+		h.Write([]byte{':'})
+		h.Write([]byte(value))
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
+
+// NormalizeValue returns the canonical form of a value of a column of the given type (as named by information_schema),
+// e.g. "1.50" and "1.5" are the same numeric. The values that cannot be parsed are returned as they are.
+func NormalizeValue(value, dataType string) string {
+	switch dataType {
+	case "smallint", "integer", "bigint", "numeric":
+		if r, ok := new(big.Rat).SetString(strings.TrimSpace(value)); ok {
+			return r.RatString()
+		}
+	case "real", "double precision":
+		bitSize := 64
+		if dataType == "real" {
+			bitSize = 32
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(value), bitSize); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, bitSize)
+		}
+	case "boolean":
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return "true"
+		case "f", "false", "n", "no", "off", "0":
+			return "false"
+		}
+	case "character":
+		// char(n) values are padded with spaces
+		return strings.TrimRight(value, " ")
+	}
+	return value
+}
+
+func isDateType(dataType string) bool {
+	return dataType == "date" || strings.HasPrefix(dataType, "timestamp") || strings.HasPrefix(dataType, "time ") ||
+		dataType == "interval"
+}
+
+// VerifyTags checks that a sample of the TAG_IDs of the observations (the concept_cd and modifier_cd "TAG_ID:..." of
+// the .csv file copied by facts) are c_basecode of the tagged table. It returns the number of TAG_IDs checked and the
+// ones that were not found.
+func VerifyTags(dbSettings DBSettings, facts Statement, tagged string) (int, []string, error) {
+	db, err := sql.Open("postgres", dbSettings.ConnectionString())
+	if err != nil {
+		return 0, nil, &LoadError{Err: err}
+	}
+	defer db.Close()
+
+	// the fields of the file are in the order of the columns of the table
+	schema, table := splitTableName(facts.Table)
+	columns, _, err := tableColumnTypes(db, schema, table)
+	if err != nil {
+		return 0, nil, &LoadError{Table: facts.Table, Err: err}
+	}
+	indexes := make([]int, 0, 2)
+	for i, column := range columns {
+		if column == "concept_cd" || column == "modifier_cd" {
+			indexes = append(indexes, i)
+		}
+	}
+
+	set := make(map[string]struct{})
+	err = readCopiedRows(facts, len(columns), func(record []*string) {
+		for _, i := range indexes {
+			if record[i] != nil && strings.HasPrefix(*record[i], "TAG_ID:") {
+				set[*record[i]] = struct{}{}
+			}
+		}
+	})
+	if err != nil {
+		return 0, nil, &LoadError{Table: facts.Table, Path: facts.Path, Err: err}
+	}
+
+	sample := make([]string, 0, len(set))
+	for tag := range set {
+		sample = append(sample, tag)
+	}
+	sort.Strings(sample)
+	if len(sample) > TagSampleSize {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		rnd.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+		sample = sample[:TagSampleSize]
+		sort.Strings(sample)
+	}
+	if len(sample) == 0 {
+		return 0, nil, nil
+	}
+
+	found := make(map[string]struct{})
+	rows, err := db.Query("SELECT c_basecode FROM "+tagged+" WHERE c_basecode = ANY($1)", pq.Array(sample))
+	if err != nil {
+		return 0, nil, &LoadError{Table: tagged, Err: err}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var basecode string
+		if err := rows.Scan(&basecode); err != nil {
+			return 0, nil, &LoadError{Table: tagged, Err: err}
+		}
+		found[basecode] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, &LoadError{Table: tagged, Err: err}
+	}
+
+	missing := make([]string, 0)
+	for _, tag := range sample {
+		if _, ok := found[tag]; !ok {
+			missing = append(missing, tag)
+		}
+	}
+	return len(sample), missing, nil
+}
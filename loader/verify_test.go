@@ -0,0 +1,54 @@
+package loader_test
+
+import (
+	"errors"
+	"github.com/ldsec/medco-loader/loader"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	// the values of the .csv files and their text representation in the database are the same once normalized
+	for _, c := range []struct{ file, db, dataType string }{
+		{"1.5", "1.50000", "numeric"},
+		{"007", "7", "integer"},
+		{"0.1", "0.1", "double precision"},
+		{"1e3", "1000", "real"},
+		{"t", "true", "boolean"},
+		{"0", "false", "boolean"},
+		{"LA", "LA ", "character"},
+		{`\N`, `\N`, "character varying"},
+	} {
+		assert.Equal(t, loader.NormalizeValue(c.db, c.dataType), loader.NormalizeValue(c.file, c.dataType), c)
+	}
+
+	assert.NotEqual(t, loader.NormalizeValue("1.5", "numeric"), loader.NormalizeValue("1.05", "numeric"))
+	assert.NotEqual(t, loader.NormalizeValue("LA ", "text"), loader.NormalizeValue("LA", "text"))
+	assert.Equal(t, "not a number", loader.NormalizeValue("not a number", "integer"))
+}
+
+func TestVerification(t *testing.T) {
+	replaced := loader.TableCheck{Table: "i2b2demodata_i2b2.patient_dimension", Replaced: true, FileRows: 3, DBRows: 3, FileChecksum: 42, DBChecksum: 42}
+	appended := loader.TableCheck{Table: "medco_ont.table_access", FileRows: 1, DBRows: 5}
+	assert.True(t, replaced.OK())
+	assert.True(t, appended.OK())
+
+	v := loader.Verification{Tables: []loader.TableCheck{replaced, appended}, TagsChecked: 10}
+	assert.True(t, v.OK())
+	assert.Nil(t, v.Err())
+
+	// a partial copy
+	replaced.DBRows, replaced.DBChecksum = 2, 40
+	// a row of the file is not in the table
+	appended.Missing = 1
+	v = loader.Verification{Tables: []loader.TableCheck{replaced, appended}, TagsChecked: 10, MissingTags: []string{"TAG_ID:3"}}
+	assert.False(t, replaced.OK())
+	assert.False(t, appended.OK())
+	assert.False(t, v.OK())
+
+	err := v.Err()
+	assert.True(t, errors.Is(err, loader.ErrDBLoad))
+	assert.Contains(t, err.Error(), "i2b2demodata_i2b2.patient_dimension, medco_ont.table_access")
+	assert.Contains(t, err.Error(), "TAG_ID:3")
+	assert.Contains(t, v.String(), "MISMATCH i2b2demodata_i2b2.patient_dimension: 3 rows in the files, 2 rows in the database")
+}